@@ -1,4 +1,4 @@
-CREATE TABLE todos (
+CREATE TABLE IF NOT EXISTS todos (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     title VARCHAR(255) NOT NULL,
     description TEXT,
@@ -7,5 +7,5 @@ CREATE TABLE todos (
     updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 
-CREATE INDEX idx_completed ON todos(completed);
-CREATE INDEX idx_created_at ON todos(created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_completed ON todos(completed);
+CREATE INDEX IF NOT EXISTS idx_created_at ON todos(created_at DESC);
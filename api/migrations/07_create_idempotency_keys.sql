@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key VARCHAR(255) NOT NULL,
+    user_id UUID,
+    request_body JSONB NOT NULL,
+    todo_id UUID NOT NULL,
+    response_body JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Keys are scoped per user; anonymous (single-user mode) keys share one scope
+CREATE UNIQUE INDEX IF NOT EXISTS idx_idempotency_keys_key_user ON idempotency_keys
+    (key, COALESCE(user_id, '00000000-0000-0000-0000-000000000000'::uuid));
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at);
@@ -0,0 +1,6 @@
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS due_date TIMESTAMPTZ;
+
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS recurrence VARCHAR(16) NOT NULL DEFAULT 'none'
+    CHECK (recurrence IN ('none', 'daily', 'weekly', 'monthly'));
+
+CREATE INDEX IF NOT EXISTS idx_due_date ON todos(due_date);
@@ -0,0 +1,6 @@
+-- Finds a user's open todos by title, for the optional rule that open todos
+-- have distinct titles. The rule is checked by the application, so existing
+-- todos sharing a title do not stop this migration.
+CREATE INDEX IF NOT EXISTS idx_todos_open_title ON todos
+    (COALESCE(user_id, '00000000-0000-0000-0000-000000000000'::uuid), title)
+    WHERE NOT completed;
@@ -0,0 +1,26 @@
+-- New todos take the next value of a shared sequence, so they always sort
+-- after every position handed out before, including reordered ones
+CREATE SEQUENCE IF NOT EXISTS todos_position_seq;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'todos' AND column_name = 'position'
+    ) THEN
+        ALTER TABLE todos ADD COLUMN position BIGINT;
+
+        -- Existing todos keep their creation order
+        UPDATE todos SET position = ranked.position
+        FROM (SELECT id, ROW_NUMBER() OVER (ORDER BY created_at, id) AS position FROM todos) ranked
+        WHERE todos.id = ranked.id;
+
+        PERFORM setval('todos_position_seq', COALESCE((SELECT MAX(position) FROM todos), 0) + 1, false);
+
+        ALTER TABLE todos
+            ALTER COLUMN position SET DEFAULT nextval('todos_position_seq'),
+            ALTER COLUMN position SET NOT NULL;
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS idx_position ON todos(position);
@@ -0,0 +1,4 @@
+-- Who created and last changed each todo. Actors are not necessarily
+-- registered users (see X-Actor-ID), so there is no foreign key.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS created_by UUID;
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS updated_by UUID;
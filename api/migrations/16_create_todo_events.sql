@@ -0,0 +1,13 @@
+-- Every change made to a todo, with a snapshot of the todo afterwards (or as it
+-- was, for a delete). There is no foreign key so the history outlives the todo.
+CREATE TABLE IF NOT EXISTS todo_events (
+    id BIGSERIAL PRIMARY KEY,
+    todo_id UUID NOT NULL,
+    user_id UUID,
+    event TEXT NOT NULL CHECK (event IN ('created', 'updated', 'deleted')),
+    actor_id UUID,
+    snapshot JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_todo_events_todo_id ON todo_events(todo_id, id DESC);
@@ -0,0 +1,15 @@
+-- Deleted todos (with their subtasks, as a JSON array) kept until their undo
+-- window closes. `user_id` is whoever deleted them and may undo it.
+CREATE TABLE IF NOT EXISTS pending_deletes (
+    token TEXT PRIMARY KEY,
+    user_id UUID,
+    todos JSONB NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_pending_deletes_expires_at ON pending_deletes(expires_at);
+
+-- Undone deletions are recorded in the history as 'restored'
+ALTER TABLE todo_events DROP CONSTRAINT IF EXISTS todo_events_event_check;
+ALTER TABLE todo_events ADD CONSTRAINT todo_events_event_check
+    CHECK (event IN ('created', 'updated', 'deleted', 'restored'));
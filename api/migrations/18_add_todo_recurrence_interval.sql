@@ -0,0 +1,7 @@
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS recurrence_interval INTEGER NOT NULL DEFAULT 1
+    CHECK (recurrence_interval BETWEEN 1 AND 365);
+
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS completed_at TIMESTAMPTZ;
+
+-- Todos completed before completed_at existed were last changed when completed, at the latest
+UPDATE todos SET completed_at = updated_at WHERE completed AND completed_at IS NULL;
@@ -0,0 +1,23 @@
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS remind_at TIMESTAMPTZ;
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS reminded_at TIMESTAMPTZ;
+
+-- Delivery bookkeeping for the reminder scheduler. reminder_retry_at holds off
+-- the next claim, both after a failure and while an instance is delivering.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS reminder_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS reminder_error TEXT;
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS reminder_retry_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_todos_pending_reminders ON todos(remind_at)
+    WHERE reminded_at IS NULL AND NOT completed;
+
+-- Reminders delivered to the API; kept after the todo is deleted, so no foreign key
+CREATE TABLE IF NOT EXISTS notifications (
+    id UUID PRIMARY KEY,
+    user_id UUID,
+    todo_id UUID NOT NULL,
+    title TEXT NOT NULL,
+    remind_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id, created_at DESC);
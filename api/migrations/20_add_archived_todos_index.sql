@@ -0,0 +1,2 @@
+-- Lets the purge job find archived todos by age without scanning active ones
+CREATE INDEX IF NOT EXISTS idx_todos_archived_updated_at ON todos(updated_at) WHERE archived;
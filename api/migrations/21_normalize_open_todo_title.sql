@@ -0,0 +1,8 @@
+-- The optional unique title rule compares open titles regardless of case and
+-- surrounding spaces, so "Deploy v2" and " deploy V2" count as the same title.
+-- Index that expression instead of the raw title. It is not unique, so open
+-- todos that already differ only that way do not stop this migration.
+DROP INDEX IF EXISTS idx_todos_open_title;
+CREATE INDEX idx_todos_open_title ON todos
+    (COALESCE(user_id, '00000000-0000-0000-0000-000000000000'::uuid), lower(btrim(title)))
+    WHERE NOT completed;
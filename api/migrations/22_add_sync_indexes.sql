@@ -0,0 +1,4 @@
+-- GET /api/todos/changes looks up todos changed, and history events recorded,
+-- after a point in time
+CREATE INDEX IF NOT EXISTS idx_todos_updated_at ON todos(updated_at);
+CREATE INDEX IF NOT EXISTS idx_todo_events_event_created_at ON todo_events(event, created_at);
@@ -0,0 +1,4 @@
+-- Day of month a monthly series started on, so an occurrence moved to the end
+-- of a shorter month returns to it afterwards (Jan 31 -> Feb 28 -> Mar 31)
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS recurrence_day INTEGER
+    CHECK (recurrence_day BETWEEN 1 AND 31);
@@ -0,0 +1,11 @@
+-- Open todos written while unique titles were required are marked strict, and
+-- no two strict open todos of a user may share a title, compared regardless of
+-- case and surrounding spaces. The repository still looks for any open todo
+-- with the title first; this index catches two strict writes that both passed
+-- that check at the same time. Existing todos start unmarked, so duplicates
+-- written while the rule was off do not stop this migration.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS strict_title BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_todos_strict_open_title ON todos
+    (COALESCE(user_id, '00000000-0000-0000-0000-000000000000'::uuid), lower(btrim(title)))
+    WHERE NOT completed AND strict_title;
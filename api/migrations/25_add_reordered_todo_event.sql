@@ -0,0 +1,4 @@
+-- Todos moved by PUT /api/todos/reorder are recorded in the history as 'reordered'
+ALTER TABLE todo_events DROP CONSTRAINT IF EXISTS todo_events_event_check;
+ALTER TABLE todo_events ADD CONSTRAINT todo_events_event_check
+    CHECK (event IN ('created', 'updated', 'deleted', 'restored', 'reordered'));
@@ -0,0 +1,136 @@
+use actix_web::{dev::Payload, FromRequest, HttpMessage, HttpRequest};
+use chrono::Utc;
+use jsonwebtoken::{decode, encode, Algorithm, DecodingKey, EncodingKey, Header, Validation};
+use serde::{Deserialize, Serialize};
+use std::env;
+use std::future::{ready, Ready};
+use uuid::Uuid;
+
+use crate::error::ApiError;
+
+/// JWT claims; `sub` carries the user ID
+#[derive(Debug, Serialize, Deserialize)]
+pub struct Claims {
+    pub sub: String,
+    pub exp: usize,
+}
+
+/// Default token lifetime: one day
+const DEFAULT_TOKEN_TTL_SECS: i64 = 24 * 60 * 60;
+
+/// HS256 JWT issuing and verification. Disabled when JWT_SECRET is unset, in
+/// which case every request is handled as the anonymous single user.
+#[derive(Clone, Default)]
+pub struct JwtAuth {
+    secret: Option<String>,
+    ttl_secs: i64,
+}
+
+impl JwtAuth {
+    pub fn from_env() -> Result<Self, String> {
+        let ttl_secs = match env::var("JWT_EXPIRY_SECS").ok().filter(|v| !v.is_empty()) {
+            None => DEFAULT_TOKEN_TTL_SECS,
+            Some(value) => value
+                .trim()
+                .parse()
+                .ok()
+                .filter(|ttl| *ttl > 0)
+                .ok_or_else(|| format!("JWT_EXPIRY_SECS must be a positive number of seconds, got '{}'", value))?,
+        };
+        Ok(JwtAuth { secret: env::var("JWT_SECRET").ok().filter(|s| !s.is_empty()), ttl_secs })
+    }
+
+    pub fn enabled(&self) -> bool {
+        self.secret.is_some()
+    }
+
+    /// Fail the way `issue` would when no tokens can be issued, for callers
+    /// that should check before doing anything else
+    pub fn require_enabled(&self) -> Result<(), ApiError> {
+        self.signing_secret().map(|_| ())
+    }
+
+    fn signing_secret(&self) -> Result<&str, ApiError> {
+        self.secret
+            .as_deref()
+            .ok_or_else(|| ApiError::BadRequest("Authentication is not enabled on this server".to_string()))
+    }
+
+    /// Issue a token for `user_id`, returning it with its lifetime in seconds
+    pub fn issue(&self, user_id: Uuid) -> Result<(String, i64), ApiError> {
+        let secret = self.signing_secret()?;
+
+        let claims = Claims {
+            sub: user_id.to_string(),
+            exp: (Utc::now().timestamp() + self.ttl_secs) as usize,
+        };
+        let token = encode(&Header::default(), &claims, &EncodingKey::from_secret(secret.as_bytes()))
+            .map_err(|e| ApiError::InternalServerError(format!("Failed to issue token: {}", e)))?;
+
+        Ok((token, self.ttl_secs))
+    }
+
+    /// Validate a token and return the user ID it was issued for
+    pub fn verify(&self, token: &str) -> Result<Uuid, ApiError> {
+        let secret = self
+            .secret
+            .as_ref()
+            .ok_or_else(|| ApiError::Unauthorized("Authentication is not configured".to_string()))?;
+
+        let data = decode::<Claims>(
+            token,
+            &DecodingKey::from_secret(secret.as_bytes()),
+            &Validation::new(Algorithm::HS256),
+        )
+        .map_err(|_| ApiError::Unauthorized("Invalid or expired token".to_string()))?;
+
+        Uuid::parse_str(&data.claims.sub)
+            .map_err(|_| ApiError::Unauthorized("Invalid or expired token".to_string()))
+    }
+}
+
+/// The user a request is acting as. `user_id` is None when authentication is
+/// disabled; queries then only see todos that have no owner.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct AuthUser {
+    pub user_id: Option<Uuid>,
+}
+
+impl FromRequest for AuthUser {
+    type Error = actix_web::Error;
+    type Future = Ready<Result<Self, Self::Error>>;
+
+    fn from_request(req: &HttpRequest, _payload: &mut Payload) -> Self::Future {
+        ready(Ok(req.extensions().get::<AuthUser>().copied().unwrap_or_default()))
+    }
+}
+
+/// Header naming who makes a change when the request is not authenticated
+pub const ACTOR_HEADER: &str = "X-Actor-ID";
+
+/// Who is making a change, recorded as a todo's `created_by` / `updated_by`:
+/// the authenticated user, or else the optional X-Actor-ID header
+#[derive(Debug, Clone, Copy, Default)]
+pub struct Actor(pub Option<Uuid>);
+
+impl FromRequest for Actor {
+    type Error = actix_web::Error;
+    type Future = Ready<Result<Self, Self::Error>>;
+
+    fn from_request(req: &HttpRequest, _payload: &mut Payload) -> Self::Future {
+        if let Some(user_id) = req.extensions().get::<AuthUser>().and_then(|user| user.user_id) {
+            return ready(Ok(Actor(Some(user_id))));
+        }
+
+        let actor = match req.headers().get(ACTOR_HEADER) {
+            None => Ok(Actor(None)),
+            Some(value) => value
+                .to_str()
+                .ok()
+                .and_then(|v| Uuid::parse_str(v.trim()).ok())
+                .map(|id| Actor(Some(id)))
+                .ok_or_else(|| ApiError::BadRequest(format!("{} must be a UUID", ACTOR_HEADER)).into()),
+        };
+        ready(actor)
+    }
+}
@@ -0,0 +1,440 @@
+//! Command-line client for the todo API.
+//!
+//! Settings come from flags, then TODOCTL_* environment variables, then
+//! `$XDG_CONFIG_HOME/todoctl/config` (`~/.config/todoctl/config`), a file of
+//! `key = value` lines with the keys `url`, `api_key` and `token`.
+
+use reqwest::header::{AUTHORIZATION, CONTENT_TYPE};
+use reqwest::{Method, StatusCode};
+use serde_json::{json, Map, Value};
+use std::collections::HashMap;
+use std::env;
+use std::fs;
+use std::path::PathBuf;
+use std::process::ExitCode;
+
+const DEFAULT_URL: &str = "http://localhost:8080";
+
+/// Set at compile time like the server's, through APP_VERSION and GIT_COMMIT
+const VERSION: &str = match option_env!("APP_VERSION") {
+    Some(version) => version,
+    None => "dev",
+};
+const GIT_COMMIT: &str = match option_env!("GIT_COMMIT") {
+    Some(commit) => commit,
+    None => "unknown",
+};
+
+const USAGE: &str = "Usage: todoctl [--url URL] [--api-key KEY] [--token JWT] <command>
+       todoctl --version
+
+Commands:
+  list [--completed] [--json]          List todos; --completed shows only completed ones
+  add <title> [-d DESCRIPTION] [--json]
+  get <id> [--json]
+  done <id> [--json]                   Mark a todo as completed
+  rm <id>
+  edit <id> [--title TITLE] [-d DESCRIPTION] [--json]
+
+Settings are read from flags, then TODOCTL_URL, TODOCTL_API_KEY and
+TODOCTL_TOKEN, then the config file at $XDG_CONFIG_HOME/todoctl/config.
+
+Exit codes: 0 success, 1 server or connection failure, 2 usage error,
+3 todo not found, 4 request rejected (400, 409 and other 4xx).";
+
+/// How a command failed, mapped to the process exit code
+enum Failure {
+    /// Network errors, 5xx responses and unreadable replies
+    Server(String),
+    Usage(String),
+    NotFound(String),
+    /// Any other 4xx response
+    Rejected(String),
+}
+
+impl Failure {
+    fn exit_code(&self) -> u8 {
+        match self {
+            Failure::Server(_) => 1,
+            Failure::Usage(_) => 2,
+            Failure::NotFound(_) => 3,
+            Failure::Rejected(_) => 4,
+        }
+    }
+
+    fn message(&self) -> &str {
+        match self {
+            Failure::Server(msg) | Failure::Usage(msg) | Failure::NotFound(msg) | Failure::Rejected(msg) => msg,
+        }
+    }
+}
+
+impl From<reqwest::Error> for Failure {
+    fn from(err: reqwest::Error) -> Self {
+        Failure::Server(format!("request failed: {}", err))
+    }
+}
+
+/// Where and how to reach the API
+struct Settings {
+    url: String,
+    api_key: Option<String>,
+    token: Option<String>,
+}
+
+impl Settings {
+    /// Resolve each setting from `flags`, the environment and the config file,
+    /// in that order
+    fn resolve(flags: &HashMap<String, String>) -> Result<Self, Failure> {
+        let file = read_config()?;
+        let lookup = |flag: &str, var: &str, key: &str| {
+            flags
+                .get(flag)
+                .cloned()
+                .or_else(|| env::var(var).ok().filter(|v| !v.is_empty()))
+                .or_else(|| file.get(key).cloned())
+        };
+
+        Ok(Settings {
+            url: lookup("url", "TODOCTL_URL", "url")
+                .unwrap_or_else(|| DEFAULT_URL.to_string())
+                .trim_end_matches('/')
+                .to_string(),
+            api_key: lookup("api-key", "TODOCTL_API_KEY", "api_key"),
+            token: lookup("token", "TODOCTL_TOKEN", "token"),
+        })
+    }
+}
+
+fn config_path() -> Option<PathBuf> {
+    env::var_os("XDG_CONFIG_HOME")
+        .filter(|dir| !dir.is_empty())
+        .map(PathBuf::from)
+        .or_else(|| env::var_os("HOME").map(|home| PathBuf::from(home).join(".config")))
+        .map(|dir| dir.join("todoctl").join("config"))
+}
+
+/// Read `key = value` lines from the config file; a missing file is empty
+fn read_config() -> Result<HashMap<String, String>, Failure> {
+    let Some(path) = config_path() else {
+        return Ok(HashMap::new());
+    };
+    let contents = match fs::read_to_string(&path) {
+        Ok(contents) => contents,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(HashMap::new()),
+        Err(e) => return Err(Failure::Usage(format!("cannot read {}: {}", path.display(), e))),
+    };
+
+    let mut config = HashMap::new();
+    for (i, line) in contents.lines().enumerate() {
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        let (key, value) = line.split_once('=').ok_or_else(|| {
+            Failure::Usage(format!("{}:{}: expected key = value", path.display(), i + 1))
+        })?;
+        let value = value.trim().trim_matches('"');
+        config.insert(key.trim().to_string(), value.to_string());
+    }
+    Ok(config)
+}
+
+/// Parsed command line: option values, switches and positional arguments
+#[derive(Default)]
+struct Args {
+    options: HashMap<String, String>,
+    switches: Vec<String>,
+    positional: Vec<String>,
+}
+
+impl Args {
+    fn parse(raw: impl Iterator<Item = String>) -> Result<Self, Failure> {
+        let mut args = Args::default();
+        let mut raw = raw.peekable();
+        while let Some(arg) = raw.next() {
+            let name = match arg.as_str() {
+                "-d" => "description".to_string(),
+                "-h" => "help".to_string(),
+                _ => match arg.strip_prefix("--") {
+                    Some(name) => name.to_string(),
+                    None => {
+                        args.positional.push(arg);
+                        continue;
+                    }
+                },
+            };
+
+            match name.as_str() {
+                "url" | "api-key" | "token" | "title" | "description" => {
+                    let value = raw
+                        .next()
+                        .ok_or_else(|| Failure::Usage(format!("{} needs a value", arg)))?;
+                    args.options.insert(name, value);
+                }
+                "completed" | "json" | "help" | "version" => args.switches.push(name),
+                _ => return Err(Failure::Usage(format!("unknown option {}", arg))),
+            }
+        }
+        Ok(args)
+    }
+
+    fn switch(&self, name: &str) -> bool {
+        self.switches.iter().any(|s| s == name)
+    }
+
+    /// The single positional argument a command takes after its name
+    fn operand(&self, what: &str) -> Result<&str, Failure> {
+        match self.positional.as_slice() {
+            [_, operand] => Ok(operand),
+            [_] => Err(Failure::Usage(format!("missing {}", what))),
+            _ => Err(Failure::Usage("too many arguments".to_string())),
+        }
+    }
+}
+
+struct Client {
+    http: reqwest::Client,
+    settings: Settings,
+}
+
+impl Client {
+    /// Send a request and return the decoded JSON body, or the server's error
+    /// message as a `Failure` matching the status
+    async fn send(&self, method: Method, path: &str, body: Option<Value>) -> Result<Value, Failure> {
+        let mut request = self.http.request(method, format!("{}{}", self.settings.url, path));
+        if let Some(key) = &self.settings.api_key {
+            request = request.header("x-api-key", key);
+        }
+        if let Some(token) = &self.settings.token {
+            request = request.header(AUTHORIZATION, format!("Bearer {}", token));
+        }
+        if let Some(body) = body {
+            request = request.header(CONTENT_TYPE, "application/json").body(body.to_string());
+        }
+
+        let response = request.send().await?;
+        let status = response.status();
+        let text = response.text().await?;
+        if status.is_success() {
+            if text.is_empty() {
+                return Ok(Value::Null);
+            }
+            return serde_json::from_str(&text)
+                .map_err(|e| Failure::Server(format!("invalid response from server: {}", e)));
+        }
+
+        // Errors arrive as {"error": ..., "message": ...}; fall back to the raw body
+        let message = serde_json::from_str::<Value>(&text)
+            .ok()
+            .and_then(|body| body.get("message").and_then(Value::as_str).map(str::to_string))
+            .unwrap_or(text);
+        let message = format!("{} ({})", message, status.as_u16());
+        Err(match status {
+            StatusCode::NOT_FOUND => Failure::NotFound(message),
+            s if s.is_client_error() => Failure::Rejected(message),
+            _ => Failure::Server(message),
+        })
+    }
+}
+
+/// Todos as a table with one row each
+fn print_table(todos: &[Value]) {
+    let field = |todo: &Value, name: &str| todo.get(name).and_then(Value::as_str).unwrap_or("").to_string();
+    println!("{:<36}  {:<4}  {}", "ID", "DONE", "TITLE");
+    for todo in todos {
+        let done = todo.get("completed").and_then(Value::as_bool).unwrap_or(false);
+        println!(
+            "{:<36}  {:<4}  {}",
+            field(todo, "id"),
+            if done { "yes" } else { "no" },
+            field(todo, "title")
+        );
+    }
+}
+
+/// Print one todo as raw JSON or as a short key/value listing
+fn print_todo(todo: &Value, as_json: bool) {
+    if as_json {
+        println!("{}", serde_json::to_string_pretty(todo).unwrap_or_default());
+        return;
+    }
+    let Some(fields) = todo.as_object() else {
+        return;
+    };
+    for key in ["id", "title", "description", "completed", "tags", "due_date", "created_at", "updated_at"] {
+        let value = match fields.get(key) {
+            None | Some(Value::Null) => continue,
+            Some(Value::String(s)) => s.clone(),
+            Some(other) => other.to_string(),
+        };
+        println!("{:<12} {}", key, value);
+    }
+}
+
+async fn run(args: Args) -> Result<(), Failure> {
+    let Some(command) = args.positional.first().cloned() else {
+        return Err(Failure::Usage("missing command".to_string()));
+    };
+    let client = Client {
+        http: reqwest::Client::builder()
+            .user_agent(format!("todoctl/{}", VERSION))
+            .build()?,
+        settings: Settings::resolve(&args.options)?,
+    };
+    let as_json = args.switch("json");
+
+    match command.as_str() {
+        "list" => {
+            if args.positional.len() > 1 {
+                return Err(Failure::Usage("list takes no arguments".to_string()));
+            }
+            let todos = client.send(Method::GET, "/api/todos", None).await?;
+            let mut todos = todos.as_array().cloned().unwrap_or_default();
+            if args.switch("completed") {
+                todos.retain(|t| t.get("completed").and_then(Value::as_bool).unwrap_or(false));
+            }
+            if as_json {
+                println!("{}", serde_json::to_string_pretty(&todos).unwrap_or_default());
+            } else {
+                print_table(&todos);
+            }
+        }
+        "add" => {
+            let title = args.operand("title")?;
+            let mut body = json!({ "title": title });
+            if let Some(description) = args.options.get("description") {
+                body["description"] = json!(description);
+            }
+            let todo = client.send(Method::POST, "/api/todos", Some(body)).await?;
+            print_todo(&todo, as_json);
+        }
+        "get" => {
+            let id = args.operand("todo id")?;
+            let todo = client.send(Method::GET, &format!("/api/todos/{}", id), None).await?;
+            print_todo(&todo, as_json);
+        }
+        "done" => {
+            let id = args.operand("todo id")?;
+            let todo = client
+                .send(Method::POST, &format!("/api/todos/{}/complete", id), None)
+                .await?;
+            print_todo(&todo, as_json);
+        }
+        "rm" => {
+            let id = args.operand("todo id")?;
+            client.send(Method::DELETE, &format!("/api/todos/{}", id), None).await?;
+        }
+        "edit" => {
+            let id = args.operand("todo id")?;
+            let mut changes = Map::new();
+            if let Some(title) = args.options.get("title") {
+                changes.insert("title".to_string(), json!(title));
+            }
+            if let Some(description) = args.options.get("description") {
+                changes.insert("description".to_string(), json!(description));
+            }
+            if changes.is_empty() {
+                return Err(Failure::Usage("edit needs --title or -d".to_string()));
+            }
+            let todo = client
+                .send(Method::PUT, &format!("/api/todos/{}", id), Some(Value::Object(changes)))
+                .await?;
+            print_todo(&todo, as_json);
+        }
+        other => return Err(Failure::Usage(format!("unknown command '{}'", other))),
+    }
+    Ok(())
+}
+
+#[tokio::main]
+async fn main() -> ExitCode {
+    let result = match Args::parse(env::args().skip(1)) {
+        Ok(args) if args.switch("help") => {
+            println!("{}", USAGE);
+            return ExitCode::SUCCESS;
+        }
+        Ok(args) if args.switch("version") => {
+            println!("todoctl {} ({})", VERSION, GIT_COMMIT);
+            return ExitCode::SUCCESS;
+        }
+        Ok(args) => run(args).await,
+        Err(failure) => Err(failure),
+    };
+
+    match result {
+        Ok(()) => ExitCode::SUCCESS,
+        Err(failure) => {
+            eprintln!("todoctl: {}", failure.message());
+            if let Failure::Usage(_) = failure {
+                eprintln!("\n{}", USAGE);
+            }
+            ExitCode::from(failure.exit_code())
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::{web, App, HttpResponse};
+    use serde_json::{json, Value};
+
+    use super::{run, Args};
+
+    const KNOWN_ID: &str = "00000000-0000-0000-0000-000000000001";
+
+    fn error(status: u16, code: &str, message: &str) -> HttpResponse {
+        let status = actix_web::http::StatusCode::from_u16(status).unwrap();
+        HttpResponse::build(status).json(json!({ "error": code, "message": message }))
+    }
+
+    async fn get_todo(id: web::Path<String>) -> HttpResponse {
+        if id.as_str() != KNOWN_ID {
+            return error(404, "NOT_FOUND", "Todo not found");
+        }
+        HttpResponse::Ok().json(json!({ "id": KNOWN_ID, "title": "Buy milk", "completed": false }))
+    }
+
+    async fn create_todo(body: web::Json<Value>) -> HttpResponse {
+        match body["title"].as_str() {
+            Some(title) if !title.trim().is_empty() => {
+                HttpResponse::Created().json(json!({ "id": KNOWN_ID, "title": title, "completed": false }))
+            }
+            _ => error(400, "VALIDATION_ERROR", "Title must not be empty"),
+        }
+    }
+
+    async fn list_todos() -> HttpResponse {
+        error(500, "INTERNAL_SERVER_ERROR", "Internal server error")
+    }
+
+    /// The exit code todoctl would finish with for `args`, run against `srv`
+    async fn exit_code(srv: &actix_test::TestServer, args: &[&str]) -> u8 {
+        let url = srv.url("");
+        let raw = ["--url", url.as_str()].into_iter().chain(args.iter().copied()).map(str::to_string);
+        let result = match Args::parse(raw) {
+            Ok(args) => run(args).await,
+            Err(failure) => Err(failure),
+        };
+        result.map_or_else(|failure| failure.exit_code(), |()| 0)
+    }
+
+    #[actix_web::test]
+    async fn exit_codes_follow_the_response_status() {
+        let srv = actix_test::start(|| {
+            App::new()
+                .route("/api/todos", web::get().to(list_todos))
+                .route("/api/todos", web::post().to(create_todo))
+                .route("/api/todos/{id}", web::get().to(get_todo))
+        });
+
+        assert_eq!(exit_code(&srv, &["get", KNOWN_ID]).await, 0);
+        assert_eq!(exit_code(&srv, &["add", "Buy milk", "--json"]).await, 0);
+        assert_eq!(exit_code(&srv, &["get", "00000000-0000-0000-0000-000000000002"]).await, 3);
+        assert_eq!(exit_code(&srv, &["add", " "]).await, 4);
+        assert_eq!(exit_code(&srv, &["list"]).await, 1);
+        assert_eq!(exit_code(&srv, &["get"]).await, 2);
+        assert_eq!(exit_code(&srv, &["get", KNOWN_ID, "--bogus"]).await, 2);
+        assert_eq!(exit_code(&srv, &["frobnicate"]).await, 2);
+    }
+}
@@ -0,0 +1,258 @@
+use crate::auth::JwtAuth;
+use crate::db::metrics::SlowQueryThreshold;
+use crate::debug::Profiling;
+use crate::handlers::docs::Docs;
+use crate::handlers::idempotency::IdempotencyTtl;
+use crate::handlers::purge::PurgeSettings;
+use crate::handlers::reset::AllowDestructive;
+use crate::handlers::subtask::SubtaskDeletePolicy;
+use crate::handlers::title::UniqueTitles;
+use crate::handlers::undo::UndoWindow;
+use crate::handlers::ws::ConnectionLimit;
+use crate::listen::Listen;
+use crate::logging::LogLevel;
+use crate::models::{OmitNullDescription, RecurrenceZone};
+use crate::middleware::{
+    AdminToken, ApiKeyAuth, BodyLimit, ConcurrencyLimit, CorsSettings, RateLimiter, ReadOnly, RequestTimeout,
+    TrustedProxies,
+};
+use crate::reminders::ReminderSettings;
+use crate::repository::{Backend, CacheSettings, TodoSort};
+use crate::seed::SeedSource;
+use crate::shutdown::ShutdownTimeout;
+use crate::tls::TlsSettings;
+use crate::webhooks::WebhookSettings;
+use std::env;
+use std::fmt;
+
+/// Every setting the server reads from the environment (and `.env`), loaded
+/// in one place before anything starts
+pub struct Config {
+    pub backend: Backend,
+    pub listen: Listen,
+    pub body_limit: BodyLimit,
+    pub request_timeout: RequestTimeout,
+    pub cors: CorsSettings,
+    pub api_key_auth: ApiKeyAuth,
+    pub rate_limiter: Option<RateLimiter>,
+    pub trusted_proxies: TrustedProxies,
+    pub concurrency_limit: Option<ConcurrencyLimit>,
+    pub jwt_auth: JwtAuth,
+    pub tls: Option<TlsSettings>,
+    pub ws_limit: ConnectionLimit,
+    pub idempotency_ttl: IdempotencyTtl,
+    pub subtask_policy: SubtaskDeletePolicy,
+    pub default_sort: TodoSort,
+    pub webhooks: WebhookSettings,
+    pub seed: Option<SeedSource>,
+    pub shutdown_timeout: ShutdownTimeout,
+    pub undo_window: UndoWindow,
+    pub reminders: ReminderSettings,
+    pub purge: PurgeSettings,
+    pub admin_token: AdminToken,
+    pub read_only: ReadOnly,
+    pub allow_destructive: AllowDestructive,
+    pub unique_titles: UniqueTitles,
+    pub recurrence_zone: RecurrenceZone,
+    /// None unless CACHE_TTL is set
+    pub cache: Option<CacheSettings>,
+    pub log_level: LogLevel,
+    pub slow_queries: SlowQueryThreshold,
+    pub profiling: Profiling,
+    pub docs: Docs,
+    pub omit_null_description: OmitNullDescription,
+}
+
+/// All the invalid settings found while loading, reported together so one
+/// restart is enough to fix them
+#[derive(Debug)]
+pub struct ConfigErrors(pub Vec<String>);
+
+impl fmt::Display for ConfigErrors {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "invalid configuration: {}", self.0.join("; "))
+    }
+}
+
+impl std::error::Error for ConfigErrors {}
+
+impl From<ConfigErrors> for std::io::Error {
+    fn from(errors: ConfigErrors) -> Self {
+        std::io::Error::new(std::io::ErrorKind::InvalidInput, errors)
+    }
+}
+
+/// An on/off setting: true/false, 1/0, yes/no or on/off in any case, and
+/// `default` when unset or empty
+pub fn flag(name: &str, default: bool) -> Result<bool, String> {
+    let Some(value) = env::var(name).ok().filter(|v| !v.trim().is_empty()) else {
+        return Ok(default);
+    };
+    match value.trim().to_ascii_lowercase().as_str() {
+        "true" | "1" | "yes" | "on" => Ok(true),
+        "false" | "0" | "no" | "off" => Ok(false),
+        _ => Err(format!("{} must be true or false, got '{}'", name, value)),
+    }
+}
+
+/// Keep a valid setting, or record why it is invalid and carry on
+fn check<T>(result: Result<T, String>, errors: &mut Vec<String>) -> Option<T> {
+    result.map_err(|e| errors.push(e)).ok()
+}
+
+impl Config {
+    /// Load every setting, failing with the full list of problems rather
+    /// than stopping at the first one
+    pub fn from_env() -> Result<Self, ConfigErrors> {
+        let mut errors = Vec::new();
+        let backend = check(Backend::from_env(), &mut errors);
+        let listen = check(Listen::from_env(), &mut errors);
+        let body_limit = check(BodyLimit::from_env(), &mut errors);
+        let request_timeout = check(RequestTimeout::from_env(), &mut errors);
+        let cors = check(CorsSettings::from_env(), &mut errors);
+        let api_key_auth = check(ApiKeyAuth::from_env(), &mut errors);
+        let rate_limiter = check(RateLimiter::from_env(), &mut errors);
+        let trusted_proxies = check(TrustedProxies::from_env(), &mut errors);
+        let concurrency_limit = check(ConcurrencyLimit::from_env(), &mut errors);
+        let jwt_auth = check(JwtAuth::from_env(), &mut errors);
+        let tls = check(TlsSettings::from_env(), &mut errors);
+        let ws_limit = check(ConnectionLimit::from_env(), &mut errors);
+        let idempotency_ttl = check(IdempotencyTtl::from_env(), &mut errors);
+        let subtask_policy = check(SubtaskDeletePolicy::from_env(), &mut errors);
+        let default_sort = check(TodoSort::from_env(), &mut errors);
+        let webhooks = check(WebhookSettings::from_env(), &mut errors);
+        let seed = check(SeedSource::from_env(), &mut errors);
+        let shutdown_timeout = check(ShutdownTimeout::from_env(), &mut errors);
+        let undo_window = check(UndoWindow::from_env(), &mut errors);
+        let reminders = check(ReminderSettings::from_env(), &mut errors);
+        let purge = check(PurgeSettings::from_env(), &mut errors);
+        let admin_token = check(AdminToken::from_env(), &mut errors);
+        let read_only = check(ReadOnly::from_env(), &mut errors);
+        let allow_destructive = check(AllowDestructive::from_env(), &mut errors);
+        let unique_titles = check(UniqueTitles::from_env(), &mut errors);
+        let recurrence_zone = check(RecurrenceZone::from_env(), &mut errors);
+        let cache = check(CacheSettings::from_env(), &mut errors);
+        let log_level = check(LogLevel::from_env(), &mut errors);
+        let slow_queries = check(SlowQueryThreshold::from_env(), &mut errors);
+        let profiling = check(Profiling::from_env(), &mut errors);
+        let docs = check(Docs::from_env(), &mut errors);
+        let omit_null_description = check(OmitNullDescription::from_env(), &mut errors);
+
+        // Every setting is Some exactly when no error was recorded for it
+        let config = || {
+            Some(Config {
+                backend: backend?,
+                listen: listen?,
+                body_limit: body_limit?,
+                request_timeout: request_timeout?,
+                cors: cors?,
+                api_key_auth: api_key_auth?,
+                rate_limiter: rate_limiter?,
+                trusted_proxies: trusted_proxies?,
+                concurrency_limit: concurrency_limit?,
+                jwt_auth: jwt_auth?,
+                tls: tls?,
+                ws_limit: ws_limit?,
+                idempotency_ttl: idempotency_ttl?,
+                subtask_policy: subtask_policy?,
+                default_sort: default_sort?,
+                webhooks: webhooks?,
+                seed: seed?,
+                shutdown_timeout: shutdown_timeout?,
+                undo_window: undo_window?,
+                reminders: reminders?,
+                purge: purge?,
+                admin_token: admin_token?,
+                read_only: read_only?,
+                allow_destructive: allow_destructive?,
+                unique_titles: unique_titles?,
+                recurrence_zone: recurrence_zone?,
+                cache: cache?,
+                log_level: log_level?,
+                slow_queries: slow_queries?,
+                profiling: profiling?,
+                docs: docs?,
+                omit_null_description: omit_null_description?,
+            })
+        };
+        config().ok_or(ConfigErrors(errors))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::Config;
+    use crate::testing;
+
+    #[test]
+    fn defaults_are_valid() {
+        let config = testing::with_env(&[("STORAGE", "memory")], Config::from_env);
+        assert!(config.is_ok(), "{}", config.err().unwrap());
+    }
+
+    #[test]
+    fn every_invalid_setting_is_reported() {
+        let vars = [
+            ("STORAGE", "memory"),
+            ("SUBTASK_DELETE_POLICY", "orphan"),
+            ("SHUTDOWN_TIMEOUT", "soon"),
+            ("RECURRENCE_TZ", "Mars/Olympus_Mons"),
+            ("RATE_LIMIT_RPS", "inf"),
+            ("MAX_BODY_BYTES", "1MB"),
+        ];
+        let errors = testing::with_env(&vars, Config::from_env).err().unwrap();
+        assert_eq!(errors.0.len(), 5, "{}", errors);
+        for name in ["SUBTASK_DELETE_POLICY", "SHUTDOWN_TIMEOUT", "RECURRENCE_TZ", "RATE_LIMIT_RPS", "MAX_BODY_BYTES"] {
+            assert!(errors.0.iter().any(|e| e.contains(name)), "{} missing from {}", name, errors);
+        }
+        assert!(errors.to_string().starts_with("invalid configuration: "));
+    }
+
+    #[test]
+    fn garbage_is_never_replaced_by_a_default() {
+        let vars = [
+            ("STORAGE", "memory"),
+            ("CORS_MAX_AGE", "an hour"),
+            ("CORS_ALLOW_CREDENTIALS", "sure"),
+            ("JWT_EXPIRY_SECS", "0"),
+            ("WS_MAX_CONNECTIONS", "many"),
+            ("IDEMPOTENCY_TTL_SECS", "-1"),
+            ("WEBHOOK_TIMEOUT_SECS", "10s"),
+            ("SEED_FILE", "/no/such/seed.json"),
+            ("ADMIN_TOKEN", "   "),
+            ("READ_ONLY", "maybe"),
+            ("ALLOW_DESTRUCTIVE", "yes please"),
+            ("STRICT_UNIQUE_TITLES", "2"),
+            ("LOG_LEVEL", "loud"),
+            ("SLOW_QUERY_THRESHOLD", "slow"),
+            ("PPROF_PORT", "70000"),
+            ("ENABLE_DOCS", "nah"),
+            ("OMIT_NULL_DESCRIPTION", "sometimes"),
+        ];
+        let errors = testing::with_env(&vars, Config::from_env).err().unwrap();
+        // One error per setting; CORS reports the first of its variables
+        assert_eq!(errors.0.len(), 15, "{}", errors);
+        let expected = [
+            "CORS_MAX_AGE", "JWT_EXPIRY_SECS", "WS_MAX_CONNECTIONS", "IDEMPOTENCY_TTL_SECS", "WEBHOOK_TIMEOUT_SECS",
+            "/no/such/seed.json", "ADMIN_TOKEN", "READ_ONLY", "ALLOW_DESTRUCTIVE", "STRICT_UNIQUE_TITLES",
+            "LOG_LEVEL", "SLOW_QUERY_THRESHOLD", "PPROF_PORT", "ENABLE_DOCS", "OMIT_NULL_DESCRIPTION",
+        ];
+        for name in expected {
+            assert!(errors.0.iter().any(|e| e.contains(name)), "{} missing from {}", name, errors);
+        }
+    }
+
+    #[test]
+    fn flags_accept_the_usual_spellings() {
+        let spellings = [
+            ("TRUE", true), ("1", true), ("yes", true), (" on ", true),
+            ("False", false), ("0", false), ("no", false), ("off", false),
+        ];
+        for (value, expected) in spellings {
+            let result = testing::with_env(&[("READ_ONLY", value)], || super::flag("READ_ONLY", !expected));
+            assert_eq!(result, Ok(expected), "{:?}", value);
+        }
+        assert_eq!(testing::with_env(&[("READ_ONLY", "")], || super::flag("READ_ONLY", true)), Ok(true));
+        assert!(testing::with_env(&[("READ_ONLY", "y")], || super::flag("READ_ONLY", false)).is_err());
+    }
+}
@@ -0,0 +1,289 @@
+use futures_util::future::BoxFuture;
+use futures_util::stream::{BoxStream, StreamExt};
+use sqlx::database::HasStatement;
+use sqlx::{Database, Describe, Either, Execute, Executor, Pool, Transaction};
+use std::cell::Cell;
+use std::env;
+use std::future::Future;
+use std::ops::{Deref, DerefMut};
+use std::panic::Location;
+use std::sync::OnceLock;
+use std::time::{Duration, Instant};
+
+use super::parse_duration;
+
+const DEFAULT_SLOW_QUERY_THRESHOLD: Duration = Duration::from_millis(500);
+
+/// Longest statement text included in a slow query warning
+const MAX_STATEMENT_LEN: usize = 200;
+
+tokio::task_local! {
+    static DB_TIME: Cell<Duration>;
+}
+
+/// Statements running at least this long are logged at warn level,
+/// configured through SLOW_QUERY_THRESHOLD; None when set to 0
+#[derive(Debug, Clone, Copy)]
+pub struct SlowQueryThreshold(pub Option<Duration>);
+
+static THRESHOLD: OnceLock<Option<Duration>> = OnceLock::new();
+
+impl SlowQueryThreshold {
+    pub fn from_env() -> Result<Self, String> {
+        let threshold = match env::var("SLOW_QUERY_THRESHOLD").ok().filter(|v| !v.is_empty()) {
+            None => DEFAULT_SLOW_QUERY_THRESHOLD,
+            Some(value) => parse_duration(&value).ok_or_else(|| {
+                format!("SLOW_QUERY_THRESHOLD must be a duration such as '500ms', or 0 to disable, got '{}'", value)
+            })?,
+        };
+        Ok(SlowQueryThreshold((!threshold.is_zero()).then_some(threshold)))
+    }
+
+    /// Make this the threshold every timed pool reports against. Only the
+    /// first call has an effect.
+    pub fn install(self) {
+        let _ = THRESHOLD.set(self.0);
+    }
+}
+
+/// The installed threshold, the default when none was
+fn slow_query_threshold() -> Option<Duration> {
+    *THRESHOLD.get_or_init(|| Some(DEFAULT_SLOW_QUERY_THRESHOLD))
+}
+
+/// Run `fut`, returning its output together with the time spent in database
+/// statements while it ran
+pub async fn measure<F: Future>(fut: F) -> (F::Output, Duration) {
+    DB_TIME
+        .scope(Cell::new(Duration::ZERO), async {
+            let output = fut.await;
+            (output, DB_TIME.with(Cell::get))
+        })
+        .await
+}
+
+/// A connection pool that times every statement run directly on it. Each
+/// one adds to the database time of the request it ran for, and statements
+/// slower than SLOW_QUERY_THRESHOLD are logged. Statements inside a
+/// transaction run on its connection, so a transaction is timed as a whole
+/// instead; see `TimedTransaction`.
+#[derive(Debug, Clone)]
+pub struct TimedPool<DB: Database> {
+    pool: Pool<DB>,
+}
+
+impl<DB: Database> TimedPool<DB> {
+    pub fn new(pool: Pool<DB>) -> Self {
+        TimedPool { pool }
+    }
+
+    pub fn inner(&self) -> &Pool<DB> {
+        &self.pool
+    }
+
+    /// Begin a transaction, timed from here until it ends. Slow ones are
+    /// logged with the place they were begun, since their statements are not.
+    #[track_caller]
+    pub fn begin(&self) -> impl Future<Output = Result<TimedTransaction<'static, DB>, sqlx::Error>> + '_ {
+        let timer = TransactionTimer { begun_at: Location::caller(), started: Instant::now() };
+        async move {
+            let tx = self.pool.begin().await?;
+            Ok(TimedTransaction { tx, timer })
+        }
+    }
+}
+
+/// A transaction begun on a `TimedPool`. It dereferences to the connection
+/// like `Transaction` does, so statements run on `&mut *tx`.
+pub struct TimedTransaction<'c, DB: Database> {
+    tx: Transaction<'c, DB>,
+    timer: TransactionTimer,
+}
+
+impl<'c, DB: Database> TimedTransaction<'c, DB> {
+    pub async fn commit(self) -> Result<(), sqlx::Error> {
+        let TimedTransaction { tx, timer } = self;
+        let result = tx.commit().await;
+        drop(timer);
+        result
+    }
+
+    pub async fn rollback(self) -> Result<(), sqlx::Error> {
+        let TimedTransaction { tx, timer } = self;
+        let result = tx.rollback().await;
+        drop(timer);
+        result
+    }
+}
+
+impl<DB: Database> Deref for TimedTransaction<'_, DB> {
+    type Target = DB::Connection;
+
+    fn deref(&self) -> &DB::Connection {
+        &self.tx
+    }
+}
+
+impl<DB: Database> DerefMut for TimedTransaction<'_, DB> {
+    fn deref_mut(&mut self) -> &mut DB::Connection {
+        &mut self.tx
+    }
+}
+
+/// Times a transaction from BEGIN until it is committed, rolled back or
+/// dropped
+struct TransactionTimer {
+    begun_at: &'static Location<'static>,
+    started: Instant,
+}
+
+impl Drop for TransactionTimer {
+    fn drop(&mut self) {
+        let elapsed = self.started.elapsed();
+        let _ = DB_TIME.try_with(|total| total.set(total.get() + elapsed));
+
+        if slow_query_threshold().is_some_and(|threshold| elapsed >= threshold) {
+            log::warn!(
+                target: "db",
+                begun_at = self.begun_at.to_string().as_str(),
+                duration_ms = elapsed.as_millis() as u64;
+                "slow transaction"
+            );
+        }
+    }
+}
+
+impl<DB: Database> Deref for TimedPool<DB> {
+    type Target = Pool<DB>;
+
+    fn deref(&self) -> &Pool<DB> {
+        &self.pool
+    }
+}
+
+/// Times one statement from start until its result has been read or dropped
+struct QueryTimer<'q> {
+    statement: &'q str,
+    started: Instant,
+    rows: u64,
+}
+
+impl<'q> QueryTimer<'q> {
+    fn start(statement: &'q str) -> Self {
+        QueryTimer { statement, started: Instant::now(), rows: 0 }
+    }
+}
+
+impl Drop for QueryTimer<'_> {
+    fn drop(&mut self) {
+        let elapsed = self.started.elapsed();
+        let _ = DB_TIME.try_with(|total| total.set(total.get() + elapsed));
+
+        if slow_query_threshold().is_some_and(|threshold| elapsed >= threshold) {
+            log::warn!(
+                target: "db",
+                statement = summarize(self.statement).as_str(),
+                rows = self.rows,
+                duration_ms = elapsed.as_millis() as u64;
+                "slow query"
+            );
+        }
+    }
+}
+
+/// The statement on one line with its whitespace collapsed, cut short if long
+fn summarize(sql: &str) -> String {
+    let mut summary = sql.split_whitespace().collect::<Vec<_>>().join(" ");
+    if let Some((cut, _)) = summary.char_indices().nth(MAX_STATEMENT_LEN) {
+        summary.truncate(cut);
+        summary.push_str("...");
+    }
+    summary
+}
+
+impl<'p, DB: Database> Executor<'p> for &'p TimedPool<DB>
+where
+    for<'c> &'c mut DB::Connection: Executor<'c, Database = DB>,
+{
+    type Database = DB;
+
+    fn fetch_many<'e, 'q: 'e, E: 'q>(
+        self,
+        query: E,
+    ) -> BoxStream<'e, Result<Either<DB::QueryResult, DB::Row>, sqlx::Error>>
+    where
+        'p: 'e,
+        E: Execute<'q, DB>,
+    {
+        let mut timer = QueryTimer::start(query.sql());
+        self.pool
+            .fetch_many(query)
+            .map(move |item| {
+                if let Ok(Either::Right(_)) = &item {
+                    timer.rows += 1;
+                }
+                item
+            })
+            .boxed()
+    }
+
+    fn fetch_optional<'e, 'q: 'e, E: 'q>(
+        self,
+        query: E,
+    ) -> BoxFuture<'e, Result<Option<DB::Row>, sqlx::Error>>
+    where
+        'p: 'e,
+        E: Execute<'q, DB>,
+    {
+        let mut timer = QueryTimer::start(query.sql());
+        let row = self.pool.fetch_optional(query);
+        Box::pin(async move {
+            let row = row.await;
+            if let Ok(Some(_)) = &row {
+                timer.rows = 1;
+            }
+            row
+        })
+    }
+
+    fn prepare_with<'e, 'q: 'e>(
+        self,
+        sql: &'q str,
+        parameters: &'e [DB::TypeInfo],
+    ) -> BoxFuture<'e, Result<<DB as HasStatement<'q>>::Statement, sqlx::Error>>
+    where
+        'p: 'e,
+    {
+        self.pool.prepare_with(sql, parameters)
+    }
+
+    fn describe<'e, 'q: 'e>(self, sql: &'q str) -> BoxFuture<'e, Result<Describe<DB>, sqlx::Error>>
+    where
+        'p: 'e,
+    {
+        self.pool.describe(sql)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use sqlx::sqlite::SqlitePoolOptions;
+    use std::time::Duration;
+
+    use super::{measure, TimedPool};
+
+    #[actix_web::test]
+    async fn transactions_count_as_database_time() {
+        let pool = SqlitePoolOptions::new().max_connections(1).connect("sqlite::memory:").await.unwrap();
+        let pool = TimedPool::new(pool);
+
+        let ((), elapsed) = measure(async {
+            let mut tx = pool.begin().await.unwrap();
+            sqlx::query("SELECT 1").execute(&mut *tx).await.unwrap();
+            actix_web::rt::time::sleep(Duration::from_millis(20)).await;
+            tx.commit().await.unwrap();
+        })
+        .await;
+        assert!(elapsed >= Duration::from_millis(20), "{:?}", elapsed);
+    }
+}
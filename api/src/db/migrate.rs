@@ -0,0 +1,202 @@
+use sqlx::{Executor, PgPool};
+
+/// A schema change from the migrations directory, embedded at build time
+struct Migration {
+    version: i64,
+    name: &'static str,
+    sql: &'static str,
+}
+
+macro_rules! migration {
+    ($version:literal, $name:literal) => {
+        Migration {
+            version: $version,
+            name: $name,
+            sql: include_str!(concat!("../../migrations/", stringify!($version), "_", $name, ".sql")),
+        }
+    };
+}
+
+/// Every migration in the order it must be applied. Add new files here as well.
+const MIGRATIONS: &[Migration] = &[
+    migration!(01, "create_todos_table"),
+    migration!(02, "add_todo_version"),
+    migration!(03, "add_todo_tags"),
+    migration!(04, "add_todo_user_id"),
+    migration!(05, "create_users_table"),
+    migration!(06, "create_lists"),
+    migration!(07, "create_idempotency_keys"),
+    migration!(08, "add_todo_parent_id"),
+    migration!(09, "add_todo_recurrence"),
+    migration!(10, "add_open_todo_title_index"),
+    migration!(11, "create_webhooks"),
+    migration!(12, "add_todo_archived"),
+    migration!(13, "add_todo_position"),
+    migration!(14, "add_todo_audit"),
+    migration!(15, "add_todo_search"),
+    migration!(16, "create_todo_events"),
+    migration!(17, "create_pending_deletes"),
+    migration!(18, "add_todo_recurrence_interval"),
+    migration!(19, "add_todo_reminders"),
+    migration!(20, "add_archived_todos_index"),
+    migration!(21, "normalize_open_todo_title"),
+    migration!(22, "add_sync_indexes"),
+    migration!(23, "add_todo_recurrence_day"),
+    migration!(24, "add_todo_strict_title"),
+    migration!(25, "add_reordered_todo_event"),
+];
+
+/// Arbitrary key for the advisory lock that keeps two instances from migrating at once
+const MIGRATION_LOCK: i64 = 0x746f_646f_6d69_67;
+
+/// Apply every migration not yet recorded in `schema_migrations`. Each one runs
+/// in its own transaction, so a failing migration leaves no partial changes and
+/// is retried on the next run. The migrations themselves are idempotent too, so
+/// databases set up by hand or by the Postgres container's init scripts are
+/// brought under tracking without errors.
+pub async fn run(pool: &PgPool) -> Result<(), sqlx::Error> {
+    apply(pool, MIGRATIONS).await
+}
+
+/// Apply the given migrations, skipping those already recorded
+async fn apply(pool: &PgPool, migrations: &[Migration]) -> Result<(), sqlx::Error> {
+    pool.execute(
+        "CREATE TABLE IF NOT EXISTS schema_migrations (
+             version BIGINT PRIMARY KEY,
+             name TEXT NOT NULL,
+             applied_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+         )",
+    )
+    .await?;
+
+    for migration in migrations {
+        let mut tx = pool.begin().await?;
+        sqlx::query("SELECT pg_advisory_xact_lock($1)")
+            .bind(MIGRATION_LOCK)
+            .execute(&mut *tx)
+            .await?;
+
+        let applied: bool =
+            sqlx::query_scalar("SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)")
+                .bind(migration.version)
+                .fetch_one(&mut *tx)
+                .await?;
+        if applied {
+            continue;
+        }
+
+        log::info!(version = migration.version, name = migration.name; "applying migration");
+        (&mut *tx).execute(migration.sql).await?;
+        sqlx::query("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)")
+            .bind(migration.version)
+            .bind(migration.name)
+            .execute(&mut *tx)
+            .await?;
+        tx.commit().await?;
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use sqlx::postgres::{PgConnectOptions, PgPool, PgPoolOptions};
+    use sqlx::Executor;
+    use std::collections::BTreeSet;
+    use std::fs;
+    use std::str::FromStr;
+    use uuid::Uuid;
+
+    use super::{apply, run, MIGRATIONS};
+
+    #[test]
+    fn every_migration_file_is_listed_in_order() {
+        let versions: Vec<i64> = MIGRATIONS.iter().map(|m| m.version).collect();
+        assert!(versions.windows(2).all(|pair| pair[0] < pair[1]), "{:?}", versions);
+
+        let dir = concat!(env!("CARGO_MANIFEST_DIR"), "/migrations");
+        let files: BTreeSet<String> = fs::read_dir(dir)
+            .unwrap()
+            .map(|entry| entry.unwrap().file_name().to_string_lossy().into_owned())
+            .filter(|name| name.ends_with(".sql"))
+            .collect();
+        let listed: BTreeSet<String> =
+            MIGRATIONS.iter().map(|m| format!("{:02}_{}.sql", m.version, m.name)).collect();
+        assert_eq!(files, listed);
+    }
+
+    /// A pool whose connections work in a new, empty schema of TEST_DATABASE_URL.
+    /// Returns a pool on the default schema too, for dropping it afterwards.
+    async fn fresh_schema() -> (PgPool, PgPool, String) {
+        let url = std::env::var("TEST_DATABASE_URL").expect("TEST_DATABASE_URL must be set");
+        let schema = format!("migrate_{}", Uuid::new_v4().simple());
+        let admin = PgPoolOptions::new().max_connections(1).connect(&url).await.unwrap();
+        admin.execute(format!("CREATE SCHEMA {}", schema).as_str()).await.unwrap();
+
+        let options = PgConnectOptions::from_str(&url).unwrap().options([("search_path", schema.as_str())]);
+        let pool = PgPoolOptions::new().max_connections(1).connect_with(options).await.unwrap();
+        (pool, admin, schema)
+    }
+
+    /// Needs a Postgres to write to:
+    /// `TEST_DATABASE_URL=postgres://... cargo test -- --ignored migrations_apply_twice`
+    #[actix_web::test]
+    #[ignore]
+    async fn migrations_apply_twice() {
+        let (pool, admin, schema) = fresh_schema().await;
+        run(&pool).await.unwrap();
+        // A second run finds everything recorded and changes nothing
+        run(&pool).await.unwrap();
+        let applied: Vec<i64> = sqlx::query_scalar("SELECT version FROM schema_migrations ORDER BY version")
+            .fetch_all(&pool)
+            .await
+            .unwrap();
+        assert_eq!(applied, MIGRATIONS.iter().map(|m| m.version).collect::<Vec<_>>());
+        // The files are safe to replay on a schema that already has them, as
+        // happens when the container's init scripts created it
+        for migration in MIGRATIONS {
+            if let Err(e) = pool.execute(migration.sql).await {
+                panic!("migration {} failed on replay: {}", migration.version, e);
+            }
+        }
+
+        pool.close().await;
+        admin.execute(format!("DROP SCHEMA {} CASCADE", schema).as_str()).await.unwrap();
+    }
+
+    /// Open todos sharing a title, exactly or only by case and spacing, were
+    /// allowed before titles could be required unique. Databases holding them
+    /// must still migrate all the way.
+    #[actix_web::test]
+    #[ignore]
+    async fn migrations_apply_twice_over_duplicate_titles() {
+        let (pool, admin, schema) = fresh_schema().await;
+        let before_titles = MIGRATIONS.iter().position(|m| m.version == 10).unwrap();
+        apply(&pool, &MIGRATIONS[..before_titles]).await.unwrap();
+        let user = Uuid::new_v4();
+        for title in ["Deploy v2", "Deploy v2", " deploy V2"] {
+            sqlx::query("INSERT INTO todos (title, user_id) VALUES ($1, $2)")
+                .bind(title)
+                .bind(user)
+                .execute(&pool)
+                .await
+                .unwrap();
+        }
+
+        run(&pool).await.unwrap();
+        run(&pool).await.unwrap();
+        let applied: i64 = sqlx::query_scalar("SELECT count(*) FROM schema_migrations")
+            .fetch_one(&pool)
+            .await
+            .unwrap();
+        assert_eq!(applied, MIGRATIONS.len() as i64);
+        let open: i64 = sqlx::query_scalar("SELECT count(*) FROM todos WHERE NOT completed")
+            .fetch_one(&pool)
+            .await
+            .unwrap();
+        assert_eq!(open, 3);
+
+        pool.close().await;
+        admin.execute(format!("DROP SCHEMA {} CASCADE", schema).as_str()).await.unwrap();
+    }
+}
@@ -1,15 +1,311 @@
-use sqlx::postgres::PgPoolOptions;
-use sqlx::PgPool;
+pub mod metrics;
+pub mod migrate;
+
+use log::LevelFilter;
+use sqlx::postgres::{PgConnectOptions, PgPoolOptions};
+use sqlx::{ConnectOptions, Database, PgPool};
 use std::env;
+use std::fmt;
+use std::future::Future;
+use std::str::FromStr;
+use std::time::{Duration, Instant};
+
+use crate::config::flag;
+use metrics::TimedTransaction;
+
+const DEFAULT_QUERY_TIMEOUT: Duration = Duration::from_secs(5);
+const DEFAULT_CONNECT_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// Delay before the first reconnect attempt; doubled after every failure
+const INITIAL_BACKOFF: Duration = Duration::from_millis(250);
+const MAX_BACKOFF: Duration = Duration::from_secs(5);
+
+/// Storage backend, chosen by DB_DRIVER or else by the DATABASE_URL scheme
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Driver {
+    Postgres,
+    Sqlite,
+}
 
-pub async fn establish_connection() -> Result<PgPool, sqlx::Error> {
-    let database_url = env::var("DATABASE_URL")
-        .expect("DATABASE_URL must be set");
+impl Driver {
+    /// DB_DRIVER, or else the driver the scheme of `url` names
+    pub fn from_env(url: &str) -> Result<Self, String> {
+        match env::var("DB_DRIVER").ok().as_deref().map(str::trim) {
+            None | Some("") => {
+                if url.starts_with("sqlite:") {
+                    Ok(Driver::Sqlite)
+                } else {
+                    Ok(Driver::Postgres)
+                }
+            }
+            Some(driver) if driver.eq_ignore_ascii_case("postgres") => Ok(Driver::Postgres),
+            Some(driver) if driver.eq_ignore_ascii_case("sqlite") => Ok(Driver::Sqlite),
+            Some(other) => Err(format!(
+                "DB_DRIVER must be 'postgres' or 'sqlite', got '{}'",
+                other
+            )),
+        }
+    }
 
-    let pool = PgPoolOptions::new()
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Driver::Postgres => "postgres",
+            Driver::Sqlite => "sqlite",
+        }
+    }
+}
+
+/// Parse a duration such as "5", "5s", "500ms", "10m", "2h" or "30d"; bare
+/// numbers are seconds
+pub(crate) fn parse_duration(value: &str) -> Option<Duration> {
+    let value = value.trim();
+    if let Some(ms) = value.strip_suffix("ms") {
+        return ms.trim().parse().ok().map(Duration::from_millis);
+    }
+    let (number, unit) = match value.char_indices().last() {
+        Some((i, 's')) => (&value[..i], 1.0),
+        Some((i, 'm')) => (&value[..i], 60.0),
+        Some((i, 'h')) => (&value[..i], 3600.0),
+        Some((i, 'd')) => (&value[..i], 86400.0),
+        _ => (value, 1.0),
+    };
+    number
+        .trim()
+        .parse::<f64>()
+        .ok()
+        .filter(|n| *n >= 0.0)
+        .and_then(|n| Duration::try_from_secs_f64(n * unit).ok())
+}
+
+/// A duration from `name`, `default` when unset or empty. Zero is refused
+/// unless `allow_zero`.
+fn duration_env(name: &str, default: Duration, allow_zero: bool) -> Result<Duration, String> {
+    match env::var(name).ok().filter(|v| !v.is_empty()) {
+        None => Ok(default),
+        Some(value) => parse_duration(&value)
+            .filter(|d| allow_zero || !d.is_zero())
+            .ok_or_else(|| format!("{} must be a duration such as '5', '5s' or '500ms', got '{}'", name, value)),
+    }
+}
+
+/// Where the database is and how to use it, for the database backends
+#[derive(Debug, Clone)]
+pub struct DatabaseSettings {
+    pub driver: Driver,
+    /// DATABASE_URL
+    pub url: String,
+    /// Longest a single query may run, configured through DB_QUERY_TIMEOUT
+    pub query_timeout: Duration,
+    /// How long to keep retrying the initial connection, configured through
+    /// DB_CONNECT_TIMEOUT
+    pub connect_timeout: Duration,
+    /// Whether to migrate at startup, configured through AUTO_MIGRATE
+    pub auto_migrate: bool,
+}
+
+impl DatabaseSettings {
+    pub fn from_env() -> Result<Self, String> {
+        let url = env::var("DATABASE_URL")
+            .ok()
+            .filter(|v| !v.trim().is_empty())
+            .ok_or("DATABASE_URL must be set unless STORAGE=memory")?;
+        Ok(DatabaseSettings {
+            driver: Driver::from_env(&url)?,
+            query_timeout: duration_env("DB_QUERY_TIMEOUT", DEFAULT_QUERY_TIMEOUT, false)?,
+            connect_timeout: duration_env("DB_CONNECT_TIMEOUT", DEFAULT_CONNECT_TIMEOUT, true)?,
+            auto_migrate: flag("AUTO_MIGRATE", false)?,
+            url,
+        })
+    }
+}
+
+/// Commit `tx` if `result` is Ok and roll it back otherwise, then hand back
+/// `result`. Write paths run their statements in an async block against the
+/// transaction and pass its outcome here, so an early return or `?` can never
+/// leave half of a change behind.
+pub async fn finish<DB: Database, T, E: From<sqlx::Error>>(
+    tx: TimedTransaction<'_, DB>,
+    result: Result<T, E>,
+) -> Result<T, E> {
+    match result {
+        Ok(value) => {
+            tx.commit().await?;
+            Ok(value)
+        }
+        Err(err) => {
+            // The caller's error is the one worth reporting; the connection
+            // is closed rather than reused if the rollback itself fails
+            if let Err(rollback) = tx.rollback().await {
+                log::warn!(error = rollback.to_string().as_str(); "transaction rollback failed");
+            }
+            Err(err)
+        }
+    }
+}
+
+/// Connect to the database, retrying with exponential backoff until
+/// DB_CONNECT_TIMEOUT has passed. Postgres often needs a few seconds longer
+/// than the API to accept connections when both start together.
+pub async fn establish_connection(settings: &DatabaseSettings) -> Result<PgPool, sqlx::Error> {
+    let timeout = settings.query_timeout;
+
+    // Postgres cancels statements that exceed statement_timeout itself, so a
+    // hung query fails and its connection goes back to the pool. Slow
+    // statements are reported by metrics::TimedPool rather than by sqlx.
+    let options = PgConnectOptions::from_str(&settings.url)?
+        .options([("statement_timeout", timeout.as_millis().to_string())])
+        .log_slow_statements(LevelFilter::Off, Duration::ZERO);
+
+    let pool_options = PgPoolOptions::new()
         .max_connections(5)
-        .connect(&database_url)
-        .await?;
+        .acquire_timeout(timeout);
+
+    retry(settings.connect_timeout, || pool_options.clone().connect_with(options.clone())).await
+}
+
+/// Call `connect` until it succeeds, waiting with exponential backoff between
+/// attempts, and give up with the last error once `timeout` has passed
+async fn retry<T, E, F, Fut>(timeout: Duration, mut connect: F) -> Result<T, E>
+where
+    E: fmt::Display,
+    F: FnMut() -> Fut,
+    Fut: Future<Output = Result<T, E>>,
+{
+    let deadline = Instant::now() + timeout;
+    let mut backoff = INITIAL_BACKOFF;
+    let mut attempt = 1;
+
+    loop {
+        match connect().await {
+            Ok(connected) => return Ok(connected),
+            Err(err) => {
+                let remaining = deadline.saturating_duration_since(Instant::now());
+                if remaining.is_zero() {
+                    return Err(err);
+                }
+
+                let delay = backoff.min(remaining);
+                log::warn!(
+                    attempt = attempt,
+                    retry_in_ms = delay.as_millis() as u64,
+                    error = err.to_string().as_str();
+                    "database connection failed, retrying"
+                );
+                tokio::time::sleep(delay).await;
+
+                backoff = (backoff * 2).min(MAX_BACKOFF);
+                attempt += 1;
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use sqlx::sqlite::SqlitePoolOptions;
+    use sqlx::{Executor, Sqlite, SqlitePool};
+
+    use std::cell::Cell;
+    use std::time::{Duration, Instant};
+
+    use super::metrics::TimedPool;
+    use super::{finish, retry, DatabaseSettings, Driver, DEFAULT_QUERY_TIMEOUT};
+    use crate::testing;
+
+    /// An in-memory database holding an empty `items` table. One connection,
+    /// since every in-memory connection is a database of its own.
+    async fn pool() -> TimedPool<Sqlite> {
+        let pool = SqlitePoolOptions::new().max_connections(1).connect("sqlite::memory:").await.unwrap();
+        pool.execute("CREATE TABLE items (id INTEGER PRIMARY KEY)").await.unwrap();
+        TimedPool::new(pool)
+    }
+
+    async fn items(pool: &SqlitePool) -> i64 {
+        sqlx::query_scalar("SELECT COUNT(*) FROM items").fetch_one(pool).await.unwrap()
+    }
+
+    #[actix_web::test]
+    async fn error_rolls_back_every_statement() {
+        let pool = pool().await;
+        let mut tx = pool.begin().await.unwrap();
+        sqlx::query("INSERT INTO items (id) VALUES (1)").execute(&mut *tx).await.unwrap();
+        let result = sqlx::query("INSERT INTO items (id) VALUES (1)").execute(&mut *tx).await;
+        assert!(result.is_err());
+
+        assert!(finish(tx, result).await.is_err());
+        assert_eq!(items(&pool).await, 0);
+    }
+
+    #[actix_web::test]
+    async fn ok_commits() {
+        let pool = pool().await;
+        let mut tx = pool.begin().await.unwrap();
+        let result = sqlx::query("INSERT INTO items (id) VALUES (1)").execute(&mut *tx).await;
+
+        assert_eq!(finish(tx, result).await.unwrap().rows_affected(), 1);
+        assert_eq!(items(&pool).await, 1);
+    }
+
+    #[test]
+    fn database_settings_are_checked() {
+        let settings = |vars: &[(&str, &str)]| {
+            let mut vars = vars.to_vec();
+            vars.push(("DATABASE_URL", "postgres://localhost/todo_db"));
+            testing::with_env(&vars, DatabaseSettings::from_env)
+        };
+        let timeout = |value: &str| settings(&[("DB_QUERY_TIMEOUT", value)]).map(|s| s.query_timeout);
+        assert_eq!(timeout(""), Ok(DEFAULT_QUERY_TIMEOUT));
+        assert_eq!(timeout("250ms"), Ok(Duration::from_millis(250)));
+        assert_eq!(timeout("2"), Ok(Duration::from_secs(2)));
+        assert_eq!(timeout("1m"), Ok(Duration::from_secs(60)));
+        for invalid in ["0", "soon", "-1"] {
+            assert!(timeout(invalid).unwrap_err().contains("DB_QUERY_TIMEOUT"), "{:?}", invalid);
+        }
+
+        let connect = settings(&[("DB_CONNECT_TIMEOUT", "0")]).unwrap();
+        assert_eq!(connect.connect_timeout, Duration::ZERO);
+        assert_eq!(connect.driver, Driver::Postgres);
+        assert!(!connect.auto_migrate);
+        assert!(settings(&[("AUTO_MIGRATE", "True")]).unwrap().auto_migrate);
+        assert!(settings(&[("AUTO_MIGRATE", "always")]).is_err());
+
+        let sqlite = testing::with_env(&[("DATABASE_URL", "sqlite://todo.db")], DatabaseSettings::from_env);
+        assert_eq!(sqlite.unwrap().driver, Driver::Sqlite);
+        assert!(testing::with_env(&[], DatabaseSettings::from_env).unwrap_err().contains("DATABASE_URL"));
+    }
+
+    #[actix_web::test]
+    async fn retry_keeps_trying_until_connected() {
+        let attempts = Cell::new(0);
+        let result = retry(Duration::from_secs(10), || {
+            attempts.set(attempts.get() + 1);
+            let attempt = attempts.get();
+            async move {
+                match attempt {
+                    1 | 2 => Err("connection refused"),
+                    _ => Ok(attempt),
+                }
+            }
+        })
+        .await;
+
+        assert_eq!(result, Ok(3));
+    }
+
+    #[actix_web::test]
+    async fn retry_gives_up_with_the_last_error_at_the_deadline() {
+        let attempts = Cell::new(0);
+        let started = Instant::now();
+        let result: Result<(), String> = retry(Duration::from_millis(600), || {
+            attempts.set(attempts.get() + 1);
+            let error = format!("attempt {} refused", attempts.get());
+            async move { Err(error) }
+        })
+        .await;
 
-    Ok(pool)
+        // 250ms and then the remaining 350ms of backoff before the last try
+        assert_eq!(result, Err("attempt 3 refused".to_string()));
+        assert!(started.elapsed() >= Duration::from_millis(600));
+        assert!(started.elapsed() < Duration::from_secs(5));
+    }
 }
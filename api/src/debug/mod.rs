@@ -0,0 +1,134 @@
+use actix_web::{web, HttpResponse};
+use serde::Deserialize;
+use std::time::Duration;
+
+use crate::config::flag;
+use crate::error::ApiError;
+
+const INDEX_HTML: &str = r#"<html>
+<head><title>/debug/pprof/</title></head>
+<body>
+<p>Profiles:</p>
+<ul>
+<li><a href="/debug/pprof/profile?seconds=30">profile</a>: CPU profile rendered as a flamegraph. Use the <code>seconds</code> parameter to control the sampling duration.</li>
+</ul>
+</body>
+</html>
+"#;
+
+const DEFAULT_PROFILE_SECONDS: u64 = 30;
+const MAX_PROFILE_SECONDS: u64 = 300;
+
+#[derive(Debug, Deserialize)]
+pub struct ProfileQuery {
+    pub seconds: Option<u64>,
+}
+
+const DEFAULT_PORT: u16 = 6060;
+
+/// The localhost port of the profiling listener, configured through
+/// ENABLE_PPROF and PPROF_PORT; None when profiling is off
+#[derive(Debug, Clone, Copy)]
+pub struct Profiling(pub Option<u16>);
+
+impl Profiling {
+    pub fn from_env() -> Result<Self, String> {
+        let port = match std::env::var("PPROF_PORT").ok().filter(|v| !v.trim().is_empty()) {
+            None => DEFAULT_PORT,
+            Some(value) => value
+                .trim()
+                .parse()
+                .map_err(|_| format!("PPROF_PORT must be a port number, got '{}'", value))?,
+        };
+        Ok(Profiling(flag("ENABLE_PPROF", false)?.then_some(port)))
+    }
+
+    pub fn enabled(&self) -> bool {
+        self.0.is_some()
+    }
+
+    /// Address of the profiling listener; always bound to localhost
+    pub fn address(&self) -> Option<String> {
+        self.0.map(|port| format!("127.0.0.1:{}", port))
+    }
+}
+
+pub fn configure_routes(cfg: &mut web::ServiceConfig) {
+    cfg.service(
+        web::scope("/debug/pprof")
+            .route("", web::get().to(index))
+            .route("/", web::get().to(index))
+            .route("/profile", web::get().to(profile))
+    );
+}
+
+/// List the available profiles
+pub async fn index() -> HttpResponse {
+    HttpResponse::Ok()
+        .content_type("text/html; charset=utf-8")
+        .body(INDEX_HTML)
+}
+
+/// Sample the CPU for the requested duration and return a flamegraph
+pub async fn profile(query: web::Query<ProfileQuery>) -> Result<HttpResponse, ApiError> {
+    let seconds = query
+        .seconds
+        .unwrap_or(DEFAULT_PROFILE_SECONDS)
+        .clamp(1, MAX_PROFILE_SECONDS);
+
+    let guard = pprof::ProfilerGuardBuilder::default()
+        .frequency(1000)
+        .blocklist(&["libc", "libgcc", "pthread", "vdso"])
+        .build()
+        .map_err(|e| ApiError::InternalServerError(format!("Failed to start profiler: {}", e)))?;
+
+    actix_web::rt::time::sleep(Duration::from_secs(seconds)).await;
+
+    let report = guard
+        .report()
+        .build()
+        .map_err(|e| ApiError::InternalServerError(format!("Failed to build profile: {}", e)))?;
+
+    let mut body = Vec::new();
+    report
+        .flamegraph(&mut body)
+        .map_err(|e| ApiError::InternalServerError(format!("Failed to render flamegraph: {}", e)))?;
+
+    Ok(HttpResponse::Ok().content_type("image/svg+xml").body(body))
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+    use actix_web::App;
+
+    use crate::testing;
+
+    #[actix_web::test]
+    async fn index_lists_the_profiles() {
+        let app = test::init_service(App::new().configure(super::configure_routes)).await;
+        for uri in ["/debug/pprof", "/debug/pprof/"] {
+            let res = test::call_service(&app, TestRequest::get().uri(uri).to_request()).await;
+            assert_eq!(res.status(), StatusCode::OK);
+            let body = test::read_body(res).await;
+            assert!(std::str::from_utf8(&body).unwrap().contains("/debug/pprof/profile"));
+        }
+    }
+
+    #[actix_web::test]
+    async fn api_does_not_serve_profiles() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let res = test::call_service(&app, TestRequest::get().uri("/debug/pprof/").to_request()).await;
+        assert_eq!(res.status(), StatusCode::NOT_FOUND);
+    }
+
+    #[test]
+    fn disabled_unless_asked_for() {
+        assert!(!testing::with_env(&[("ENABLE_PPROF", "")], super::enabled));
+        assert!(!testing::with_env(&[("ENABLE_PPROF", "no")], super::enabled));
+        assert!(testing::with_env(&[("ENABLE_PPROF", "TRUE")], super::enabled));
+        assert!(testing::with_env(&[("ENABLE_PPROF", "1")], super::enabled));
+    }
+}
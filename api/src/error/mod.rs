@@ -1,11 +1,42 @@
-use actix_web::{error::ResponseError, http::StatusCode, HttpResponse};
+use actix_web::{
+    body::MessageBody,
+    dev::ServiceResponse,
+    error::ResponseError,
+    http::{header::CONTENT_TYPE, StatusCode},
+    middleware::{ErrorHandlerResponse, ErrorHandlers},
+    web, HttpResponse,
+};
 use serde::Serialize;
 use std::fmt;
+use uuid::Uuid;
+
+use crate::middleware::current_request_id;
 
 #[derive(Debug, Serialize)]
 pub struct ErrorResponse {
     pub error: String,
     pub message: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub request_id: Option<String>,
+    /// Every invalid field, for validation failures
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub fields: Vec<FieldError>,
+    /// The open todo a duplicate title clashes with, when it is known
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub existing_id: Option<Uuid>,
+}
+
+/// One invalid field of a request body
+#[derive(Debug, Clone, Serialize)]
+pub struct FieldError {
+    pub field: &'static str,
+    pub message: String,
+}
+
+impl FieldError {
+    pub fn new(field: &'static str, message: impl Into<String>) -> Self {
+        FieldError { field, message: message.into() }
+    }
 }
 
 #[derive(Debug)]
@@ -13,8 +44,21 @@ pub enum ApiError {
     NotFound(String),
     BadRequest(String),
     InternalServerError(String),
-    #[allow(dead_code)]
     Conflict(String),
+    PayloadTooLarge(String),
+    UnsupportedMediaType(String),
+    Unauthorized(String),
+    Forbidden(String),
+    TooManyRequests(String),
+    GatewayTimeout(String),
+    ServiceUnavailable(String),
+    Gone(String),
+    NotAcceptable(String),
+    MethodNotAllowed(String),
+    /// 400 listing every invalid field rather than only the first
+    Validation(Vec<FieldError>),
+    /// 409 for a title already used by another open todo, naming that todo
+    DuplicateTitle { title: String, existing_id: Uuid },
 }
 
 impl fmt::Display for ApiError {
@@ -24,6 +68,23 @@ impl fmt::Display for ApiError {
             ApiError::BadRequest(msg) => write!(f, "{}", msg),
             ApiError::InternalServerError(msg) => write!(f, "{}", msg),
             ApiError::Conflict(msg) => write!(f, "{}", msg),
+            ApiError::PayloadTooLarge(msg) => write!(f, "{}", msg),
+            ApiError::UnsupportedMediaType(msg) => write!(f, "{}", msg),
+            ApiError::Unauthorized(msg) => write!(f, "{}", msg),
+            ApiError::Forbidden(msg) => write!(f, "{}", msg),
+            ApiError::TooManyRequests(msg) => write!(f, "{}", msg),
+            ApiError::GatewayTimeout(msg) => write!(f, "{}", msg),
+            ApiError::ServiceUnavailable(msg) => write!(f, "{}", msg),
+            ApiError::Gone(msg) => write!(f, "{}", msg),
+            ApiError::NotAcceptable(msg) => write!(f, "{}", msg),
+            ApiError::MethodNotAllowed(msg) => write!(f, "{}", msg),
+            ApiError::Validation(fields) => {
+                let messages: Vec<&str> = fields.iter().map(|e| e.message.as_str()).collect();
+                write!(f, "{}", messages.join("; "))
+            }
+            ApiError::DuplicateTitle { title, .. } => {
+                write!(f, "An open todo titled '{}' already exists", title)
+            }
         }
     }
 }
@@ -35,6 +96,18 @@ impl ResponseError for ApiError {
             ApiError::BadRequest(_) => StatusCode::BAD_REQUEST,
             ApiError::InternalServerError(_) => StatusCode::INTERNAL_SERVER_ERROR,
             ApiError::Conflict(_) => StatusCode::CONFLICT,
+            ApiError::PayloadTooLarge(_) => StatusCode::PAYLOAD_TOO_LARGE,
+            ApiError::UnsupportedMediaType(_) => StatusCode::UNSUPPORTED_MEDIA_TYPE,
+            ApiError::Unauthorized(_) => StatusCode::UNAUTHORIZED,
+            ApiError::Forbidden(_) => StatusCode::FORBIDDEN,
+            ApiError::TooManyRequests(_) => StatusCode::TOO_MANY_REQUESTS,
+            ApiError::GatewayTimeout(_) => StatusCode::GATEWAY_TIMEOUT,
+            ApiError::ServiceUnavailable(_) => StatusCode::SERVICE_UNAVAILABLE,
+            ApiError::Gone(_) => StatusCode::GONE,
+            ApiError::NotAcceptable(_) => StatusCode::NOT_ACCEPTABLE,
+            ApiError::MethodNotAllowed(_) => StatusCode::METHOD_NOT_ALLOWED,
+            ApiError::Validation(_) => StatusCode::BAD_REQUEST,
+            ApiError::DuplicateTitle { .. } => StatusCode::CONFLICT,
         }
     }
 
@@ -44,24 +117,219 @@ impl ResponseError for ApiError {
             ApiError::BadRequest(_) => "BAD_REQUEST",
             ApiError::InternalServerError(_) => "INTERNAL_SERVER_ERROR",
             ApiError::Conflict(_) => "CONFLICT",
+            ApiError::PayloadTooLarge(_) => "PAYLOAD_TOO_LARGE",
+            ApiError::UnsupportedMediaType(_) => "UNSUPPORTED_MEDIA_TYPE",
+            ApiError::Unauthorized(_) => "UNAUTHORIZED",
+            ApiError::Forbidden(_) => "FORBIDDEN",
+            ApiError::TooManyRequests(_) => "TOO_MANY_REQUESTS",
+            ApiError::GatewayTimeout(_) => "TIMEOUT",
+            ApiError::ServiceUnavailable(_) => "SERVICE_UNAVAILABLE",
+            ApiError::Gone(_) => "GONE",
+            ApiError::NotAcceptable(_) => "NOT_ACCEPTABLE",
+            ApiError::MethodNotAllowed(_) => "METHOD_NOT_ALLOWED",
+            ApiError::Validation(_) => "BAD_REQUEST",
+            ApiError::DuplicateTitle { .. } => "CONFLICT",
         };
 
-        let response = ErrorResponse {
-            error: error_type.to_string(),
-            message: self.to_string(),
-        };
-
+        let mut response = error_body(error_type.to_string(), self.to_string());
+        match self {
+            ApiError::Validation(fields) => response.fields = fields.clone(),
+            ApiError::DuplicateTitle { existing_id, .. } => response.existing_id = Some(*existing_id),
+            _ => {}
+        }
         HttpResponse::build(self.status_code()).json(response)
     }
 }
 
+impl std::error::Error for ApiError {}
+
+fn error_body(error: String, message: String) -> ErrorResponse {
+    ErrorResponse {
+        error,
+        message,
+        request_id: current_request_id(),
+        fields: Vec::new(),
+        existing_id: None,
+    }
+}
+
+/// Build an ErrorResponse JSON body for the given status
+fn json_error(status: StatusCode, error: String, message: String) -> HttpResponse {
+    HttpResponse::build(status).json(error_body(error, message))
+}
+
+/// Error code for statuses that have no ApiError variant, e.g. "Method Not
+/// Allowed" becomes METHOD_NOT_ALLOWED
+fn error_type_for(status: StatusCode) -> String {
+    status
+        .canonical_reason()
+        .unwrap_or("Error")
+        .to_uppercase()
+        .replace(' ', "_")
+}
+
+/// Path extractor config reporting malformed path parameters as 400 ErrorResponse JSON
+pub fn path_config() -> web::PathConfig {
+    web::PathConfig::default()
+        .error_handler(|err, _req| ApiError::BadRequest(format!("Invalid path parameter: {}", err)).into())
+}
+
+/// Query extractor config reporting malformed query strings as 400 ErrorResponse JSON
+pub fn query_config() -> web::QueryConfig {
+    web::QueryConfig::default()
+        .error_handler(|err, _req| ApiError::BadRequest(format!("Invalid query string: {}", err)).into())
+}
+
+/// Rewrite error responses that were not produced by ApiError (unmatched routes,
+/// framework errors) into ErrorResponse JSON so clients always get the same shape
+fn render_json_error<B: MessageBody + 'static>(
+    res: ServiceResponse<B>,
+) -> actix_web::Result<ErrorHandlerResponse<B>> {
+    let is_json = res
+        .headers()
+        .get(CONTENT_TYPE)
+        .map(|v| v.as_bytes().starts_with(b"application/json"))
+        .unwrap_or(false);
+    if is_json {
+        return Ok(ErrorHandlerResponse::Response(res.map_into_left_body()));
+    }
+
+    let status = res.status();
+    let message = res
+        .response()
+        .error()
+        .map(|e| e.to_string())
+        .unwrap_or_else(|| status.canonical_reason().unwrap_or("Error").to_string());
+
+    let (req, _) = res.into_parts();
+    let body = json_error(status, error_type_for(status), message);
+    Ok(ErrorHandlerResponse::Response(
+        ServiceResponse::new(req, body).map_into_right_body(),
+    ))
+}
+
+pub fn json_error_handlers<B: MessageBody + 'static>() -> ErrorHandlers<B> {
+    ErrorHandlers::new().default_handler(render_json_error)
+}
+
 impl From<sqlx::Error> for ApiError {
     fn from(err: sqlx::Error) -> Self {
         match err {
             sqlx::Error::RowNotFound => {
                 ApiError::NotFound("Resource not found".to_string())
             }
+            sqlx::Error::PoolTimedOut => {
+                ApiError::GatewayTimeout("Timed out waiting for a database connection".to_string())
+            }
+            // query_canceled: the statement ran past DB_QUERY_TIMEOUT
+            sqlx::Error::Database(ref db) if db.code().as_deref() == Some("57014") => {
+                ApiError::GatewayTimeout("Database query timed out".to_string())
+            }
+            // SQLITE_BUSY and its extended codes: still locked after busy_timeout
+            sqlx::Error::Database(ref db)
+                if matches!(db.code().as_deref(), Some("5" | "261" | "517")) =>
+            {
+                ApiError::GatewayTimeout("Database is busy".to_string())
+            }
             _ => ApiError::InternalServerError(format!("Database error: {}", err)),
         }
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use actix_web::error::ResponseError;
+    use actix_web::http::header::{ALLOW, CONTENT_TYPE};
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+    use serde_json::Value;
+    use sqlx::error::{DatabaseError, ErrorKind};
+    use std::borrow::Cow;
+    use std::error::Error;
+    use std::fmt;
+
+    use super::ApiError;
+    use crate::testing;
+
+    /// A driver error carrying only a SQLSTATE or SQLite result code
+    #[derive(Debug)]
+    struct CodedError(&'static str);
+
+    impl fmt::Display for CodedError {
+        fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+            write!(f, "error {}", self.0)
+        }
+    }
+
+    impl Error for CodedError {}
+
+    impl DatabaseError for CodedError {
+        fn message(&self) -> &str {
+            "database error"
+        }
+
+        fn code(&self) -> Option<Cow<'_, str>> {
+            Some(Cow::Borrowed(self.0))
+        }
+
+        fn as_error(&self) -> &(dyn Error + Send + Sync + 'static) {
+            self
+        }
+
+        fn as_error_mut(&mut self) -> &mut (dyn Error + Send + Sync + 'static) {
+            self
+        }
+
+        fn into_error(self: Box<Self>) -> Box<dyn Error + Send + Sync + 'static> {
+            self
+        }
+
+        fn kind(&self) -> ErrorKind {
+            ErrorKind::Other
+        }
+    }
+
+    fn status_for(code: &'static str) -> StatusCode {
+        ApiError::from(sqlx::Error::Database(Box::new(CodedError(code)))).status_code()
+    }
+
+    #[test]
+    fn timeouts_and_busy_databases_are_gateway_timeouts() {
+        // query_canceled, raised once statement_timeout (DB_QUERY_TIMEOUT) passes
+        assert_eq!(status_for("57014"), StatusCode::GATEWAY_TIMEOUT);
+        let err = ApiError::from(sqlx::Error::Database(Box::new(CodedError("57014"))));
+        assert_eq!(err.to_string(), "Database query timed out");
+
+        for busy in ["5", "261", "517"] {
+            assert_eq!(status_for(busy), StatusCode::GATEWAY_TIMEOUT);
+        }
+        assert_eq!(ApiError::from(sqlx::Error::PoolTimedOut).status_code(), StatusCode::GATEWAY_TIMEOUT);
+        assert_eq!(status_for("23505"), StatusCode::INTERNAL_SERVER_ERROR);
+        assert_eq!(ApiError::from(sqlx::Error::RowNotFound).status_code(), StatusCode::NOT_FOUND);
+    }
+
+    #[actix_web::test]
+    async fn router_errors_are_json() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+
+        let cases = [
+            (TestRequest::get().uri("/no/such/route"), StatusCode::NOT_FOUND, "NOT_FOUND"),
+            (TestRequest::post().uri("/no/such/route"), StatusCode::NOT_FOUND, "NOT_FOUND"),
+            (TestRequest::delete().uri("/api/no/such/route"), StatusCode::NOT_FOUND, "NOT_FOUND"),
+            (TestRequest::patch().uri("/health"), StatusCode::METHOD_NOT_ALLOWED, "METHOD_NOT_ALLOWED"),
+            (TestRequest::get().uri("/api/todos/not-a-uuid"), StatusCode::BAD_REQUEST, "BAD_REQUEST"),
+        ];
+        for (req, status, error) in cases {
+            let res = test::call_service(&app, req.to_request()).await;
+            assert_eq!(res.status(), status);
+            assert_eq!(res.headers().get(CONTENT_TYPE).unwrap(), "application/json");
+            if status == StatusCode::METHOD_NOT_ALLOWED {
+                assert_eq!(res.headers().get(ALLOW).unwrap(), "GET, OPTIONS");
+            }
+            let body: Value = test::read_body_json(res).await;
+            assert_eq!(body["error"], error);
+            assert!(body["message"].as_str().is_some_and(|m| !m.is_empty()));
+        }
+    }
+}
@@ -0,0 +1,93 @@
+use serde::Serialize;
+use tokio::sync::broadcast;
+use uuid::Uuid;
+
+use crate::models::{Todo, TodoResponse};
+
+/// Events buffered per subscriber before a slow client starts missing them
+const BROKER_CAPACITY: usize = 256;
+
+#[derive(Debug, Clone, Copy, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum EventKind {
+    Created,
+    Updated,
+    Deleted,
+}
+
+/// A change to a todo, sent to subscribers as a JSON frame
+#[derive(Debug, Clone, Serialize)]
+pub struct TodoEvent {
+    #[serde(rename = "type")]
+    pub kind: EventKind,
+    pub id: Uuid,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub todo: Option<TodoResponse>,
+    /// The todo as of this event, kept for deletions too so webhooks can send it
+    #[serde(skip)]
+    pub snapshot: TodoResponse,
+    /// Owner and list of the todo, used to decide who may receive the event
+    #[serde(skip)]
+    pub user_id: Option<Uuid>,
+    #[serde(skip)]
+    pub list_id: Option<Uuid>,
+}
+
+impl TodoEvent {
+    fn new(kind: EventKind, todo: &Todo, include_todo: bool) -> Self {
+        let snapshot = TodoResponse::from(todo.clone());
+        TodoEvent {
+            kind,
+            id: todo.id,
+            todo: include_todo.then(|| snapshot.clone()),
+            snapshot,
+            user_id: todo.user_id,
+            list_id: todo.list_id,
+        }
+    }
+
+    pub fn created(todo: &Todo) -> Self {
+        TodoEvent::new(EventKind::Created, todo, true)
+    }
+
+    pub fn updated(todo: &Todo) -> Self {
+        TodoEvent::new(EventKind::Updated, todo, true)
+    }
+
+    pub fn deleted(todo: &Todo) -> Self {
+        TodoEvent::new(EventKind::Deleted, todo, false)
+    }
+}
+
+/// In-process fan-out of todo events. Each subscriber holds its own receiver,
+/// so a disconnected client is pruned simply by dropping it.
+#[derive(Clone)]
+pub struct Broker {
+    tx: broadcast::Sender<TodoEvent>,
+}
+
+impl Broker {
+    pub fn new() -> Self {
+        let (tx, _) = broadcast::channel(BROKER_CAPACITY);
+        Broker { tx }
+    }
+
+    /// Send an event to every current subscriber; a no-op when nobody listens
+    pub fn publish(&self, event: TodoEvent) {
+        let _ = self.tx.send(event);
+    }
+
+    pub fn subscribe(&self) -> broadcast::Receiver<TodoEvent> {
+        self.tx.subscribe()
+    }
+
+    pub fn subscribers(&self) -> usize {
+        self.tx.receiver_count()
+    }
+}
+
+impl Default for Broker {
+    fn default() -> Self {
+        Broker::new()
+    }
+}
@@ -0,0 +1,123 @@
+use uuid::Uuid;
+
+use crate::auth::AuthUser;
+use crate::error::ApiError;
+use crate::models::{Role, Todo};
+use crate::repository::{todo_not_found, ListRepository, TodoRepository};
+
+fn forbidden(required: Role) -> ApiError {
+    ApiError::Forbidden(format!("This action requires the {} role", required.as_str()))
+}
+
+/// Load a todo the caller has at least `required` access to. Todos the caller
+/// cannot see at all are reported as not found.
+pub(crate) async fn authorize_todo(
+    todos: &dyn TodoRepository,
+    user: AuthUser,
+    id: Uuid,
+    required: Role,
+) -> Result<Todo, ApiError> {
+    let (todo, role) = todos
+        .find(user, id)
+        .await?
+        .ok_or_else(|| todo_not_found(id))?;
+
+    if role < required {
+        return Err(forbidden(required));
+    }
+    Ok(todo)
+}
+
+/// Check the caller has at least `required` access to a list and return their role
+pub(crate) async fn authorize_list(
+    lists: &dyn ListRepository,
+    user: AuthUser,
+    list_id: Uuid,
+    required: Role,
+) -> Result<Role, ApiError> {
+    let role = lists
+        .role(user, list_id)
+        .await?
+        .ok_or_else(|| ApiError::NotFound(format!("List with id {} not found", list_id)))?;
+
+    if role < required {
+        return Err(forbidden(required));
+    }
+    Ok(role)
+}
+
+/// Lists belong to user accounts, so they are unavailable in single-user mode
+pub(crate) fn require_account(user: AuthUser) -> Result<Uuid, ApiError> {
+    user.user_id.ok_or_else(|| {
+        ApiError::Unauthorized("Lists require user accounts; set JWT_SECRET to enable them".to_string())
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+    use serde_json::{json, Value};
+
+    use crate::testing;
+
+    #[actix_web::test]
+    async fn list_roles_grant_what_they_name() {
+        let config = testing::config(&[("JWT_SECRET", "test-secret")]);
+        let repositories = testing::repositories();
+        let mut tokens = Vec::new();
+        for name in ["owner", "editor", "viewer", "outsider"] {
+            let user = repositories.users.create(name, "not-a-hash").await.unwrap();
+            tokens.push((name, config.jwt_auth.issue(user.id).unwrap().0));
+        }
+        let owner = tokens[0].1.clone();
+        let guest = repositories.users.create("guest", "not-a-hash").await.unwrap();
+        let app = test::init_service(testing::app(config, &repositories)).await;
+
+        let req = testing::bearer(TestRequest::post().uri("/api/lists"), &owner).set_json(json!({"name": "Shared"}));
+        let list: Value = test::call_and_read_body_json(&app, req.to_request()).await;
+        let list_id = list["id"].as_str().unwrap();
+        let share_uri = format!("/api/lists/{}/share", list_id);
+        let guest_uri = format!("/api/lists/{}/members/{}", list_id, guest.id);
+        for role in ["editor", "viewer"] {
+            let req = testing::bearer(TestRequest::post().uri(&share_uri), &owner)
+                .set_json(json!({"username": role, "role": role}));
+            assert_eq!(test::call_service(&app, req.to_request()).await.status(), StatusCode::OK);
+        }
+
+        use actix_web::http::StatusCode as S;
+        // Expected statuses for reading and updating a todo in the list, adding
+        // one to it, sharing the list, revoking a member and deleting the todo
+        let matrix = [
+            ("owner", [S::OK, S::OK, S::CREATED, S::OK, S::NO_CONTENT, S::OK]),
+            ("editor", [S::OK, S::OK, S::CREATED, S::FORBIDDEN, S::FORBIDDEN, S::OK]),
+            ("viewer", [S::OK, S::FORBIDDEN, S::FORBIDDEN, S::FORBIDDEN, S::FORBIDDEN, S::FORBIDDEN]),
+            ("outsider", [S::NOT_FOUND, S::NOT_FOUND, S::NOT_FOUND, S::NOT_FOUND, S::NOT_FOUND, S::NOT_FOUND]),
+        ];
+        for ((name, token), (role, expected)) in tokens.iter().zip(matrix) {
+            assert_eq!(*name, role);
+            let req = testing::bearer(TestRequest::post().uri("/api/todos"), &owner)
+                .set_json(json!({"title": format!("For the {}", role), "list_id": list_id}));
+            let todo: Value = test::call_and_read_body_json(&app, req.to_request()).await;
+            let uri = format!("/api/todos/{}", todo["id"].as_str().unwrap());
+            // Give the guest access again, so revoking has a member to remove
+            let req = testing::bearer(TestRequest::post().uri(&share_uri), &owner)
+                .set_json(json!({"username": "guest", "role": "viewer"}));
+            assert_eq!(test::call_service(&app, req.to_request()).await.status(), StatusCode::OK);
+
+            let requests = [
+                TestRequest::get().uri(&uri),
+                TestRequest::put().uri(&uri).set_json(json!({"title": "Changed"})),
+                TestRequest::post().uri("/api/todos").set_json(json!({"title": "Added", "list_id": list_id})),
+                TestRequest::post().uri(&share_uri).set_json(json!({"username": "guest", "role": "editor"})),
+                TestRequest::delete().uri(&guest_uri),
+                TestRequest::delete().uri(&uri),
+            ];
+            for (req, expected) in requests.into_iter().zip(expected) {
+                let res = test::call_service(&app, testing::bearer(req, token).to_request()).await;
+                let request = res.request();
+                assert_eq!(res.status(), expected, "{} {} {}", role, request.method(), request.path());
+            }
+        }
+    }
+}
@@ -0,0 +1,126 @@
+use actix_web::{web, HttpRequest, HttpResponse};
+use chrono::{DateTime, Utc};
+use log::LevelFilter;
+use std::str::FromStr;
+
+use crate::auth::JwtAuth;
+use crate::debug::Profiling;
+use crate::error::ApiError;
+use crate::logging;
+use crate::middleware::{ApiKeyAuth, ConcurrencyLimit, RateLimiter, ReadOnly};
+use crate::models::{AdminStatus, Features, LogLevelRequest, LogLevelResponse, RateLimitStatus, RuntimeStats};
+use crate::repository::{HealthRepository, TodoCache};
+use crate::version::{GIT_COMMIT, VERSION};
+
+use super::docs::Docs;
+
+/// When the server started, for the uptime in GET /api/admin/status
+#[derive(Debug, Clone, Copy)]
+pub struct StartedAt(pub DateTime<Utc>);
+
+/// Snapshot of the runtime settings operators can inspect without a redeploy:
+/// log level, rate limiting, optional features, the database pool and the
+/// todo cache
+pub async fn admin_status(
+    req: HttpRequest,
+    started_at: web::Data<StartedAt>,
+    health: web::Data<dyn HealthRepository>,
+    api_key_auth: web::Data<ApiKeyAuth>,
+    jwt_auth: web::Data<JwtAuth>,
+    rate_limiter: Option<web::Data<RateLimiter>>,
+    concurrency_limit: Option<web::Data<ConcurrencyLimit>>,
+    cache: Option<web::Data<TodoCache>>,
+) -> HttpResponse {
+    let started_at = started_at.0;
+    HttpResponse::Ok().json(AdminStatus {
+        version: VERSION,
+        commit: GIT_COMMIT,
+        started_at,
+        uptime_secs: (Utc::now() - started_at).num_seconds(),
+        log_level: logging::level().to_string().to_lowercase(),
+        read_only: req.app_data::<ReadOnly>().is_some_and(|r| r.0),
+        features: Features {
+            pprof: req.app_data::<Profiling>().is_some_and(Profiling::enabled),
+            docs: req.app_data::<Docs>().is_some_and(|d| d.0),
+            api_key_auth: api_key_auth.enabled(),
+            jwt_auth: jwt_auth.enabled(),
+        },
+        rate_limit: rate_limiter.map(|limiter| RateLimitStatus {
+            requests_per_second: limiter.rate(),
+            burst: limiter.burst(),
+        }),
+        max_concurrent_requests: concurrency_limit.map(|limit| limit.max()),
+        database: health.pool_stats().await.ok(),
+        cache: cache.map(|cache| cache.stats()),
+        runtime: RuntimeStats {
+            pid: std::process::id(),
+            cpus: std::thread::available_parallelism().map(|n| n.get()).unwrap_or(1),
+        },
+    })
+}
+
+/// Change the log level until the next restart, e.g. to `debug` while
+/// investigating a problem. LOG_LEVEL applies again after a restart.
+pub async fn set_log_level(req: web::Json<LogLevelRequest>) -> Result<HttpResponse, ApiError> {
+    let level = LevelFilter::from_str(req.level.trim()).map_err(|_| {
+        ApiError::BadRequest(format!(
+            "level must be one of off, error, warn, info, debug or trace, got '{}'",
+            req.level
+        ))
+    })?;
+
+    let previous = logging::level();
+    logging::set_level(level);
+    // Logged at warn so the change shows up at every level but off
+    log::warn!(previous = previous.as_str(), level = level.as_str(); "log level changed");
+
+    Ok(HttpResponse::Ok().json(LogLevelResponse {
+        level: level.to_string().to_lowercase(),
+        previous: previous.to_string().to_lowercase(),
+    }))
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+    use serde_json::{json, Value};
+
+    use crate::logging;
+    use crate::middleware::admin::ADMIN_TOKEN_HEADER;
+    use crate::testing;
+
+    #[actix_web::test]
+    async fn log_level_change_shows_in_the_status() {
+        let _lock = logging::LEVEL_LOCK.lock().unwrap_or_else(|e| e.into_inner());
+        let original = logging::level();
+        let config = testing::config(&[("ADMIN_TOKEN", "admin-secret")]);
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(config, &repositories)).await;
+        let set = |level: &str| {
+            TestRequest::put()
+                .uri("/api/admin/loglevel")
+                .insert_header((ADMIN_TOKEN_HEADER, "admin-secret"))
+                .set_json(json!({ "level": level }))
+                .to_request()
+        };
+        let status = || TestRequest::get().uri("/api/admin/status").insert_header((ADMIN_TOKEN_HEADER, "admin-secret"));
+
+        let changed: Value = test::call_and_read_body_json(&app, set("debug")).await;
+        assert_eq!(changed["level"], "debug");
+        let body: Value = test::call_and_read_body_json(&app, status().to_request()).await;
+        assert_eq!(body["log_level"], "debug");
+
+        let changed: Value = test::call_and_read_body_json(&app, set(" TRACE ")).await;
+        assert_eq!((&changed["level"], &changed["previous"]), (&json!("trace"), &json!("debug")));
+        let body: Value = test::call_and_read_body_json(&app, status().to_request()).await;
+        assert_eq!(body["log_level"], "trace");
+
+        let res = test::call_service(&app, set("loud")).await;
+        assert_eq!(res.status(), StatusCode::BAD_REQUEST);
+        let body: Value = test::call_and_read_body_json(&app, status().to_request()).await;
+        assert_eq!(body["log_level"], "trace");
+
+        logging::set_level(original);
+    }
+}
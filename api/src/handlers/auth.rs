@@ -0,0 +1,130 @@
+use actix_web::{web, HttpResponse};
+
+use crate::auth::JwtAuth;
+use crate::error::ApiError;
+use crate::models::{AuthResponse, LoginRequest, RegisterRequest, User};
+use crate::repository::UserRepository;
+
+const MIN_PASSWORD_LEN: usize = 8;
+
+/// bcrypt hash, at the default cost, of a password no account has. Checked
+/// when the username is unknown so that takes as long as a wrong password.
+const DUMMY_HASH: &str = "$2b$12$rUBIJIjJN.kWNvnVRNmljuUff1ZyWkBfonaW4u56asZv6Z3BTDefW";
+
+fn auth_response(jwt: &JwtAuth, user: User) -> Result<AuthResponse, ApiError> {
+    let (token, expires_in) = jwt.issue(user.id)?;
+    Ok(AuthResponse {
+        token,
+        token_type: "Bearer".to_string(),
+        expires_in,
+        user: user.into(),
+    })
+}
+
+/// Create a user account and return a token for it
+pub async fn register(
+    users: web::Data<dyn UserRepository>,
+    jwt: web::Data<JwtAuth>,
+    req: web::Json<RegisterRequest>,
+) -> Result<HttpResponse, ApiError> {
+    // Without tokens the account could never be used, so refuse before creating it
+    jwt.require_enabled()?;
+
+    let req = req.into_inner();
+    let username = req.username.trim().to_string();
+
+    if username.is_empty() {
+        return Err(ApiError::BadRequest("Username cannot be empty".to_string()));
+    }
+    if req.password.chars().count() < MIN_PASSWORD_LEN {
+        return Err(ApiError::BadRequest(format!(
+            "Password must be at least {} characters",
+            MIN_PASSWORD_LEN
+        )));
+    }
+
+    // bcrypt is deliberately slow; keep it off the async workers
+    let password = req.password;
+    let password_hash = web::block(move || bcrypt::hash(password, bcrypt::DEFAULT_COST))
+        .await
+        .map_err(|e| ApiError::InternalServerError(format!("Failed to hash password: {}", e)))?
+        .map_err(|e| ApiError::InternalServerError(format!("Failed to hash password: {}", e)))?;
+
+    let user = users.create(&username, &password_hash).await?;
+
+    Ok(HttpResponse::Created().json(auth_response(&jwt, user)?))
+}
+
+/// Exchange a username and password for a token
+pub async fn login(
+    users: web::Data<dyn UserRepository>,
+    jwt: web::Data<JwtAuth>,
+    req: web::Json<LoginRequest>,
+) -> Result<HttpResponse, ApiError> {
+    let req = req.into_inner();
+    let invalid = || ApiError::Unauthorized("Invalid username or password".to_string());
+
+    let user = users.find_by_username(req.username.trim()).await?;
+
+    let password = req.password;
+    let hash = user.as_ref().map_or(DUMMY_HASH.to_string(), |user| user.password_hash.clone());
+    let valid = web::block(move || bcrypt::verify(password, &hash))
+        .await
+        .map_err(|e| ApiError::InternalServerError(format!("Failed to verify password: {}", e)))?
+        .unwrap_or(false);
+
+    match user {
+        Some(user) if valid => Ok(HttpResponse::Ok().json(auth_response(&jwt, user)?)),
+        _ => Err(invalid()),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+    use serde_json::json;
+
+    use super::DUMMY_HASH;
+    use crate::testing;
+
+    #[actix_web::test]
+    async fn register_without_jwt_creates_no_account() {
+        let repositories = testing::repositories();
+        let account = json!({"username": "alice", "password": "correct horse"});
+
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let req = TestRequest::post().uri("/api/auth/register").set_json(&account).to_request();
+        assert_eq!(test::call_service(&app, req).await.status(), StatusCode::BAD_REQUEST);
+
+        // A retry once JWT is on is not refused as a taken username
+        let config = testing::config(&[("JWT_SECRET", "test-secret")]);
+        let app = test::init_service(testing::app(config, &repositories)).await;
+        let req = TestRequest::post().uri("/api/auth/register").set_json(&account).to_request();
+        assert_eq!(test::call_service(&app, req).await.status(), StatusCode::CREATED);
+    }
+
+    #[actix_web::test]
+    async fn unknown_usernames_are_refused_like_wrong_passwords() {
+        assert!(bcrypt::verify("", DUMMY_HASH).is_ok());
+
+        let repositories = testing::repositories();
+        let config = testing::config(&[("JWT_SECRET", "test-secret")]);
+        let app = test::init_service(testing::app(config, &repositories)).await;
+        let account = json!({"username": "alice", "password": "correct horse"});
+        let req = TestRequest::post().uri("/api/auth/register").set_json(&account).to_request();
+        assert_eq!(test::call_service(&app, req).await.status(), StatusCode::CREATED);
+
+        let attempts = [
+            json!({"username": "alice", "password": "wrong horse"}),
+            json!({"username": "bob", "password": "correct horse"}),
+        ];
+        for attempt in attempts {
+            let req = TestRequest::post().uri("/api/auth/login").set_json(&attempt).to_request();
+            let res = test::call_service(&app, req).await;
+            assert_eq!(res.status(), StatusCode::UNAUTHORIZED, "{}", attempt);
+            let body: serde_json::Value = test::read_body_json(res).await;
+            assert_eq!(body["message"], "Invalid username or password");
+        }
+    }
+}
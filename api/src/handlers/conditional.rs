@@ -0,0 +1,65 @@
+use actix_web::http::header::{Header, HttpDate, IfModifiedSince, LastModified};
+use actix_web::{HttpRequest, HttpResponse};
+use chrono::{DateTime, Utc};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+/// `Last-Modified` header for a timestamp. HTTP dates only carry whole seconds.
+pub(crate) fn last_modified(ts: DateTime<Utc>) -> LastModified {
+    let secs = ts.timestamp().max(0) as u64;
+    LastModified(HttpDate::from(UNIX_EPOCH + Duration::from_secs(secs)))
+}
+
+/// 304 Not Modified when the request's If-Modified-Since is at or after
+/// `modified`. A missing or unparsable header never matches.
+pub(crate) fn not_modified(req: &HttpRequest, modified: DateTime<Utc>) -> Option<HttpResponse> {
+    let IfModifiedSince(since) = IfModifiedSince::parse(req).ok()?;
+    let since = SystemTime::from(since).duration_since(UNIX_EPOCH).ok()?.as_secs() as i64;
+
+    (modified.timestamp() <= since).then(|| {
+        HttpResponse::NotModified()
+            .insert_header(last_modified(modified))
+            .finish()
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::{header, StatusCode};
+    use actix_web::test::{self, TestRequest};
+    use serde_json::{json, Value};
+    use std::time::Duration;
+
+    use crate::testing;
+
+    #[actix_web::test]
+    async fn unchanged_todos_are_not_sent_again() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let req = TestRequest::post().uri("/api/todos").set_json(json!({"title": "Cache me"})).to_request();
+        let created: Value = test::call_and_read_body_json(&app, req).await;
+        let uri = format!("/api/todos/{}", created["id"].as_str().unwrap());
+
+        let res = test::call_service(&app, TestRequest::get().uri(&uri).to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+        let modified = res.headers().get(header::LAST_MODIFIED).unwrap().clone();
+
+        for uri in [uri.as_str(), "/api/todos"] {
+            let req = TestRequest::get().uri(uri).insert_header((header::IF_MODIFIED_SINCE, modified.clone()));
+            let res = test::call_service(&app, req.to_request()).await;
+            assert_eq!(res.status(), StatusCode::NOT_MODIFIED, "{}", uri);
+            assert_eq!(res.headers().get(header::LAST_MODIFIED), Some(&modified));
+        }
+        let long_ago = (header::IF_MODIFIED_SINCE, "Mon, 01 Jan 2001 00:00:00 GMT");
+        let req = TestRequest::get().uri(&uri).insert_header(long_ago);
+        assert_eq!(test::call_service(&app, req.to_request()).await.status(), StatusCode::OK);
+
+        // HTTP dates carry whole seconds, so change the todo in a later one
+        actix_web::rt::time::sleep(Duration::from_millis(1100)).await;
+        let req = TestRequest::put().uri(&uri).set_json(json!({"title": "Cache me again", "version": 1})).to_request();
+        assert_eq!(test::call_service(&app, req).await.status(), StatusCode::OK);
+        let req = TestRequest::get().uri(&uri).insert_header((header::IF_MODIFIED_SINCE, modified.clone()));
+        let res = test::call_service(&app, req.to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+        assert_ne!(res.headers().get(header::LAST_MODIFIED), Some(&modified));
+    }
+}
@@ -0,0 +1,178 @@
+use actix_web::HttpResponse;
+use serde_json::{json, Value};
+use std::collections::BTreeSet;
+
+use crate::config::flag;
+use crate::models::{Todo, TodoResponse};
+
+/// OpenAPI 3 description of the API, compiled into the binary
+const OPENAPI_SPEC: &str = include_str!("../../openapi.json");
+
+/// Swagger UI page rendering the spec from `/openapi.json`
+const SWAGGER_UI: &str = r#"<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8" />
+  <title>TODO App API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css" />
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+"#;
+
+/// Whether the Swagger UI is served at /docs; on unless ENABLE_DOCS turns it off
+#[derive(Debug, Clone, Copy)]
+pub struct Docs(pub bool);
+
+impl Docs {
+    pub fn from_env() -> Result<Self, String> {
+        flag("ENABLE_DOCS", true).map(Docs)
+    }
+}
+
+/// Check that the spec's `Todo` schema has exactly the fields a serialized
+/// `TodoResponse` has, so the document cannot silently drift from the model.
+/// Run once at startup.
+pub fn check_spec() -> Result<(), String> {
+    let spec: Value = serde_json::from_str(OPENAPI_SPEC)
+        .map_err(|e| format!("openapi.json is not valid JSON: {}", e))?;
+    let documented: BTreeSet<String> = spec
+        .pointer("/components/schemas/Todo/properties")
+        .and_then(Value::as_object)
+        .ok_or("openapi.json has no Todo schema")?
+        .keys()
+        .cloned()
+        .collect();
+
+    let sample: Todo = serde_json::from_value(json!({
+        "id": "00000000-0000-0000-0000-000000000000",
+        "title": "",
+        "completed": false,
+        "version": 1,
+        "tags": [],
+        "user_id": null,
+        "list_id": null,
+        "parent_id": null,
+        "due_date": null,
+        "recurrence": "none",
+        "created_at": "1970-01-01T00:00:00Z",
+        "updated_at": "1970-01-01T00:00:00Z",
+    }))
+    .map_err(|e| format!("Failed to build a sample todo: {}", e))?;
+    let mut response = TodoResponse::from(sample);
+    // Optional fields are skipped when empty; fill them so they are compared too
+    response.description = Some(String::new());
+    response.next_occurrence_id = Some(response.id);
+    response.description_truncated = true;
+    let serialized: BTreeSet<String> = serde_json::to_value(response)
+        .map_err(|e| format!("Failed to encode a sample todo: {}", e))?
+        .as_object()
+        .map(|fields| fields.keys().cloned().collect())
+        .unwrap_or_default();
+
+    if documented != serialized {
+        let missing: Vec<&String> = serialized.difference(&documented).collect();
+        let extra: Vec<&String> = documented.difference(&serialized).collect();
+        return Err(format!(
+            "openapi.json Todo schema is out of date: missing {:?}, not in TodoResponse {:?}",
+            missing, extra
+        ));
+    }
+    Ok(())
+}
+
+/// Serve the OpenAPI spec; always public
+pub async fn openapi_spec() -> HttpResponse {
+    HttpResponse::Ok()
+        .content_type("application/json")
+        .body(OPENAPI_SPEC)
+}
+
+/// Serve the Swagger UI; public unless disabled with ENABLE_DOCS=false
+pub async fn swagger_ui() -> HttpResponse {
+    HttpResponse::Ok()
+        .content_type("text/html; charset=utf-8")
+        .body(SWAGGER_UI)
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::test::{self, TestRequest};
+    use chrono::DateTime;
+    use serde_json::{json, Value};
+    use uuid::Uuid;
+
+    use super::check_spec;
+    use crate::testing;
+
+    #[test]
+    fn spec_matches_the_todo_model() {
+        assert_eq!(check_spec(), Ok(()));
+    }
+
+    /// Whether `value` is allowed by the property `schema` of `spec`
+    fn conforms(spec: &Value, schema: &Value, value: &Value) -> bool {
+        if let Some(reference) = schema["$ref"].as_str() {
+            let target = spec.pointer(reference.trim_start_matches('#')).unwrap();
+            return conforms(spec, target, value);
+        }
+        if value.is_null() {
+            return schema["nullable"] == true;
+        }
+        if let Some(allowed) = schema["enum"].as_array() {
+            return allowed.contains(value);
+        }
+        match (schema["type"].as_str(), value) {
+            (Some("string"), Value::String(s)) => match schema["format"].as_str() {
+                Some("uuid") => Uuid::parse_str(s).is_ok(),
+                Some("date-time") => DateTime::parse_from_rfc3339(s).is_ok(),
+                _ => true,
+            },
+            (Some("boolean"), Value::Bool(_)) => true,
+            (Some("integer"), Value::Number(n)) => n.is_i64(),
+            (Some("array"), Value::Array(items)) => items.iter().all(|item| conforms(spec, &schema["items"], item)),
+            _ => false,
+        }
+    }
+
+    #[actix_web::test]
+    async fn served_todos_round_trip_through_the_schema() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let get = |uri: &str| TestRequest::get().uri(uri).to_request();
+        let spec: Value = test::call_and_read_body_json(&app, get("/api/openapi.json")).await;
+        let public: Value = test::call_and_read_body_json(&app, get("/openapi.json")).await;
+        assert_eq!(spec, public);
+        let schema = &spec["components"]["schemas"]["Todo"];
+
+        let req = TestRequest::post().uri("/api/todos").set_json(json!({
+            "title": "Water plants",
+            "description": "Balcony too",
+            "tags": ["home"],
+            "due_date": "2030-01-02T09:00:00.000Z",
+            "recurrence": "weekly",
+        }));
+        let created: Value = test::call_and_read_body_json(&app, req.to_request()).await;
+        let uri = format!("/api/todos/{}/complete", created["id"].as_str().unwrap());
+        let completed: Value = test::call_and_read_body_json(&app, TestRequest::post().uri(&uri).to_request()).await;
+
+        for todo in [&created, &completed] {
+            let fields = todo.as_object().unwrap();
+            for (field, value) in fields {
+                let property = &schema["properties"][field];
+                assert!(property.is_object(), "{} is not documented", field);
+                assert!(conforms(&spec, property, value), "{} = {} does not match {}", field, value, property);
+            }
+            for required in schema["required"].as_array().unwrap() {
+                assert!(fields.contains_key(required.as_str().unwrap()), "{} is missing", required);
+            }
+        }
+        assert!(completed.get("next_occurrence_id").is_some());
+    }
+}
@@ -0,0 +1,258 @@
+use actix_web::http::header::{ContentDisposition, DispositionParam, DispositionType, ACCEPT};
+use actix_web::{web, HttpRequest, HttpResponse};
+use actix_web::web::Bytes;
+use chrono::Utc;
+use futures_util::{stream, Stream, StreamExt};
+use serde::Deserialize;
+use tokio::sync::mpsc;
+
+use crate::auth::AuthUser;
+use crate::error::ApiError;
+use crate::models::{timestamp, Todo, TodoResponse};
+use crate::repository::TodoRepository;
+use super::fields::todo_value;
+use super::xml;
+
+/// Column layout shared by CSV export and import
+pub(crate) const CSV_COLUMNS: [&str; 6] =
+    ["id", "title", "description", "completed", "created_at", "updated_at"];
+
+const CSV_HEADER: &str = "id,title,description,completed,created_at,updated_at\r\n";
+
+/// Number of encoded rows buffered between the database and the client
+const EXPORT_BUFFER_ROWS: usize = 64;
+
+/// Quote a CSV field when it contains a delimiter, quote or line break
+fn csv_field(value: &str) -> String {
+    if value.contains([',', '"', '\r', '\n']) {
+        format!("\"{}\"", value.replace('"', "\"\""))
+    } else {
+        value.to_string()
+    }
+}
+
+/// One row, with timestamps formatted exactly as JSON renders them
+fn csv_row(todo: &Todo) -> String {
+    format!(
+        "{},{},{},{},{},{}\r\n",
+        todo.id,
+        csv_field(&todo.title),
+        csv_field(todo.description.as_deref().unwrap_or("")),
+        todo.completed,
+        timestamp::format(&todo.created_at),
+        timestamp::format(&todo.updated_at),
+    )
+}
+
+/// A CSV document of `todos`, one chunk per row after the header
+pub(crate) fn csv_stream(todos: Vec<Todo>) -> impl Stream<Item = Result<Bytes, ApiError>> {
+    let header = Bytes::from_static(CSV_HEADER.as_bytes());
+    let rows = todos.into_iter().map(|todo| Bytes::from(csv_row(&todo)));
+    stream::iter(std::iter::once(header).chain(rows).map(Ok))
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum ExportFormat {
+    #[default]
+    Csv,
+    Json,
+    Xml,
+}
+
+impl ExportFormat {
+    /// The format the request's Accept header prefers. No header means JSON;
+    /// a header that accepts none of JSON, CSV or XML is 406 Not Acceptable. Among
+    /// equally weighted media ranges the exact one beats a wildcard, and then
+    /// the first listed wins. CSV and XML are only chosen over an acceptable
+    /// JSON when the client ranks them first: a browser asking for HTML with
+    /// XML as a fallback gets JSON.
+    pub(crate) fn negotiate(req: &HttpRequest) -> Result<Self, ApiError> {
+        let accept = match req.headers().get(ACCEPT).map(|v| v.to_str()) {
+            None => return Ok(ExportFormat::Json),
+            Some(Ok(accept)) if accept.trim().is_empty() => return Ok(ExportFormat::Json),
+            Some(Ok(accept)) => accept,
+            Some(Err(_)) => "",
+        };
+
+        let mut best: Option<((f32, bool), ExportFormat)> = None;
+        let mut top_quality = 0.0;
+        let mut json_acceptable = false;
+        for range in accept.split(',') {
+            let mut params = range.split(';');
+            let media = params.next().unwrap_or("").trim().to_ascii_lowercase();
+            let quality = params
+                .find_map(|p| p.trim().strip_prefix("q="))
+                .map_or(Some(1.0), |q| q.trim().parse::<f32>().ok())
+                .unwrap_or(0.0);
+            top_quality = f32::max(top_quality, quality);
+            let format = match media.as_str() {
+                "application/json" | "application/*" | "*/*" => ExportFormat::Json,
+                "text/csv" | "text/*" => ExportFormat::Csv,
+                "application/xml" | "text/xml" => ExportFormat::Xml,
+                _ => continue,
+            };
+            let rank = (quality, !media.contains('*'));
+            json_acceptable |= format == ExportFormat::Json && quality > 0.0;
+            if quality > 0.0 && best.map_or(true, |(best, _)| rank > best) {
+                best = Some((rank, format));
+            }
+        }
+        // Below the client's first choice, another format only beats JSON when JSON is not acceptable
+        if let Some(((quality, _), format)) = best {
+            if format != ExportFormat::Json && quality < top_quality && json_acceptable {
+                return Ok(ExportFormat::Json);
+            }
+        }
+        best.map(|(_, format)| format).ok_or_else(|| {
+            ApiError::NotAcceptable(
+                "Accept must allow application/json, text/csv or application/xml".to_string(),
+            )
+        })
+    }
+
+    pub(crate) fn content_type(&self) -> &'static str {
+        match self {
+            ExportFormat::Csv => "text/csv; charset=utf-8",
+            ExportFormat::Json => "application/json",
+            ExportFormat::Xml => "application/xml; charset=utf-8",
+        }
+    }
+
+    fn extension(&self) -> &'static str {
+        match self {
+            ExportFormat::Csv => "csv",
+            ExportFormat::Json => "json",
+            ExportFormat::Xml => "xml",
+        }
+    }
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ExportQuery {
+    #[serde(default)]
+    pub format: ExportFormat,
+}
+
+fn json_row(todo: Todo) -> Result<Bytes, ApiError> {
+    serde_json::to_vec(&TodoResponse::from(todo))
+        .map(Bytes::from)
+        .map_err(|e| ApiError::InternalServerError(format!("Failed to encode todo: {}", e)))
+}
+
+fn xml_row(todo: Todo) -> Result<Bytes, ApiError> {
+    let mut row = String::new();
+    xml::element("todo", &todo_value(&TodoResponse::from(todo))?, &mut row);
+    Ok(Bytes::from(row))
+}
+
+/// Export every todo the caller can see as CSV (the default), a JSON array or
+/// an XML document, streaming rows to the client as they are read
+pub async fn export_todos(
+    todos: web::Data<dyn TodoRepository>,
+    user: AuthUser,
+    query: web::Query<ExportQuery>,
+) -> HttpResponse {
+    let format = query.format;
+    let (tx, rx) = mpsc::channel::<Result<Todo, ApiError>>(EXPORT_BUFFER_ROWS);
+
+    // The repository stops reading once the client goes away and rx is dropped
+    actix_web::rt::spawn(async move {
+        todos.export(user, tx).await;
+    });
+
+    let (open, close): (Bytes, &'static [u8]) = match format {
+        ExportFormat::Csv => (Bytes::from_static(CSV_HEADER.as_bytes()), b""),
+        ExportFormat::Json => (Bytes::from_static(b"["), b"]"),
+        ExportFormat::Xml => (Bytes::from(format!("{}<todos>", xml::XML_DECLARATION)), b"</todos>\n"),
+    };
+    let header = stream::once(async move { Ok::<_, ApiError>(open) });
+    let rows = stream::unfold((rx, true), move |(mut rx, first)| async move {
+        let row = rx.recv().await?;
+        let bytes = row.and_then(|todo| match format {
+            ExportFormat::Csv => Ok(Bytes::from(csv_row(&todo))),
+            ExportFormat::Json if first => json_row(todo),
+            ExportFormat::Json => {
+                json_row(todo).map(|json| Bytes::from([b",".as_slice(), &json[..]].concat()))
+            }
+            ExportFormat::Xml => xml_row(todo),
+        });
+        Some((bytes, (rx, false)))
+    });
+    let footer = stream::once(async move { Ok::<_, ApiError>(Bytes::from_static(close)) });
+    let body = header.chain(rows).chain(footer);
+
+    let filename = format!("todos-{}.{}", Utc::now().format("%Y-%m-%d"), format.extension());
+    HttpResponse::Ok()
+        .content_type(format.content_type())
+        .insert_header(ContentDisposition {
+            disposition: DispositionType::Attachment,
+            parameters: vec![DispositionParam::Filename(filename)],
+        })
+        .streaming(body)
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::header::ACCEPT;
+    use actix_web::test::TestRequest;
+
+    use super::{csv_field, ExportFormat, CSV_COLUMNS, CSV_HEADER};
+
+    #[test]
+    fn fields_are_quoted_only_when_needed() {
+        let cases = [
+            ("plain", "plain"),
+            ("", ""),
+            ("a,b", "\"a,b\""),
+            ("say \"hi\"", "\"say \"\"hi\"\"\""),
+            ("two\nlines", "\"two\nlines\""),
+            ("carriage\rreturn", "\"carriage\rreturn\""),
+        ];
+        for (value, expected) in cases {
+            assert_eq!(csv_field(value), expected, "{:?}", value);
+        }
+    }
+
+    #[test]
+    fn quoted_fields_read_back_unchanged() {
+        let values = ["a,b", "say \"hi\"", "two\r\nlines", " padded "];
+        let line: Vec<String> = values.iter().map(|v| csv_field(v)).collect();
+        let line = line.join(",");
+
+        let mut reader = csv::ReaderBuilder::new().has_headers(false).from_reader(line.as_bytes());
+        let record = reader.records().next().unwrap().unwrap();
+        assert_eq!(record.iter().collect::<Vec<_>>(), values);
+    }
+
+    #[test]
+    fn negotiation_prefers_json_unless_another_format_ranks_first() {
+        let cases = [
+            (None, Ok(ExportFormat::Json)),
+            (Some(""), Ok(ExportFormat::Json)),
+            (Some("*/*"), Ok(ExportFormat::Json)),
+            (Some("text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"), Ok(ExportFormat::Json)),
+            (Some("application/xml"), Ok(ExportFormat::Xml)),
+            (Some("application/xml, application/json;q=0.5"), Ok(ExportFormat::Xml)),
+            (Some("application/json, application/xml"), Ok(ExportFormat::Json)),
+            (Some("text/*;q=0.9, application/json;q=0.5"), Ok(ExportFormat::Csv)),
+            (Some("text/html, text/csv;q=0.5"), Ok(ExportFormat::Csv)),
+            (Some("text/html, text/csv;q=0.5, */*;q=0.1"), Ok(ExportFormat::Json)),
+            (Some("text/html"), Err(())),
+            (Some("application/json;q=0"), Err(())),
+        ];
+        for (accept, expected) in cases {
+            let mut req = TestRequest::get();
+            if let Some(accept) = accept {
+                req = req.insert_header((ACCEPT, accept));
+            }
+            let format = ExportFormat::negotiate(&req.to_http_request()).map_err(|_| ());
+            assert_eq!(format, expected, "{:?}", accept);
+        }
+    }
+
+    #[test]
+    fn header_names_the_import_columns() {
+        assert_eq!(CSV_HEADER, format!("{}\r\n", CSV_COLUMNS.join(",")));
+    }
+}
@@ -0,0 +1,184 @@
+use serde_json::{Map, Value};
+
+use crate::error::ApiError;
+use crate::models::TodoResponse;
+
+/// Todo fields a client may ask for with `?fields=`
+pub(crate) const TODO_FIELDS: &[&str] = &[
+    "id",
+    "title",
+    "description",
+    "completed",
+    "archived",
+    "position",
+    "version",
+    "tags",
+    "list_id",
+    "parent_id",
+    "due_date",
+    "recurrence",
+    "recurrence_interval",
+    "completed_at",
+    "remind_at",
+    "reminded_at",
+    "created_at",
+    "updated_at",
+    "created_by",
+    "updated_by",
+];
+
+/// Characters a description is cut to with `?description=summary`
+pub(crate) const SUMMARY_LEN: usize = 200;
+
+/// A todo as a JSON value, the form field selection and the XML encoder
+/// work from
+pub(crate) fn todo_value(todo: &TodoResponse) -> Result<Value, ApiError> {
+    serde_json::to_value(todo)
+        .map_err(|e| ApiError::InternalServerError(format!("Failed to encode todo: {}", e)))
+}
+
+/// How much of each description to return, chosen with `?description=`
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum DescriptionMode {
+    Full,
+    Summary,
+}
+
+impl DescriptionMode {
+    pub fn parse(value: Option<&str>) -> Result<Self, ApiError> {
+        match value.map(str::trim) {
+            None | Some("") | Some("full") => Ok(DescriptionMode::Full),
+            Some("summary") => Ok(DescriptionMode::Summary),
+            Some(other) => Err(ApiError::BadRequest(format!(
+                "description must be 'full' or 'summary', got '{}'",
+                other
+            ))),
+        }
+    }
+
+    /// Cut the description to SUMMARY_LEN characters in summary mode, flagging
+    /// the todo when anything was removed
+    pub fn apply(self, mut todo: TodoResponse) -> TodoResponse {
+        if self == DescriptionMode::Summary {
+            if let Some(description) = todo.description.as_mut() {
+                if let Some((cut, _)) = description.char_indices().nth(SUMMARY_LEN) {
+                    description.truncate(cut);
+                    todo.description_truncated = true;
+                }
+            }
+        }
+        todo
+    }
+}
+
+/// A validated `?fields=` selection, in the order the client listed them
+#[derive(Debug, Clone)]
+pub(crate) struct Fields(Vec<&'static str>);
+
+impl Fields {
+    /// Parse a comma separated field list. A missing parameter means the full
+    /// todo; unknown or empty selections are rejected.
+    pub fn parse(fields: Option<&str>) -> Result<Option<Self>, ApiError> {
+        let Some(fields) = fields else {
+            return Ok(None);
+        };
+
+        let mut selected: Vec<&'static str> = Vec::new();
+        for name in fields.split(',').map(str::trim).filter(|f| !f.is_empty()) {
+            let field = TODO_FIELDS.iter().find(|f| **f == name).ok_or_else(|| {
+                ApiError::BadRequest(format!(
+                    "Unknown field '{}', expected any of: {}",
+                    name,
+                    TODO_FIELDS.join(",")
+                ))
+            })?;
+            if !selected.contains(field) {
+                selected.push(field);
+            }
+        }
+
+        if selected.is_empty() {
+            return Err(ApiError::BadRequest("fields cannot be empty".to_string()));
+        }
+        Ok(Some(Fields(selected)))
+    }
+
+    /// Keep only the selected fields of a todo
+    pub fn select(&self, todo: &TodoResponse) -> Result<Value, ApiError> {
+        let Value::Object(mut all) = todo_value(todo)? else {
+            return Err(ApiError::InternalServerError("Todo is not a JSON object".to_string()));
+        };
+
+        let mut selected = Map::with_capacity(self.0.len());
+        for field in &self.0 {
+            if let Some(value) = all.remove(*field) {
+                selected.insert(field.to_string(), value);
+            }
+        }
+        // The truncation flag belongs with the description it describes
+        if self.0.contains(&"description") {
+            if let Some(truncated) = all.remove("description_truncated") {
+                selected.insert("description_truncated".to_string(), truncated);
+            }
+        }
+        Ok(Value::Object(selected))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+    use serde_json::{json, Value};
+
+    use super::{Fields, SUMMARY_LEN};
+    use crate::error::ApiError;
+    use crate::testing;
+
+    #[test]
+    fn unknown_and_empty_selections_are_refused() {
+        assert!(matches!(Fields::parse(Some("title,colour")), Err(ApiError::BadRequest(_))));
+        assert!(matches!(Fields::parse(Some(" , ")), Err(ApiError::BadRequest(_))));
+        let fields = Fields::parse(Some("title, id,title")).unwrap().unwrap();
+        assert_eq!(fields.0, ["title", "id"]);
+        assert!(Fields::parse(None).unwrap().is_none());
+    }
+
+    #[actix_web::test]
+    async fn only_selected_fields_are_returned() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let req = TestRequest::post().uri("/api/todos").set_json(json!({"title": "Pick fields"})).to_request();
+        let created: Value = test::call_and_read_body_json(&app, req).await;
+        let uri = format!("/api/todos/{}", created["id"].as_str().unwrap());
+
+        let req = TestRequest::get().uri(&format!("{}?fields=title,id", uri)).to_request();
+        let body: Value = test::call_and_read_body_json(&app, req).await;
+        assert_eq!(body, json!({"title": "Pick fields", "id": created["id"]}));
+
+        let req = TestRequest::get().uri(&format!("{}?fields=title,colour", uri)).to_request();
+        let res = test::call_service(&app, req).await;
+        assert_eq!(res.status(), StatusCode::BAD_REQUEST);
+        let body: Value = test::read_body_json(res).await;
+        assert!(body["message"].as_str().unwrap().contains("'colour'"), "{}", body);
+    }
+
+    #[actix_web::test]
+    async fn summaries_cut_multibyte_descriptions_between_characters() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        // Two bytes per character, so a byte-based cut would split one
+        let description = "é".repeat(SUMMARY_LEN + 1);
+        let req = TestRequest::post()
+            .uri("/api/todos")
+            .set_json(json!({"title": "Résumé", "description": description}))
+            .to_request();
+        let created: Value = test::call_and_read_body_json(&app, req).await;
+        let uri = format!("/api/todos/{}?description=summary", created["id"].as_str().unwrap());
+
+        let todo: Value = test::call_and_read_body_json(&app, TestRequest::get().uri(&uri).to_request()).await;
+        assert_eq!(todo["description"], "é".repeat(SUMMARY_LEN));
+        assert_eq!(todo["description_truncated"], true);
+        assert_eq!(todo["title"], "Résumé");
+    }
+}
@@ -0,0 +1,17 @@
+use actix_web::{web, HttpResponse};
+use serde_json::json;
+
+use crate::error::ApiError;
+use crate::repository::HealthRepository;
+use crate::version::{GIT_COMMIT, VERSION};
+
+/// Liveness check naming the running build; always public
+pub async fn health() -> HttpResponse {
+    HttpResponse::Ok().json(json!({ "status": "ok", "version": VERSION, "commit": GIT_COMMIT }))
+}
+
+/// Ping the database and report its connection pool, to diagnose connection
+/// exhaustion. 503 when the database does not answer or there is no pool.
+pub async fn database_health(health: web::Data<dyn HealthRepository>) -> Result<HttpResponse, ApiError> {
+    Ok(HttpResponse::Ok().json(health.pool_stats().await?))
+}
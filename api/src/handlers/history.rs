@@ -0,0 +1,95 @@
+use actix_web::{web, HttpResponse};
+use base64::engine::general_purpose::URL_SAFE_NO_PAD;
+use base64::Engine;
+use uuid::Uuid;
+
+use crate::auth::AuthUser;
+use crate::error::ApiError;
+use crate::models::{HistoryPage, HistoryQuery};
+use crate::repository::{todo_not_found, TodoRepository};
+use super::pagination::page_size;
+
+/// Opaque cursor for the page of events below event `id`
+fn encode_cursor(id: i64) -> String {
+    URL_SAFE_NO_PAD.encode(id.to_string())
+}
+
+fn decode_cursor(cursor: &str) -> Result<i64, ApiError> {
+    let invalid = || ApiError::BadRequest("Invalid pagination cursor".to_string());
+    let raw = URL_SAFE_NO_PAD.decode(cursor).map_err(|_| invalid())?;
+    String::from_utf8(raw)
+        .ok()
+        .and_then(|raw| raw.parse().ok())
+        .ok_or_else(invalid)
+}
+
+/// List the changes made to a todo, newest first, one page at a time. Anyone
+/// who can see the todo can read its history; once it is deleted only its
+/// owner can.
+pub async fn todo_history(
+    todos: web::Data<dyn TodoRepository>,
+    user: AuthUser,
+    id: web::Path<Uuid>,
+    query: web::Query<HistoryQuery>,
+) -> Result<HttpResponse, ApiError> {
+    let id = id.into_inner();
+    let limit = page_size(query.limit)?;
+    let after = query.after.as_deref().map(decode_cursor).transpose()?;
+
+    if todos.find(user, id).await?.is_none() {
+        // The latest event of a deleted todo names who owned it
+        let latest = todos.history(id, None, 1).await?;
+        if !latest.first().is_some_and(|event| event.user_id == user.user_id) {
+            return Err(todo_not_found(id));
+        }
+    }
+
+    // Fetch one extra event to learn whether another page follows
+    let mut events = todos.history(id, after, limit + 1).await?;
+    let next_cursor = if events.len() as i64 > limit {
+        events.truncate(limit as usize);
+        events.last().map(|e| encode_cursor(e.id)).unwrap_or_default()
+    } else {
+        String::new()
+    };
+
+    Ok(HttpResponse::Ok().json(HistoryPage {
+        events: events.into_iter().map(Into::into).collect(),
+        next_cursor,
+    }))
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+    use serde_json::{json, Value};
+
+    use crate::testing;
+
+    #[actix_web::test]
+    async fn every_change_is_recorded_newest_first() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let req = TestRequest::post().uri("/api/todos").set_json(json!({"title": "Draft"})).to_request();
+        let created: Value = test::call_and_read_body_json(&app, req).await;
+        let uri = format!("/api/todos/{}", created["id"].as_str().unwrap());
+
+        let req = TestRequest::put().uri(&uri).set_json(json!({"title": "Final", "version": 1})).to_request();
+        assert_eq!(test::call_service(&app, req).await.status(), StatusCode::OK);
+        let req = TestRequest::post().uri(&format!("{}/complete", uri)).to_request();
+        assert_eq!(test::call_service(&app, req).await.status(), StatusCode::OK);
+        let res = test::call_service(&app, TestRequest::delete().uri(&uri).to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+
+        let req = TestRequest::get().uri(&format!("{}/history", uri)).to_request();
+        let page: Value = test::call_and_read_body_json(&app, req).await;
+        let events = page["events"].as_array().unwrap();
+        let names: Vec<&str> = events.iter().map(|e| e["event"].as_str().unwrap()).collect();
+        assert_eq!(names, ["deleted", "updated", "updated", "created"]);
+        let titles: Vec<&str> = events.iter().map(|e| e["todo"]["title"].as_str().unwrap()).collect();
+        assert_eq!(titles, ["Final", "Final", "Final", "Draft"]);
+        assert_eq!(events[1]["todo"]["completed"], true);
+        assert!(events.windows(2).all(|pair| pair[0]["id"].as_i64() > pair[1]["id"].as_i64()));
+    }
+}
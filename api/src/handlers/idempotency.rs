@@ -0,0 +1,72 @@
+use actix_web::HttpRequest;
+use serde_json::Value;
+use std::env;
+
+use crate::auth::AuthUser;
+use crate::error::ApiError;
+use crate::repository::TodoRepository;
+
+pub const IDEMPOTENCY_KEY_HEADER: &str = "idempotency-key";
+
+const MAX_KEY_LEN: usize = 255;
+
+/// Default time a key is remembered: one day
+const DEFAULT_TTL_SECS: i64 = 24 * 60 * 60;
+
+/// How long an Idempotency-Key is remembered, configured through IDEMPOTENCY_TTL_SECS
+#[derive(Debug, Clone, Copy)]
+pub struct IdempotencyTtl(pub i64);
+
+impl IdempotencyTtl {
+    pub fn from_env() -> Result<Self, String> {
+        match env::var("IDEMPOTENCY_TTL_SECS").ok().filter(|v| !v.is_empty()) {
+            None => Ok(IdempotencyTtl(DEFAULT_TTL_SECS)),
+            Some(value) => value
+                .trim()
+                .parse()
+                .ok()
+                .filter(|secs| *secs > 0)
+                .map(IdempotencyTtl)
+                .ok_or_else(|| format!("IDEMPOTENCY_TTL_SECS must be a positive number of seconds, got '{}'", value)),
+        }
+    }
+}
+
+/// Read the Idempotency-Key header, if the client sent one
+pub(crate) fn idempotency_key(req: &HttpRequest) -> Result<Option<String>, ApiError> {
+    let Some(value) = req.headers().get(IDEMPOTENCY_KEY_HEADER) else {
+        return Ok(None);
+    };
+
+    let key = value
+        .to_str()
+        .map(str::trim)
+        .map_err(|_| ApiError::BadRequest("Idempotency-Key must be printable ASCII".to_string()))?;
+    if key.is_empty() || key.len() > MAX_KEY_LEN {
+        return Err(ApiError::BadRequest(format!(
+            "Idempotency-Key must be between 1 and {} characters",
+            MAX_KEY_LEN
+        )));
+    }
+
+    Ok(Some(key.to_string()))
+}
+
+/// Look up the response stored for `key`. Returns the original response when the
+/// same request was seen within the TTL, and a conflict when the key was used
+/// for a different request body.
+pub(crate) async fn replay(
+    todos: &dyn TodoRepository,
+    user: AuthUser,
+    key: &str,
+    request: &Value,
+    ttl: IdempotencyTtl,
+) -> Result<Option<Value>, ApiError> {
+    match todos.idempotent_response(user, key, request, ttl.0).await? {
+        None => Ok(None),
+        Some(stored) if stored.same_request => Ok(Some(stored.response)),
+        Some(_) => Err(ApiError::Conflict(
+            "Idempotency-Key was already used with a different request body".to_string(),
+        )),
+    }
+}
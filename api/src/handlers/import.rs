@@ -0,0 +1,254 @@
+use actix_web::{web, HttpMessage, HttpRequest, HttpResponse};
+use chrono::{DateTime, Utc};
+use uuid::Uuid;
+
+use crate::auth::{Actor, AuthUser};
+use crate::error::ApiError;
+use crate::models::{ImportMode, ImportQuery, ImportResponse, ImportRowError, ImportTodo};
+use crate::repository::{ImportRow, TodoRepository};
+use super::export::CSV_COLUMNS;
+use super::todo::{normalize_tags, validate_todo};
+
+/// Most rows a single import may contain. The body size is capped separately by
+/// MAX_BODY_BYTES.
+const MAX_IMPORT_ROWS: usize = 10_000;
+
+/// A payload row, or why it could not be read
+type ParsedRow = Result<ImportRow, ImportRowError>;
+
+fn row_error(row: usize, location: &str, message: impl std::fmt::Display) -> ImportRowError {
+    ImportRowError { row, error: format!("{}: {}", location, message) }
+}
+
+fn too_many_rows() -> ApiError {
+    ApiError::BadRequest(format!("Imports are limited to {} rows", MAX_IMPORT_ROWS))
+}
+
+fn parse_timestamp(value: &str) -> Result<Option<DateTime<Utc>>, ()> {
+    if value.is_empty() {
+        return Ok(None);
+    }
+    DateTime::parse_from_rfc3339(value)
+        .map(|ts| Some(ts.with_timezone(&Utc)))
+        .map_err(|_| ())
+}
+
+/// Build the import row for `todo`, giving it a fresh id when it has none
+fn import_row(row: usize, location: String, todo: ImportTodo) -> ImportRow {
+    ImportRow { row, location, id: todo.id.unwrap_or_else(Uuid::new_v4), todo }
+}
+
+/// Parse one CSV record laid out like the export
+fn parse_record(row: usize, location: String, record: &csv::StringRecord) -> ParsedRow {
+    let field = |i: usize| record.get(i).unwrap_or("").trim();
+    let invalid = |column: &str, value: &str| row_error(row, &location, format!("invalid {} '{}'", column, value));
+
+    let id = match field(0) {
+        "" => None,
+        id => Some(Uuid::parse_str(id).map_err(|_| invalid("id", id))?),
+    };
+    let completed = match field(3) {
+        "" => None,
+        value => Some(value.parse::<bool>().map_err(|_| invalid("completed", value))?),
+    };
+    let created_at = parse_timestamp(field(4)).map_err(|_| invalid("created_at", field(4)))?;
+    let updated_at = parse_timestamp(field(5)).map_err(|_| invalid("updated_at", field(5)))?;
+
+    let todo = ImportTodo {
+        id,
+        title: field(1).to_string(),
+        description: Some(field(2).to_string()).filter(|d| !d.is_empty()),
+        completed,
+        tags: None,
+        created_at,
+        updated_at,
+    };
+    Ok(import_row(row, location, todo))
+}
+
+/// Parse CSV using the same column layout as the export
+fn parse_csv(body: &[u8]) -> Result<Vec<ParsedRow>, ApiError> {
+    let mut reader = csv::ReaderBuilder::new().from_reader(body);
+
+    let headers = reader
+        .headers()
+        .map_err(|e| ApiError::BadRequest(format!("Malformed CSV header: {}", e)))?;
+    if !headers.iter().map(str::trim).eq(CSV_COLUMNS) {
+        return Err(ApiError::BadRequest(format!(
+            "CSV header must be '{}'",
+            CSV_COLUMNS.join(",")
+        )));
+    }
+
+    let mut rows = Vec::new();
+    for (i, record) in reader.records().enumerate() {
+        if i == MAX_IMPORT_ROWS {
+            return Err(too_many_rows());
+        }
+        let row = i + 1;
+        rows.push(match record {
+            Ok(record) => {
+                let location = format!("Line {}", record.position().map(|p| p.line()).unwrap_or(0));
+                parse_record(row, location, &record)
+            }
+            Err(e) => {
+                let location = match e.position() {
+                    Some(pos) => format!("Line {}", pos.line()),
+                    None => format!("Row {}", row),
+                };
+                Err(row_error(row, &location, "malformed CSV row"))
+            }
+        });
+    }
+
+    Ok(rows)
+}
+
+/// Parse a JSON array of todos
+fn parse_json(body: &[u8]) -> Result<Vec<ParsedRow>, ApiError> {
+    let items: Vec<serde_json::Value> = serde_json::from_slice(body).map_err(|e| {
+        ApiError::BadRequest(format!("Invalid JSON at line {}: {}", e.line(), e))
+    })?;
+    if items.len() > MAX_IMPORT_ROWS {
+        return Err(too_many_rows());
+    }
+
+    Ok(items
+        .into_iter()
+        .enumerate()
+        .map(|(i, item)| {
+            let location = format!("Item {}", i + 1);
+            match serde_json::from_value::<ImportTodo>(item) {
+                Ok(todo) => Ok(import_row(i + 1, location, todo)),
+                Err(e) => Err(row_error(i + 1, &location, e)),
+            }
+        })
+        .collect())
+}
+
+/// Import todos from CSV or JSON, chosen by Content-Type. `mode` decides what
+/// happens to rows whose id already exists: `fail` (the default) rejects the
+/// whole import, `skip` leaves the stored todo alone and `overwrite` replaces
+/// it. Every mode checks rows with `validate_todo` before they reach the
+/// repository. In `fail` mode an invalid row also rejects the import; otherwise
+/// it is reported in `errors` and the remaining rows are still imported.
+pub async fn import_todos(
+    todos: web::Data<dyn TodoRepository>,
+    user: AuthUser,
+    actor: Actor,
+    query: web::Query<ImportQuery>,
+    req: HttpRequest,
+    body: web::Bytes,
+) -> Result<HttpResponse, ApiError> {
+    let parsed = match req.content_type() {
+        "text/csv" => parse_csv(&body)?,
+        "application/json" => parse_json(&body)?,
+        other => {
+            return Err(ApiError::UnsupportedMediaType(format!(
+                "Unsupported content type '{}', expected text/csv or application/json",
+                other
+            )))
+        }
+    };
+
+    let mut rows = Vec::with_capacity(parsed.len());
+    let mut errors = Vec::new();
+    for row in parsed {
+        match row {
+            Ok(mut row) => match validate_todo(Some(&row.todo.title), row.todo.description.as_deref(), None) {
+                Ok(()) => {
+                    row.todo.tags = Some(normalize_tags(row.todo.tags.as_deref().unwrap_or_default()));
+                    rows.push(row);
+                }
+                Err(e) => errors.push(row_error(row.row, &row.location, e)),
+            },
+            Err(error) => errors.push(error),
+        }
+    }
+
+    if query.mode == ImportMode::Fail {
+        if let Some(error) = errors.first() {
+            return Err(ApiError::BadRequest(error.error.clone()));
+        }
+    }
+
+    let outcome = todos.import(user, actor, &rows, query.mode).await?;
+    errors.extend(outcome.errors);
+    errors.sort_by_key(|e| e.row);
+
+    let response = ImportResponse {
+        imported: outcome.imported,
+        skipped: outcome.skipped,
+        failed: errors.len(),
+        errors,
+    };
+    if response.imported > 0 {
+        Ok(HttpResponse::Created().json(response))
+    } else {
+        Ok(HttpResponse::Ok().json(response))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+    use serde_json::{json, Value};
+
+    use crate::testing;
+
+    fn import(mode: &str, todos: Value) -> TestRequest {
+        TestRequest::post().uri(&format!("/api/todos/import?mode={}", mode)).set_json(todos)
+    }
+
+    #[actix_web::test]
+    async fn oversized_fields_reject_a_failing_import() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+
+        let todos = json!([{"title": "Fine"}, {"title": "t".repeat(256)}]);
+        let res = test::call_service(&app, import("fail", todos).to_request()).await;
+        assert_eq!(res.status(), StatusCode::BAD_REQUEST);
+        let body: Value = test::read_body_json(res).await;
+        assert_eq!(body["message"], "Item 2: Title must be at most 255 characters");
+
+        let req = TestRequest::get().uri("/api/todos").to_request();
+        let listed: Value = test::call_and_read_body_json(&app, req).await;
+        assert_eq!(listed, json!([]));
+    }
+
+    #[actix_web::test]
+    async fn skip_mode_reports_invalid_rows() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+
+        let todos = json!([{"title": " "}, {"title": "Fine"}, {"title": "t".repeat(256)}]);
+        let res = test::call_service(&app, import("skip", todos).to_request()).await;
+        assert_eq!(res.status(), StatusCode::CREATED);
+        let body: Value = test::read_body_json(res).await;
+        assert_eq!(body["imported"], 1);
+        assert_eq!(body["failed"], 2);
+        assert_eq!(body["errors"][0], json!({"row": 1, "error": "Item 1: Title cannot be empty"}));
+        assert_eq!(body["errors"][1]["row"], 3);
+    }
+
+    #[actix_web::test]
+    async fn overwrite_mode_keeps_the_stored_todo_on_an_invalid_row() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let req = TestRequest::post().uri("/api/todos").set_json(json!({"title": "Original"})).to_request();
+        let stored: Value = test::call_and_read_body_json(&app, req).await;
+        let id = stored["id"].as_str().unwrap();
+
+        let todos = json!([{"id": id, "title": "Replaced", "description": "d".repeat(10_001)}]);
+        let res = test::call_service(&app, import("overwrite", todos).to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+        let body: Value = test::read_body_json(res).await;
+        assert_eq!(body["imported"], 0);
+        assert_eq!(body["errors"][0]["error"], "Item 1: Description must be at most 10000 characters");
+
+        let req = TestRequest::get().uri(&format!("/api/todos/{}", id)).to_request();
+        let fetched: Value = test::call_and_read_body_json(&app, req).await;
+        assert_eq!(fetched["title"], "Original");
+    }
+}
@@ -0,0 +1,102 @@
+use actix_web::{web, HttpResponse};
+use uuid::Uuid;
+
+use crate::auth::AuthUser;
+use crate::error::ApiError;
+use crate::models::{CreateListRequest, ListResponse, Role, ShareListRequest};
+use crate::repository::{ListRepository, UserRepository};
+use super::access::{authorize_list, require_account};
+
+/// List every list the caller owns or has been shared
+pub async fn list_lists(
+    lists: web::Data<dyn ListRepository>,
+    user: AuthUser,
+) -> Result<HttpResponse, ApiError> {
+    let user_id = require_account(user)?;
+
+    let response: Vec<ListResponse> = lists
+        .lists_for(user_id)
+        .await?
+        .into_iter()
+        .map(|l| l.into())
+        .collect();
+    Ok(HttpResponse::Ok().json(response))
+}
+
+/// Create a list owned by the caller
+pub async fn create_list(
+    lists: web::Data<dyn ListRepository>,
+    user: AuthUser,
+    req: web::Json<CreateListRequest>,
+) -> Result<HttpResponse, ApiError> {
+    let user_id = require_account(user)?;
+
+    let name = req.name.trim();
+    if name.is_empty() {
+        return Err(ApiError::BadRequest("Name cannot be empty".to_string()));
+    }
+
+    let list = lists.create(user_id, name).await?;
+    Ok(HttpResponse::Created().json(ListResponse::from(list)))
+}
+
+/// Share a list with another user, or change the role they already have
+pub async fn share_list(
+    lists: web::Data<dyn ListRepository>,
+    users: web::Data<dyn UserRepository>,
+    user: AuthUser,
+    id: web::Path<Uuid>,
+    req: web::Json<ShareListRequest>,
+) -> Result<HttpResponse, ApiError> {
+    let owner_id = require_account(user)?;
+    let list_id = id.into_inner();
+    authorize_list(lists.get_ref(), user, list_id, Role::Owner).await?;
+
+    if req.role == Role::Owner {
+        return Err(ApiError::BadRequest("Role must be 'viewer' or 'editor'".to_string()));
+    }
+
+    let username = req.username.trim();
+    let target = users
+        .find_by_username(username)
+        .await?
+        .ok_or_else(|| ApiError::NotFound(format!("User '{}' not found", username)))?;
+
+    if target.id == owner_id {
+        return Err(ApiError::BadRequest("Cannot share a list with its owner".to_string()));
+    }
+
+    let member = lists.share(list_id, target.id, req.role).await?;
+    Ok(HttpResponse::Ok().json(member))
+}
+
+/// List everyone with access to a list
+pub async fn list_members(
+    lists: web::Data<dyn ListRepository>,
+    user: AuthUser,
+    id: web::Path<Uuid>,
+) -> Result<HttpResponse, ApiError> {
+    require_account(user)?;
+    let list_id = id.into_inner();
+    authorize_list(lists.get_ref(), user, list_id, Role::Viewer).await?;
+
+    let members = lists.members(list_id).await?;
+    Ok(HttpResponse::Ok().json(members))
+}
+
+/// Revoke a user's access to a list
+pub async fn revoke_member(
+    lists: web::Data<dyn ListRepository>,
+    user: AuthUser,
+    path: web::Path<(Uuid, Uuid)>,
+) -> Result<HttpResponse, ApiError> {
+    require_account(user)?;
+    let (list_id, member_id) = path.into_inner();
+    authorize_list(lists.get_ref(), user, list_id, Role::Owner).await?;
+
+    if !lists.revoke(list_id, member_id).await? {
+        return Err(ApiError::NotFound(format!("User {} is not a member of this list", member_id)));
+    }
+
+    Ok(HttpResponse::NoContent().finish())
+}
@@ -1,5 +1,49 @@
+pub mod access;
+pub mod admin;
+pub mod auth;
+pub mod conditional;
+pub mod docs;
+pub mod export;
+pub mod fields;
+pub mod health;
+pub mod history;
+pub mod idempotency;
+pub mod import;
+pub mod list;
+pub mod notification;
+pub mod pagination;
+pub mod purge;
+pub mod reset;
+pub mod subtask;
+pub mod sync;
+pub mod title;
 pub mod todo;
+pub mod undo;
+pub mod view;
+pub mod webhook;
+pub mod ws;
+pub mod xml;
 
+pub use admin::{admin_status, set_log_level};
+pub use auth::{login, register};
+pub use docs::{openapi_spec, swagger_ui};
+pub use export::export_todos;
+pub use health::{health, database_health};
+pub use history::todo_history;
+pub use import::import_todos;
+pub use notification::list_notifications;
+pub use purge::purge_now;
+pub use reset::delete_all_todos;
+pub use subtask::list_subtasks;
+pub use sync::todo_changes;
+pub use list::{list_lists, create_list, share_list, list_members, revoke_member};
 pub use todo::{
-    list_todos, get_todo, create_todo, update_todo, delete_todo,
+    list_todos, count_todos, todo_board, get_todo, create_todo, duplicate_todo, update_todo, update_todo_title,
+    update_todo_description, delete_todo,
+    complete_todo, uncomplete_todo, archive_todo, unarchive_todo, reorder_todos, search_todos, todos_exist,
+    batch_get_todos, batch_update_todos,
 };
+pub use undo::undo_delete;
+pub use view::todo_view;
+pub use webhook::{list_webhooks, create_webhook, get_webhook, update_webhook, delete_webhook};
+pub use ws::todo_updates;
@@ -0,0 +1,23 @@
+use actix_web::{web, HttpResponse};
+
+use crate::auth::AuthUser;
+use crate::error::ApiError;
+use crate::models::{NotificationQuery, NotificationResponse};
+use crate::repository::ReminderRepository;
+use super::pagination::page_size;
+
+/// List the reminders delivered to the caller, newest first
+pub async fn list_notifications(
+    reminders: web::Data<dyn ReminderRepository>,
+    user: AuthUser,
+    query: web::Query<NotificationQuery>,
+) -> Result<HttpResponse, ApiError> {
+    let limit = page_size(query.limit)?;
+    let response: Vec<NotificationResponse> = reminders
+        .notifications(user, limit)
+        .await?
+        .into_iter()
+        .map(Into::into)
+        .collect();
+    Ok(HttpResponse::Ok().json(response))
+}
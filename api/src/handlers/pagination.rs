@@ -0,0 +1,70 @@
+use base64::engine::general_purpose::URL_SAFE_NO_PAD;
+use base64::Engine;
+use chrono::{DateTime, SecondsFormat, Utc};
+use uuid::Uuid;
+
+use crate::error::ApiError;
+use crate::models::Todo;
+use crate::repository::{SortField, SortKey, TodoSort};
+
+pub(crate) const DEFAULT_PAGE_SIZE: i64 = 50;
+pub(crate) const MAX_PAGE_SIZE: i64 = 100;
+
+/// Position after which the next page starts, as the `(sort key, id)` of the
+/// last todo on the previous page
+#[derive(Debug, Clone, Copy)]
+pub(crate) struct Cursor {
+    pub key: SortKey,
+    pub id: Uuid,
+}
+
+impl Cursor {
+    pub fn after(todo: &Todo, sort: TodoSort) -> Self {
+        Cursor { key: sort.key(todo), id: todo.id }
+    }
+
+    /// Opaque form handed to clients
+    pub fn encode(&self) -> String {
+        let key = match self.key {
+            SortKey::Time(time) => time.to_rfc3339_opts(SecondsFormat::AutoSi, true),
+            SortKey::Position(position) => position.to_string(),
+        };
+        let raw = format!("{},{}", key, self.id);
+        URL_SAFE_NO_PAD.encode(raw)
+    }
+
+    /// Read a cursor handed out for a listing sorted by `sort`
+    pub fn decode(cursor: &str, sort: TodoSort) -> Result<Self, ApiError> {
+        let invalid = || ApiError::BadRequest("Invalid pagination cursor".to_string());
+
+        let raw = URL_SAFE_NO_PAD.decode(cursor).map_err(|_| invalid())?;
+        let raw = String::from_utf8(raw).map_err(|_| invalid())?;
+        let (key, id) = raw.split_once(',').ok_or_else(invalid)?;
+
+        let key = match sort.field {
+            SortField::Position => SortKey::Position(key.parse().map_err(|_| invalid())?),
+            SortField::CreatedAt | SortField::UpdatedAt => SortKey::Time(
+                DateTime::parse_from_rfc3339(key)
+                    .map_err(|_| invalid())?
+                    .with_timezone(&Utc),
+            ),
+        };
+
+        Ok(Cursor {
+            key,
+            id: Uuid::parse_str(id).map_err(|_| invalid())?,
+        })
+    }
+}
+
+/// Validate a requested page size
+pub(crate) fn page_size(limit: Option<i64>) -> Result<i64, ApiError> {
+    match limit {
+        None => Ok(DEFAULT_PAGE_SIZE),
+        Some(limit) if (1..=MAX_PAGE_SIZE).contains(&limit) => Ok(limit),
+        Some(_) => Err(ApiError::BadRequest(format!(
+            "limit must be between 1 and {}",
+            MAX_PAGE_SIZE
+        ))),
+    }
+}
@@ -0,0 +1,154 @@
+use actix_web::{web, HttpResponse};
+use chrono::{DateTime, Utc};
+use std::env;
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::sync::watch;
+
+use crate::db::parse_duration;
+use crate::error::ApiError;
+use crate::models::PurgeResponse;
+use crate::repository::TodoRepository;
+
+const DEFAULT_INTERVAL: Duration = Duration::from_secs(3600);
+const DEFAULT_AFTER: Duration = Duration::from_secs(30 * 86400);
+
+/// Todos deleted per statement, small enough that no batch holds its locks for long
+const BATCH_SIZE: i64 = 500;
+
+/// How often and after how long archived todos are deleted for good,
+/// configured through PURGE_INTERVAL and PURGE_AFTER
+#[derive(Debug, Clone, Copy)]
+pub struct PurgeSettings {
+    pub interval: Duration,
+    /// Age since the last change after which an archived todo is purged;
+    /// None when PURGE_AFTER=0 turns purging off
+    pub after: Option<Duration>,
+}
+
+impl PurgeSettings {
+    pub fn from_env() -> Result<Self, String> {
+        let interval = match env::var("PURGE_INTERVAL").ok().filter(|v| !v.is_empty()) {
+            None => DEFAULT_INTERVAL,
+            Some(value) => parse_duration(&value).filter(|d| !d.is_zero()).ok_or_else(|| {
+                format!("PURGE_INTERVAL must be a positive duration such as '3600', '60m' or '1h', got '{}'", value)
+            })?,
+        };
+        let after = match env::var("PURGE_AFTER").ok().filter(|v| !v.is_empty()) {
+            None => Some(DEFAULT_AFTER),
+            Some(value) => parse_duration(&value)
+                .map(|d| Some(d).filter(|d| !d.is_zero()))
+                .ok_or_else(|| format!("PURGE_AFTER must be a duration such as '30d' or '720h', or 0 to disable, got '{}'", value))?,
+        };
+        Ok(PurgeSettings { interval, after })
+    }
+
+    /// Archived todos last changed before this are due at `now`
+    fn cutoff(&self, now: DateTime<Utc>) -> Option<DateTime<Utc>> {
+        let after = chrono::Duration::from_std(self.after?).ok()?;
+        now.checked_sub_signed(after)
+    }
+}
+
+/// Delete every archived todo last changed before `before`, one batch at a time
+async fn purge(todos: &dyn TodoRepository, before: DateTime<Utc>) -> Result<u64, ApiError> {
+    let mut total = 0;
+    loop {
+        let purged = todos.purge_archived(before, BATCH_SIZE).await?;
+        total += purged;
+        if purged < BATCH_SIZE as u64 {
+            return Ok(total);
+        }
+        // Let other work reach the database between batches
+        tokio::task::yield_now().await;
+    }
+}
+
+/// The running purge job; stop it before closing the storage
+pub struct Purger {
+    stop: watch::Sender<bool>,
+    task: actix_web::rt::task::JoinHandle<()>,
+}
+
+impl Purger {
+    /// Let a purge in progress finish its current run, then stop
+    pub async fn stop(self) {
+        let _ = self.stop.send(true);
+        if let Err(e) = self.task.await {
+            log::error!(error = e.to_string().as_str(); "purge job failed");
+        }
+    }
+}
+
+/// Periodically delete old archived todos, unless PURGE_AFTER=0
+pub fn spawn_purger(todos: Arc<dyn TodoRepository>, settings: PurgeSettings) -> Option<Purger> {
+    settings.after?;
+    let (stop, mut stopped) = watch::channel(false);
+    let task = actix_web::rt::spawn(async move {
+        let mut interval = actix_web::rt::time::interval(settings.interval);
+        loop {
+            tokio::select! {
+                _ = interval.tick() => {}
+                _ = stopped.changed() => break,
+            }
+            let Some(before) = settings.cutoff(Utc::now()) else { continue };
+            match purge(todos.as_ref(), before).await {
+                Ok(0) => {}
+                Ok(purged) => log::info!(purged = purged; "purged old archived todos"),
+                Err(e) => log::warn!(error = e.to_string().as_str(); "failed to purge old archived todos"),
+            }
+        }
+    });
+    Some(Purger { stop, task })
+}
+
+/// Run the purge now instead of waiting for PURGE_INTERVAL
+pub async fn purge_now(
+    todos: web::Data<dyn TodoRepository>,
+    settings: web::Data<PurgeSettings>,
+) -> Result<HttpResponse, ApiError> {
+    let before = settings
+        .cutoff(Utc::now())
+        .ok_or_else(|| ApiError::Conflict("Purging is disabled (PURGE_AFTER=0)".to_string()))?;
+    let purged = purge(todos.get_ref(), before).await?;
+    log::info!(purged = purged; "purged old archived todos on request");
+    Ok(HttpResponse::Ok().json(PurgeResponse { purged, before }))
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+    use serde_json::{json, Value};
+    use std::time::Duration;
+
+    use crate::middleware::admin::ADMIN_TOKEN_HEADER;
+    use crate::testing;
+
+    #[actix_web::test]
+    async fn purges_old_archived_todos_and_keeps_fresh_ones() {
+        let config = testing::config(&[("ADMIN_TOKEN", "admin-secret"), ("PURGE_AFTER", "1s")]);
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(config, &repositories)).await;
+
+        let mut ids = Vec::new();
+        for title in ["Old archived", "Fresh archived", "Old open"] {
+            let req = TestRequest::post().uri("/api/todos").set_json(json!({ "title": title })).to_request();
+            let todo: Value = test::call_and_read_body_json(&app, req).await;
+            ids.push(todo["id"].as_str().unwrap().to_string());
+        }
+        let archive = |id: &str| TestRequest::post().uri(&format!("/api/todos/{}/archive", id)).to_request();
+        assert_eq!(test::call_service(&app, archive(&ids[0])).await.status(), StatusCode::OK);
+        tokio::time::sleep(Duration::from_millis(1100)).await;
+        assert_eq!(test::call_service(&app, archive(&ids[1])).await.status(), StatusCode::OK);
+
+        let req = TestRequest::post().uri("/api/admin/purge").insert_header((ADMIN_TOKEN_HEADER, "admin-secret"));
+        let body: Value = test::call_and_read_body_json(&app, req.to_request()).await;
+        assert_eq!(body["purged"], 1);
+
+        let get = |id: &str| TestRequest::get().uri(&format!("/api/todos/{}", id)).to_request();
+        assert_eq!(test::call_service(&app, get(&ids[0])).await.status(), StatusCode::NOT_FOUND);
+        assert_eq!(test::call_service(&app, get(&ids[1])).await.status(), StatusCode::OK);
+        assert_eq!(test::call_service(&app, get(&ids[2])).await.status(), StatusCode::OK);
+    }
+}
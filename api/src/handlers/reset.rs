@@ -0,0 +1,96 @@
+use actix_web::{web, HttpResponse};
+
+use crate::auth::AuthUser;
+use crate::config::flag;
+use crate::error::ApiError;
+use crate::models::DeleteAllResponse;
+use crate::repository::TodoRepository;
+
+/// Whether DELETE /api/todos/all may wipe the data, configured through
+/// ALLOW_DESTRUCTIVE for test environments and demos. Off unless set to true.
+#[derive(Debug, Clone, Copy)]
+pub struct AllowDestructive(pub bool);
+
+impl AllowDestructive {
+    pub fn from_env() -> Result<Self, String> {
+        flag("ALLOW_DESTRUCTIVE", false).map(AllowDestructive)
+    }
+}
+
+/// Delete every todo of every user, with no undo, and report how many there
+/// were. The route also needs the admin token, so a signed-in user alone
+/// cannot reach it. Refused with 403 unless ALLOW_DESTRUCTIVE is set; every
+/// call that gets here is logged either way.
+pub async fn delete_all_todos(
+    todos: web::Data<dyn TodoRepository>,
+    allow: web::Data<AllowDestructive>,
+    user: AuthUser,
+) -> Result<HttpResponse, ApiError> {
+    let user_id = user.user_id.map(|id| id.to_string()).unwrap_or_default();
+    if !allow.0 {
+        log::warn!(user_id = user_id.as_str(); "refused to delete all todos; ALLOW_DESTRUCTIVE is off");
+        return Err(ApiError::Forbidden(
+            "Deleting all todos is disabled; set ALLOW_DESTRUCTIVE=true to allow it".to_string(),
+        ));
+    }
+
+    let deleted = todos.delete_all().await?;
+    log::warn!(user_id = user_id.as_str(), deleted = deleted; "deleted all todos");
+    Ok(HttpResponse::Ok().json(DeleteAllResponse { deleted }))
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+    use serde_json::{json, Value};
+
+    use crate::middleware::admin::ADMIN_TOKEN_HEADER;
+    use crate::testing;
+
+    const SECRET: (&str, &str) = ("JWT_SECRET", "test-secret");
+    const DESTRUCTIVE: (&str, &str) = ("ALLOW_DESTRUCTIVE", "true");
+
+    #[actix_web::test]
+    async fn signed_in_user_cannot_delete_everything() {
+        let config = testing::config(&[SECRET, DESTRUCTIVE]);
+        let (_, token) = testing::token(&config);
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(config, &repositories)).await;
+
+        let req = testing::bearer(TestRequest::post().uri("/api/todos"), &token)
+            .set_json(json!({"title": "Keep me"}))
+            .to_request();
+        assert_eq!(test::call_service(&app, req).await.status(), StatusCode::CREATED);
+
+        let req = testing::bearer(TestRequest::delete().uri("/api/todos/all"), &token).to_request();
+        assert_eq!(test::call_service(&app, req).await.status(), StatusCode::FORBIDDEN);
+
+        let req = testing::bearer(TestRequest::get().uri("/api/todos"), &token).to_request();
+        let todos: Value = test::call_and_read_body_json(&app, req).await;
+        assert_eq!(todos.as_array().unwrap().len(), 1);
+    }
+
+    #[actix_web::test]
+    async fn deleting_everything_needs_the_admin_token() {
+        let config = testing::config(&[SECRET, DESTRUCTIVE, ("ADMIN_TOKEN", "admin-secret")]);
+        let (_, token) = testing::token(&config);
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(config, &repositories)).await;
+        let req = testing::bearer(TestRequest::post().uri("/api/todos"), &token)
+            .set_json(json!({"title": "Delete me"}))
+            .to_request();
+        assert_eq!(test::call_service(&app, req).await.status(), StatusCode::CREATED);
+
+        let req = testing::bearer(TestRequest::delete().uri("/api/todos/all"), &token).to_request();
+        assert_eq!(test::call_service(&app, req).await.status(), StatusCode::UNAUTHORIZED);
+
+        let req = testing::bearer(TestRequest::delete().uri("/api/todos/all"), &token)
+            .insert_header((ADMIN_TOKEN_HEADER, "admin-secret"))
+            .to_request();
+        let res = test::call_service(&app, req).await;
+        assert_eq!(res.status(), StatusCode::OK);
+        let body: Value = test::read_body_json(res).await;
+        assert_eq!(body["deleted"], 1);
+    }
+}
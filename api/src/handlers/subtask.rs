@@ -0,0 +1,85 @@
+use actix_web::{web, HttpResponse};
+use std::env;
+use uuid::Uuid;
+
+use crate::auth::AuthUser;
+use crate::error::ApiError;
+use crate::models::{Role, TodoResponse};
+use crate::repository::TodoRepository;
+use super::access::authorize_todo;
+
+/// What deleting a todo that still has subtasks does, configured through
+/// SUBTASK_DELETE_POLICY
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum SubtaskDeletePolicy {
+    /// Delete the subtasks along with their parent
+    Cascade,
+    /// Refuse with 409 Conflict until the subtasks are removed
+    Block,
+}
+
+impl SubtaskDeletePolicy {
+    pub fn from_env() -> Result<Self, String> {
+        match env::var("SUBTASK_DELETE_POLICY") {
+            Err(_) => Ok(SubtaskDeletePolicy::Block),
+            Ok(policy) => match policy.to_ascii_lowercase().as_str() {
+                "" | "block" => Ok(SubtaskDeletePolicy::Block),
+                "cascade" => Ok(SubtaskDeletePolicy::Cascade),
+                _ => Err(format!(
+                    "SUBTASK_DELETE_POLICY must be 'block' or 'cascade', got '{}'",
+                    policy
+                )),
+            },
+        }
+    }
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            SubtaskDeletePolicy::Cascade => "cascade",
+            SubtaskDeletePolicy::Block => "block",
+        }
+    }
+}
+
+/// Check `parent_id` can become the parent of the todo `id` (None for a todo
+/// that is being created): the caller must be able to see the parent, and the
+/// todo must not be the parent itself or one of its ancestors
+pub(crate) async fn validate_parent(
+    todos: &dyn TodoRepository,
+    user: AuthUser,
+    id: Option<Uuid>,
+    parent_id: Uuid,
+) -> Result<(), ApiError> {
+    authorize_todo(todos, user, parent_id, Role::Viewer)
+        .await
+        .map_err(|e| match e {
+            ApiError::NotFound(_) => {
+                ApiError::BadRequest(format!("Parent todo {} does not exist", parent_id))
+            }
+            e => e,
+        })?;
+
+    if let Some(id) = id {
+        if todos.is_ancestor(id, parent_id).await? {
+            return Err(ApiError::BadRequest(
+                "A todo cannot be its own ancestor".to_string(),
+            ));
+        }
+    }
+    Ok(())
+}
+
+/// List the direct children of a todo
+pub async fn list_subtasks(
+    todos: web::Data<dyn TodoRepository>,
+    user: AuthUser,
+    id: web::Path<Uuid>,
+) -> Result<HttpResponse, ApiError> {
+    let id = id.into_inner();
+    authorize_todo(todos.get_ref(), user, id, Role::Viewer).await?;
+
+    let subtasks = todos.subtasks(user, id).await?;
+
+    let response: Vec<TodoResponse> = subtasks.into_iter().map(|t| t.into()).collect();
+    Ok(HttpResponse::Ok().json(response))
+}
@@ -0,0 +1,82 @@
+use actix_web::{web, HttpResponse};
+use chrono::{DateTime, Duration, Utc};
+
+use crate::auth::AuthUser;
+use crate::error::ApiError;
+use crate::models::{ChangesQuery, ChangesResponse, TodoResponse};
+use crate::repository::TodoRepository;
+
+/// Seconds `server_time` trails the clock. Writes stamp `updated_at` before
+/// they commit, so a change stamped just before a sync can become visible just
+/// after it; starting the next sync this far back picks it up, and also covers
+/// small clock differences between API instances. Clients therefore see some
+/// changes twice and should apply them as upserts.
+const SYNC_OVERLAP_SECS: i64 = 30;
+
+/// The watermark to hand out for a sync whose query started at `now`
+pub(crate) fn server_time(now: DateTime<Utc>) -> DateTime<Utc> {
+    now - Duration::seconds(SYNC_OVERLAP_SECS)
+}
+
+/// Everything that changed for the caller after `since`: created, updated and
+/// restored todos plus tombstones for deleted ones, each oldest first. Only the
+/// server's clock is ever compared, so clients must pass back the previous
+/// response's `server_time` rather than their own time.
+pub async fn todo_changes(
+    todos: web::Data<dyn TodoRepository>,
+    user: AuthUser,
+    query: web::Query<ChangesQuery>,
+) -> Result<HttpResponse, ApiError> {
+    // Read before querying, so anything committed during the query is
+    // picked up again next time
+    let now = Utc::now();
+    if query.since > now {
+        return Err(ApiError::BadRequest(
+            "since is in the future; pass the server_time of the previous response".to_string(),
+        ));
+    }
+
+    let changes = todos.changes(user, query.since).await?;
+    Ok(HttpResponse::Ok().json(ChangesResponse {
+        todos: changes.todos.into_iter().map(TodoResponse::from).collect(),
+        deleted: changes.deleted,
+        server_time: server_time(now),
+    }))
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+    use serde_json::{json, Value};
+
+    use crate::testing;
+
+    #[actix_web::test]
+    async fn deleting_a_parent_tombstones_its_subtasks_too() {
+        let repositories = testing::repositories();
+        let config = testing::config(&[("SUBTASK_DELETE_POLICY", "cascade")]);
+        let app = test::init_service(testing::app(config, &repositories)).await;
+        let req = TestRequest::post().uri("/api/todos").set_json(json!({"title": "Move house"})).to_request();
+        let parent: Value = test::call_and_read_body_json(&app, req).await;
+        let req = TestRequest::post()
+            .uri("/api/todos")
+            .set_json(json!({"title": "Pack books", "parent_id": parent["id"]}))
+            .to_request();
+        let child: Value = test::call_and_read_body_json(&app, req).await;
+
+        let uri = format!("/api/todos/{}", parent["id"].as_str().unwrap());
+        let res = test::call_service(&app, TestRequest::delete().uri(&uri).to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+
+        let req = TestRequest::get().uri("/api/todos/changes?since=2000-01-01T00:00:00Z").to_request();
+        let changes: Value = test::call_and_read_body_json(&app, req).await;
+        assert_eq!(changes["todos"], json!([]));
+        let mut deleted: Vec<&str> =
+            changes["deleted"].as_array().unwrap().iter().map(|t| t["id"].as_str().unwrap()).collect();
+        deleted.sort_unstable();
+        let mut expected = vec![parent["id"].as_str().unwrap(), child["id"].as_str().unwrap()];
+        expected.sort_unstable();
+        assert_eq!(deleted, expected);
+    }
+}
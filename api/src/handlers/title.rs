@@ -0,0 +1,29 @@
+
+use crate::config::flag;
+use crate::models::Todo;
+use crate::repository::title_key;
+
+/// Whether the titles of a user's open todos must be distinct, configured
+/// through STRICT_UNIQUE_TITLES. Off unless set to true; a single request can
+/// still ask for the check with `allow_duplicate=false`.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct UniqueTitles(pub bool);
+
+impl UniqueTitles {
+    pub fn from_env() -> Result<Self, String> {
+        flag("STRICT_UNIQUE_TITLES", false).map(UniqueTitles)
+    }
+
+    /// Whether a write sent with `allow_duplicate` must keep its title unique.
+    /// `allow_duplicate=true` cannot lift the server-wide rule.
+    pub fn required(self, allow_duplicate: Option<bool>) -> bool {
+        self.0 || allow_duplicate == Some(false)
+    }
+}
+
+/// Whether changing `existing` to `title`, completed or not, renames a todo
+/// that stays open: the only change the title rule checks, so todos whose
+/// titles clashed before the rule applied can still be edited and reopened
+pub fn renames_open_todo(existing: &Todo, title: &str, completed: bool) -> bool {
+    !completed && title_key(title) != title_key(&existing.title)
+}
@@ -1,126 +1,1420 @@
-use actix_web::{web, HttpResponse};
-use sqlx::PgPool;
+use actix_web::http::header::{HeaderName, LOCATION, VARY};
+use actix_web::{web, HttpRequest, HttpResponse};
+use chrono::{SecondsFormat, Utc};
+use std::collections::{BTreeMap, HashMap, HashSet};
 use uuid::Uuid;
-use chrono::Utc;
 
-use crate::models::{CreateTodoRequest, UpdateTodoRequest, TodoResponse, Todo};
-use crate::error::ApiError;
+use crate::auth::{Actor, AuthUser};
+use crate::models::{
+    CreateTodoRequest, CreateTodoForm, UpdateTodoRequest, UpdateTitleRequest, UpdateDescriptionRequest, TodoResponse,
+    ListTodosQuery, GetTodoQuery, TodoPage, Role, Patch,
+    Recurrence, ExistsRequest, ReorderRequest, SearchQuery, SearchResult, Envelope, DuplicateQuery,
+    DeleteResponse, Board, BoardQuery, BatchGetRequest, BatchGetResponse, BatchUpdateItem, BatchUpdateQuery,
+    BatchUpdateResponse, TitleQuery, Todo, MAX_RECURRENCE_INTERVAL,
+};
+use crate::error::{ApiError, FieldError};
+use crate::events::{Broker, TodoEvent};
+use crate::repository::{
+    todo_not_found, IdempotencyKey, ListRepository, NewTodo, TodoChanges, TodoFilter,
+    TodoRepository, TodoSort, Updated,
+};
+use super::access::{authorize_list, authorize_todo};
+use super::conditional::{last_modified, not_modified};
+use super::export::{csv_stream, ExportFormat};
+use super::fields::{todo_value, DescriptionMode, Fields};
+use super::idempotency::{self, IdempotencyTtl};
+use super::pagination::{page_size, Cursor};
+use super::subtask::{validate_parent, SubtaskDeletePolicy};
+use super::sync;
+use super::title::{renames_open_todo, UniqueTitles};
+use super::undo::{UndoWindow, UNDO_TOKEN_HEADER};
+use super::xml;
 
-/// List all todos
-pub async fn list_todos(pool: web::Data<PgPool>) -> Result<HttpResponse, ApiError> {
-    let todos = sqlx::query_as::<_, Todo>(
-        "SELECT id, title, description, completed, created_at, updated_at FROM todos ORDER BY created_at DESC"
-    )
-    .fetch_all(pool.get_ref())
-    .await?;
+/// Trim tags, drop empty ones and remove duplicates while keeping the first occurrence
+pub(crate) fn normalize_tags(tags: &[String]) -> Vec<String> {
+    let mut normalized: Vec<String> = Vec::with_capacity(tags.len());
+    for tag in tags {
+        let tag = tag.trim();
+        if !tag.is_empty() && !normalized.iter().any(|t| t == tag) {
+            normalized.push(tag.to_string());
+        }
+    }
+    normalized
+}
 
-    let response: Vec<TodoResponse> = todos.into_iter().map(|t| t.into()).collect();
-    Ok(HttpResponse::Ok().json(response))
+/// Longest title a todo may have, the size of the column
+const MAX_TITLE_LEN: usize = 255;
+
+/// Longest description a todo may have
+const MAX_DESCRIPTION_LEN: usize = 10_000;
+
+/// Check the fields a create or update sets, reporting every invalid one at
+/// once. Fields passed as None are not being set.
+pub(super) fn validate_todo(
+    title: Option<&str>,
+    description: Option<&str>,
+    recurrence_interval: Option<i32>,
+) -> Result<(), ApiError> {
+    let mut errors = Vec::new();
+    if let Some(title) = title {
+        if title.trim().is_empty() {
+            errors.push(FieldError::new("title", "Title cannot be empty"));
+        } else if title.chars().count() > MAX_TITLE_LEN {
+            errors.push(FieldError::new(
+                "title",
+                format!("Title must be at most {} characters", MAX_TITLE_LEN),
+            ));
+        }
+    }
+    if description.is_some_and(|d| d.chars().count() > MAX_DESCRIPTION_LEN) {
+        errors.push(FieldError::new(
+            "description",
+            format!("Description must be at most {} characters", MAX_DESCRIPTION_LEN),
+        ));
+    }
+    if recurrence_interval.is_some_and(|i| !(1..=MAX_RECURRENCE_INTERVAL).contains(&i)) {
+        errors.push(FieldError::new(
+            "recurrence_interval",
+            format!("recurrence_interval must be between 1 and {}", MAX_RECURRENCE_INTERVAL),
+        ));
+    }
+
+    if errors.is_empty() {
+        Ok(())
+    } else {
+        Err(ApiError::Validation(errors))
+    }
+}
+
+/// Publish the change events for an update and build its response
+fn updated_response(broker: &Broker, updated: Updated) -> HttpResponse {
+    HttpResponse::Ok().json(publish_updated(broker, updated))
 }
 
-/// Get a single todo by ID
+/// Announce an updated todo, and the next occurrence it created, returning the
+/// todo as a response
+fn publish_updated(broker: &Broker, updated: Updated) -> TodoResponse {
+    broker.publish(TodoEvent::updated(&updated.todo));
+    let mut response = TodoResponse::from(updated.todo);
+    if let Some(next) = updated.next_occurrence {
+        response.next_occurrence_id = Some(next.id);
+        broker.publish(TodoEvent::created(&next));
+    }
+    response
+}
+
+/// Response header carrying `next_cursor` for CSV pages, which have no body field for it
+pub const NEXT_CURSOR_HEADER: &str = "x-next-cursor";
+
+/// Response header with the number of todos matching the filters across all pages
+pub const TOTAL_COUNT_HEADER: &str = "x-total-count";
+
+/// Response header with the watermark to pass as `updated_since` next time
+pub const SERVER_TIME_HEADER: &str = "x-server-time";
+
+/// The `sort` query parameter, or `default` when it is missing
+pub(crate) fn sort_param(spec: Option<&str>, default: TodoSort) -> Result<TodoSort, ApiError> {
+    match spec {
+        Some(spec) => TodoSort::parse(spec).ok_or_else(|| {
+            ApiError::BadRequest(
+                "sort must be 'created_at', 'updated_at' or 'position', optionally followed by ':asc' or ':desc'"
+                    .to_string(),
+            )
+        }),
+        None => Ok(default),
+    }
+}
+
+/// The filters of a list request, without paging
+fn list_filter(query: &ListTodosQuery) -> Result<TodoFilter, ApiError> {
+    if let (Some(after), Some(before)) = (query.created_after, query.created_before) {
+        if after >= before {
+            return Err(ApiError::BadRequest("created_after must be earlier than created_before".to_string()));
+        }
+    }
+    Ok(TodoFilter {
+        tag: query.tag.clone(),
+        archived: query.archived.unwrap_or(false),
+        completed: query.completed,
+        updated_since: query.updated_since,
+        created_after: query.created_after,
+        created_before: query.created_before,
+        ..TodoFilter::default()
+    })
+}
+
+/// List the caller's todos and those in lists shared with them, optionally
+/// filtered by tag, in the order named by `sort` or else DEFAULT_SORT. Archived todos are only
+/// listed with `archived=true`, and then without the active ones. Passing `limit` or
+/// `after` returns one page at a time using keyset pagination on the sort key
+/// and `id`, and `fields` trims each todo to the named fields; `description=summary`
+/// shortens long descriptions. `envelope=true`
+/// wraps the todos with page metadata instead of returning the bare list or
+/// page. `Last-Modified` is the newest `updated_at` among the returned todos.
+/// `Accept: text/csv` returns the same todos as CSV, with the next page's
+/// cursor in X-Next-Cursor. X-Total-Count counts the matching todos across
+/// all pages. `updated_since` only returns todos changed after it, and
+/// X-Server-Time is the value to pass as `updated_since` on the next call.
+pub async fn list_todos(
+    todos: web::Data<dyn TodoRepository>,
+    sort: web::Data<TodoSort>,
+    user: AuthUser,
+    query: web::Query<ListTodosQuery>,
+    req: HttpRequest,
+) -> Result<HttpResponse, ApiError> {
+    let format = ExportFormat::negotiate(&req)?;
+    match format {
+        ExportFormat::Csv
+            if query.fields.is_some() || query.envelope.unwrap_or(false) || query.description.is_some() =>
+        {
+            return Err(ApiError::BadRequest(
+                "fields, envelope and description are not supported for CSV".to_string(),
+            ));
+        }
+        ExportFormat::Xml if query.envelope.unwrap_or(false) => {
+            return Err(ApiError::BadRequest("envelope is only supported for JSON".to_string()));
+        }
+        _ => {}
+    }
+    let fields = Fields::parse(query.fields.as_deref())?;
+    let description = DescriptionMode::parse(query.description.as_deref())?;
+    let paginated = query.limit.is_some() || query.after.is_some();
+    let limit = if paginated { Some(page_size(query.limit)?) } else { None };
+    let sort = sort_param(query.sort.as_deref(), **sort)?;
+    let after = query.after.as_deref().map(|c| Cursor::decode(c, sort)).transpose()?;
+    // Read before querying so the watermark never skips a change
+    let server_time = sync::server_time(Utc::now());
+
+    // Fetch one extra row to learn whether another page follows
+    let filter = TodoFilter {
+        sort,
+        after: after.map(|c| (c.key, c.id)),
+        limit: limit.map(|l| l + 1),
+        ..list_filter(&query)?
+    };
+    let mut page = todos.list(user, &filter).await?;
+
+    let next_cursor = match limit {
+        Some(limit) if page.len() as i64 > limit => {
+            page.truncate(limit as usize);
+            page.last().map(|t| Cursor::after(t, sort).encode())
+        }
+        Some(_) => Some(String::new()),
+        None => None,
+    };
+
+    let mut response = HttpResponse::Ok();
+    if let Some(modified) = page.iter().map(|t| t.updated_at).max() {
+        if let Some(not_modified) = not_modified(&req, modified) {
+            return Ok(not_modified);
+        }
+        response.insert_header(last_modified(modified));
+    }
+    response.insert_header((VARY, "Accept"));
+    response.insert_header((TOTAL_COUNT_HEADER, todos.count(user, &filter).await?));
+    response.insert_header((SERVER_TIME_HEADER, server_time.to_rfc3339_opts(SecondsFormat::AutoSi, true)));
+
+    if format == ExportFormat::Csv {
+        if let Some(next_cursor) = next_cursor.filter(|c| !c.is_empty()) {
+            response.insert_header((NEXT_CURSOR_HEADER, next_cursor));
+        }
+        return Ok(response.content_type(format.content_type()).streaming(csv_stream(page)));
+    }
+
+    let page: Vec<TodoResponse> = page.into_iter().map(|t| description.apply(t.into())).collect();
+    if format == ExportFormat::Xml {
+        if let Some(next_cursor) = next_cursor.filter(|c| !c.is_empty()) {
+            response.insert_header((NEXT_CURSOR_HEADER, next_cursor));
+        }
+        let todos = page
+            .iter()
+            .map(|t| fields.as_ref().map_or_else(|| todo_value(t), |fields| fields.select(t)))
+            .collect::<Result<Vec<_>, _>>()?;
+        return Ok(response
+            .content_type(format.content_type())
+            .body(xml::document("todos", &serde_json::Value::Array(todos))));
+    }
+
+    if query.envelope.unwrap_or(false) {
+        let response = match fields {
+            None => response.json(Envelope::new(page, limit, next_cursor)),
+            Some(fields) => {
+                let todos = page.iter().map(|t| fields.select(t)).collect::<Result<Vec<_>, _>>()?;
+                response.json(Envelope::new(todos, limit, next_cursor))
+            }
+        };
+        return Ok(response);
+    }
+
+    let response = match (fields, next_cursor) {
+        (None, None) => response.json(page),
+        (None, Some(next_cursor)) => response.json(TodoPage { todos: page, next_cursor }),
+        (Some(fields), next_cursor) => {
+            let todos = page.iter().map(|t| fields.select(t)).collect::<Result<Vec<_>, _>>()?;
+            match next_cursor {
+                Some(next_cursor) => response.json(TodoPage { todos, next_cursor }),
+                None => response.json(todos),
+            }
+        }
+    };
+    Ok(response)
+}
+
+/// The caller's todos split into open and completed columns for board views,
+/// read with one query and each column in the requested sort. Each column
+/// holds at most `limit` todos; the rest can be paged through with
+/// GET /api/todos?completed=...
+pub async fn todo_board(
+    todos: web::Data<dyn TodoRepository>,
+    sort: web::Data<TodoSort>,
+    user: AuthUser,
+    query: web::Query<BoardQuery>,
+) -> Result<HttpResponse, ApiError> {
+    let limit = page_size(query.limit)? as usize;
+    let filter = TodoFilter {
+        tag: query.tag.clone(),
+        archived: query.archived.unwrap_or(false),
+        sort: sort_param(query.sort.as_deref(), **sort)?,
+        ..TodoFilter::default()
+    };
+
+    let mut board = Board::default();
+    for todo in todos.list(user, &filter).await? {
+        let column = if todo.completed { &mut board.completed } else { &mut board.pending };
+        if column.len() < limit {
+            column.push(TodoResponse::from(todo));
+        }
+    }
+    Ok(HttpResponse::Ok().json(board))
+}
+
+/// HEAD /api/todos: only the X-Total-Count a GET with the same filters would
+/// send, for badges that need counts but not the todos themselves
+pub async fn count_todos(
+    todos: web::Data<dyn TodoRepository>,
+    user: AuthUser,
+    query: web::Query<ListTodosQuery>,
+) -> Result<HttpResponse, ApiError> {
+    let total = todos.count(user, &list_filter(&query)?).await?;
+    Ok(HttpResponse::Ok().insert_header((TOTAL_COUNT_HEADER, total)).finish())
+}
+
+/// Get a single todo by ID as JSON, CSV or XML depending on Accept, optionally
+/// trimmed to the requested `fields` and with a shortened description for
+/// `description=summary`. Answers 304 Not Modified when If-Modified-Since is not older than the todo.
 pub async fn get_todo(
-    pool: web::Data<PgPool>,
+    todos: web::Data<dyn TodoRepository>,
+    user: AuthUser,
     id: web::Path<Uuid>,
+    query: web::Query<GetTodoQuery>,
+    req: HttpRequest,
 ) -> Result<HttpResponse, ApiError> {
-    let todo = sqlx::query_as::<_, Todo>(
-        "SELECT id, title, description, completed, created_at, updated_at FROM todos WHERE id = $1"
-    )
-    .bind(id.into_inner())
-    .fetch_one(pool.get_ref())
-    .await?;
+    let format = ExportFormat::negotiate(&req)?;
+    if format == ExportFormat::Csv && (query.fields.is_some() || query.description.is_some()) {
+        return Err(ApiError::BadRequest(
+            "fields and description are not supported for CSV".to_string(),
+        ));
+    }
+    let fields = Fields::parse(query.fields.as_deref())?;
+    let description = DescriptionMode::parse(query.description.as_deref())?;
+    let todo = authorize_todo(todos.get_ref(), user, id.into_inner(), Role::Viewer).await?;
 
-    Ok(HttpResponse::Ok().json(TodoResponse::from(todo)))
+    if let Some(not_modified) = not_modified(&req, todo.updated_at) {
+        return Ok(not_modified);
+    }
+
+    let mut response = HttpResponse::Ok();
+    response.insert_header(last_modified(todo.updated_at));
+    response.insert_header((VARY, "Accept"));
+    if format == ExportFormat::Csv {
+        return Ok(response.content_type(format.content_type()).streaming(csv_stream(vec![todo])));
+    }
+
+    let todo = description.apply(TodoResponse::from(todo));
+    match (format, fields) {
+        (ExportFormat::Xml, fields) => {
+            let value = fields.map_or_else(|| todo_value(&todo), |fields| fields.select(&todo))?;
+            Ok(response.content_type(format.content_type()).body(xml::document("todo", &value)))
+        }
+        (_, Some(fields)) => Ok(response.json(fields.select(&todo)?)),
+        (_, None) => Ok(response.json(todo)),
+    }
+}
+
+/// Parse todo IDs sent as strings, naming the first one that is malformed
+fn parse_ids(ids: &[String]) -> Result<Vec<Uuid>, ApiError> {
+    ids.iter()
+        .map(|id| {
+            Uuid::parse_str(id.trim())
+                .map_err(|_| ApiError::BadRequest(format!("Invalid todo id '{}'", id)))
+        })
+        .collect()
+}
+
+/// Most IDs a single batch get may ask for
+const MAX_BATCH_GET_IDS: usize = 100;
+
+/// Fetch several todos by ID with one query, for views showing a known set of
+/// todos. IDs that are not todos the caller can see are listed in `missing`.
+pub async fn batch_get_todos(
+    todos: web::Data<dyn TodoRepository>,
+    user: AuthUser,
+    req: web::Json<BatchGetRequest>,
+) -> Result<HttpResponse, ApiError> {
+    if req.ids.len() > MAX_BATCH_GET_IDS {
+        return Err(ApiError::BadRequest(format!(
+            "At most {} todos can be fetched at once",
+            MAX_BATCH_GET_IDS
+        )));
+    }
+
+    let mut ids = parse_ids(&req.ids)?;
+    // Keep the first occurrence of each ID, in request order
+    let mut seen = HashSet::new();
+    ids.retain(|id| seen.insert(*id));
+
+    let mut found: HashMap<Uuid, Todo> = todos
+        .find_many(user, &ids)
+        .await?
+        .into_iter()
+        .map(|t| (t.id, t))
+        .collect();
+    let mut response = BatchGetResponse { todos: Vec::with_capacity(found.len()), missing: Vec::new() };
+    for id in ids {
+        match found.remove(&id) {
+            Some(todo) => response.todos.push(todo.into()),
+            None => response.missing.push(id),
+        }
+    }
+    Ok(HttpResponse::Ok().json(response))
+}
+
+/// Most IDs a single existence check may ask about
+const MAX_EXISTS_IDS: usize = 1000;
+
+/// Report which of the given IDs belong to todos the caller can see, so offline
+/// clients can sync without a GET per todo
+pub async fn todos_exist(
+    todos: web::Data<dyn TodoRepository>,
+    user: AuthUser,
+    req: web::Json<ExistsRequest>,
+) -> Result<HttpResponse, ApiError> {
+    if req.ids.len() > MAX_EXISTS_IDS {
+        return Err(ApiError::BadRequest(format!(
+            "At most {} ids can be checked at once",
+            MAX_EXISTS_IDS
+        )));
+    }
+
+    let ids = parse_ids(&req.ids)?;
+    let found = todos.existing(user, &ids).await?;
+    let exists: BTreeMap<Uuid, bool> = ids.iter().map(|id| (*id, found.contains(id))).collect();
+    Ok(HttpResponse::Ok().json(exists))
 }
 
-/// Create a new todo
+/// Longest search query accepted
+const MAX_SEARCH_LEN: usize = 200;
+
+/// Full-text search over the titles and descriptions of the caller's active
+/// todos, best match first. Each result carries its `rank`.
+pub async fn search_todos(
+    todos: web::Data<dyn TodoRepository>,
+    user: AuthUser,
+    query: web::Query<SearchQuery>,
+) -> Result<HttpResponse, ApiError> {
+    let q = query.q.as_deref().map(str::trim).unwrap_or_default();
+    if q.is_empty() {
+        return Err(ApiError::BadRequest("q must not be empty".to_string()));
+    }
+    if q.chars().count() > MAX_SEARCH_LEN {
+        return Err(ApiError::BadRequest(format!(
+            "q must be at most {} characters",
+            MAX_SEARCH_LEN
+        )));
+    }
+    let limit = page_size(query.limit)?;
+
+    let results: Vec<SearchResult> = todos
+        .search(user, q, limit)
+        .await?
+        .into_iter()
+        .map(|(todo, rank)| SearchResult { todo: todo.into(), rank })
+        .collect();
+    Ok(HttpResponse::Ok().json(results))
+}
+
+/// Create a new todo from a JSON body or a urlencoded form. Requests carrying
+/// an Idempotency-Key that was already seen get the original response instead
+/// of creating another todo. With STRICT_UNIQUE_TITLES or
+/// `allow_duplicate=false`, a title another open todo has is refused with 409.
 pub async fn create_todo(
-    pool: web::Data<PgPool>,
-    req: web::Json<CreateTodoRequest>,
+    todos: web::Data<dyn TodoRepository>,
+    lists: web::Data<dyn ListRepository>,
+    broker: web::Data<Broker>,
+    ttl: web::Data<IdempotencyTtl>,
+    unique: web::Data<UniqueTitles>,
+    user: AuthUser,
+    actor: Actor,
+    http_req: HttpRequest,
+    query: web::Query<TitleQuery>,
+    body: web::Either<web::Json<CreateTodoRequest>, web::Form<CreateTodoForm>>,
 ) -> Result<HttpResponse, ApiError> {
-    if req.title.trim().is_empty() {
-        return Err(ApiError::BadRequest("Title cannot be empty".to_string()));
+    let req = match body {
+        web::Either::Left(json) => json.into_inner(),
+        web::Either::Right(form) => CreateTodoRequest::from(form.into_inner()),
+    };
+    validate_todo(Some(&req.title), req.description.as_deref(), req.recurrence_interval)?;
+
+    let idempotency_key = match idempotency::idempotency_key(&http_req)? {
+        Some(key) => {
+            let request = serde_json::to_value(&req)
+                .map_err(|e| ApiError::InternalServerError(format!("Failed to encode request: {}", e)))?;
+            if let Some(response) =
+                idempotency::replay(todos.get_ref(), user, &key, &request, **ttl).await?
+            {
+                let mut created = HttpResponse::Created();
+                if let Some(id) = response.get("id").and_then(|id| id.as_str()) {
+                    created.insert_header(todo_location(id));
+                }
+                return Ok(created.json(response));
+            }
+            Some(IdempotencyKey { key, request })
+        }
+        None => None,
+    };
+
+    // Adding to a list needs write access to it
+    if let Some(list_id) = req.list_id {
+        authorize_list(lists.get_ref(), user, list_id, Role::Editor).await?;
+    }
+    if let Some(parent_id) = req.parent_id {
+        validate_parent(todos.get_ref(), user, None, parent_id).await?;
     }
 
-    let id = Uuid::new_v4();
-    let now = Utc::now();
+    let new = NewTodo {
+        tags: normalize_tags(req.tags.as_deref().unwrap_or_default()),
+        title: req.title,
+        description: req.description,
+        list_id: req.list_id,
+        parent_id: req.parent_id,
+        due_date: req.due_date,
+        recurrence: req.recurrence.unwrap_or_default(),
+        recurrence_interval: req.recurrence_interval.unwrap_or(1),
+        remind_at: req.remind_at,
+        unique_title: unique.required(query.allow_duplicate),
+        actor,
+    };
+    let todo = todos.create(user, new, idempotency_key).await?;
 
-    let todo = sqlx::query_as::<_, Todo>(
-        "INSERT INTO todos (id, title, description, completed, created_at, updated_at)
-         VALUES ($1, $2, $3, $4, $5, $6)
-         RETURNING id, title, description, completed, created_at, updated_at"
-    )
-    .bind(id)
-    .bind(&req.title)
-    .bind(&req.description)
-    .bind(false)
-    .bind(now)
-    .bind(now)
-    .fetch_one(pool.get_ref())
-    .await?;
+    broker.publish(TodoEvent::created(&todo));
+    Ok(HttpResponse::Created().insert_header(todo_location(todo.id)).json(TodoResponse::from(todo)))
+}
+
+/// Location header pointing at a newly created todo
+fn todo_location(id: impl std::fmt::Display) -> (HeaderName, String) {
+    (LOCATION, format!("/api/todos/{}", id))
+}
 
-    Ok(HttpResponse::Created().json(TodoResponse::from(todo)))
+/// `title` with `suffix` appended, shortened first so the result is at most
+/// MAX_TITLE_LEN characters
+fn with_suffix(title: &str, suffix: &str) -> String {
+    let keep = MAX_TITLE_LEN.saturating_sub(suffix.chars().count());
+    let title: String = title.chars().take(keep).collect();
+    format!("{}{}", title.trim_end(), suffix)
 }
 
-/// Update a todo
+/// The title for a copy of a todo titled `title`: " (copy)" appended, or
+/// " (copy 2)", " (copy 3)" and so on when `user_id` already has an open todo
+/// with that title
+async fn free_copy_title(todos: &dyn TodoRepository, user_id: Option<Uuid>, title: &str) -> Result<String, ApiError> {
+    let mut candidate = with_suffix(title, " (copy)");
+    let mut n = 1;
+    while todos.open_titled(user_id, &candidate).await?.is_some() {
+        n += 1;
+        candidate = with_suffix(title, &format!(" (copy {})", n));
+    }
+    Ok(candidate)
+}
+
+/// Create an open copy of a todo the caller can see, with " (copy)" appended
+/// to its title unless `suffix=false`; see `free_copy_title`. The copy belongs to the caller; it stays
+/// in the source's list only if they may add todos to it, and under the same
+/// parent only if they can see the parent.
+pub async fn duplicate_todo(
+    todos: web::Data<dyn TodoRepository>,
+    lists: web::Data<dyn ListRepository>,
+    broker: web::Data<Broker>,
+    unique: web::Data<UniqueTitles>,
+    user: AuthUser,
+    actor: Actor,
+    id: web::Path<Uuid>,
+    query: web::Query<DuplicateQuery>,
+) -> Result<HttpResponse, ApiError> {
+    let source = authorize_todo(todos.get_ref(), user, id.into_inner(), Role::Viewer).await?;
+
+    let list_id = match source.list_id {
+        Some(list_id) if lists.role(user, list_id).await? >= Some(Role::Editor) => Some(list_id),
+        _ => None,
+    };
+    let parent_id = match source.parent_id {
+        Some(parent_id) if todos.find(user, parent_id).await?.is_some() => Some(parent_id),
+        _ => None,
+    };
+
+    let title = if query.suffix.unwrap_or(true) {
+        free_copy_title(todos.get_ref(), user.user_id, &source.title).await?
+    } else {
+        source.title
+    };
+    validate_todo(Some(&title), source.description.as_deref(), Some(source.recurrence_interval))?;
+    let new = NewTodo {
+        title,
+        description: source.description,
+        tags: source.tags,
+        list_id,
+        parent_id,
+        due_date: source.due_date,
+        recurrence: Recurrence::from_db(&source.recurrence).unwrap_or_default(),
+        recurrence_interval: source.recurrence_interval,
+        remind_at: source.remind_at,
+        unique_title: unique.required(None),
+        actor,
+    };
+    let todo = todos.create(user, new, None).await?;
+
+    broker.publish(TodoEvent::created(&todo));
+    Ok(HttpResponse::Created().insert_header(todo_location(todo.id)).json(TodoResponse::from(todo)))
+}
+
+/// The changes an update request makes to `existing`; fields left out of the
+/// request keep their value. `unique_title` says whether a rename must keep
+/// the title free among open todos.
+fn update_changes(existing: &Todo, req: UpdateTodoRequest, unique_title: bool, actor: Actor) -> TodoChanges {
+    let title = req.title.unwrap_or_else(|| existing.title.clone());
+    let completed = req.completed.unwrap_or(existing.completed);
+    TodoChanges {
+        unique_title: unique_title && renames_open_todo(existing, &title, completed),
+        title,
+        description: req.description.apply(existing.description.clone()),
+        completed,
+        tags: match &req.tags {
+            Some(tags) => normalize_tags(tags),
+            None => existing.tags.clone(),
+        },
+        parent_id: req.parent_id.apply(existing.parent_id),
+        due_date: req.due_date.apply(existing.due_date),
+        recurrence: match req.recurrence {
+            Some(recurrence) => recurrence.as_str().to_string(),
+            None => existing.recurrence.clone(),
+        },
+        recurrence_interval: req.recurrence_interval.unwrap_or(existing.recurrence_interval),
+        remind_at: req.remind_at.apply(existing.remind_at),
+        version: req.version.unwrap_or(existing.version),
+        actor,
+    }
+}
+
+/// Update a todo. Fields left out of the body keep their value and nullable
+/// fields sent as `null` are cleared. Completing a recurring todo also creates
+/// its next occurrence, whose ID is returned as `next_occurrence_id`. Renames
+/// follow the same title rule as `create_todo`.
 pub async fn update_todo(
-    pool: web::Data<PgPool>,
+    todos: web::Data<dyn TodoRepository>,
+    broker: web::Data<Broker>,
+    unique: web::Data<UniqueTitles>,
+    user: AuthUser,
+    actor: Actor,
     id: web::Path<Uuid>,
+    query: web::Query<TitleQuery>,
     req: web::Json<UpdateTodoRequest>,
 ) -> Result<HttpResponse, ApiError> {
     let id = id.into_inner();
-    let now = Utc::now();
 
-    // First, check if the todo exists
-    let existing = sqlx::query_as::<_, Todo>(
-        "SELECT id, title, description, completed, created_at, updated_at FROM todos WHERE id = $1"
-    )
-    .bind(id)
-    .fetch_optional(pool.get_ref())
-    .await?;
+    validate_todo(
+        req.title.as_deref(),
+        req.description.value().map(String::as_str),
+        req.recurrence_interval,
+    )?;
 
-    if existing.is_none() {
-        return Err(ApiError::NotFound(format!("Todo with id {} not found", id)));
+    // First, check the todo exists and the caller may change it
+    let existing = authorize_todo(todos.get_ref(), user, id, Role::Editor).await?;
+    if let Some(&parent_id) = req.parent_id.value() {
+        validate_parent(todos.get_ref(), user, Some(id), parent_id).await?;
     }
 
-    let existing = existing.unwrap();
+    let changes = update_changes(&existing, req.into_inner(), unique.required(query.allow_duplicate), actor);
+    let updated = todos.update(&existing, changes).await?;
+    Ok(updated_response(&broker, updated))
+}
 
-    // Update fields, keeping existing values if not provided
-    let title = req.title.as_ref().unwrap_or(&existing.title).clone();
-    let description = req.description.as_ref().or(existing.description.as_ref()).cloned();
-    let completed = req.completed.unwrap_or(existing.completed);
+/// Most todos a single batch update may change
+const MAX_BATCH_UPDATE: usize = 100;
+
+/// Update several todos in one transaction, each entry taking the fields of
+/// `update_todo`. An ID that is not a todo the caller can see fails the whole
+/// batch with 404, unless `partial=true` skips it and lists it in `missing`.
+/// Any other failure, such as a version conflict, still fails every update.
+pub async fn batch_update_todos(
+    todos: web::Data<dyn TodoRepository>,
+    broker: web::Data<Broker>,
+    unique: web::Data<UniqueTitles>,
+    user: AuthUser,
+    actor: Actor,
+    query: web::Query<BatchUpdateQuery>,
+    req: web::Json<Vec<BatchUpdateItem>>,
+) -> Result<HttpResponse, ApiError> {
+    let items = req.into_inner();
+    if items.len() > MAX_BATCH_UPDATE {
+        return Err(ApiError::BadRequest(format!(
+            "At most {} todos can be updated at once",
+            MAX_BATCH_UPDATE
+        )));
+    }
+    let mut seen = HashSet::new();
+    if let Some(item) = items.iter().find(|item| !seen.insert(item.id)) {
+        return Err(ApiError::BadRequest(format!("Todo {} is listed more than once", item.id)));
+    }
+
+    let partial = query.partial.unwrap_or(false);
+    let unique_title = unique.required(query.allow_duplicate);
+    let mut updates = Vec::with_capacity(items.len());
+    let mut missing = Vec::new();
+    for BatchUpdateItem { id, changes } in items {
+        validate_todo(
+            changes.title.as_deref(),
+            changes.description.value().map(String::as_str),
+            changes.recurrence_interval,
+        )?;
+
+        let existing = match authorize_todo(todos.get_ref(), user, id, Role::Editor).await {
+            Ok(existing) => existing,
+            Err(ApiError::NotFound(_)) if partial => {
+                missing.push(id);
+                continue;
+            }
+            Err(e) => return Err(e),
+        };
+        if let Some(&parent_id) = changes.parent_id.value() {
+            validate_parent(todos.get_ref(), user, Some(id), parent_id).await?;
+        }
+        let changes = update_changes(&existing, changes, unique_title, actor);
+        updates.push((existing, changes));
+    }
 
-    let todo = sqlx::query_as::<_, Todo>(
-        "UPDATE todos SET title = $1, description = $2, completed = $3, updated_at = $4
-         WHERE id = $5
-         RETURNING id, title, description, completed, created_at, updated_at"
-    )
-    .bind(title)
-    .bind(description)
-    .bind(completed)
-    .bind(now)
-    .bind(id)
-    .fetch_one(pool.get_ref())
-    .await?;
+    let updated = todos.update_many(updates).await?;
+    let responses: Vec<TodoResponse> = updated.into_iter().map(|u| publish_updated(&broker, u)).collect();
 
+    if partial {
+        Ok(HttpResponse::Ok().json(BatchUpdateResponse { todos: responses, missing }))
+    } else {
+        Ok(HttpResponse::Ok().json(responses))
+    }
+}
+
+/// Change only the title of a todo, for inline editing. Follows the same
+/// title rule as `create_todo`.
+pub async fn update_todo_title(
+    todos: web::Data<dyn TodoRepository>,
+    broker: web::Data<Broker>,
+    unique: web::Data<UniqueTitles>,
+    user: AuthUser,
+    actor: Actor,
+    id: web::Path<Uuid>,
+    query: web::Query<TitleQuery>,
+    req: web::Json<UpdateTitleRequest>,
+) -> Result<HttpResponse, ApiError> {
+    let req = req.into_inner();
+    validate_todo(Some(&req.title), None, None)?;
+
+    let existing = authorize_todo(todos.get_ref(), user, id.into_inner(), Role::Editor).await?;
+    let changes = TodoChanges {
+        unique_title: unique.required(query.allow_duplicate)
+            && renames_open_todo(&existing, &req.title, existing.completed),
+        title: req.title,
+        version: req.version.unwrap_or(existing.version),
+        ..TodoChanges::keep(&existing, actor)
+    };
+
+    let updated = todos.update(&existing, changes).await?;
+    Ok(updated_response(&broker, updated))
+}
+
+/// Change only the description of a todo, for inline editing. `null` clears it.
+pub async fn update_todo_description(
+    todos: web::Data<dyn TodoRepository>,
+    broker: web::Data<Broker>,
+    user: AuthUser,
+    actor: Actor,
+    id: web::Path<Uuid>,
+    req: web::Json<UpdateDescriptionRequest>,
+) -> Result<HttpResponse, ApiError> {
+    let req = req.into_inner();
+    if matches!(req.description, Patch::Missing) {
+        return Err(ApiError::Validation(vec![FieldError::new(
+            "description",
+            "description is required; send null to clear it",
+        )]));
+    }
+    validate_todo(None, req.description.value().map(String::as_str), None)?;
+
+    let existing = authorize_todo(todos.get_ref(), user, id.into_inner(), Role::Editor).await?;
+    let changes = TodoChanges {
+        description: req.description.apply(None),
+        version: req.version.unwrap_or(existing.version),
+        ..TodoChanges::keep(&existing, actor)
+    };
+
+    let updated = todos.update(&existing, changes).await?;
+    Ok(updated_response(&broker, updated))
+}
+
+/// Mark a todo as completed
+pub async fn complete_todo(
+    todos: web::Data<dyn TodoRepository>,
+    broker: web::Data<Broker>,
+    user: AuthUser,
+    actor: Actor,
+    id: web::Path<Uuid>,
+) -> Result<HttpResponse, ApiError> {
+    let existing = authorize_todo(todos.get_ref(), user, id.into_inner(), Role::Editor).await?;
+    let updated = todos.set_completed(&existing, true, actor).await?;
+    Ok(updated_response(&broker, updated))
+}
+
+/// Mark a todo as not completed
+pub async fn uncomplete_todo(
+    todos: web::Data<dyn TodoRepository>,
+    broker: web::Data<Broker>,
+    user: AuthUser,
+    actor: Actor,
+    id: web::Path<Uuid>,
+) -> Result<HttpResponse, ApiError> {
+    let existing = authorize_todo(todos.get_ref(), user, id.into_inner(), Role::Editor).await?;
+    let updated = todos.set_completed(&existing, false, actor).await?;
+    Ok(updated_response(&broker, updated))
+}
+
+/// Archive a todo, hiding it from the default list whether or not it is completed
+pub async fn archive_todo(
+    todos: web::Data<dyn TodoRepository>,
+    broker: web::Data<Broker>,
+    user: AuthUser,
+    actor: Actor,
+    id: web::Path<Uuid>,
+) -> Result<HttpResponse, ApiError> {
+    let existing = authorize_todo(todos.get_ref(), user, id.into_inner(), Role::Editor).await?;
+    let todo = todos.set_archived(&existing, true, actor).await?;
+    broker.publish(TodoEvent::updated(&todo));
+    Ok(HttpResponse::Ok().json(TodoResponse::from(todo)))
+}
+
+/// Bring an archived todo back to the default list
+pub async fn unarchive_todo(
+    todos: web::Data<dyn TodoRepository>,
+    broker: web::Data<Broker>,
+    user: AuthUser,
+    actor: Actor,
+    id: web::Path<Uuid>,
+) -> Result<HttpResponse, ApiError> {
+    let existing = authorize_todo(todos.get_ref(), user, id.into_inner(), Role::Editor).await?;
+    let todo = todos.set_archived(&existing, false, actor).await?;
+    broker.publish(TodoEvent::updated(&todo));
     Ok(HttpResponse::Ok().json(TodoResponse::from(todo)))
 }
 
-/// Delete a todo
+/// Set the manual order of the caller's todos. `ids` must name every todo they
+/// own exactly once, first to last; list them with `sort=position`.
+pub async fn reorder_todos(
+    todos: web::Data<dyn TodoRepository>,
+    user: AuthUser,
+    actor: Actor,
+    body: web::Json<ReorderRequest>,
+) -> Result<HttpResponse, ApiError> {
+    todos.reorder(user, &body.ids, actor).await?;
+    Ok(HttpResponse::NoContent().finish())
+}
+
+/// Delete a todo. Subtasks are deleted with it or block the delete, depending
+/// on the configured policy. The response carries a token that undoes the
+/// deletion within UNDO_WINDOW, also sent as the X-Undo-Token header.
 pub async fn delete_todo(
-    pool: web::Data<PgPool>,
+    todos: web::Data<dyn TodoRepository>,
+    broker: web::Data<Broker>,
+    policy: web::Data<SubtaskDeletePolicy>,
+    window: web::Data<UndoWindow>,
+    user: AuthUser,
+    actor: Actor,
     id: web::Path<Uuid>,
 ) -> Result<HttpResponse, ApiError> {
     let id = id.into_inner();
+    authorize_todo(todos.get_ref(), user, id, Role::Editor).await?;
 
-    let result = sqlx::query("DELETE FROM todos WHERE id = $1")
-        .bind(id)
-        .execute(pool.get_ref())
-        .await?;
+    if **policy == SubtaskDeletePolicy::Block && todos.has_subtasks(id).await? {
+        return Err(ApiError::Conflict(format!(
+            "Todo with id {} has subtasks; delete them first",
+            id
+        )));
+    }
+
+    // The todo may have been deleted since it was authorized
+    let undo = window.issue(Utc::now());
+    let todo = todos
+        .delete(user, id, actor, &undo)
+        .await?
+        .ok_or_else(|| todo_not_found(id))?;
+
+    broker.publish(TodoEvent::deleted(&todo));
+    Ok(HttpResponse::Ok()
+        .insert_header((UNDO_TOKEN_HEADER, undo.token.as_str()))
+        .json(DeleteResponse { undo_token: undo.token, undo_expires_at: undo.expires_at }))
+}
 
-    if result.rows_affected() == 0 {
-        return Err(ApiError::NotFound(format!("Todo with id {} not found", id)));
+#[cfg(test)]
+mod tests {
+    use actix_web::dev::ServiceResponse;
+    use actix_web::http::{header, Method, StatusCode};
+    use actix_web::test::{self, TestRequest};
+    use futures_util::future::join;
+    use serde_json::{json, Value};
+    use std::time::Duration;
+    use uuid::Uuid;
+
+    use super::{MAX_BATCH_GET_IDS, TOTAL_COUNT_HEADER, UNDO_TOKEN_HEADER};
+    use crate::auth::{AuthUser, ACTOR_HEADER};
+    use crate::handlers::idempotency::IDEMPOTENCY_KEY_HEADER;
+    use crate::testing;
+
+    #[actix_web::test]
+    async fn created_todo_can_be_read_back() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+
+        let req = TestRequest::post()
+            .uri("/api/todos")
+            .set_json(json!({"title": "Write tests", "tags": ["dev", " dev ", ""]}))
+            .to_request();
+        let res = test::call_service(&app, req).await;
+        assert_eq!(res.status(), StatusCode::CREATED);
+        let location = res.headers().get(header::LOCATION).unwrap().to_str().unwrap().to_string();
+        let created: Value = test::read_body_json(res).await;
+        assert_eq!(created["title"], "Write tests");
+        assert_eq!(created["tags"], json!(["dev"]));
+        assert_eq!(location, format!("/api/todos/{}", created["id"].as_str().unwrap()));
+
+        let res = test::call_service(&app, TestRequest::get().uri(&location).to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+        let fetched: Value = test::read_body_json(res).await;
+        assert_eq!(fetched, created);
     }
 
-    Ok(HttpResponse::NoContent().finish())
+    #[actix_web::test]
+    async fn list_counts_matching_todos() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        for title in ["One", "Two", "Three"] {
+            let req = TestRequest::post().uri("/api/todos").set_json(json!({"title": title})).to_request();
+            assert_eq!(test::call_service(&app, req).await.status(), StatusCode::CREATED);
+        }
+
+        let res = test::call_service(&app, TestRequest::get().uri("/api/todos?limit=2").to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+        assert_eq!(res.headers().get(TOTAL_COUNT_HEADER).unwrap(), "3");
+        let page: Value = test::read_body_json(res).await;
+        assert_eq!(page["todos"].as_array().unwrap().len(), 2);
+        assert!(!page["next_cursor"].as_str().unwrap().is_empty());
+    }
+
+    fn total<B>(res: &ServiceResponse<B>) -> &str {
+        res.headers().get(TOTAL_COUNT_HEADER).unwrap().to_str().unwrap()
+    }
+
+    #[actix_web::test]
+    async fn total_count_follows_the_filters_not_the_page() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let mut ids = Vec::new();
+        for (title, tags) in [
+            ("Dishes", vec!["home"]),
+            ("Laundry", vec!["home"]),
+            ("Vacuum", vec!["home"]),
+            ("Report", vec!["work"]),
+            ("Email", vec![]),
+        ] {
+            let req = TestRequest::post().uri("/api/todos").set_json(json!({"title": title, "tags": tags}));
+            let created: Value = test::call_and_read_body_json(&app, req.to_request()).await;
+            ids.push(created["id"].as_str().unwrap().to_string());
+        }
+        let req = TestRequest::post().uri(&format!("/api/todos/{}/complete", ids[0]));
+        assert_eq!(test::call_service(&app, req.to_request()).await.status(), StatusCode::OK);
+
+        for (uri, expected) in [
+            ("/api/todos", "5"),
+            ("/api/todos?tag=home&limit=1", "3"),
+            ("/api/todos?tag=home&completed=false", "2"),
+            ("/api/todos?tag=work", "1"),
+            ("/api/todos?tag=none", "0"),
+        ] {
+            let res = test::call_service(&app, TestRequest::get().uri(uri).to_request()).await;
+            assert_eq!(total(&res), expected, "{}", uri);
+            let head = TestRequest::default().method(Method::HEAD).uri(uri);
+            let res = test::call_service(&app, head.to_request()).await;
+            assert_eq!(total(&res), expected, "HEAD {}", uri);
+        }
+    }
+
+    #[actix_web::test]
+    async fn invalid_fields_are_all_reported() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+
+        let req = TestRequest::post()
+            .uri("/api/todos")
+            .set_json(json!({"title": " ", "description": "x".repeat(10_001)}))
+            .to_request();
+        let res = test::call_service(&app, req).await;
+        assert_eq!(res.status(), StatusCode::BAD_REQUEST);
+        let body: Value = test::read_body_json(res).await;
+        let fields: Vec<&str> = body["fields"]
+            .as_array()
+            .unwrap()
+            .iter()
+            .map(|f| f["field"].as_str().unwrap())
+            .collect();
+        assert_eq!(fields, ["title", "description"]);
+    }
+
+    #[actix_web::test]
+    async fn stale_version_is_a_conflict() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let req = TestRequest::post().uri("/api/todos").set_json(json!({"title": "Edit me"})).to_request();
+        let created: Value = test::call_and_read_body_json(&app, req).await;
+        let uri = format!("/api/todos/{}", created["id"].as_str().unwrap());
+
+        let req = TestRequest::put().uri(&uri).set_json(json!({"title": "First", "version": 1})).to_request();
+        let updated: Value = test::call_and_read_body_json(&app, req).await;
+        assert_eq!(updated["version"], 2);
+
+        let req = TestRequest::put().uri(&uri).set_json(json!({"title": "Second", "version": 1})).to_request();
+        assert_eq!(test::call_service(&app, req).await.status(), StatusCode::CONFLICT);
+    }
+
+    #[actix_web::test]
+    async fn deleted_todo_is_gone_until_undone() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let req = TestRequest::post().uri("/api/todos").set_json(json!({"title": "Delete me"})).to_request();
+        let created: Value = test::call_and_read_body_json(&app, req).await;
+        let uri = format!("/api/todos/{}", created["id"].as_str().unwrap());
+
+        let res = test::call_service(&app, TestRequest::delete().uri(&uri).to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+        let token = res.headers().get(UNDO_TOKEN_HEADER).unwrap().to_str().unwrap().to_string();
+        let res = test::call_service(&app, TestRequest::get().uri(&uri).to_request()).await;
+        assert_eq!(res.status(), StatusCode::NOT_FOUND);
+
+        let req = TestRequest::post().uri("/api/todos/undo").set_json(json!({"token": token})).to_request();
+        assert_eq!(test::call_service(&app, req).await.status(), StatusCode::OK);
+        let res = test::call_service(&app, TestRequest::get().uri(&uri).to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+    }
+
+    fn create(title: &str) -> TestRequest {
+        TestRequest::post().uri("/api/todos").set_json(json!({"title": title}))
+    }
+
+    #[actix_web::test]
+    async fn titles_may_repeat_by_default() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let first: Value = test::call_and_read_body_json(&app, create("Deploy v2").to_request()).await;
+        let res = test::call_service(&app, create("Deploy v2").to_request()).await;
+        assert_eq!(res.status(), StatusCode::CREATED);
+
+        let uri = format!("/api/todos/{}/duplicate?suffix=false", first["id"].as_str().unwrap());
+        let res = test::call_service(&app, TestRequest::post().uri(&uri).to_request()).await;
+        assert_eq!(res.status(), StatusCode::CREATED);
+
+        let uri = format!("/api/todos/{}/complete", first["id"].as_str().unwrap());
+        let res = test::call_service(&app, TestRequest::post().uri(&uri).to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+        let uri = format!("/api/todos/{}/uncomplete", first["id"].as_str().unwrap());
+        let res = test::call_service(&app, TestRequest::post().uri(&uri).to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+    }
+
+    #[actix_web::test]
+    async fn strict_titles_name_the_clashing_todo() {
+        let repositories = testing::repositories();
+        let config = testing::config(&[("STRICT_UNIQUE_TITLES", "true")]);
+        let app = test::init_service(testing::app(config, &repositories)).await;
+        let first: Value = test::call_and_read_body_json(&app, create("Deploy v2").to_request()).await;
+        let first_id = first["id"].as_str().unwrap();
+
+        let res = test::call_service(&app, create(" deploy V2 ").to_request()).await;
+        assert_eq!(res.status(), StatusCode::CONFLICT);
+        let body: Value = test::read_body_json(res).await;
+        assert_eq!(body["existing_id"], first_id);
+
+        // Renaming onto the title clashes too, unlike other edits
+        let other: Value = test::call_and_read_body_json(&app, create("Release").to_request()).await;
+        let uri = format!("/api/todos/{}/title", other["id"].as_str().unwrap());
+        let req = TestRequest::patch().uri(&uri).set_json(json!({"title": "DEPLOY V2"})).to_request();
+        assert_eq!(test::call_service(&app, req).await.status(), StatusCode::CONFLICT);
+        let req = TestRequest::patch().uri(&uri).set_json(json!({"title": "release"})).to_request();
+        assert_eq!(test::call_service(&app, req).await.status(), StatusCode::OK);
+
+        // Completed todos free their title, and reopening is never refused
+        let uri = format!("/api/todos/{}/complete", first_id);
+        let res = test::call_service(&app, TestRequest::post().uri(&uri).to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+        let res = test::call_service(&app, create("Deploy v2").to_request()).await;
+        assert_eq!(res.status(), StatusCode::CREATED);
+        let uri = format!("/api/todos/{}/uncomplete", first_id);
+        let res = test::call_service(&app, TestRequest::post().uri(&uri).to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+    }
+
+    #[test]
+    fn copy_suffix_fits_the_title_limit() {
+        assert_eq!(super::with_suffix("Deploy v2", " (copy)"), "Deploy v2 (copy)");
+        let long = format!("{} x", "a".repeat(247));
+        let copy = super::with_suffix(&long, " (copy)");
+        assert_eq!(copy, format!("{} (copy)", "a".repeat(247)));
+        let copy = super::with_suffix(&"é".repeat(255), " (copy 12)");
+        assert_eq!(copy.chars().count(), 255);
+        assert!(copy.ends_with("é (copy 12)"));
+    }
+
+    #[actix_web::test]
+    async fn duplicates_take_the_next_free_copy_title() {
+        let repositories = testing::repositories();
+        let config = testing::config(&[("STRICT_UNIQUE_TITLES", "true")]);
+        let app = test::init_service(testing::app(config, &repositories)).await;
+        let source: Value = test::call_and_read_body_json(&app, create("Deploy v2").to_request()).await;
+        let uri = format!("/api/todos/{}/duplicate", source["id"].as_str().unwrap());
+
+        for expected in ["Deploy v2 (copy)", "Deploy v2 (copy 2)", "Deploy v2 (copy 3)"] {
+            let res = test::call_service(&app, TestRequest::post().uri(&uri).to_request()).await;
+            assert_eq!(res.status(), StatusCode::CREATED);
+            let copy: Value = test::read_body_json(res).await;
+            assert_eq!(copy["title"], expected);
+        }
+    }
+
+    #[actix_web::test]
+    async fn duplicating_a_long_title_shortens_it() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let title = "t".repeat(super::MAX_TITLE_LEN);
+        let source: Value = test::call_and_read_body_json(&app, create(&title).to_request()).await;
+
+        let uri = format!("/api/todos/{}/duplicate", source["id"].as_str().unwrap());
+        let res = test::call_service(&app, TestRequest::post().uri(&uri).to_request()).await;
+        assert_eq!(res.status(), StatusCode::CREATED);
+        let copy: Value = test::read_body_json(res).await;
+        let copy = copy["title"].as_str().unwrap();
+        assert_eq!(copy.chars().count(), super::MAX_TITLE_LEN);
+        assert!(copy.ends_with("t (copy)"));
+    }
+
+    #[actix_web::test]
+    async fn allow_duplicate_false_checks_one_request() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let first: Value = test::call_and_read_body_json(&app, create("Deploy v2").to_request()).await;
+
+        let req = TestRequest::post()
+            .uri("/api/todos?allow_duplicate=false")
+            .set_json(json!({"title": "Deploy v2"}))
+            .to_request();
+        let res = test::call_service(&app, req).await;
+        assert_eq!(res.status(), StatusCode::CONFLICT);
+        let body: Value = test::read_body_json(res).await;
+        assert_eq!(body["existing_id"], first["id"]);
+
+        let res = test::call_service(&app, create("Deploy v2").to_request()).await;
+        assert_eq!(res.status(), StatusCode::CREATED);
+    }
+
+    #[actix_web::test]
+    async fn concurrent_strict_creates_let_one_through() {
+        let repositories = testing::repositories();
+        let config = testing::config(&[("STRICT_UNIQUE_TITLES", "true")]);
+        let app = test::init_service(testing::app(config, &repositories)).await;
+
+        let (a, b) = join(
+            test::call_service(&app, create("Deploy v2").to_request()),
+            test::call_service(&app, create("Deploy v2").to_request()),
+        )
+        .await;
+        let mut statuses = [a.status(), b.status()];
+        statuses.sort();
+        assert_eq!(statuses, [StatusCode::CREATED, StatusCode::CONFLICT]);
+    }
+
+    #[actix_web::test]
+    async fn completing_a_recurring_todo_twice_creates_one_occurrence() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let req = TestRequest::post()
+            .uri("/api/todos")
+            .set_json(json!({"title": "Water plants", "recurrence": "daily", "due_date": "2030-01-01T09:00:00Z"}))
+            .to_request();
+        let created: Value = test::call_and_read_body_json(&app, req).await;
+        let uri = format!("/api/todos/{}/complete", created["id"].as_str().unwrap());
+
+        let first: Value = test::call_and_read_body_json(&app, TestRequest::post().uri(&uri).to_request()).await;
+        assert_eq!(first["completed"], true);
+        let next_id = first["next_occurrence_id"].as_str().unwrap();
+        let next: Value =
+            test::call_and_read_body_json(&app, TestRequest::get().uri(&format!("/api/todos/{}", next_id)).to_request())
+                .await;
+        assert_eq!((next["title"].as_str(), next["completed"].as_bool()), (Some("Water plants"), Some(false)));
+        assert_eq!(next["due_date"], "2030-01-02T09:00:00.000Z");
+
+        let again: Value = test::call_and_read_body_json(&app, TestRequest::post().uri(&uri).to_request()).await;
+        assert!(again.get("next_occurrence_id").is_none());
+        assert_eq!(again["version"], first["version"]);
+        let res = test::call_service(&app, TestRequest::get().uri("/api/todos?completed=false").to_request()).await;
+        assert_eq!(res.headers().get(TOTAL_COUNT_HEADER).unwrap(), "1");
+    }
+
+    fn create_with_key(key: &str, body: Value) -> TestRequest {
+        TestRequest::post().uri("/api/todos").insert_header((IDEMPOTENCY_KEY_HEADER, key)).set_json(body)
+    }
+
+    #[actix_web::test]
+    async fn repeated_idempotency_key_replays_the_first_response() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+
+        let req = create_with_key("order-42", json!({"title": "Pay invoice"})).to_request();
+        let first = test::call_service(&app, req).await;
+        assert_eq!(first.status(), StatusCode::CREATED);
+        let location = first.headers().get(header::LOCATION).cloned();
+        let first: Value = test::read_body_json(first).await;
+
+        let req = create_with_key("order-42", json!({"title": "Pay invoice"})).to_request();
+        let again = test::call_service(&app, req).await;
+        assert_eq!(again.status(), StatusCode::CREATED);
+        assert_eq!(again.headers().get(header::LOCATION).cloned(), location);
+        let again: Value = test::read_body_json(again).await;
+        assert_eq!(again, first);
+
+        let res = test::call_service(&app, TestRequest::get().uri("/api/todos").to_request()).await;
+        assert_eq!(res.headers().get(TOTAL_COUNT_HEADER).unwrap(), "1");
+    }
+
+    #[actix_web::test]
+    async fn idempotency_key_reused_with_another_body_is_a_conflict() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+
+        let req = create_with_key("order-42", json!({"title": "Pay invoice"})).to_request();
+        let res = test::call_service(&app, req).await;
+        assert_eq!(res.status(), StatusCode::CREATED);
+        let req = create_with_key("order-42", json!({"title": "Pay rent"})).to_request();
+        let res = test::call_service(&app, req).await;
+        assert_eq!(res.status(), StatusCode::CONFLICT);
+
+        let res = test::call_service(&app, TestRequest::get().uri("/api/todos").to_request()).await;
+        assert_eq!(res.headers().get(TOTAL_COUNT_HEADER).unwrap(), "1");
+    }
+
+    #[actix_web::test]
+    async fn expired_idempotency_keys_are_swept_whoever_stored_them() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let body = json!({"title": "Pay invoice"});
+        let res = test::call_service(&app, create_with_key("order-42", body.clone()).to_request()).await;
+        assert_eq!(res.status(), StatusCode::CREATED);
+        actix_web::rt::time::sleep(Duration::from_millis(10)).await;
+
+        // Another user looking up another key with a zero TTL clears it too
+        let stranger = AuthUser { user_id: Some(Uuid::new_v4()) };
+        let todos = &repositories.todos;
+        assert!(todos.idempotent_response(stranger, "other", &json!({}), 0).await.unwrap().is_none());
+        let stored = todos.idempotent_response(AuthUser { user_id: None }, "order-42", &body, 86400).await;
+        assert!(stored.unwrap().is_none());
+    }
+
+    #[actix_web::test]
+    async fn update_keeps_omitted_fields_and_clears_nulls() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let req = TestRequest::post().uri("/api/todos").set_json(json!({
+            "title": "Renew passport",
+            "description": "Photos first",
+            "due_date": "2030-01-02T09:00:00.000Z",
+            "remind_at": "2030-01-01T09:00:00.000Z",
+        }));
+        let created: Value = test::call_and_read_body_json(&app, req.to_request()).await;
+        let uri = format!("/api/todos/{}", created["id"].as_str().unwrap());
+        let update = |body: Value| TestRequest::put().uri(&uri).set_json(body).to_request();
+
+        let renamed: Value = test::call_and_read_body_json(&app, update(json!({"title": "Renew ID"}))).await;
+        assert_eq!(renamed["title"], "Renew ID");
+        assert_eq!(renamed["description"], "Photos first");
+        assert_eq!(renamed["due_date"], "2030-01-02T09:00:00.000Z");
+        assert_eq!(renamed["remind_at"], "2030-01-01T09:00:00.000Z");
+
+        let cleared: Value =
+            test::call_and_read_body_json(&app, update(json!({"description": null, "due_date": null}))).await;
+        assert!(cleared["description"].is_null());
+        assert!(cleared["due_date"].is_null());
+        assert_eq!(cleared["remind_at"], "2030-01-01T09:00:00.000Z");
+        // null on a field that cannot be empty is the same as leaving it out
+        let kept: Value = test::call_and_read_body_json(&app, update(json!({"title": null}))).await;
+        assert_eq!(kept["title"], "Renew ID");
+
+        let set: Value = test::call_and_read_body_json(&app, update(json!({"description": "Book a slot"}))).await;
+        assert_eq!(set["description"], "Book a slot");
+        assert!(set["due_date"].is_null());
+    }
+
+    #[actix_web::test]
+    async fn description_patch_sets_clears_and_requires_the_field() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let req = TestRequest::post().uri("/api/todos").set_json(json!({"title": "Fix bike", "description": "Flat"}));
+        let created: Value = test::call_and_read_body_json(&app, req.to_request()).await;
+        let todo_uri = format!("/api/todos/{}", created["id"].as_str().unwrap());
+        let uri = format!("{}/description", todo_uri);
+        let patch = |body: Value| TestRequest::patch().uri(&uri).set_json(body).to_request();
+
+        let set: Value = test::call_and_read_body_json(&app, patch(json!({"description": "Rear tyre"}))).await;
+        assert_eq!((&set["title"], &set["description"]), (&json!("Fix bike"), &json!("Rear tyre")));
+
+        let cleared: Value = test::call_and_read_body_json(&app, patch(json!({"description": null}))).await;
+        assert!(cleared["description"].is_null());
+        assert_eq!(cleared["title"], "Fix bike");
+        assert_eq!(cleared["version"], set["version"].as_i64().unwrap() + 1);
+
+        let res = test::call_service(&app, patch(json!({}))).await;
+        assert_eq!(res.status(), StatusCode::BAD_REQUEST);
+        let fetched: Value = test::call_and_read_body_json(&app, TestRequest::get().uri(&todo_uri).to_request()).await;
+        assert!(fetched["description"].is_null());
+    }
+
+    #[actix_web::test]
+    async fn batch_get_returns_found_todos_in_order_and_lists_the_rest() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let mut ids = Vec::new();
+        for title in ["First", "Second"] {
+            let req = TestRequest::post().uri("/api/todos").set_json(json!({"title": title}));
+            let created: Value = test::call_and_read_body_json(&app, req.to_request()).await;
+            ids.push(created["id"].as_str().unwrap().to_string());
+        }
+        let unknown = Uuid::new_v4().to_string();
+        let get = |ids: Value| TestRequest::post().uri("/api/todos/batch-get").set_json(json!({"ids": ids}));
+
+        let body: Value =
+            test::call_and_read_body_json(&app, get(json!([ids[1], unknown, ids[0], ids[1]])).to_request()).await;
+        let todos = body["todos"].as_array().unwrap();
+        let titles: Vec<&str> = todos.iter().map(|t| t["title"].as_str().unwrap()).collect();
+        assert_eq!(titles, ["Second", "First"]);
+        assert_eq!(body["missing"], json!([unknown]));
+
+        let at_cap: Vec<String> = (0..MAX_BATCH_GET_IDS).map(|_| Uuid::new_v4().to_string()).collect();
+        let body: Value = test::call_and_read_body_json(&app, get(json!(at_cap)).to_request()).await;
+        assert_eq!(body["missing"].as_array().unwrap().len(), MAX_BATCH_GET_IDS);
+        let over_cap: Vec<String> = (0..=MAX_BATCH_GET_IDS).map(|_| Uuid::new_v4().to_string()).collect();
+        let res = test::call_service(&app, get(json!(over_cap)).to_request()).await;
+        assert_eq!(res.status(), StatusCode::BAD_REQUEST);
+    }
+
+    #[actix_web::test]
+    async fn updates_record_who_made_them() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let (alice, bob) = (Uuid::new_v4().to_string(), Uuid::new_v4().to_string());
+
+        let req = TestRequest::post()
+            .uri("/api/todos")
+            .insert_header((ACTOR_HEADER, alice.as_str()))
+            .set_json(json!({"title": "Plan trip"}));
+        let created: Value = test::call_and_read_body_json(&app, req.to_request()).await;
+        assert_eq!((&created["created_by"], &created["updated_by"]), (&json!(alice), &json!(alice)));
+
+        let uri = format!("/api/todos/{}", created["id"].as_str().unwrap());
+        let req = TestRequest::put()
+            .uri(&uri)
+            .insert_header((ACTOR_HEADER, bob.as_str()))
+            .set_json(json!({"title": "Plan the trip"}));
+        let updated: Value = test::call_and_read_body_json(&app, req.to_request()).await;
+        assert_eq!((&updated["created_by"], &updated["updated_by"]), (&json!(alice), &json!(bob)));
+
+        let req = TestRequest::put().uri(&uri).set_json(json!({"completed": true}));
+        let anonymous: Value = test::call_and_read_body_json(&app, req.to_request()).await;
+        assert_eq!(anonymous["created_by"], json!(alice));
+        assert!(anonymous["updated_by"].is_null());
+
+        let req = TestRequest::put().uri(&uri).insert_header((ACTOR_HEADER, "someone")).set_json(json!({}));
+        assert_eq!(test::call_service(&app, req.to_request()).await.status(), StatusCode::BAD_REQUEST);
+    }
+
+    #[actix_web::test]
+    async fn signed_in_user_is_the_actor_whatever_the_header_says() {
+        let config = testing::config(&[("JWT_SECRET", "test-secret")]);
+        let (user_id, token) = testing::token(&config);
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(config, &repositories)).await;
+
+        let req = testing::bearer(TestRequest::post().uri("/api/todos"), &token)
+            .insert_header((ACTOR_HEADER, Uuid::new_v4().to_string()))
+            .set_json(json!({"title": "Plan trip"}));
+        let created: Value = test::call_and_read_body_json(&app, req.to_request()).await;
+        let uri = format!("/api/todos/{}", created["id"].as_str().unwrap());
+        let req = testing::bearer(TestRequest::put().uri(&uri), &token)
+            .insert_header((ACTOR_HEADER, Uuid::new_v4().to_string()))
+            .set_json(json!({"title": "Plan the trip"}));
+        let updated: Value = test::call_and_read_body_json(&app, req.to_request()).await;
+        assert_eq!(updated["created_by"], json!(user_id));
+        assert_eq!(updated["updated_by"], json!(user_id));
+    }
+
+    fn batch(uri: &str, body: Value) -> TestRequest {
+        TestRequest::patch().uri(uri).set_json(body)
+    }
+
+    #[actix_web::test]
+    async fn batch_update_fails_whole_or_skips_missing_when_partial() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let first: Value = test::call_and_read_body_json(&app, create("First").to_request()).await;
+        let second: Value = test::call_and_read_body_json(&app, create("Second").to_request()).await;
+        let missing = uuid::Uuid::new_v4().to_string();
+
+        // Without partial, a missing id fails every update
+        let body = json!([{"id": first["id"], "completed": true}, {"id": missing, "completed": true}]);
+        let res = test::call_service(&app, batch("/api/todos/batch", body.clone()).to_request()).await;
+        assert_eq!(res.status(), StatusCode::NOT_FOUND);
+        let error: Value = test::read_body_json(res).await;
+        assert!(error["message"].as_str().unwrap().contains(&missing), "{}", error);
+        let uri = format!("/api/todos/{}", first["id"].as_str().unwrap());
+        let unchanged: Value = test::call_and_read_body_json(&app, TestRequest::get().uri(&uri).to_request()).await;
+        assert_eq!(unchanged["completed"], false);
+
+        // With partial, it is skipped and reported
+        let res = test::call_service(&app, batch("/api/todos/batch?partial=true", body).to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+        let outcome: Value = test::read_body_json(res).await;
+        assert_eq!(outcome["missing"], json!([missing]));
+        let todos = outcome["todos"].as_array().unwrap();
+        assert_eq!(todos.len(), 1);
+        assert_eq!((&todos[0]["id"], &todos[0]["completed"]), (&first["id"], &json!(true)));
+
+        // Any other failure rolls back the rows already updated, even with partial
+        let body = json!([
+            {"id": second["id"], "completed": true},
+            {"id": first["id"], "title": "Stale", "version": 1},
+        ]);
+        let res = test::call_service(&app, batch("/api/todos/batch?partial=true", body).to_request()).await;
+        assert_eq!(res.status(), StatusCode::CONFLICT);
+        let uri = format!("/api/todos/{}", second["id"].as_str().unwrap());
+        let unchanged: Value = test::call_and_read_body_json(&app, TestRequest::get().uri(&uri).to_request()).await;
+        assert_eq!((unchanged["completed"].as_bool(), unchanged["version"].as_i64()), (Some(false), Some(1)));
+    }
 }
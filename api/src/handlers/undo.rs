@@ -0,0 +1,83 @@
+use actix_web::{web, HttpResponse};
+use chrono::{DateTime, Utc};
+use std::env;
+use std::sync::Arc;
+use std::time::Duration;
+use uuid::Uuid;
+
+use crate::auth::{Actor, AuthUser};
+use crate::db::parse_duration;
+use crate::error::ApiError;
+use crate::events::{Broker, TodoEvent};
+use crate::models::{TodoResponse, UndoRequest};
+use crate::repository::{TodoRepository, UndoToken};
+
+pub const UNDO_TOKEN_HEADER: &str = "x-undo-token";
+
+const DEFAULT_WINDOW: Duration = Duration::from_secs(30);
+
+/// How often expired deletions are made final
+const SWEEP_INTERVAL: Duration = Duration::from_secs(10);
+
+/// How long a deletion can be undone, configured through UNDO_WINDOW
+#[derive(Debug, Clone, Copy)]
+pub struct UndoWindow(pub Duration);
+
+impl UndoWindow {
+    pub fn from_env() -> Result<Self, String> {
+        match env::var("UNDO_WINDOW").ok().filter(|v| !v.is_empty()) {
+            None => Ok(UndoWindow(DEFAULT_WINDOW)),
+            Some(value) => parse_duration(&value)
+                .filter(|d| !d.is_zero())
+                .map(UndoWindow)
+                .ok_or_else(|| {
+                    format!("UNDO_WINDOW must be a positive duration such as '30', '30s' or '500ms', got '{}'", value)
+                }),
+        }
+    }
+
+    /// A fresh token for a deletion happening at `now`
+    pub(crate) fn issue(&self, now: DateTime<Utc>) -> UndoToken {
+        let window = chrono::Duration::from_std(self.0).unwrap_or_else(|_| chrono::Duration::seconds(30));
+        UndoToken {
+            token: Uuid::new_v4().simple().to_string(),
+            expires_at: now + window,
+        }
+    }
+}
+
+/// Periodically make deletions whose undo window has closed final
+pub fn spawn_sweeper(todos: Arc<dyn TodoRepository>) {
+    actix_web::rt::spawn(async move {
+        let mut interval = actix_web::rt::time::interval(SWEEP_INTERVAL);
+        loop {
+            interval.tick().await;
+            match todos.purge_expired_deletes(Utc::now()).await {
+                Ok(0) => {}
+                Ok(purged) => log::debug!(purged = purged; "finalized expired deletions"),
+                Err(e) => log::warn!(error = e.to_string().as_str(); "failed to finalize expired deletions"),
+            }
+        }
+    });
+}
+
+/// Undo a deletion with the token DELETE returned, restoring the todo and its
+/// subtasks exactly as they were
+pub async fn undo_delete(
+    todos: web::Data<dyn TodoRepository>,
+    broker: web::Data<Broker>,
+    user: AuthUser,
+    actor: Actor,
+    req: web::Json<UndoRequest>,
+) -> Result<HttpResponse, ApiError> {
+    let restored = todos.restore(user, req.token.trim(), actor, Utc::now()).await?;
+    for todo in &restored {
+        broker.publish(TodoEvent::created(todo));
+    }
+
+    let todo = restored
+        .into_iter()
+        .next()
+        .ok_or_else(|| ApiError::InternalServerError("Nothing was restored".to_string()))?;
+    Ok(HttpResponse::Ok().json(TodoResponse::from(todo)))
+}
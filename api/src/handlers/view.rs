@@ -0,0 +1,178 @@
+use actix_web::{web, HttpResponse};
+use chrono::{DateTime, Duration, NaiveDate, NaiveTime, TimeZone, Utc};
+use chrono_tz::Tz;
+
+use crate::auth::AuthUser;
+use crate::error::ApiError;
+use crate::models::{TodoPage, TodoResponse, ViewQuery};
+use crate::repository::{TodoFilter, TodoRepository, TodoSort};
+use super::pagination::{page_size, Cursor};
+use super::todo::{sort_param, TOTAL_COUNT_HEADER};
+
+/// Days the upcoming view covers when `days` is not given
+const DEFAULT_UPCOMING_DAYS: i64 = 7;
+
+/// Most days ahead the upcoming view may cover
+const MAX_UPCOMING_DAYS: i64 = 365;
+
+/// The named views of GET /api/todos/views/{name}. Each only holds open,
+/// unarchived todos.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum View {
+    /// Due today or overdue
+    Today,
+    /// Due on one of the next `days` days, not counting today
+    Upcoming,
+    /// Without a due date
+    Someday,
+}
+
+impl View {
+    fn parse(name: &str) -> Result<Self, ApiError> {
+        match name {
+            "today" => Ok(View::Today),
+            "upcoming" => Ok(View::Upcoming),
+            "someday" => Ok(View::Someday),
+            _ => Err(ApiError::NotFound(format!(
+                "View '{}' not found; use today, upcoming or someday",
+                name
+            ))),
+        }
+    }
+}
+
+/// The `tz` query parameter, UTC when it is missing
+fn time_zone(name: Option<&str>) -> Result<Tz, ApiError> {
+    match name {
+        Some(name) => name.parse().map_err(|_| {
+            ApiError::BadRequest(format!("tz '{}' is not an IANA time zone such as Europe/Bucharest", name))
+        }),
+        None => Ok(Tz::UTC),
+    }
+}
+
+/// The instant `date` starts in `tz`. Where a daylight saving change skips
+/// midnight, the day starts at the first local time that exists.
+fn start_of_day(date: NaiveDate, tz: Tz) -> DateTime<Utc> {
+    let midnight = date.and_time(NaiveTime::MIN);
+    (0..24 * 4)
+        .map(|quarter| midnight + Duration::minutes(15 * quarter))
+        .find_map(|local| tz.from_local_datetime(&local).earliest())
+        .map_or_else(|| Utc.from_utc_datetime(&midnight), |start| start.with_timezone(&Utc))
+}
+
+/// The filters selecting `view` on the day `today`
+fn view_filter(view: View, today: NaiveDate, tz: Tz, days: i64) -> TodoFilter {
+    let tomorrow = start_of_day(today + Duration::days(1), tz);
+    let filter = TodoFilter { completed: Some(false), ..TodoFilter::default() };
+    match view {
+        View::Today => TodoFilter { due_before: Some(tomorrow), ..filter },
+        View::Upcoming => TodoFilter {
+            due_from: Some(tomorrow),
+            due_before: Some(start_of_day(today + Duration::days(days + 1), tz)),
+            ..filter
+        },
+        View::Someday => TodoFilter { has_due_date: Some(false), ..filter },
+    }
+}
+
+/// The caller's open todos in one of the named views `today`, `upcoming` and
+/// `someday`, with days counted in the `tz` time zone. Pages and sorts like
+/// GET /api/todos, including X-Total-Count.
+pub async fn todo_view(
+    todos: web::Data<dyn TodoRepository>,
+    sort: web::Data<TodoSort>,
+    user: AuthUser,
+    name: web::Path<String>,
+    query: web::Query<ViewQuery>,
+) -> Result<HttpResponse, ApiError> {
+    let view = View::parse(&name)?;
+    let tz = time_zone(query.tz.as_deref())?;
+    let days = match (view, query.days) {
+        (View::Upcoming, Some(days)) if !(1..=MAX_UPCOMING_DAYS).contains(&days) => {
+            return Err(ApiError::BadRequest(format!("days must be between 1 and {}", MAX_UPCOMING_DAYS)));
+        }
+        (View::Upcoming, days) => days.unwrap_or(DEFAULT_UPCOMING_DAYS),
+        (_, Some(_)) => {
+            return Err(ApiError::BadRequest("days only applies to the upcoming view".to_string()));
+        }
+        (_, None) => 0,
+    };
+    let paginated = query.limit.is_some() || query.after.is_some();
+    let limit = if paginated { Some(page_size(query.limit)?) } else { None };
+    let sort = sort_param(query.sort.as_deref(), **sort)?;
+    let after = query.after.as_deref().map(|c| Cursor::decode(c, sort)).transpose()?;
+
+    let today = Utc::now().with_timezone(&tz).date_naive();
+    // Fetch one extra row to learn whether another page follows
+    let filter = TodoFilter {
+        tag: query.tag.clone(),
+        sort,
+        after: after.map(|c| (c.key, c.id)),
+        limit: limit.map(|l| l + 1),
+        ..view_filter(view, today, tz, days)
+    };
+    let mut page = todos.list(user, &filter).await?;
+    let total = todos.count(user, &filter).await?;
+
+    let mut response = HttpResponse::Ok();
+    response.insert_header((TOTAL_COUNT_HEADER, total));
+    let next_cursor = match limit {
+        Some(limit) if page.len() as i64 > limit => {
+            page.truncate(limit as usize);
+            page.last().map(|t| Cursor::after(t, sort).encode())
+        }
+        Some(_) => Some(String::new()),
+        None => None,
+    };
+
+    let page: Vec<TodoResponse> = page.into_iter().map(TodoResponse::from).collect();
+    Ok(match next_cursor {
+        Some(next_cursor) => response.json(TodoPage { todos: page, next_cursor }),
+        None => response.json(page),
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::test::{self, TestRequest};
+    use chrono::{Duration, NaiveDate, TimeZone, Utc};
+    use chrono_tz::Tz;
+    use serde_json::{json, Value};
+
+    use super::{start_of_day, view_filter, View};
+    use crate::testing;
+
+    const TZ: Tz = chrono_tz::Pacific::Auckland;
+
+    #[test]
+    fn days_are_bounded_by_local_midnight() {
+        let today = NaiveDate::from_ymd_opt(2024, 7, 10).unwrap();
+        // Auckland is twelve hours ahead of UTC in July
+        let tomorrow = Utc.with_ymd_and_hms(2024, 7, 10, 12, 0, 0).unwrap();
+
+        let filter = view_filter(View::Today, today, TZ, 0);
+        assert_eq!((filter.due_from, filter.due_before), (None, Some(tomorrow)));
+        let filter = view_filter(View::Upcoming, today, TZ, 7);
+        assert_eq!((filter.due_from, filter.due_before), (Some(tomorrow), Some(tomorrow + Duration::days(7))));
+    }
+
+    #[actix_web::test]
+    async fn views_split_at_local_midnight() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let tomorrow = start_of_day(Utc::now().with_timezone(&TZ).date_naive() + Duration::days(1), TZ);
+
+        for (title, due) in [("Before", tomorrow - Duration::minutes(1)), ("After", tomorrow + Duration::minutes(1))] {
+            let req = TestRequest::post().uri("/api/todos").set_json(json!({"title": title, "due_date": due}));
+            test::call_service(&app, req.to_request()).await;
+        }
+
+        for (view, expected) in [("today", "Before"), ("upcoming", "After")] {
+            let uri = format!("/api/todos/views/{}?tz=Pacific/Auckland", view);
+            let todos: Value = test::call_and_read_body_json(&app, TestRequest::get().uri(&uri).to_request()).await;
+            let titles: Vec<&str> = todos.as_array().unwrap().iter().map(|t| t["title"].as_str().unwrap()).collect();
+            assert_eq!(titles, vec![expected], "{}", view);
+        }
+    }
+}
@@ -0,0 +1,165 @@
+use actix_web::{web, HttpResponse};
+use uuid::Uuid;
+
+use crate::auth::AuthUser;
+use crate::error::ApiError;
+use crate::models::{CreateWebhookRequest, UpdateWebhookRequest, WebhookEvent, WebhookResponse};
+use crate::repository::WebhookRepository;
+use crate::webhooks::{self, WebhookSettings};
+
+fn webhook_not_found(id: Uuid) -> ApiError {
+    ApiError::NotFound(format!("Webhook with id {} not found", id))
+}
+
+/// Accept only absolute http(s) URLs whose host resolves to public addresses,
+/// unless WEBHOOK_ALLOW_PRIVATE is set. This only gives early feedback: each
+/// delivery resolves and checks the host again.
+async fn validate_url(url: &str, settings: &WebhookSettings) -> Result<String, ApiError> {
+    let url = url.trim();
+    let parsed = match reqwest::Url::parse(url) {
+        Ok(parsed) if matches!(parsed.scheme(), "http" | "https") => parsed,
+        _ => return Err(ApiError::BadRequest("url must be an absolute http or https URL".to_string())),
+    };
+    webhooks::check_target(&parsed, settings.allow_private)
+        .await
+        .map_err(ApiError::BadRequest)?;
+    Ok(url.to_string())
+}
+
+fn validate_secret(secret: &str) -> Result<String, ApiError> {
+    if secret.trim().is_empty() {
+        return Err(ApiError::BadRequest("secret cannot be empty".to_string()));
+    }
+    Ok(secret.to_string())
+}
+
+/// Event names to store, without duplicates
+fn validate_events(events: &[WebhookEvent]) -> Result<Vec<String>, ApiError> {
+    let mut names: Vec<String> = Vec::with_capacity(events.len());
+    for event in events {
+        if !names.iter().any(|n| n == event.as_str()) {
+            names.push(event.as_str().to_string());
+        }
+    }
+    if names.is_empty() {
+        return Err(ApiError::BadRequest("events cannot be empty".to_string()));
+    }
+    Ok(names)
+}
+
+/// List the caller's webhooks
+pub async fn list_webhooks(
+    webhooks: web::Data<dyn WebhookRepository>,
+    user: AuthUser,
+) -> Result<HttpResponse, ApiError> {
+    let response: Vec<WebhookResponse> = webhooks
+        .list(user)
+        .await?
+        .into_iter()
+        .map(|w| w.into())
+        .collect();
+    Ok(HttpResponse::Ok().json(response))
+}
+
+/// Register a webhook that receives the caller's todo events
+pub async fn create_webhook(
+    webhooks: web::Data<dyn WebhookRepository>,
+    settings: web::Data<WebhookSettings>,
+    user: AuthUser,
+    req: web::Json<CreateWebhookRequest>,
+) -> Result<HttpResponse, ApiError> {
+    let url = validate_url(&req.url, &settings).await?;
+    let secret = validate_secret(&req.secret)?;
+    let events = validate_events(&req.events)?;
+
+    let webhook = webhooks.create(user, &url, &secret, &events).await?;
+    Ok(HttpResponse::Created().json(WebhookResponse::from(webhook)))
+}
+
+pub async fn get_webhook(
+    webhooks: web::Data<dyn WebhookRepository>,
+    user: AuthUser,
+    id: web::Path<Uuid>,
+) -> Result<HttpResponse, ApiError> {
+    let id = id.into_inner();
+    let webhook = webhooks.find(user, id).await?.ok_or_else(|| webhook_not_found(id))?;
+    Ok(HttpResponse::Ok().json(WebhookResponse::from(webhook)))
+}
+
+/// Change a webhook's url, secret or events, keeping what is not provided
+pub async fn update_webhook(
+    webhooks: web::Data<dyn WebhookRepository>,
+    settings: web::Data<WebhookSettings>,
+    user: AuthUser,
+    id: web::Path<Uuid>,
+    req: web::Json<UpdateWebhookRequest>,
+) -> Result<HttpResponse, ApiError> {
+    let id = id.into_inner();
+    let mut webhook = webhooks.find(user, id).await?.ok_or_else(|| webhook_not_found(id))?;
+
+    if let Some(url) = &req.url {
+        webhook.url = validate_url(url, &settings).await?;
+    }
+    if let Some(secret) = &req.secret {
+        webhook.secret = validate_secret(secret)?;
+    }
+    if let Some(events) = &req.events {
+        webhook.events = validate_events(events)?;
+    }
+
+    // The webhook may have been deleted since it was looked up
+    if !webhooks.update(&webhook).await? {
+        return Err(webhook_not_found(id));
+    }
+    Ok(HttpResponse::Ok().json(WebhookResponse::from(webhook)))
+}
+
+pub async fn delete_webhook(
+    webhooks: web::Data<dyn WebhookRepository>,
+    user: AuthUser,
+    id: web::Path<Uuid>,
+) -> Result<HttpResponse, ApiError> {
+    let id = id.into_inner();
+    if !webhooks.delete(user, id).await? {
+        return Err(webhook_not_found(id));
+    }
+    Ok(HttpResponse::NoContent().finish())
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+    use serde_json::json;
+
+    use crate::testing;
+
+    fn register(url: &str) -> TestRequest {
+        TestRequest::post()
+            .uri("/api/webhooks")
+            .set_json(json!({"url": url, "secret": "s3cret", "events": ["todo.created"]}))
+    }
+
+    #[actix_web::test]
+    async fn private_urls_are_refused() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+
+        for url in ["http://127.0.0.1:9000/hook", "http://169.254.169.254/latest/meta-data", "http://[fd00::1]/"] {
+            let res = test::call_service(&app, register(url).to_request()).await;
+            assert_eq!(res.status(), StatusCode::BAD_REQUEST, "{}", url);
+        }
+        let res = test::call_service(&app, register("https://93.184.216.34/hook").to_request()).await;
+        assert_eq!(res.status(), StatusCode::CREATED);
+    }
+
+    #[actix_web::test]
+    async fn private_urls_can_be_allowed() {
+        let repositories = testing::repositories();
+        let config = testing::config(&[("WEBHOOK_ALLOW_PRIVATE", "true")]);
+        let app = test::init_service(testing::app(config, &repositories)).await;
+
+        let res = test::call_service(&app, register("http://127.0.0.1:9000/hook").to_request()).await;
+        assert_eq!(res.status(), StatusCode::CREATED);
+    }
+}
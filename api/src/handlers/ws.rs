@@ -0,0 +1,255 @@
+use actix_web::{web, HttpRequest, HttpResponse};
+use actix_ws::{CloseCode, CloseReason, Message, Session};
+use futures_util::StreamExt;
+use serde::Deserialize;
+use std::env;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+use tokio::sync::broadcast::error::RecvError;
+use uuid::Uuid;
+
+use crate::auth::AuthUser;
+use crate::error::ApiError;
+use crate::events::{Broker, TodoEvent};
+use crate::repository::ListRepository;
+
+/// How often the server pings an idle connection
+const HEARTBEAT_INTERVAL: Duration = Duration::from_secs(15);
+
+/// Connections that have not answered for this long are considered dead
+const CLIENT_TIMEOUT: Duration = Duration::from_secs(45);
+
+/// A client that takes longer than this to accept a frame is disconnected
+const SEND_TIMEOUT: Duration = Duration::from_secs(10);
+
+const DEFAULT_MAX_CONNECTIONS: usize = 1000;
+
+/// Caps how many WebSocket clients may be connected at once, across all workers
+#[derive(Debug, Clone)]
+pub struct ConnectionLimit {
+    max: usize,
+    open: Arc<AtomicUsize>,
+}
+
+impl ConnectionLimit {
+    /// Read WS_MAX_CONNECTIONS, 1000 when unset
+    pub fn from_env() -> Result<Self, String> {
+        let max = match env::var("WS_MAX_CONNECTIONS").ok().filter(|v| !v.is_empty()) {
+            None => DEFAULT_MAX_CONNECTIONS,
+            Some(value) => value
+                .trim()
+                .parse()
+                .ok()
+                .filter(|max| *max > 0)
+                .ok_or_else(|| format!("WS_MAX_CONNECTIONS must be a positive number, got '{}'", value))?,
+        };
+        Ok(ConnectionLimit { max, open: Arc::new(AtomicUsize::new(0)) })
+    }
+
+    pub fn max(&self) -> usize {
+        self.max
+    }
+
+    /// Take a connection slot, or `None` when every slot is in use
+    fn acquire(&self) -> Option<ConnectionSlot> {
+        self.open
+            .fetch_update(Ordering::AcqRel, Ordering::Acquire, |open| {
+                (open < self.max).then_some(open + 1)
+            })
+            .ok()?;
+        Some(ConnectionSlot(self.open.clone()))
+    }
+}
+
+/// A connection counted against the limit until dropped
+struct ConnectionSlot(Arc<AtomicUsize>);
+
+impl Drop for ConnectionSlot {
+    fn drop(&mut self) {
+        self.0.fetch_sub(1, Ordering::AcqRel);
+    }
+}
+
+/// Frames a client may send
+#[derive(Debug, Deserialize)]
+#[serde(tag = "type", rename_all = "lowercase")]
+enum ClientMessage {
+    /// Only receive events for todos matching the given fields; a later
+    /// subscribe replaces the filter and one without fields clears it
+    Subscribe {
+        completed: Option<bool>,
+        list_id: Option<Uuid>,
+    },
+}
+
+/// The filter set by the client's last subscribe message
+#[derive(Debug, Default)]
+struct Subscription {
+    completed: Option<bool>,
+    list_id: Option<Uuid>,
+}
+
+impl Subscription {
+    fn matches(&self, event: &TodoEvent) -> bool {
+        self.completed.map_or(true, |completed| event.snapshot.completed == completed)
+            && self.list_id.map_or(true, |list_id| event.list_id == Some(list_id))
+    }
+}
+
+/// Send a text frame, failing when the client does not take it in time
+async fn send(session: &mut Session, frame: String) -> bool {
+    matches!(tokio::time::timeout(SEND_TIMEOUT, session.text(frame)).await, Ok(Ok(())))
+}
+
+/// Whether `user` may see the todo an event is about: their own todos, or
+/// todos in a list they are a member of
+async fn visible_to(lists: &dyn ListRepository, user: AuthUser, event: &TodoEvent) -> bool {
+    if event.user_id == user.user_id {
+        return true;
+    }
+    let (Some(list_id), Some(_)) = (event.list_id, user.user_id) else {
+        return false;
+    };
+
+    matches!(lists.role(user, list_id).await, Ok(Some(_)))
+}
+
+/// Upgrade to a WebSocket and push todo change events to the client as JSON
+/// frames. Clients may narrow the stream with a `subscribe` message; those that
+/// fall behind are disconnected rather than slowing everyone else down.
+pub async fn todo_updates(
+    lists: web::Data<dyn ListRepository>,
+    broker: web::Data<Broker>,
+    limit: web::Data<ConnectionLimit>,
+    user: AuthUser,
+    req: HttpRequest,
+    body: web::Payload,
+) -> Result<HttpResponse, actix_web::Error> {
+    let Some(slot) = limit.acquire() else {
+        log::warn!(max = limit.max(); "websocket connection limit reached");
+        return Err(ApiError::ServiceUnavailable(
+            "Too many live connections, try again later".to_string(),
+        )
+        .into());
+    };
+    let (response, mut session, mut messages) = actix_ws::handle(&req, body)?;
+    let mut events = broker.subscribe();
+
+    log::debug!(subscribers = broker.subscribers(); "websocket client connected");
+
+    actix_web::rt::spawn(async move {
+        let mut last_seen = Instant::now();
+        let mut heartbeat = tokio::time::interval(HEARTBEAT_INTERVAL);
+        let mut subscription = Subscription::default();
+
+        let reason = loop {
+            tokio::select! {
+                msg = messages.next() => match msg {
+                    Some(Ok(Message::Ping(bytes))) => {
+                        last_seen = Instant::now();
+                        if session.pong(&bytes).await.is_err() {
+                            break None;
+                        }
+                    }
+                    Some(Ok(Message::Pong(_))) => last_seen = Instant::now(),
+                    Some(Ok(Message::Close(reason))) => break reason,
+                    Some(Ok(Message::Text(text))) => {
+                        last_seen = Instant::now();
+                        match serde_json::from_str::<ClientMessage>(&text) {
+                            Ok(ClientMessage::Subscribe { completed, list_id }) => {
+                                subscription = Subscription { completed, list_id };
+                            }
+                            Err(e) => {
+                                let frame = serde_json::json!({
+                                    "type": "error",
+                                    "message": format!("Invalid message: {}", e),
+                                });
+                                if !send(&mut session, frame.to_string()).await {
+                                    break None;
+                                }
+                            }
+                        }
+                    }
+                    Some(Ok(_)) => last_seen = Instant::now(),
+                    Some(Err(_)) | None => break None,
+                },
+                event = events.recv() => match event {
+                    Ok(event) => {
+                        if !subscription.matches(&event) || !visible_to(lists.get_ref(), user, &event).await {
+                            continue;
+                        }
+                        let frame = match serde_json::to_string(&event) {
+                            Ok(frame) => frame,
+                            Err(_) => continue,
+                        };
+                        if !send(&mut session, frame).await {
+                            log::warn!("websocket client did not accept an event in time, disconnecting");
+                            break None;
+                        }
+                    }
+                    // The client cannot keep up; drop it instead of letting it
+                    // silently miss events
+                    Err(RecvError::Lagged(skipped)) => {
+                        log::warn!(skipped = skipped; "websocket client fell behind, disconnecting");
+                        break Some(CloseReason {
+                            code: CloseCode::Policy,
+                            description: Some("client too slow".to_string()),
+                        });
+                    }
+                    Err(RecvError::Closed) => break None,
+                },
+                _ = heartbeat.tick() => {
+                    if last_seen.elapsed() > CLIENT_TIMEOUT || session.ping(b"").await.is_err() {
+                        break None;
+                    }
+                }
+            }
+        };
+
+        // Dropping the receiver here removes this client from the broker
+        drop(events);
+        drop(slot);
+        let _ = session.close(reason).await;
+        log::debug!("websocket client disconnected");
+    });
+
+    Ok(response)
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use awc::ws::Frame;
+    use futures_util::StreamExt;
+    use serde_json::{json, Value};
+    use std::time::Duration;
+
+    use crate::testing;
+
+    #[actix_web::test]
+    async fn created_todos_are_pushed_to_connected_clients() {
+        let repos = testing::repositories();
+        let mut srv = actix_test::start(move || testing::app(testing::config(&[]), &repos));
+        let mut ws = srv.ws_at("/api/todos/ws").await.unwrap();
+
+        let mut res = srv.post("/api/todos").send_json(&json!({ "title": "Buy milk" })).await.unwrap();
+        assert_eq!(res.status(), StatusCode::CREATED);
+        let created: Value = res.json().await.unwrap();
+
+        // The first heartbeat ping goes out as soon as the client connects
+        let event = tokio::time::timeout(Duration::from_secs(5), async {
+            loop {
+                match ws.next().await.unwrap().unwrap() {
+                    Frame::Text(text) => break serde_json::from_slice::<Value>(&text).unwrap(),
+                    _ => continue,
+                }
+            }
+        })
+        .await
+        .expect("no event arrived");
+        assert_eq!(event["type"], "created");
+        assert_eq!(event["id"], created["id"]);
+        assert_eq!(event["todo"]["title"], "Buy milk");
+    }
+}
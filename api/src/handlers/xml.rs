@@ -0,0 +1,105 @@
+use serde_json::Value;
+
+pub(crate) const XML_DECLARATION: &str = "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n";
+
+/// Escape text for element content, dropping characters XML 1.0 cannot hold
+fn escape(text: &str, out: &mut String) {
+    for c in text.chars() {
+        match c {
+            '&' => out.push_str("&amp;"),
+            '<' => out.push_str("&lt;"),
+            '>' => out.push_str("&gt;"),
+            '"' => out.push_str("&quot;"),
+            '\'' => out.push_str("&apos;"),
+            '\t' | '\n' | '\r' => out.push(c),
+            c if c < ' ' || c == '\u{FFFE}' || c == '\u{FFFF}' => {}
+            c => out.push(c),
+        }
+    }
+}
+
+/// Append `value` as an element called `name`. Objects become one child
+/// element per field, arrays repeat a child named after the singular of
+/// `name` (`tags` holds `tag` elements, `todos` holds `todo`), and null is an
+/// empty element.
+pub(crate) fn element(name: &str, value: &Value, out: &mut String) {
+    if value.is_null() {
+        out.push_str(&format!("<{}/>", name));
+        return;
+    }
+
+    out.push_str(&format!("<{}>", name));
+    match value {
+        Value::Object(fields) => {
+            for (field, value) in fields {
+                element(field, value, out);
+            }
+        }
+        Value::Array(items) => {
+            let item = name.strip_suffix('s').filter(|s| !s.is_empty()).unwrap_or("item");
+            for value in items {
+                element(item, value, out);
+            }
+        }
+        Value::String(text) => escape(text, out),
+        other => out.push_str(&other.to_string()),
+    }
+    out.push_str(&format!("</{}>", name));
+}
+
+/// A whole document whose root element is `name`
+pub(crate) fn document(name: &str, value: &Value) -> String {
+    let mut out = String::from(XML_DECLARATION);
+    element(name, value, &mut out);
+    out.push('\n');
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::header::{ACCEPT, CONTENT_TYPE};
+    use actix_web::test::{self, TestRequest};
+    use serde_json::{json, Value};
+
+    use super::{document, XML_DECLARATION};
+    use crate::testing;
+
+    #[test]
+    fn arrays_repeat_the_singular_and_text_is_escaped() {
+        let value = json!({"tags": ["a<b", "c"], "s": [1], "note": "x\u{1}y & 'z'", "due": null});
+        assert_eq!(
+            document("todo", &value),
+            format!(
+                "{}<todo><due/><note>xy &amp; &apos;z&apos;</note><s><item>1</item></s>\
+                 <tags><tag>a&lt;b</tag><tag>c</tag></tags></todo>\n",
+                XML_DECLARATION
+            )
+        );
+    }
+
+    #[actix_web::test]
+    async fn accept_xml_wraps_lists_in_todos_and_single_todos_in_todo() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let req = TestRequest::post().uri("/api/todos").set_json(json!({"title": "Fish & chips", "tags": ["food"]}));
+        let created: Value = test::call_and_read_body_json(&app, req.to_request()).await;
+
+        let req = TestRequest::get().uri("/api/todos").insert_header((ACCEPT, "application/xml"));
+        let res = test::call_service(&app, req.to_request()).await;
+        assert_eq!(res.headers().get(CONTENT_TYPE).unwrap(), "application/xml; charset=utf-8");
+        let body = String::from_utf8(test::read_body(res).await.to_vec()).unwrap();
+        assert!(body.starts_with(&format!("{}<todos><todo>", XML_DECLARATION)), "{}", body);
+        assert!(body.ends_with("</todo></todos>\n"), "{}", body);
+        assert_eq!(body.matches("<todo>").count(), 1);
+        assert!(body.contains("<title>Fish &amp; chips</title>"), "{}", body);
+        assert!(body.contains("<tags><tag>food</tag></tags>"), "{}", body);
+        assert!(body.contains("<due_date/>"), "{}", body);
+
+        let uri = format!("/api/todos/{}", created["id"].as_str().unwrap());
+        let req = TestRequest::get().uri(&uri).insert_header((ACCEPT, "text/xml"));
+        let body = String::from_utf8(test::call_and_read_body(&app, req.to_request()).await.to_vec()).unwrap();
+        assert!(body.starts_with(&format!("{}<todo>", XML_DECLARATION)), "{}", body);
+        assert!(body.ends_with("</todo>\n"), "{}", body);
+        assert!(body.contains(&format!("<id>{}</id>", created["id"].as_str().unwrap())), "{}", body);
+    }
+}
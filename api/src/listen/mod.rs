@@ -0,0 +1,160 @@
+use std::env;
+use std::fmt;
+use std::net::{SocketAddr, TcpListener, ToSocketAddrs};
+
+const DEFAULT_HOST: &str = "0.0.0.0";
+const DEFAULT_PORT: u16 = 8080;
+
+/// First file descriptor passed by systemd socket activation
+#[cfg(unix)]
+const SD_LISTEN_FDS_START: i32 = 3;
+
+/// Where the API server accepts connections
+pub enum Listen {
+    /// Bind a new socket on this address
+    Addr(SocketAddr),
+    /// Use a socket that was already bound and handed over by the service manager
+    Inherited(TcpListener),
+}
+
+impl Listen {
+    /// Resolve the listen address from the environment, in order of precedence:
+    /// systemd's LISTEN_FDS, an explicit ADDR=host:port, or HOST and PORT
+    pub fn from_env() -> Result<Self, String> {
+        let var = |name: &str| env::var(name).ok().filter(|v| !v.is_empty());
+
+        if let Some(fds) = var("LISTEN_FDS") {
+            return inherited(&fds, var("LISTEN_PID").as_deref());
+        }
+
+        if let Some(addr) = var("ADDR") {
+            if var("HOST").is_some() || var("PORT").is_some() {
+                return Err("ADDR cannot be combined with HOST or PORT".to_string());
+            }
+            return resolve(&addr).map(Listen::Addr);
+        }
+
+        let host = var("HOST").unwrap_or_else(|| DEFAULT_HOST.to_string());
+        let port = match var("PORT") {
+            Some(port) => parse_port(&port)?,
+            None => DEFAULT_PORT,
+        };
+
+        // Bracket IPv6 literals so they can be joined with the port
+        let addr = if host.contains(':') && !host.starts_with('[') {
+            format!("[{}]:{}", host, port)
+        } else {
+            format!("{}:{}", host, port)
+        };
+        resolve(&addr).map(Listen::Addr)
+    }
+
+    /// Port the server is reachable on
+    pub fn port(&self) -> std::io::Result<u16> {
+        match self {
+            Listen::Addr(addr) => Ok(addr.port()),
+            Listen::Inherited(listener) => listener.local_addr().map(|addr| addr.port()),
+        }
+    }
+}
+
+impl fmt::Display for Listen {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Listen::Addr(addr) => write!(f, "{}", addr),
+            Listen::Inherited(listener) => match listener.local_addr() {
+                Ok(addr) => write!(f, "{} (socket activated)", addr),
+                Err(_) => write!(f, "inherited socket"),
+            },
+        }
+    }
+}
+
+fn parse_port(port: &str) -> Result<u16, String> {
+    match port.parse::<u16>() {
+        Ok(port) if port > 0 => Ok(port),
+        _ => Err(format!("PORT must be a number between 1 and 65535, got '{}'", port)),
+    }
+}
+
+fn resolve(addr: &str) -> Result<SocketAddr, String> {
+    let (_, port) = addr
+        .rsplit_once(':')
+        .ok_or_else(|| format!("Listen address '{}' must be in host:port form", addr))?;
+    parse_port(port)?;
+
+    addr.to_socket_addrs()
+        .map_err(|e| format!("Invalid listen address '{}': {}", addr, e))?
+        .next()
+        .ok_or_else(|| format!("Listen address '{}' did not resolve", addr))
+}
+
+#[cfg(unix)]
+fn inherited(fds: &str, pid: Option<&str>) -> Result<Listen, String> {
+    use std::os::unix::io::FromRawFd;
+
+    if let Some(pid) = pid {
+        if pid != std::process::id().to_string() {
+            return Err(format!("LISTEN_PID {} does not match this process", pid));
+        }
+    }
+    match fds.parse::<u32>() {
+        Ok(1) => {}
+        Ok(n) => return Err(format!("Expected exactly one socket in LISTEN_FDS, got {}", n)),
+        Err(_) => return Err(format!("LISTEN_FDS must be a number, got '{}'", fds)),
+    }
+
+    // Safety: systemd guarantees the descriptor is open and owned by us when
+    // LISTEN_FDS is set for this process
+    let listener = unsafe { TcpListener::from_raw_fd(SD_LISTEN_FDS_START) };
+    listener
+        .local_addr()
+        .map_err(|e| format!("Inherited socket is not a TCP listener: {}", e))?;
+    Ok(Listen::Inherited(listener))
+}
+
+#[cfg(not(unix))]
+fn inherited(_fds: &str, _pid: Option<&str>) -> Result<Listen, String> {
+    Err("LISTEN_FDS socket activation is only supported on Unix".to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::Listen;
+    use crate::testing;
+
+    fn listen(vars: &[(&str, &str)]) -> Result<String, String> {
+        testing::with_env(vars, Listen::from_env).map(|listen| listen.to_string())
+    }
+
+    #[test]
+    fn address_comes_from_host_and_port_or_addr() {
+        let cases: [(&[(&str, &str)], &str); 6] = [
+            (&[], "0.0.0.0:8080"),
+            (&[("PORT", "3000")], "0.0.0.0:3000"),
+            (&[("HOST", "127.0.0.1")], "127.0.0.1:8080"),
+            (&[("HOST", "::1"), ("PORT", "3000")], "[::1]:3000"),
+            (&[("ADDR", "127.0.0.1:9000")], "127.0.0.1:9000"),
+            (&[("ADDR", "[::1]:9000"), ("HOST", ""), ("PORT", "")], "[::1]:9000"),
+        ];
+        for (vars, expected) in cases {
+            assert_eq!(listen(vars).as_deref(), Ok(expected), "{:?}", vars);
+        }
+    }
+
+    #[test]
+    fn conflicting_or_invalid_settings_are_rejected() {
+        let cases: [&[(&str, &str)]; 7] = [
+            &[("ADDR", "127.0.0.1:9000"), ("PORT", "3000")],
+            &[("ADDR", "127.0.0.1:9000"), ("HOST", "127.0.0.1")],
+            &[("ADDR", "127.0.0.1")],
+            &[("PORT", "0")],
+            &[("PORT", "65536")],
+            &[("LISTEN_FDS", "2")],
+            &[("LISTEN_FDS", "1"), ("LISTEN_PID", "0")],
+        ];
+        for vars in cases {
+            assert!(listen(vars).is_err(), "{:?}", vars);
+        }
+    }
+}
@@ -0,0 +1,136 @@
+use chrono::{SecondsFormat, Utc};
+use log::kv::{self, Key, Source, VisitSource};
+use log::{LevelFilter, Record};
+use serde_json::{Map, Value};
+use std::env;
+use std::io::Write;
+
+use crate::middleware::current_request_id;
+
+/// Collects a record's key/value pairs into the JSON object being written
+struct JsonFields<'a>(&'a mut Map<String, Value>);
+
+impl<'kvs> VisitSource<'kvs> for JsonFields<'_> {
+    fn visit_pair(&mut self, key: Key<'kvs>, value: kv::Value<'kvs>) -> Result<(), kv::Error> {
+        let value = if let Some(v) = value.to_u64() {
+            Value::from(v)
+        } else if let Some(v) = value.to_i64() {
+            Value::from(v)
+        } else if let Some(v) = value.to_f64() {
+            Value::from(v)
+        } else if let Some(v) = value.to_bool() {
+            Value::from(v)
+        } else {
+            Value::from(value.to_string())
+        };
+        self.0.insert(key.as_str().to_string(), value);
+        Ok(())
+    }
+}
+
+/// The JSON object written for `record`: timestamp, level, target, message,
+/// the current request id and the record's own key/value pairs
+pub(crate) fn entry(record: &Record) -> Map<String, Value> {
+    let mut entry = Map::new();
+    entry.insert(
+        "ts".to_string(),
+        Value::from(Utc::now().to_rfc3339_opts(SecondsFormat::Millis, true)),
+    );
+    entry.insert("level".to_string(), Value::from(record.level().as_str()));
+    entry.insert("target".to_string(), Value::from(record.target()));
+    entry.insert("msg".to_string(), Value::from(record.args().to_string()));
+    if let Some(id) = current_request_id() {
+        entry.insert("request_id".to_string(), Value::from(id));
+    }
+    let _ = record.key_values().visit(&mut JsonFields(&mut entry));
+    entry
+}
+
+/// Overall level configured through LOG_LEVEL, defaulting to info
+#[derive(Debug, Clone, Copy)]
+pub struct LogLevel(pub LevelFilter);
+
+impl LogLevel {
+    pub fn from_env() -> Result<Self, String> {
+        match env::var("LOG_LEVEL").ok().filter(|v| !v.trim().is_empty()) {
+            None => Ok(LogLevel(LevelFilter::Info)),
+            Some(value) => value.trim().parse().map(LogLevel).map_err(|_| {
+                format!("LOG_LEVEL must be one of off, error, warn, info, debug or trace, got '{}'", value)
+            }),
+        }
+    }
+}
+
+/// Install a logger that writes one JSON object per line to stderr, at info
+/// until the configured LogLevel is applied with `set_level`.
+///
+/// The overall level can also be changed while running; RUST_LOG can still
+/// be used to quieten individual modules.
+pub fn init() {
+    // The logger itself lets everything through that RUST_LOG does not
+    // exclude, so the overall level is log's max_level alone
+    env_logger::Builder::new()
+        .filter_level(LevelFilter::Trace)
+        .parse_env("RUST_LOG")
+        .format(|buf, record| writeln!(buf, "{}", Value::Object(entry(record))))
+        .init();
+    log::set_max_level(LevelFilter::Info);
+}
+
+/// Held by tests that change the overall level or need it to stay put
+#[cfg(test)]
+pub(crate) static LEVEL_LOCK: std::sync::Mutex<()> = std::sync::Mutex::new(());
+
+/// The overall level currently in effect
+pub fn level() -> LevelFilter {
+    log::max_level()
+}
+
+/// Change the overall level until the next restart
+pub fn set_level(level: LevelFilter) {
+    log::set_max_level(level);
+}
+
+#[cfg(test)]
+mod tests {
+    use chrono::DateTime;
+    use log::kv;
+    use log::{Level, Record};
+    use serde_json::Value;
+
+    use super::entry;
+
+    #[test]
+    fn records_become_one_flat_json_object() {
+        let fields = [
+            ("method", kv::Value::from("GET")),
+            ("status", kv::Value::from(404u64)),
+            ("offset", kv::Value::from(-3i64)),
+            ("ratio", kv::Value::from(0.5f64)),
+            ("cached", kv::Value::from(true)),
+        ];
+        let line = Value::Object(entry(
+            &Record::builder()
+                .level(Level::Warn)
+                .target("access")
+                .args(format_args!("request {}", "completed"))
+                .key_values(&fields)
+                .build(),
+        ))
+        .to_string();
+
+        assert!(!line.contains('\n'));
+        let entry: Value = serde_json::from_str(&line).unwrap();
+        assert!(DateTime::parse_from_rfc3339(entry["ts"].as_str().unwrap()).is_ok());
+        assert_eq!(entry["level"], "WARN");
+        assert_eq!(entry["target"], "access");
+        assert_eq!(entry["msg"], "request completed");
+        assert_eq!(entry["method"], "GET");
+        assert_eq!(entry["status"], 404);
+        assert_eq!(entry["offset"], -3);
+        assert_eq!(entry["ratio"], 0.5);
+        assert_eq!(entry["cached"], true);
+        // Outside a request there is no id to attach
+        assert!(entry.get("request_id").is_none());
+    }
+}
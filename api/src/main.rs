@@ -1,46 +1,323 @@
+mod auth;
+mod config;
 mod db;
+mod debug;
 mod error;
+mod events;
 mod handlers;
+mod listen;
+mod logging;
+mod middleware;
 mod models;
+mod reminders;
+mod repository;
 mod routes;
+mod seed;
+mod shutdown;
+#[cfg(test)]
+mod testing;
+mod tls;
+mod version;
+mod webhooks;
 
-use actix_web::{web, App, HttpServer, middleware};
-use actix_cors::Cors;
+use actix_web::{web, App, HttpServer};
+use actix_web::middleware::{from_fn, DefaultHeaders};
 use dotenv::dotenv;
-use env_logger::Env;
 use std::env;
 
 #[actix_web::main]
 async fn main() -> std::io::Result<()> {
     dotenv().ok();
-    env_logger::Builder::from_env(Env::default().default_filter_or("info")).init();
+    logging::init();
+    middleware::install_panic_hook();
 
-    let database_url = env::var("DATABASE_URL").expect("DATABASE_URL must be set");
-    let port = env::var("PORT").unwrap_or_else(|_| "8080".to_string());
-    let addr = format!("127.0.0.1:{}", port);
+    let invalid_config = |e: String| std::io::Error::new(std::io::ErrorKind::InvalidInput, e);
+    handlers::docs::check_spec().map_err(invalid_config)?;
+    let config = config::Config::from_env()?;
+    logging::set_level(config.log_level.0);
+    let backend = config.backend;
 
-    // Establish database connection
-    let pool = db::establish_connection()
-        .await
-        .expect("Failed to create pool");
+    // `--migrate` applies pending migrations and exits without serving
+    if env::args().skip(1).any(|arg| arg == "--migrate" || arg == "-migrate") {
+        return repository::migrate(&backend).await.map_err(|e| {
+            log::error!(error = e.to_string().as_str(); "migration failed");
+            std::io::Error::new(std::io::ErrorKind::Other, e)
+        });
+    }
 
-    log::info!("Starting server at http://{}", addr);
-    log::info!("Connected to database: {}", database_url);
+    let body_limit = config.body_limit;
+    let request_timeout = config.request_timeout;
+    let cors_settings = config.cors;
+    let listen = config.listen;
+    let api_key_auth = config.api_key_auth;
+    let rate_limiter = config.rate_limiter.map(web::Data::new);
+    let concurrency_limit = config.concurrency_limit.map(web::Data::new);
+    let trusted_proxies = web::Data::new(config.trusted_proxies);
+    let jwt_auth = config.jwt_auth;
+    let tls_settings = config.tls;
+    // Load certificates before connecting to the database so a bad pair fails fast
+    let tls_config = tls_settings
+        .as_ref()
+        .map(|tls| tls.server_config())
+        .transpose()
+        .map_err(invalid_config)?;
+    let started_at = web::Data::new(handlers::admin::StartedAt(chrono::Utc::now()));
+    let broker = web::Data::new(events::Broker::new());
+    let ws_limit = web::Data::new(config.ws_limit);
+    let idempotency_ttl = web::Data::new(config.idempotency_ttl);
+    let subtask_policy = config.subtask_policy;
+    let default_sort = config.default_sort;
+    let shutdown_timeout = config.shutdown_timeout;
+    let undo_window = config.undo_window;
+    let purge_settings = config.purge;
+    let admin_token = config.admin_token;
+    let read_only = config.read_only;
+    let allow_destructive = config.allow_destructive;
+    let unique_titles = config.unique_titles;
+    let profiling = config.profiling;
+    let docs = config.docs;
+    config.recurrence_zone.install();
+    config.slow_queries.install();
+    config.omit_null_description.install();
 
-    HttpServer::new(move || {
-        // Configure CORS
-        let cors = Cors::default()
-            .allow_any_origin()
-            .allow_any_method()
-            .allow_any_header();
+    // Establish database connection, or load the in-memory store
+    let repositories = repository::open(&backend).await.map_err(|e| {
+        log::error!(error = e.to_string().as_str(); "failed to open storage");
+        std::io::Error::new(std::io::ErrorKind::Other, e)
+    })?;
+    let repositories = match config.cache {
+        Some(settings) => repositories.cached(settings),
+        None => repositories,
+    };
+
+    if let Some(source) = config.seed {
+        let added = seed::run(repositories.todos.as_ref(), &source)
+            .await
+            .map_err(invalid_config)?;
+        log::info!("Seeded {} todos from {}", added, source.describe());
+    }
+
+    let webhook_settings = web::Data::new(config.webhooks);
+    webhooks::spawn(&broker, repositories.webhooks.clone(), config.webhooks);
+
+    handlers::undo::spawn_sweeper(repositories.todos.clone());
+    let purger = handlers::purge::spawn_purger(repositories.todos.clone(), purge_settings);
+
+    let scheduler = reminders::spawn(repositories.reminders.clone(), config.reminders)
+        .map_err(|e| std::io::Error::new(std::io::ErrorKind::Other, e))?;
+
+    let todo_repository = web::Data::from(repositories.todos.clone());
+    let list_repository = web::Data::from(repositories.lists.clone());
+    let user_repository = web::Data::from(repositories.users.clone());
+    let webhook_repository = web::Data::from(repositories.webhooks.clone());
+    let reminder_repository = web::Data::from(repositories.reminders.clone());
+    let health_repository = web::Data::from(repositories.health.clone());
+    let todo_cache = repositories.cache().map(web::Data::from);
+
+    log::info!(version = version::VERSION, commit = version::GIT_COMMIT; "todo-app build");
+    let scheme = if tls_config.is_some() { "https" } else { "http" };
+    log::info!("Starting server at {}://{}", scheme, listen);
+    match &backend {
+        repository::Backend::Database(settings) => {
+            log::info!("Connected to {} database: {}", settings.driver.as_str(), settings.url);
+            log::info!("Database queries time out after {:?}", settings.query_timeout);
+            match config.slow_queries.0 {
+                Some(threshold) => log::info!("Logging queries slower than {:?}", threshold),
+                None => log::info!("Slow query logging disabled (SLOW_QUERY_THRESHOLD=0)"),
+            }
+        }
+        repository::Backend::Memory(Some(file)) => {
+            log::info!("Using in-memory storage, saved to {} on shutdown", file.display());
+        }
+        repository::Backend::Memory(None) => {
+            log::info!("Using in-memory storage; data is lost on shutdown (set MEMORY_STORE_FILE to keep it)");
+        }
+    }
+
+    if read_only.0 {
+        log::warn!("READ-ONLY MODE: writes are answered with 503 until READ_ONLY is unset");
+    }
+
+    match request_timeout.0 {
+        Some(limit) => log::info!("Requests time out with 503 after {:?}", limit),
+        None => log::info!("Request timeout disabled (REQUEST_TIMEOUT=0)"),
+    }
+
+    if api_key_auth.enabled() {
+        log::info!("API key authentication enabled for /api routes");
+    } else {
+        log::info!("API key authentication disabled (set AUTH_ENABLED and API_KEYS to enable)");
+    }
+
+    if jwt_auth.enabled() {
+        log::info!("JWT authentication enabled; todos are scoped to the authenticated user");
+    } else {
+        log::info!("JWT authentication disabled (set JWT_SECRET to enable)");
+    }
+
+    log::info!("Deleting a todo with subtasks: {}", subtask_policy.as_str());
+
+    match purge_settings.after {
+        Some(after) => log::info!(
+            "Purging archived todos unchanged for {:?}, every {:?}",
+            after,
+            purge_settings.interval
+        ),
+        None => log::info!("Purging of archived todos disabled (PURGE_AFTER=0)"),
+    }
+    if unique_titles.0 {
+        log::info!("Open todo titles must be unique per user (STRICT_UNIQUE_TITLES)");
+    }
+    log::info!("Recurring todos repeat on the calendar of {}", config.recurrence_zone.0);
+    if allow_destructive.0 {
+        log::warn!("ALLOW_DESTRUCTIVE is set: DELETE /api/todos/all wipes every todo");
+    }
+    if !admin_token.enabled() {
+        log::info!("Admin API disabled (set ADMIN_TOKEN to enable)");
+    }
+
+    match &rate_limiter {
+        Some(limiter) => {
+            log::info!(
+                "Rate limiting enabled: {} requests/s per client, burst {}",
+                limiter.rate(),
+                limiter.burst()
+            );
+            middleware::RateLimiter::spawn_cleanup(limiter.clone());
+        }
+        None => log::info!("Rate limiting disabled (set RATE_LIMIT or RATE_LIMIT_RPS to enable)"),
+    }
+
+    if trusted_proxies.any_peer() {
+        log::warn!("TRUST_PROXY is set: X-Forwarded-For is believed from any peer; prefer TRUSTED_PROXIES");
+    } else if trusted_proxies.ranges() > 0 {
+        log::info!("Client IPs taken from X-Forwarded-For behind {} trusted proxy ranges", trusted_proxies.ranges());
+    } else {
+        log::info!("Client IPs are connection peer addresses (set TRUSTED_PROXIES behind a reverse proxy)");
+    }
+
+    match config.cache {
+        Some(settings) => log::info!(
+            "Caching todo reads for {:?}, at most {} entries",
+            settings.ttl,
+            settings.max_entries
+        ),
+        None => log::info!("Todo read cache disabled (set CACHE_TTL to enable)"),
+    }
+
+    match &concurrency_limit {
+        Some(limit) => log::info!("At most {} /api requests are handled at once", limit.max()),
+        None => log::info!("Concurrent request limit disabled (set MAX_CONCURRENT_REQUESTS to enable)"),
+    }
+
+    // Profiling gets its own localhost-only listener so it is never reachable
+    // through the public port
+    if let Some(debug_addr) = profiling.address() {
+        let debug_server = HttpServer::new(|| App::new().configure(debug::configure_routes))
+            .workers(1)
+            .bind(&debug_addr)?
+            .run();
+        actix_web::rt::spawn(debug_server);
+        log::info!("Profiling enabled at http://{}/debug/pprof/", debug_addr);
+    } else {
+        log::info!("Profiling disabled (set ENABLE_PPROF=true to enable)");
+    }
+
+    if let Some(redirect_port) = tls_settings.as_ref().and_then(|tls| tls.redirect_port()) {
+        let https_port = tls::HttpsPort(listen.port()?);
+        let redirect_addr = format!("0.0.0.0:{}", redirect_port);
+        let redirect_server = HttpServer::new(move || {
+            App::new()
+                .app_data(web::Data::new(https_port))
+                .default_service(web::to(tls::redirect_to_https))
+        })
+        .workers(1)
+        .bind(&redirect_addr)?
+        .run();
+        actix_web::rt::spawn(redirect_server);
+        log::info!("Redirecting http://{} to HTTPS", redirect_addr);
+    }
+
+    let server = HttpServer::new(move || {
+        let rate_limiter = rate_limiter.clone();
+        let concurrency_limit = concurrency_limit.clone();
+        let todo_cache = todo_cache.clone();
 
         App::new()
-            .app_data(web::Data::new(pool.clone()))
-            .wrap(cors)
-            .wrap(middleware::Logger::default())
-            .configure(routes::configure_routes)
-    })
-    .bind(&addr)?
-    .run()
-    .await
+            .app_data(todo_repository.clone())
+            .app_data(list_repository.clone())
+            .app_data(user_repository.clone())
+            .app_data(webhook_repository.clone())
+            .app_data(webhook_settings.clone())
+            .app_data(reminder_repository.clone())
+            .app_data(health_repository.clone())
+            .app_data(web::Data::new(api_key_auth.clone()))
+            .app_data(web::Data::new(jwt_auth.clone()))
+            .app_data(broker.clone())
+            .app_data(trusted_proxies.clone())
+            .app_data(ws_limit.clone())
+            .app_data(idempotency_ttl.clone())
+            .app_data(web::Data::new(subtask_policy))
+            .app_data(web::Data::new(default_sort))
+            .app_data(web::Data::new(undo_window))
+            .app_data(web::Data::new(purge_settings))
+            .app_data(web::Data::new(admin_token.clone()))
+            .app_data(started_at.clone())
+            .app_data(web::Data::new(allow_destructive))
+            .app_data(web::Data::new(unique_titles))
+            .app_data(body_limit)
+            .app_data(body_limit.json_config())
+            .app_data(body_limit.form_config())
+            .app_data(body_limit.payload_config())
+            .app_data(request_timeout)
+            .app_data(read_only)
+            .app_data(profiling)
+            .app_data(docs)
+            .app_data(error::path_config())
+            .app_data(error::query_config())
+            .wrap(error::json_error_handlers())
+            .wrap(from_fn(middleware::reject_writes))
+            .wrap(from_fn(middleware::limit_body_size))
+            .wrap(cors_settings.build())
+            .wrap(from_fn(middleware::enforce_timeout))
+            .wrap(from_fn(middleware::log_request))
+            .wrap(from_fn(middleware::resolve_client_ip))
+            .wrap(from_fn(middleware::recover))
+            .wrap(from_fn(middleware::propagate_request_id))
+            .wrap(DefaultHeaders::new().add((version::VERSION_HEADER, version::VERSION)))
+            .configure(move |cfg| {
+                if let Some(limiter) = rate_limiter {
+                    cfg.app_data(limiter);
+                }
+                if let Some(limit) = concurrency_limit {
+                    cfg.app_data(limit);
+                }
+                if let Some(cache) = todo_cache {
+                    cfg.app_data(cache);
+                }
+            })
+            .configure(move |cfg| routes::configure_routes(cfg, docs))
+    });
+
+    // Signals are handled by shutdown::serve, which drains requests before
+    // the storage is closed below and alone decides when to force an exit
+    let server = server.disable_signals().shutdown_timeout(shutdown_timeout.worker_secs());
+    let server = match (listen, tls_config) {
+        (listen::Listen::Addr(addr), Some(config)) => server.bind_rustls_0_23(addr, config)?,
+        (listen::Listen::Addr(addr), None) => server.bind(addr)?,
+        (listen::Listen::Inherited(listener), Some(config)) => server.listen_rustls_0_23(listener, config)?,
+        (listen::Listen::Inherited(listener), None) => server.listen(listener)?,
+    };
+
+    let result = shutdown::serve(server.run(), shutdown_timeout).await;
+    scheduler.stop().await;
+    if let Some(purger) = purger {
+        purger.stop().await;
+    }
+
+    if let Err(e) = repositories.save() {
+        log::error!(error = e.to_string().as_str(); "failed to save in-memory store");
+    }
+    repositories.close().await;
+    result
 }
@@ -0,0 +1,157 @@
+use actix_web::{
+    body::{BodySize, MessageBody},
+    dev::{ServiceRequest, ServiceResponse},
+    middleware::Next,
+    Error,
+};
+use log::Level;
+use std::time::Instant;
+
+use super::client_ip;
+use crate::db::metrics;
+
+/// Health checks are polled constantly; only log them at debug level unless they fail
+const QUIET_PATHS: &[&str] = &["/health"];
+
+/// Emits one structured access log line per request once it has completed,
+/// including the response status, size, how long the request took and how
+/// much of that was spent in database statements
+pub async fn log_request(
+    req: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>, Error> {
+    let start = Instant::now();
+    let method = req.method().to_string();
+    let path = req.path().to_string();
+    let remote_addr = client_ip(&req).map(|ip| ip.to_string()).unwrap_or_default();
+
+    let (res, db_time) = metrics::measure(next.call(req)).await;
+    let duration_ms = start.elapsed().as_millis() as u64;
+    let db_ms = db_time.as_millis() as u64;
+
+    let (status, bytes, error) = match &res {
+        Ok(res) => {
+            // Streamed bodies have no size up front and are reported as 0
+            let bytes = match res.response().body().size() {
+                BodySize::Sized(n) => n,
+                _ => 0,
+            };
+            (res.status().as_u16(), bytes, res.response().error().map(|e| e.to_string()))
+        }
+        Err(err) => (
+            err.as_response_error().status_code().as_u16(),
+            0,
+            Some(err.to_string()),
+        ),
+    };
+
+    let level = if status >= 500 {
+        Level::Error
+    } else if QUIET_PATHS.contains(&path.as_str()) {
+        Level::Debug
+    } else {
+        Level::Info
+    };
+
+    match error {
+        Some(error) => log::log!(
+            target: "access",
+            level,
+            method = method.as_str(),
+            path = path.as_str(),
+            remote_addr = remote_addr.as_str(),
+            status = status,
+            bytes = bytes,
+            duration_ms = duration_ms,
+            db_ms = db_ms,
+            error = error.as_str();
+            "request completed"
+        ),
+        None => log::log!(
+            target: "access",
+            level,
+            method = method.as_str(),
+            path = path.as_str(),
+            remote_addr = remote_addr.as_str(),
+            status = status,
+            bytes = bytes,
+            duration_ms = duration_ms,
+            db_ms = db_ms;
+            "request completed"
+        ),
+    }
+
+    res
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::middleware::from_fn;
+    use actix_web::test::{self, TestRequest};
+    use actix_web::{web, App, HttpResponse};
+    use log::{LevelFilter, Log, Metadata, Record};
+    use serde_json::{Map, Value};
+    use std::sync::Mutex;
+    use uuid::Uuid;
+
+    use super::log_request;
+    use crate::logging;
+
+    /// Keeps every access log entry instead of writing it out
+    struct Captured(Mutex<Vec<Map<String, Value>>>);
+
+    impl Log for Captured {
+        fn enabled(&self, _: &Metadata) -> bool {
+            true
+        }
+
+        fn log(&self, record: &Record) {
+            if record.target() == "access" {
+                self.0.lock().unwrap().push(logging::entry(record));
+            }
+        }
+
+        fn flush(&self) {}
+    }
+
+    static CAPTURED: Captured = Captured(Mutex::new(Vec::new()));
+
+    /// The entry logged for `path`; paths are unique per test since other
+    /// tests log through the same global logger
+    fn logged(path: &str) -> Map<String, Value> {
+        let entries = CAPTURED.0.lock().unwrap();
+        entries.iter().find(|e| e["path"] == path).cloned().expect("no access log entry")
+    }
+
+    #[actix_web::test]
+    async fn completed_requests_log_status_size_and_client() {
+        let _lock = logging::LEVEL_LOCK.lock().unwrap_or_else(|e| e.into_inner());
+        let _ = log::set_logger(&CAPTURED);
+        log::set_max_level(LevelFilter::Trace);
+        let app = App::new()
+            .wrap(from_fn(log_request))
+            .route("/created/{id}", web::post().to(|| async { HttpResponse::Created().body("hello") }))
+            .route("/broken/{id}", web::get().to(|| async { HttpResponse::InternalServerError().finish() }));
+        let app = test::init_service(app).await;
+
+        let created = format!("/created/{}", Uuid::new_v4());
+        let req = TestRequest::post().uri(&created).peer_addr("203.0.113.9:4711".parse().unwrap());
+        test::call_service(&app, req.to_request()).await;
+        let entry = logged(&created);
+        assert_eq!(entry["level"], "INFO");
+        assert_eq!(entry["msg"], "request completed");
+        assert_eq!(entry["method"], "POST");
+        assert_eq!(entry["status"], 201);
+        assert_eq!(entry["bytes"], 5);
+        assert_eq!(entry["remote_addr"], "203.0.113.9");
+        assert!(entry["duration_ms"].is_u64());
+        assert!(entry["db_ms"].is_u64());
+
+        let broken = format!("/broken/{}", Uuid::new_v4());
+        test::call_service(&app, TestRequest::get().uri(&broken).to_request()).await;
+        let entry = logged(&broken);
+        assert_eq!(entry["level"], "ERROR");
+        assert_eq!(entry["status"], 500);
+        assert_eq!(entry["remote_addr"], "");
+    }
+}
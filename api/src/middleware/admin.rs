@@ -0,0 +1,66 @@
+use actix_web::{
+    body::MessageBody,
+    dev::{ServiceRequest, ServiceResponse},
+    middleware::Next,
+    web, Error, ResponseError,
+};
+use std::env;
+use subtle::ConstantTimeEq;
+
+use crate::error::ApiError;
+
+pub const ADMIN_TOKEN_HEADER: &str = "x-admin-token";
+
+/// Token operators present in X-Admin-Token to reach /api/admin, configured
+/// through ADMIN_TOKEN. Without one the admin routes stay closed.
+#[derive(Debug, Clone, Default)]
+pub struct AdminToken(Option<String>);
+
+impl AdminToken {
+    pub fn from_env() -> Result<Self, String> {
+        let Some(value) = env::var("ADMIN_TOKEN").ok().filter(|t| !t.is_empty()) else {
+            return Ok(AdminToken(None));
+        };
+        // A token no header can carry would leave the admin routes closed for good
+        let token = value.trim();
+        if token.is_empty() || !token.bytes().all(|b| b.is_ascii_graphic() || b == b' ') {
+            return Err("ADMIN_TOKEN must be printable ASCII and not blank".to_string());
+        }
+        Ok(AdminToken(Some(token.to_string())))
+    }
+
+    pub fn enabled(&self) -> bool {
+        self.0.is_some()
+    }
+
+    fn accepts(&self, candidate: &str) -> bool {
+        match &self.0 {
+            Some(token) => token.as_bytes().ct_eq(candidate.as_bytes()).into(),
+            None => false,
+        }
+    }
+}
+
+/// Rejects requests without the admin token: 403 while ADMIN_TOKEN is unset,
+/// 401 for a missing or wrong token
+pub async fn require_admin_token(
+    req: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>, Error> {
+    let rejection = match req.app_data::<web::Data<AdminToken>>() {
+        Some(admin) if admin.enabled() => {
+            let presented = req.headers().get(ADMIN_TOKEN_HEADER).and_then(|v| v.to_str().ok());
+            match presented {
+                Some(candidate) if admin.accepts(candidate.trim()) => None,
+                _ => Some(ApiError::Unauthorized("Missing or invalid admin token".to_string())),
+            }
+        }
+        _ => Some(ApiError::Forbidden("The admin API is disabled (set ADMIN_TOKEN to enable)".to_string())),
+    };
+
+    if let Some(err) = rejection {
+        return Ok(req.into_response(err.error_response()).map_into_right_body());
+    }
+
+    next.call(req).await.map(ServiceResponse::map_into_left_body)
+}
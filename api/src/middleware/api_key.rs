@@ -0,0 +1,141 @@
+use actix_web::{
+    body::MessageBody,
+    dev::{ServiceRequest, ServiceResponse},
+    http::header::AUTHORIZATION,
+    middleware::Next,
+    web, Error, ResponseError,
+};
+use std::env;
+use subtle::{Choice, ConstantTimeEq};
+
+use crate::config::flag;
+use crate::error::ApiError;
+
+pub const API_KEY_HEADER: &str = "x-api-key";
+
+/// API keys accepted on /api routes.
+///
+/// Keys come from API_KEYS (comma-separated) and/or API_KEY. Authentication is
+/// controlled by AUTH_ENABLED and defaults to on whenever keys are configured,
+/// so local development without keys is unaffected.
+#[derive(Debug, Clone, Default)]
+pub struct ApiKeyAuth {
+    enabled: bool,
+    keys: Vec<String>,
+}
+
+impl ApiKeyAuth {
+    pub fn from_env() -> Result<Self, String> {
+        let keys: Vec<String> = env::var("API_KEYS")
+            .unwrap_or_default()
+            .split(',')
+            .chain(env::var("API_KEY").as_deref().unwrap_or_default().split(','))
+            .map(str::trim)
+            .filter(|k| !k.is_empty())
+            .map(str::to_string)
+            .collect();
+
+        let enabled = flag("AUTH_ENABLED", !keys.is_empty())?;
+
+        if enabled && keys.is_empty() {
+            return Err("AUTH_ENABLED is set but no API_KEYS are configured".to_string());
+        }
+
+        Ok(ApiKeyAuth { enabled, keys })
+    }
+
+    pub fn enabled(&self) -> bool {
+        self.enabled
+    }
+
+    /// Compare against every key in constant time so response timing leaks
+    /// neither which key matched nor how much of it did
+    fn accepts(&self, candidate: &str) -> bool {
+        let matched = self
+            .keys
+            .iter()
+            .fold(Choice::from(0), |acc, key| acc | key.as_bytes().ct_eq(candidate.as_bytes()));
+        matched.into()
+    }
+}
+
+/// Key presented in X-API-Key, or else as an `Authorization: Bearer` token
+fn presented_key(req: &ServiceRequest) -> Option<&str> {
+    let headers = req.headers();
+    if let Some(key) = headers.get(API_KEY_HEADER).and_then(|v| v.to_str().ok()) {
+        return Some(key);
+    }
+    headers
+        .get(AUTHORIZATION)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.strip_prefix("Bearer "))
+        .map(str::trim)
+}
+
+/// Rejects requests without a valid API key with 401
+pub async fn require_api_key(
+    req: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>, Error> {
+    let authorized = match req.app_data::<web::Data<ApiKeyAuth>>() {
+        Some(auth) if auth.enabled() => presented_key(&req)
+            .map(|candidate| auth.accepts(candidate))
+            .unwrap_or(false),
+        _ => true,
+    };
+
+    if !authorized {
+        let res = ApiError::Unauthorized("Missing or invalid API key".to_string()).error_response();
+        return Ok(req.into_response(res).map_into_right_body());
+    }
+
+    next.call(req).await.map(ServiceResponse::map_into_left_body)
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+
+    use super::API_KEY_HEADER;
+    use crate::testing;
+
+    #[actix_web::test]
+    async fn only_a_configured_key_is_let_through() {
+        let repositories = testing::repositories();
+        let config = testing::config(&[("API_KEYS", "first-key, second-key")]);
+        let app = test::init_service(testing::app(config, &repositories)).await;
+
+        let cases = [
+            (None, StatusCode::UNAUTHORIZED),
+            (Some((API_KEY_HEADER, "wrong-key")), StatusCode::UNAUTHORIZED),
+            (Some((API_KEY_HEADER, "first-key")), StatusCode::OK),
+            (Some((API_KEY_HEADER, "second-key")), StatusCode::OK),
+            (Some(("authorization", "Bearer second-key")), StatusCode::OK),
+            (Some(("authorization", "Bearer wrong-key")), StatusCode::UNAUTHORIZED),
+        ];
+        for (header, expected) in cases {
+            let mut req = TestRequest::get().uri("/api/todos");
+            if let Some(header) = header {
+                req = req.insert_header(header);
+            }
+            let res = test::call_service(&app, req.to_request()).await;
+            assert_eq!(res.status(), expected, "{:?}", header);
+        }
+    }
+
+    #[actix_web::test]
+    async fn public_routes_need_no_key() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[("API_KEY", "key")]), &repositories)).await;
+        let res = test::call_service(&app, TestRequest::get().uri("/health").to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+    }
+
+    #[test]
+    fn enabling_auth_requires_a_key() {
+        assert!(testing::with_env(&[("AUTH_ENABLED", "true")], super::ApiKeyAuth::from_env).is_err());
+        let auth = testing::with_env(&[("API_KEY", "key"), ("AUTH_ENABLED", "false")], super::ApiKeyAuth::from_env);
+        assert!(!auth.unwrap().enabled());
+    }
+}
@@ -0,0 +1,99 @@
+use actix_web::{
+    body::MessageBody,
+    dev::{ServiceRequest, ServiceResponse},
+    error::{JsonPayloadError, UrlencodedError},
+    http::header::CONTENT_LENGTH,
+    middleware::Next,
+    web, Error, ResponseError,
+};
+use std::env;
+
+use crate::error::ApiError;
+
+pub const DEFAULT_MAX_BODY_BYTES: usize = 1024 * 1024;
+
+/// Largest request body the API accepts, configured through MAX_BODY_BYTES
+#[derive(Debug, Clone, Copy)]
+pub struct BodyLimit(pub usize);
+
+impl BodyLimit {
+    pub fn from_env() -> Result<Self, String> {
+        match env::var("MAX_BODY_BYTES").ok().filter(|v| !v.is_empty()) {
+            None => Ok(BodyLimit(DEFAULT_MAX_BODY_BYTES)),
+            Some(value) => value
+                .parse()
+                .ok()
+                .filter(|&limit| limit > 0)
+                .map(BodyLimit)
+                .ok_or_else(|| format!("MAX_BODY_BYTES must be a positive number of bytes, got '{}'", value)),
+        }
+    }
+
+    fn exceeded(&self) -> ApiError {
+        ApiError::PayloadTooLarge(format!("Request body exceeds the {} byte limit", self.0))
+    }
+
+    /// JSON extractor config enforcing the limit, rejecting non-JSON content
+    /// types with 415 and reporting parse failures as ErrorResponse JSON
+    pub fn json_config(self) -> web::JsonConfig {
+        web::JsonConfig::default()
+            .limit(self.0)
+            .error_handler(move |err, _req| {
+                let err = match err {
+                    JsonPayloadError::Overflow { .. }
+                    | JsonPayloadError::OverflowKnownLength { .. } => self.exceeded(),
+                    JsonPayloadError::ContentType => ApiError::UnsupportedMediaType(
+                        "Content-Type must be application/json".to_string(),
+                    ),
+                    err => ApiError::BadRequest(err.to_string()),
+                };
+                err.into()
+            })
+    }
+
+    /// Urlencoded form extractor config enforcing the limit
+    pub fn form_config(self) -> web::FormConfig {
+        web::FormConfig::default()
+            .limit(self.0)
+            .error_handler(move |err, _req| {
+                let err = match err {
+                    UrlencodedError::Overflow { .. } => self.exceeded(),
+                    UrlencodedError::ContentType => ApiError::UnsupportedMediaType(
+                        "Content-Type must be application/x-www-form-urlencoded".to_string(),
+                    ),
+                    err => ApiError::BadRequest(err.to_string()),
+                };
+                err.into()
+            })
+    }
+
+    /// Raw body extractor config enforcing the limit
+    pub fn payload_config(self) -> web::PayloadConfig {
+        web::PayloadConfig::new(self.0)
+    }
+}
+
+/// Rejects requests whose declared Content-Length exceeds the body limit before
+/// any of the body is read
+pub async fn limit_body_size(
+    req: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>, Error> {
+    let limit = req
+        .app_data::<BodyLimit>()
+        .copied()
+        .unwrap_or(BodyLimit(DEFAULT_MAX_BODY_BYTES));
+
+    let length = req
+        .headers()
+        .get(CONTENT_LENGTH)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.parse::<usize>().ok());
+
+    if matches!(length, Some(len) if len > limit.0) {
+        let res = limit.exceeded().error_response();
+        return Ok(req.into_response(res).map_into_right_body());
+    }
+
+    next.call(req).await.map(ServiceResponse::map_into_left_body)
+}
@@ -0,0 +1,231 @@
+use actix_web::{
+    body::MessageBody,
+    dev::{ServiceRequest, ServiceResponse},
+    http::header::HeaderMap,
+    middleware::Next,
+    web, Error, HttpMessage,
+};
+use std::env;
+use std::net::IpAddr;
+
+use crate::config::flag;
+
+const FORWARDED_FOR_HEADER: &str = "x-forwarded-for";
+const REAL_IP_HEADER: &str = "x-real-ip";
+
+/// IP address of the client that sent the request, as resolved by
+/// `resolve_client_ip`. Stored in the request extensions.
+#[derive(Debug, Clone, Copy)]
+pub struct ClientIp(pub IpAddr);
+
+/// An address range such as `10.0.0.0/8`, or a single address
+#[derive(Debug, Clone, Copy)]
+struct Network {
+    addr: IpAddr,
+    prefix: u32,
+}
+
+/// The address as an integer, with the number of bits it has
+fn bits(ip: IpAddr) -> (u128, u32) {
+    match ip.to_canonical() {
+        IpAddr::V4(ip) => (u128::from(u32::from(ip)), 32),
+        IpAddr::V6(ip) => (u128::from(ip), 128),
+    }
+}
+
+impl Network {
+    fn parse(value: &str) -> Option<Self> {
+        let (addr, prefix) = match value.split_once('/') {
+            Some((addr, prefix)) => (addr, Some(prefix)),
+            None => (value, None),
+        };
+        let addr: IpAddr = addr.trim().parse::<IpAddr>().ok()?.to_canonical();
+        let (_, width) = bits(addr);
+        let prefix = match prefix {
+            Some(prefix) => prefix.trim().parse().ok().filter(|p| *p <= width)?,
+            None => width,
+        };
+        Some(Network { addr, prefix })
+    }
+
+    fn contains(&self, ip: IpAddr) -> bool {
+        let (network, width) = bits(self.addr);
+        let (ip, ip_width) = bits(ip);
+        if width != ip_width {
+            return false;
+        }
+        let host_bits = width - self.prefix;
+        host_bits == width || network >> host_bits == ip >> host_bits
+    }
+}
+
+/// Reverse proxies allowed to report the client address, configured through
+/// TRUSTED_PROXIES as a comma separated list of addresses and CIDR ranges.
+/// The older TRUST_PROXY=true trusts whichever peer connects, one hop deep.
+#[derive(Debug, Clone)]
+pub struct TrustedProxies {
+    any_peer: bool,
+    networks: Vec<Network>,
+}
+
+impl TrustedProxies {
+    pub fn from_env() -> Result<Self, String> {
+        let mut networks = Vec::new();
+        for entry in env::var("TRUSTED_PROXIES").unwrap_or_default().split(',') {
+            let entry = entry.trim();
+            if entry.is_empty() {
+                continue;
+            }
+            networks.push(Network::parse(entry).ok_or_else(|| {
+                format!("TRUSTED_PROXIES entry '{}' is not an IP address or CIDR range", entry)
+            })?);
+        }
+        Ok(TrustedProxies { any_peer: flag("TRUST_PROXY", false)?, networks })
+    }
+
+    pub fn any_peer(&self) -> bool {
+        self.any_peer
+    }
+
+    pub fn ranges(&self) -> usize {
+        self.networks.len()
+    }
+
+    fn trusts(&self, ip: IpAddr) -> bool {
+        self.networks.iter().any(|network| network.contains(ip))
+    }
+
+    /// The client behind `peer`. Forwarding headers are only believed when
+    /// `peer` is a trusted proxy; X-Forwarded-For is then walked from the
+    /// right, skipping trusted proxies, and the first other hop is the client.
+    /// Everything left of it could have been written by the client itself.
+    fn resolve(&self, peer: IpAddr, headers: &HeaderMap) -> IpAddr {
+        if !self.any_peer && !self.trusts(peer) {
+            return peer;
+        }
+
+        let hops: Vec<&str> = headers
+            .get_all(FORWARDED_FOR_HEADER)
+            .filter_map(|v| v.to_str().ok())
+            .flat_map(|v| v.split(','))
+            .collect();
+        if hops.is_empty() {
+            return headers
+                .get(REAL_IP_HEADER)
+                .and_then(|v| v.to_str().ok())
+                .and_then(|v| v.trim().parse().ok())
+                .unwrap_or(peer);
+        }
+
+        let mut client = peer;
+        for hop in hops.iter().rev() {
+            // A hop we cannot read ends the chain; the last one we could is
+            // as far as the proxies vouch for
+            let Ok(ip) = hop.trim().parse::<IpAddr>() else { break };
+            client = ip;
+            if !self.trusts(ip) {
+                break;
+            }
+        }
+        client
+    }
+}
+
+/// Works out the client IP once per request and stores it as `ClientIp`, so
+/// the access log and the rate limiter agree on who sent it
+pub async fn resolve_client_ip(
+    req: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>, Error> {
+    if let Some(peer) = req.peer_addr().map(|addr| addr.ip()) {
+        let ip = match req.app_data::<web::Data<TrustedProxies>>() {
+            Some(proxies) => proxies.resolve(peer, req.headers()),
+            None => peer,
+        };
+        req.extensions_mut().insert(ClientIp(ip));
+    }
+
+    next.call(req).await
+}
+
+/// IP address of the client that sent the request
+pub fn client_ip(req: &ServiceRequest) -> Option<IpAddr> {
+    req.extensions()
+        .get::<ClientIp>()
+        .map(|ip| ip.0)
+        .or_else(|| req.peer_addr().map(|addr| addr.ip()))
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::header::{HeaderMap, HeaderName, HeaderValue};
+    use std::net::IpAddr;
+
+    use super::{TrustedProxies, FORWARDED_FOR_HEADER, REAL_IP_HEADER};
+    use crate::testing;
+
+    fn proxies(trusted: &str) -> TrustedProxies {
+        testing::with_env(&[("TRUSTED_PROXIES", trusted)], TrustedProxies::from_env).unwrap()
+    }
+
+    fn headers(pairs: &[(&'static str, &'static str)]) -> HeaderMap {
+        let mut headers = HeaderMap::new();
+        for (name, value) in pairs {
+            headers.append(HeaderName::from_static(name), HeaderValue::from_static(value));
+        }
+        headers
+    }
+
+    fn ip(value: &str) -> IpAddr {
+        value.parse().unwrap()
+    }
+
+    #[test]
+    fn untrusted_peer_cannot_forge_its_address() {
+        let proxies = proxies("10.0.0.0/8");
+        let forged = headers(&[(FORWARDED_FOR_HEADER, "198.51.100.7"), (REAL_IP_HEADER, "198.51.100.8")]);
+        assert_eq!(proxies.resolve(ip("203.0.113.9"), &forged), ip("203.0.113.9"));
+    }
+
+    #[test]
+    fn chain_is_walked_back_to_the_first_untrusted_hop() {
+        let proxies = proxies("10.0.0.0/8, 192.0.2.1");
+        let cases = [
+            ("198.51.100.7", "198.51.100.7"),
+            ("198.51.100.7, 10.0.0.5, 192.0.2.1", "198.51.100.7"),
+            // Whatever the client wrote itself stays left of its own address
+            ("6.6.6.6, 198.51.100.7, 10.0.0.5", "198.51.100.7"),
+            ("10.0.0.9, 10.0.0.5", "10.0.0.9"),
+        ];
+        for (chain, client) in cases {
+            let headers = headers(&[(FORWARDED_FOR_HEADER, chain)]);
+            assert_eq!(proxies.resolve(ip("10.0.0.2"), &headers), ip(client), "{}", chain);
+        }
+
+        // Repeated headers read as one list, and an IPv4-mapped peer is still trusted
+        let split = headers(&[(FORWARDED_FOR_HEADER, "198.51.100.7"), (FORWARDED_FOR_HEADER, "10.0.0.5")]);
+        assert_eq!(proxies.resolve(ip("::ffff:10.0.0.2"), &split), ip("198.51.100.7"));
+        let real_ip = headers(&[(REAL_IP_HEADER, "198.51.100.7")]);
+        assert_eq!(proxies.resolve(ip("10.0.0.2"), &real_ip), ip("198.51.100.7"));
+    }
+
+    #[test]
+    fn malformed_entries_stop_the_walk() {
+        let proxies = proxies("10.0.0.0/8");
+        let cases = [
+            ("198.51.100.7, not-an-ip, 10.0.0.5", "10.0.0.5"),
+            ("198.51.100.7, unknown", "10.0.0.2"),
+            ("198.51.100.7,, 10.0.0.5", "10.0.0.5"),
+        ];
+        for (chain, client) in cases {
+            let headers = headers(&[(FORWARDED_FOR_HEADER, chain)]);
+            assert_eq!(proxies.resolve(ip("10.0.0.2"), &headers), ip(client), "{}", chain);
+        }
+        let garbled = headers(&[(REAL_IP_HEADER, "localhost")]);
+        assert_eq!(proxies.resolve(ip("10.0.0.2"), &garbled), ip("10.0.0.2"));
+
+        for entry in ["10.0.0.0/33", "proxy.internal", "10.0.0.0/x"] {
+            assert!(testing::with_env(&[("TRUSTED_PROXIES", entry)], TrustedProxies::from_env).is_err(), "{}", entry);
+        }
+    }
+}
@@ -0,0 +1,128 @@
+use actix_web::{
+    body::MessageBody,
+    dev::{ServiceRequest, ServiceResponse},
+    http::header::{HeaderValue, RETRY_AFTER},
+    middleware::Next,
+    web, Error, ResponseError,
+};
+use std::env;
+use std::sync::Arc;
+use tokio::sync::Semaphore;
+
+use crate::error::ApiError;
+
+/// Seconds a rejected client is told to wait; slots free up as soon as any
+/// in-flight request finishes, so there is no better estimate
+const RETRY_AFTER_SECS: u64 = 1;
+
+/// Most `/api/*` requests handled at once, configured through
+/// MAX_CONCURRENT_REQUESTS. Requests beyond it are refused straight away
+/// instead of queuing behind the busy ones for a database connection.
+pub struct ConcurrencyLimit {
+    max: usize,
+    slots: Arc<Semaphore>,
+}
+
+impl ConcurrencyLimit {
+    /// Returns None when MAX_CONCURRENT_REQUESTS is unset or 0
+    pub fn from_env() -> Result<Option<Self>, String> {
+        let Some(value) = env::var("MAX_CONCURRENT_REQUESTS").ok().filter(|v| !v.is_empty()) else {
+            return Ok(None);
+        };
+        let max: usize = value.parse().map_err(|_| {
+            format!("MAX_CONCURRENT_REQUESTS must be a number, or 0 to disable, got '{}'", value)
+        })?;
+        Ok((max > 0).then(|| ConcurrencyLimit::new(max)))
+    }
+
+    pub fn new(max: usize) -> Self {
+        ConcurrencyLimit { max, slots: Arc::new(Semaphore::new(max)) }
+    }
+
+    pub fn max(&self) -> usize {
+        self.max
+    }
+}
+
+/// Answers 503 with Retry-After while MAX_CONCURRENT_REQUESTS requests are
+/// already in flight. The slot is held until the handler has produced its
+/// response; streamed bodies keep flowing after it is released. The permit is
+/// dropped with the handler's future, so a request that panics or times out
+/// gives its slot back as well.
+pub async fn limit_concurrency(
+    req: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>, Error> {
+    let Some(limit) = req.app_data::<web::Data<ConcurrencyLimit>>() else {
+        return next.call(req).await.map(ServiceResponse::map_into_left_body);
+    };
+
+    let Ok(_slot) = limit.slots.clone().try_acquire_owned() else {
+        log::warn!(
+            method = req.method().as_str(),
+            path = req.path(),
+            max = limit.max;
+            "concurrent request limit reached"
+        );
+        let mut res = ApiError::ServiceUnavailable(
+            "Too many requests in flight, try again shortly".to_string(),
+        )
+        .error_response();
+        res.headers_mut().insert(RETRY_AFTER, HeaderValue::from(RETRY_AFTER_SECS));
+        return Ok(req.into_response(res).map_into_right_body());
+    };
+
+    next.call(req).await.map(ServiceResponse::map_into_left_body)
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::header::RETRY_AFTER;
+    use actix_web::http::StatusCode;
+    use actix_web::middleware::from_fn;
+    use actix_web::test::{self, TestRequest};
+    use actix_web::{web, App, HttpResponse};
+    use serde_json::Value;
+
+    use super::{limit_concurrency, ConcurrencyLimit};
+    use crate::middleware::recover;
+
+    async fn ok() -> HttpResponse {
+        HttpResponse::Ok().finish()
+    }
+
+    async fn boom() -> HttpResponse {
+        panic!("boom")
+    }
+
+    #[actix_web::test]
+    async fn full_slots_are_refused_and_panics_give_theirs_back() {
+        let limit = web::Data::new(ConcurrencyLimit::new(2));
+        let app = App::new()
+            .app_data(limit.clone())
+            .wrap(from_fn(limit_concurrency))
+            .wrap(from_fn(recover))
+            .route("/ok", web::get().to(ok))
+            .route("/boom", web::get().to(boom));
+        let app = test::init_service(app).await;
+
+        // Both slots taken by requests still in flight
+        let held = limit.slots.clone().try_acquire_many_owned(2).unwrap();
+        let res = test::call_service(&app, TestRequest::get().uri("/ok").to_request()).await;
+        assert_eq!(res.status(), StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(res.headers().get(RETRY_AFTER).unwrap(), "1");
+        let body: Value = test::read_body_json(res).await;
+        assert_eq!(body["error"], "SERVICE_UNAVAILABLE");
+        drop(held);
+
+        let res = test::call_service(&app, TestRequest::get().uri("/ok").to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+        for _ in 0..3 {
+            let res = test::call_service(&app, TestRequest::get().uri("/boom").to_request()).await;
+            assert_eq!(res.status(), StatusCode::INTERNAL_SERVER_ERROR);
+        }
+        assert_eq!(limit.slots.available_permits(), 2);
+        let res = test::call_service(&app, TestRequest::get().uri("/ok").to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+    }
+}
@@ -0,0 +1,146 @@
+use actix_cors::Cors;
+use actix_web::http::header::LOCATION;
+use std::env;
+
+use super::REQUEST_ID_HEADER;
+use crate::config::flag;
+use crate::handlers::todo::{NEXT_CURSOR_HEADER, SERVER_TIME_HEADER, TOTAL_COUNT_HEADER};
+use crate::handlers::undo::UNDO_TOKEN_HEADER;
+use crate::version::VERSION_HEADER;
+
+const DEFAULT_MAX_AGE_SECS: usize = 3600;
+
+/// CORS policy read from the environment. Empty lists mean "any".
+#[derive(Debug, Clone)]
+pub struct CorsSettings {
+    pub allowed_origins: Vec<String>,
+    pub allowed_methods: Vec<String>,
+    pub allowed_headers: Vec<String>,
+    pub allow_credentials: bool,
+    pub max_age: usize,
+}
+
+/// Comma-separated list from an env var, ignoring blanks; "*" means any
+fn env_list(name: &str) -> Vec<String> {
+    env::var(name)
+        .unwrap_or_default()
+        .split(',')
+        .map(str::trim)
+        .filter(|v| !v.is_empty() && *v != "*")
+        .map(str::to_string)
+        .collect()
+}
+
+impl CorsSettings {
+    pub fn from_env() -> Result<Self, String> {
+        let max_age = match env::var("CORS_MAX_AGE").ok().filter(|v| !v.is_empty()) {
+            None => DEFAULT_MAX_AGE_SECS,
+            Some(value) => value
+                .trim()
+                .parse()
+                .map_err(|_| format!("CORS_MAX_AGE must be a whole number of seconds, got '{}'", value))?,
+        };
+        Ok(CorsSettings {
+            allowed_origins: env_list("CORS_ALLOWED_ORIGINS"),
+            allowed_methods: env_list("CORS_ALLOWED_METHODS"),
+            allowed_headers: env_list("CORS_ALLOWED_HEADERS"),
+            allow_credentials: flag("CORS_ALLOW_CREDENTIALS", false)?,
+            max_age,
+        })
+    }
+
+    /// Build the middleware. The Origin header is validated against the allowed
+    /// list, and preflight requests are answered directly without reaching the router.
+    pub fn build(&self) -> Cors {
+        let mut cors = Cors::default()
+            .max_age(self.max_age)
+            .expose_headers([
+                REQUEST_ID_HEADER,
+                UNDO_TOKEN_HEADER,
+                NEXT_CURSOR_HEADER,
+                TOTAL_COUNT_HEADER,
+                SERVER_TIME_HEADER,
+                VERSION_HEADER,
+                LOCATION.as_str(),
+            ]);
+
+        if self.allowed_origins.is_empty() {
+            cors = cors.allow_any_origin();
+        } else {
+            for origin in &self.allowed_origins {
+                cors = cors.allowed_origin(origin);
+            }
+        }
+
+        cors = if self.allowed_methods.is_empty() {
+            cors.allow_any_method()
+        } else {
+            cors.allowed_methods(self.allowed_methods.iter().map(String::as_str))
+        };
+
+        cors = if self.allowed_headers.is_empty() {
+            cors.allow_any_header()
+        } else {
+            cors.allowed_headers(self.allowed_headers.iter().map(String::as_str))
+        };
+
+        if self.allow_credentials {
+            cors = cors.supports_credentials();
+        }
+
+        cors
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::header::{
+        ACCESS_CONTROL_ALLOW_METHODS, ACCESS_CONTROL_ALLOW_ORIGIN, ACCESS_CONTROL_MAX_AGE,
+        ACCESS_CONTROL_REQUEST_METHOD, ORIGIN,
+    };
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+
+    use crate::testing;
+
+    fn preflight(origin: &str, method: &str) -> TestRequest {
+        TestRequest::default()
+            .method(actix_web::http::Method::OPTIONS)
+            .uri("/api/todos")
+            .insert_header((ORIGIN, origin))
+            .insert_header((ACCESS_CONTROL_REQUEST_METHOD, method))
+    }
+
+    #[actix_web::test]
+    async fn preflight_is_answered_for_allowed_origins_and_methods() {
+        let config = testing::config(&[
+            ("CORS_ALLOWED_ORIGINS", "https://app.example.com"),
+            ("CORS_ALLOWED_METHODS", "GET, POST"),
+            ("CORS_MAX_AGE", "600"),
+        ]);
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(config, &repositories)).await;
+
+        let res = test::call_service(&app, preflight("https://app.example.com", "POST").to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+        let header = |name| res.headers().get(name).map(|v| v.to_str().unwrap().to_string());
+        assert_eq!(header(ACCESS_CONTROL_ALLOW_ORIGIN).as_deref(), Some("https://app.example.com"));
+        assert_eq!(header(ACCESS_CONTROL_MAX_AGE).as_deref(), Some("600"));
+        assert!(header(ACCESS_CONTROL_ALLOW_METHODS).unwrap().contains("POST"));
+
+        for (origin, method) in [("https://evil.example.com", "POST"), ("https://app.example.com", "DELETE")] {
+            let res = test::call_service(&app, preflight(origin, method).to_request()).await;
+            assert_eq!(res.status(), StatusCode::BAD_REQUEST, "{} {}", origin, method);
+            assert!(res.headers().get(ACCESS_CONTROL_ALLOW_ORIGIN).is_none());
+        }
+    }
+
+    #[actix_web::test]
+    async fn any_origin_is_allowed_by_default() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let res = test::call_service(&app, preflight("https://anywhere.example", "DELETE").to_request()).await;
+        assert_eq!(res.status(), StatusCode::OK);
+        assert!(res.headers().contains_key(ACCESS_CONTROL_ALLOW_ORIGIN));
+    }
+}
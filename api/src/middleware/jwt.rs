@@ -0,0 +1,97 @@
+use actix_web::{
+    body::MessageBody,
+    dev::{ServiceRequest, ServiceResponse},
+    http::header::AUTHORIZATION,
+    middleware::Next,
+    web, Error, HttpMessage, ResponseError,
+};
+
+use crate::auth::{AuthUser, JwtAuth};
+use crate::error::ApiError;
+
+/// Requires a valid `Authorization: Bearer <jwt>` header when JWT auth is
+/// enabled and records the authenticated user for the handlers
+pub async fn authenticate_jwt(
+    req: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>, Error> {
+    let auth = match req.app_data::<web::Data<JwtAuth>>() {
+        Some(auth) if auth.enabled() => auth.clone(),
+        _ => return next.call(req).await.map(ServiceResponse::map_into_left_body),
+    };
+
+    let token = req
+        .headers()
+        .get(AUTHORIZATION)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.strip_prefix("Bearer "))
+        .map(str::trim);
+
+    let verified = match token {
+        Some(token) => auth.verify(token),
+        None => Err(ApiError::Unauthorized("Missing bearer token".to_string())),
+    };
+
+    match verified {
+        Ok(user_id) => {
+            req.extensions_mut().insert(AuthUser { user_id: Some(user_id) });
+            next.call(req).await.map(ServiceResponse::map_into_left_body)
+        }
+        Err(err) => {
+            let res = err.error_response();
+            Ok(req.into_response(res).map_into_right_body())
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+    use serde_json::{json, Value};
+
+    use crate::testing;
+
+    #[actix_web::test]
+    async fn users_only_see_their_own_todos() {
+        let config = testing::config(&[("JWT_SECRET", "test-secret")]);
+        let (_, alice) = testing::token(&config);
+        let (_, bob) = testing::token(&config);
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(config, &repositories)).await;
+
+        let req = testing::bearer(TestRequest::post().uri("/api/todos"), &alice).set_json(json!({"title": "Private"}));
+        let created: Value = test::call_and_read_body_json(&app, req.to_request()).await;
+        let uri = format!("/api/todos/{}", created["id"].as_str().unwrap());
+
+        let req = testing::bearer(TestRequest::get().uri("/api/todos"), &bob).to_request();
+        let listed: Value = test::call_and_read_body_json(&app, req).await;
+        assert_eq!(listed, json!([]));
+        let requests = [
+            TestRequest::get().uri(&uri),
+            TestRequest::put().uri(&uri).set_json(json!({"title": "Taken over"})),
+            TestRequest::delete().uri(&uri),
+        ];
+        for req in requests {
+            let res = test::call_service(&app, testing::bearer(req, &bob).to_request()).await;
+            assert_eq!(res.status(), StatusCode::NOT_FOUND);
+        }
+
+        let req = testing::bearer(TestRequest::get().uri(&uri), &alice).to_request();
+        let fetched: Value = test::call_and_read_body_json(&app, req).await;
+        assert_eq!(fetched["title"], "Private");
+    }
+
+    #[actix_web::test]
+    async fn missing_or_forged_tokens_are_rejected() {
+        let config = testing::config(&[("JWT_SECRET", "test-secret")]);
+        let forged = testing::token(&testing::config(&[("JWT_SECRET", "other-secret")])).1;
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(config, &repositories)).await;
+
+        let res = test::call_service(&app, TestRequest::get().uri("/api/todos").to_request()).await;
+        assert_eq!(res.status(), StatusCode::UNAUTHORIZED);
+        let req = testing::bearer(TestRequest::get().uri("/api/todos"), &forged).to_request();
+        assert_eq!(test::call_service(&app, req).await.status(), StatusCode::UNAUTHORIZED);
+    }
+}
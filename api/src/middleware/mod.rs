@@ -0,0 +1,27 @@
+pub mod access_log;
+pub mod admin;
+pub mod api_key;
+pub mod body_limit;
+pub mod client_ip;
+pub mod concurrency;
+pub mod cors;
+pub mod jwt;
+pub mod rate_limit;
+pub mod read_only;
+pub mod recover;
+pub mod request_id;
+pub mod timeout;
+
+pub use access_log::log_request;
+pub use admin::{require_admin_token, AdminToken};
+pub use api_key::{require_api_key, ApiKeyAuth};
+pub use body_limit::{limit_body_size, BodyLimit};
+pub use client_ip::{client_ip, resolve_client_ip, TrustedProxies};
+pub use concurrency::{limit_concurrency, ConcurrencyLimit};
+pub use cors::CorsSettings;
+pub use jwt::authenticate_jwt;
+pub use rate_limit::{rate_limit, RateLimiter};
+pub use read_only::{reject_writes, ReadOnly};
+pub use recover::{install_panic_hook, recover};
+pub use request_id::{current_request_id, propagate_request_id, REQUEST_ID_HEADER};
+pub use timeout::{enforce_timeout, RequestTimeout};
@@ -0,0 +1,232 @@
+use actix_web::{
+    body::MessageBody,
+    dev::{ServiceRequest, ServiceResponse},
+    http::header::{HeaderValue, RETRY_AFTER},
+    middleware::Next,
+    web, Error, ResponseError,
+};
+use std::collections::HashMap;
+use std::env;
+use std::net::IpAddr;
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+use super::client_ip;
+use crate::error::ApiError;
+
+/// How often idle buckets are dropped from memory
+pub const CLEANUP_INTERVAL: Duration = Duration::from_secs(60);
+
+/// Bounds on RATE_LIMIT_RPS. Outside them the waits and refill times derived
+/// from the rate no longer fit in a `Duration`.
+const MIN_RPS: f64 = 0.001;
+const MAX_RPS: f64 = 1_000_000.0;
+
+struct Bucket {
+    tokens: f64,
+    updated_at: Instant,
+}
+
+/// In-memory token bucket per client IP. Each client may burst up to `burst`
+/// requests, refilled at `rate` tokens per second.
+pub struct RateLimiter {
+    rate: f64,
+    burst: f64,
+    buckets: Mutex<HashMap<IpAddr, Bucket>>,
+}
+
+impl RateLimiter {
+    /// Build a limiter from the environment. The rate is either RATE_LIMIT_RPS
+    /// (requests per second) or RATE_LIMIT (requests per minute); RATE_LIMIT_BURST
+    /// overrides the bucket size. Returns None when rate limiting is disabled,
+    /// and fails when RATE_LIMIT_RPS is not a number between MIN_RPS and MAX_RPS.
+    pub fn from_env() -> Result<Option<Self>, String> {
+        let per_second = match env::var("RATE_LIMIT_RPS").ok().filter(|v| !v.is_empty()) {
+            None => None,
+            Some(value) => match value.parse::<f64>() {
+                Ok(rate) if rate == 0.0 => None,
+                Ok(rate) if (MIN_RPS..=MAX_RPS).contains(&rate) => Some(rate),
+                _ => {
+                    return Err(format!(
+                        "RATE_LIMIT_RPS must be a number between {} and {}, or 0 to disable, got '{}'",
+                        MIN_RPS, MAX_RPS, value
+                    ))
+                }
+            },
+        };
+        let per_minute = env::var("RATE_LIMIT")
+            .ok()
+            .and_then(|v| v.parse::<u32>().ok())
+            .filter(|rate| *rate > 0)
+            .map(f64::from);
+
+        // A per-minute limit lets a client spend the whole minute's budget at once
+        let (rate, default_burst) = match (per_second, per_minute) {
+            (Some(rate), _) => (rate, rate.ceil().max(1.0)),
+            (None, Some(per_minute)) => (per_minute / 60.0, per_minute),
+            (None, None) => return Ok(None),
+        };
+
+        let burst = env::var("RATE_LIMIT_BURST")
+            .ok()
+            .and_then(|v| v.parse::<u32>().ok())
+            .filter(|burst| *burst > 0)
+            .map(f64::from)
+            .unwrap_or(default_burst);
+
+        Ok(Some(RateLimiter::new(rate, burst)))
+    }
+
+    pub fn new(rate: f64, burst: f64) -> Self {
+        RateLimiter {
+            rate,
+            burst,
+            buckets: Mutex::new(HashMap::new()),
+        }
+    }
+
+    pub fn rate(&self) -> f64 {
+        self.rate
+    }
+
+    pub fn burst(&self) -> f64 {
+        self.burst
+    }
+
+    /// Take a token for `ip`. When the bucket is empty, returns how long until
+    /// the next token is available.
+    fn acquire(&self, ip: IpAddr) -> Result<(), Duration> {
+        self.acquire_at(ip, Instant::now())
+    }
+
+    fn acquire_at(&self, ip: IpAddr, now: Instant) -> Result<(), Duration> {
+        let mut buckets = self.buckets.lock().unwrap();
+        let bucket = buckets.entry(ip).or_insert(Bucket {
+            tokens: self.burst,
+            updated_at: now,
+        });
+
+        let elapsed = now.duration_since(bucket.updated_at).as_secs_f64();
+        bucket.tokens = (bucket.tokens + elapsed * self.rate).min(self.burst);
+        bucket.updated_at = now;
+
+        if bucket.tokens >= 1.0 {
+            bucket.tokens -= 1.0;
+            Ok(())
+        } else {
+            Err(Duration::from_secs_f64((1.0 - bucket.tokens) / self.rate))
+        }
+    }
+
+    /// Drop buckets that have been idle long enough to be full again; they are
+    /// indistinguishable from a fresh bucket
+    pub fn cleanup(&self) {
+        let now = Instant::now();
+        let refill = Duration::from_secs_f64(self.burst / self.rate);
+        self.buckets
+            .lock()
+            .unwrap()
+            .retain(|_, bucket| now.duration_since(bucket.updated_at) < refill);
+    }
+
+    /// Periodically drop idle buckets so the map does not grow without bound
+    pub fn spawn_cleanup(limiter: web::Data<RateLimiter>) {
+        actix_web::rt::spawn(async move {
+            let mut interval = actix_web::rt::time::interval(CLEANUP_INTERVAL);
+            loop {
+                interval.tick().await;
+                limiter.cleanup();
+            }
+        });
+    }
+}
+
+/// Rejects clients that exceed their request budget with 429 and a Retry-After header
+pub async fn rate_limit(
+    req: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>, Error> {
+    let verdict = match req.app_data::<web::Data<RateLimiter>>() {
+        Some(limiter) => match client_ip(&req) {
+            Some(ip) => limiter.acquire(ip),
+            None => Ok(()),
+        },
+        None => Ok(()),
+    };
+
+    if let Err(retry_after) = verdict {
+        let mut res = ApiError::TooManyRequests("Rate limit exceeded".to_string()).error_response();
+        let secs = retry_after.as_secs_f64().ceil().max(1.0) as u64;
+        res.headers_mut().insert(RETRY_AFTER, HeaderValue::from(secs));
+        return Ok(req.into_response(res).map_into_right_body());
+    }
+
+    next.call(req).await.map(ServiceResponse::map_into_left_body)
+}
+
+#[cfg(test)]
+mod tests {
+    use std::net::IpAddr;
+    use std::time::{Duration, Instant};
+
+    use super::RateLimiter;
+    use crate::testing;
+
+    fn ip(value: &str) -> IpAddr {
+        value.parse().unwrap()
+    }
+
+    #[test]
+    fn empty_bucket_refills_at_the_rate() {
+        let limiter = RateLimiter::new(2.0, 2.0);
+        let client = ip("192.0.2.1");
+        let start = Instant::now();
+
+        assert_eq!(limiter.acquire_at(client, start), Ok(()));
+        assert_eq!(limiter.acquire_at(client, start), Ok(()));
+        assert_eq!(limiter.acquire_at(client, start), Err(Duration::from_millis(500)));
+        assert_eq!(limiter.acquire_at(client, start + Duration::from_millis(250)), Err(Duration::from_millis(250)));
+        assert_eq!(limiter.acquire_at(client, start + Duration::from_millis(500)), Ok(()));
+        assert!(limiter.acquire_at(client, start + Duration::from_millis(500)).is_err());
+    }
+
+    #[test]
+    fn idle_client_recovers_no_more_than_the_burst() {
+        let limiter = RateLimiter::new(1.0, 3.0);
+        let client = ip("192.0.2.1");
+        let start = Instant::now();
+        for _ in 0..3 {
+            assert_eq!(limiter.acquire_at(client, start), Ok(()));
+        }
+        assert!(limiter.acquire_at(client, start).is_err());
+
+        let later = start + Duration::from_secs(60);
+        for _ in 0..3 {
+            assert_eq!(limiter.acquire_at(client, later), Ok(()));
+        }
+        assert_eq!(limiter.acquire_at(client, later), Err(Duration::from_secs(1)));
+    }
+
+    #[test]
+    fn clients_have_their_own_buckets() {
+        let limiter = RateLimiter::new(1.0, 1.0);
+        let now = Instant::now();
+        assert_eq!(limiter.acquire_at(ip("192.0.2.1"), now), Ok(()));
+        assert!(limiter.acquire_at(ip("192.0.2.1"), now).is_err());
+        assert_eq!(limiter.acquire_at(ip("2001:db8::1"), now), Ok(()));
+    }
+
+    fn from_env(rps: &str) -> Result<Option<RateLimiter>, String> {
+        testing::with_env(&[("RATE_LIMIT_RPS", rps)], RateLimiter::from_env)
+    }
+
+    #[test]
+    fn per_second_rate_must_be_in_range() {
+        assert_eq!(from_env("2.5").unwrap().map(|l| (l.rate(), l.burst())), Some((2.5, 3.0)));
+        assert!(from_env("0").unwrap().is_none());
+        assert!(from_env("").unwrap().is_none());
+        for rps in ["inf", "NaN", "-1", "1e-300", "1e12", "fast"] {
+            assert!(from_env(rps).is_err(), "{}", rps);
+        }
+    }
+}
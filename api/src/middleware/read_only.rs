@@ -0,0 +1,51 @@
+use actix_web::{
+    body::MessageBody,
+    dev::{ServiceRequest, ServiceResponse},
+    http::Method,
+    middleware::Next,
+    Error, ResponseError,
+};
+
+use crate::config::flag;
+use crate::error::ApiError;
+
+/// POST endpoints that only read, and so stay open in read-only mode
+const READ_ONLY_POSTS: [&str; 3] = ["/api/auth/login", "/api/todos/exists", "/api/todos/batch-get"];
+
+/// Whether the API refuses writes, configured through READ_ONLY for
+/// maintenance windows
+#[derive(Debug, Clone, Copy)]
+pub struct ReadOnly(pub bool);
+
+impl ReadOnly {
+    pub fn from_env() -> Result<Self, String> {
+        flag("READ_ONLY", false).map(ReadOnly)
+    }
+}
+
+/// Whether a request with this method and path changes anything
+fn is_write(method: &Method, path: &str) -> bool {
+    match *method {
+        Method::GET | Method::HEAD | Method::OPTIONS => false,
+        Method::POST => !READ_ONLY_POSTS.contains(&path),
+        _ => true,
+    }
+}
+
+/// Answers writes with 503 while READ_ONLY is set, before their body is read;
+/// reads are served as usual
+pub async fn reject_writes(
+    req: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>, Error> {
+    let read_only = req.app_data::<ReadOnly>().is_some_and(|r| r.0);
+    if read_only && is_write(req.method(), req.path()) {
+        let res = ApiError::ServiceUnavailable(
+            "The service is read-only for maintenance; only reads are accepted".to_string(),
+        )
+        .error_response();
+        return Ok(req.into_response(res).map_into_right_body());
+    }
+
+    next.call(req).await.map(ServiceResponse::map_into_left_body)
+}
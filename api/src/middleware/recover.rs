@@ -0,0 +1,67 @@
+use actix_web::{
+    body::MessageBody,
+    dev::{ServiceRequest, ServiceResponse},
+    middleware::Next,
+    Error, ResponseError,
+};
+use futures_util::FutureExt;
+use std::backtrace::Backtrace;
+use std::panic::{self, AssertUnwindSafe};
+
+use crate::error::ApiError;
+
+/// Log panics through the structured logger, with their backtrace. The hook
+/// runs on the panicking task, so the line carries the request ID.
+pub fn install_panic_hook() {
+    panic::set_hook(Box::new(|info| {
+        let backtrace = Backtrace::force_capture();
+        log::error!(
+            panic = info.to_string().as_str(),
+            backtrace = backtrace.to_string().as_str();
+            "handler panicked"
+        );
+    }));
+}
+
+/// Turns a panic anywhere further down the chain into a 500 ErrorResponse
+/// instead of dropping the connection
+pub async fn recover(
+    req: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>, Error> {
+    let http_req = req.request().clone();
+
+    match AssertUnwindSafe(next.call(req)).catch_unwind().await {
+        Ok(res) => res.map(ServiceResponse::map_into_left_body),
+        Err(_) => {
+            let res = ApiError::InternalServerError("Internal server error".to_string())
+                .error_response();
+            Ok(ServiceResponse::new(http_req, res).map_into_right_body())
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use actix_web::middleware::from_fn;
+    use actix_web::test::{self, TestRequest};
+    use actix_web::{web, App, HttpResponse};
+    use serde_json::Value;
+
+    async fn boom() -> HttpResponse {
+        panic!("boom")
+    }
+
+    #[actix_web::test]
+    async fn panicking_route_returns_a_json_500() {
+        let app = App::new().wrap(from_fn(super::recover)).route("/boom", web::get().to(boom));
+        let app = test::init_service(app).await;
+
+        let res = test::call_service(&app, TestRequest::get().uri("/boom").to_request()).await;
+        assert_eq!(res.status(), StatusCode::INTERNAL_SERVER_ERROR);
+        let body: Value = test::read_body_json(res).await;
+        assert_eq!(body["error"], "INTERNAL_SERVER_ERROR");
+        assert_eq!(body["message"], "Internal server error");
+    }
+}
@@ -0,0 +1,95 @@
+use actix_web::{
+    body::MessageBody,
+    dev::{ServiceRequest, ServiceResponse},
+    http::header::{HeaderName, HeaderValue},
+    middleware::Next,
+    Error,
+};
+use uuid::Uuid;
+
+pub const REQUEST_ID_HEADER: &str = "x-request-id";
+
+/// Longest client-supplied request ID we are willing to echo back
+const MAX_REQUEST_ID_LEN: usize = 128;
+
+tokio::task_local! {
+    static REQUEST_ID: String;
+}
+
+/// ID of the request currently being handled, if called from within one
+pub fn current_request_id() -> Option<String> {
+    REQUEST_ID.try_with(|id| id.clone()).ok()
+}
+
+/// Reads X-Request-ID from the incoming request (or generates a UUID), makes it
+/// available to handlers, error responses and log lines for the duration of the
+/// request, and echoes it back in the response header
+pub async fn propagate_request_id(
+    req: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>, Error> {
+    let id = req
+        .headers()
+        .get(REQUEST_ID_HEADER)
+        .and_then(|v| v.to_str().ok())
+        .map(str::trim)
+        .filter(|v| !v.is_empty() && v.len() <= MAX_REQUEST_ID_LEN)
+        .map(str::to_string)
+        .unwrap_or_else(|| Uuid::new_v4().to_string());
+
+    let mut res = REQUEST_ID.scope(id.clone(), next.call(req)).await?;
+
+    if let Ok(value) = HeaderValue::from_str(&id) {
+        res.headers_mut()
+            .insert(HeaderName::from_static(REQUEST_ID_HEADER), value);
+    }
+
+    Ok(res)
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::http::StatusCode;
+    use actix_web::test::{self, TestRequest};
+    use serde_json::Value;
+    use uuid::Uuid;
+
+    use super::REQUEST_ID_HEADER;
+    use crate::testing;
+
+    fn echoed(res: &actix_web::dev::ServiceResponse<impl actix_web::body::MessageBody>) -> String {
+        res.headers().get(REQUEST_ID_HEADER).unwrap().to_str().unwrap().to_string()
+    }
+
+    #[actix_web::test]
+    async fn supplied_id_is_echoed_and_reported_in_errors() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+
+        let req = TestRequest::get()
+            .uri(&format!("/api/todos/{}", Uuid::new_v4()))
+            .insert_header((REQUEST_ID_HEADER, " trace-42 "))
+            .to_request();
+        let res = test::call_service(&app, req).await;
+        assert_eq!(res.status(), StatusCode::NOT_FOUND);
+        assert_eq!(echoed(&res), "trace-42");
+        let body: Value = test::read_body_json(res).await;
+        assert_eq!(body["request_id"], "trace-42");
+    }
+
+    #[actix_web::test]
+    async fn missing_or_oversized_ids_are_replaced() {
+        let repositories = testing::repositories();
+        let app = test::init_service(testing::app(testing::config(&[]), &repositories)).await;
+        let oversized = "x".repeat(super::MAX_REQUEST_ID_LEN + 1);
+
+        for supplied in [None, Some(""), Some(oversized.as_str())] {
+            let mut req = TestRequest::get().uri("/health");
+            if let Some(supplied) = supplied {
+                req = req.insert_header((REQUEST_ID_HEADER, supplied));
+            }
+            let res = test::call_service(&app, req.to_request()).await;
+            assert!(Uuid::parse_str(&echoed(&res)).is_ok(), "{:?}", supplied);
+        }
+    }
+}
@@ -0,0 +1,64 @@
+use actix_web::{
+    body::MessageBody,
+    dev::{ServiceRequest, ServiceResponse},
+    middleware::Next,
+    Error, ResponseError,
+};
+use std::env;
+use std::time::Duration;
+
+use crate::db::parse_duration;
+use crate::error::ApiError;
+
+const DEFAULT_TIMEOUT: Duration = Duration::from_secs(60);
+
+/// Longest a handler may take to produce its response, configured through
+/// REQUEST_TIMEOUT; `None` when REQUEST_TIMEOUT=0 turns the ceiling off.
+/// Streamed bodies such as exports keep flowing once the response has started.
+#[derive(Debug, Clone, Copy)]
+pub struct RequestTimeout(pub Option<Duration>);
+
+impl RequestTimeout {
+    pub fn from_env() -> Result<Self, String> {
+        match env::var("REQUEST_TIMEOUT").ok().filter(|v| !v.is_empty()) {
+            None => Ok(RequestTimeout(Some(DEFAULT_TIMEOUT))),
+            Some(value) => parse_duration(&value)
+                .map(|d| RequestTimeout(Some(d).filter(|d| !d.is_zero())))
+                .ok_or_else(|| {
+                    format!("REQUEST_TIMEOUT must be a duration such as '60', '60s' or '1m', or 0 to disable, got '{}'", value)
+                }),
+        }
+    }
+}
+
+/// Answers 503 once a request has run longer than REQUEST_TIMEOUT. The handler
+/// is dropped at that point, which cancels whatever it was awaiting, so nothing
+/// keeps running on its behalf.
+pub async fn enforce_timeout(
+    req: ServiceRequest,
+    next: Next<impl MessageBody>,
+) -> Result<ServiceResponse<impl MessageBody>, Error> {
+    let Some(limit) = req.app_data::<RequestTimeout>().and_then(|t| t.0) else {
+        return next.call(req).await.map(ServiceResponse::map_into_left_body);
+    };
+
+    // Kept to answer with, since the handler owns the request once called
+    let http_req = req.request().clone();
+    match tokio::time::timeout(limit, next.call(req)).await {
+        Ok(res) => res.map(ServiceResponse::map_into_left_body),
+        Err(_) => {
+            log::warn!(
+                method = http_req.method().as_str(),
+                path = http_req.path(),
+                timeout_ms = limit.as_millis() as u64;
+                "request timed out; abandoning handler"
+            );
+            let res = ApiError::ServiceUnavailable(format!(
+                "Request did not complete within {}ms",
+                limit.as_millis()
+            ))
+            .error_response();
+            Ok(ServiceResponse::new(http_req, res).map_into_right_body())
+        }
+    }
+}
@@ -0,0 +1,71 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+
+use super::PoolStats;
+
+/// Returned by GET /api/admin/status: what the running server is configured
+/// to do and how it is doing
+#[derive(Debug, Serialize)]
+pub struct AdminStatus {
+    pub version: &'static str,
+    pub commit: &'static str,
+    pub started_at: DateTime<Utc>,
+    pub uptime_secs: i64,
+    /// Current level, as changed by PUT /api/admin/loglevel
+    pub log_level: String,
+    pub read_only: bool,
+    pub features: Features,
+    /// None when rate limiting is off
+    pub rate_limit: Option<RateLimitStatus>,
+    /// None when MAX_CONCURRENT_REQUESTS is off
+    pub max_concurrent_requests: Option<usize>,
+    /// None for the in-memory store, or when the database did not answer
+    pub database: Option<PoolStats>,
+    /// None when CACHE_TTL is off
+    pub cache: Option<CacheStats>,
+    pub runtime: RuntimeStats,
+}
+
+/// Optional parts of the server and whether they are on
+#[derive(Debug, Serialize)]
+pub struct Features {
+    pub pprof: bool,
+    pub docs: bool,
+    pub api_key_auth: bool,
+    pub jwt_auth: bool,
+}
+
+#[derive(Debug, Serialize)]
+pub struct RateLimitStatus {
+    pub requests_per_second: f64,
+    pub burst: f64,
+}
+
+/// The todo read cache and how well it is doing since startup
+#[derive(Debug, Serialize)]
+pub struct CacheStats {
+    pub ttl_secs: f64,
+    pub max_entries: usize,
+    pub entries: usize,
+    pub hits: u64,
+    pub misses: u64,
+}
+
+#[derive(Debug, Serialize)]
+pub struct RuntimeStats {
+    pub pid: u32,
+    /// CPUs available to the process, which is also the number of workers
+    pub cpus: usize,
+}
+
+/// Body of PUT /api/admin/loglevel
+#[derive(Debug, Deserialize)]
+pub struct LogLevelRequest {
+    pub level: String,
+}
+
+#[derive(Debug, Serialize)]
+pub struct LogLevelResponse {
+    pub level: String,
+    pub previous: String,
+}
@@ -0,0 +1,28 @@
+use serde::Serialize;
+
+/// A list response wrapped with metadata about the page, for clients that
+/// ask for `envelope=true` instead of a bare array
+#[derive(Debug, Serialize)]
+pub struct Envelope<T> {
+    pub data: Vec<T>,
+    pub meta: ListMeta,
+}
+
+impl<T> Envelope<T> {
+    pub fn new(data: Vec<T>, limit: Option<i64>, next_cursor: Option<String>) -> Self {
+        let meta = ListMeta { count: data.len(), limit, next_cursor };
+        Envelope { data, meta }
+    }
+}
+
+#[derive(Debug, Serialize)]
+pub struct ListMeta {
+    /// Number of items in `data`
+    pub count: usize,
+    /// Page size in effect, or null when the list is not paginated
+    pub limit: Option<i64>,
+    /// Cursor for the next page, empty on the last one; omitted when the list
+    /// is not paginated
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub next_cursor: Option<String>,
+}
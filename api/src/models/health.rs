@@ -0,0 +1,16 @@
+use serde::Serialize;
+
+/// Database connection pool state, returned by GET /health/db
+#[derive(Debug, Serialize)]
+pub struct PoolStats {
+    /// `postgres` or `sqlite`
+    pub driver: &'static str,
+    /// Most connections the pool will open
+    pub max_connections: u32,
+    /// Connections currently open, idle or in use
+    pub total: u32,
+    pub idle: u32,
+    pub in_use: u32,
+    /// How long it took to get a connection for the health check's ping
+    pub acquire_ms: f64,
+}
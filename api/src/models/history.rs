@@ -0,0 +1,83 @@
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use chrono::{DateTime, Utc};
+use uuid::Uuid;
+
+/// What a history entry records happening to a todo
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum HistoryAction {
+    Created,
+    Updated,
+    Deleted,
+    /// Brought back by undoing its deletion
+    Restored,
+    /// Moved by reordering its owner's todos
+    Reordered,
+}
+
+impl HistoryAction {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            HistoryAction::Created => "created",
+            HistoryAction::Updated => "updated",
+            HistoryAction::Deleted => "deleted",
+            HistoryAction::Restored => "restored",
+            HistoryAction::Reordered => "reordered",
+        }
+    }
+}
+
+/// One change to a todo, written in the same transaction as the change itself.
+/// Kept after the todo is deleted.
+#[derive(Debug, Clone, Serialize, Deserialize, sqlx::FromRow)]
+pub struct HistoryEvent {
+    /// Increases with every event, so it orders them even within one instant
+    pub id: i64,
+    pub todo_id: Uuid,
+    /// Owner of the todo when the event was recorded
+    pub user_id: Option<Uuid>,
+    /// A `HistoryAction` name
+    pub event: String,
+    pub actor_id: Option<Uuid>,
+    /// The todo as returned by the API after the change, or as it was for a delete
+    pub snapshot: Value,
+    pub created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct HistoryEventResponse {
+    pub id: i64,
+    pub event: String,
+    pub actor_id: Option<Uuid>,
+    pub created_at: DateTime<Utc>,
+    pub todo: Value,
+}
+
+impl From<HistoryEvent> for HistoryEventResponse {
+    fn from(event: HistoryEvent) -> Self {
+        HistoryEventResponse {
+            id: event.id,
+            event: event.event,
+            actor_id: event.actor_id,
+            created_at: event.created_at,
+            todo: event.snapshot,
+        }
+    }
+}
+
+/// One page of a todo's history, newest first. `next_cursor` is empty on the
+/// last page.
+#[derive(Debug, Serialize)]
+pub struct HistoryPage {
+    pub events: Vec<HistoryEventResponse>,
+    pub next_cursor: String,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct HistoryQuery {
+    /// Page size
+    pub limit: Option<i64>,
+    /// `next_cursor` from the previous page
+    pub after: Option<String>,
+}
@@ -0,0 +1,82 @@
+use serde::{Deserialize, Serialize};
+use chrono::{DateTime, Utc};
+use uuid::Uuid;
+
+/// What a user may do with a list and the todos in it, from least to most
+/// privileged
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Role {
+    Viewer,
+    Editor,
+    Owner,
+}
+
+impl Role {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Role::Viewer => "viewer",
+            Role::Editor => "editor",
+            Role::Owner => "owner",
+        }
+    }
+
+    /// Parse the value stored in `list_members.role`
+    pub fn from_db(role: &str) -> Option<Role> {
+        match role {
+            "viewer" => Some(Role::Viewer),
+            "editor" => Some(Role::Editor),
+            "owner" => Some(Role::Owner),
+            _ => None,
+        }
+    }
+}
+
+#[derive(Debug, Clone, sqlx::FromRow)]
+pub struct TodoList {
+    pub id: Uuid,
+    pub name: String,
+    pub owner_id: Uuid,
+    pub role: String,
+    pub created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct ListResponse {
+    pub id: Uuid,
+    pub name: String,
+    pub owner_id: Uuid,
+    pub role: String,
+    pub created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct CreateListRequest {
+    pub name: String,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ShareListRequest {
+    pub username: String,
+    pub role: Role,
+}
+
+#[derive(Debug, Serialize, sqlx::FromRow)]
+pub struct ListMember {
+    pub user_id: Uuid,
+    pub username: String,
+    pub role: String,
+    pub created_at: DateTime<Utc>,
+}
+
+impl From<TodoList> for ListResponse {
+    fn from(list: TodoList) -> Self {
+        ListResponse {
+            id: list.id,
+            name: list.name,
+            owner_id: list.owner_id,
+            role: list.role,
+            created_at: list.created_at,
+        }
+    }
+}
@@ -1,3 +1,29 @@
+pub mod admin;
+pub mod envelope;
+pub mod health;
+pub mod history;
+pub mod list;
+pub mod notification;
+pub mod patch;
+pub mod timestamp;
 pub mod todo;
+pub mod user;
+pub mod webhook;
 
-pub use todo::{Todo, CreateTodoRequest, UpdateTodoRequest, TodoResponse};
+pub use admin::{AdminStatus, CacheStats, Features, LogLevelRequest, LogLevelResponse, RateLimitStatus, RuntimeStats};
+pub use envelope::{Envelope, ListMeta};
+pub use health::PoolStats;
+pub use history::{HistoryAction, HistoryEvent, HistoryEventResponse, HistoryPage, HistoryQuery};
+pub use notification::{Notification, NotificationQuery, NotificationResponse};
+pub use patch::Patch;
+pub use list::{Role, TodoList, ListResponse, CreateListRequest, ShareListRequest, ListMember};
+pub use todo::{
+    Todo, Recurrence, RecurrenceZone, MAX_RECURRENCE_INTERVAL, CreateTodoRequest, CreateTodoForm, UpdateTodoRequest, UpdateTitleRequest,
+    UpdateDescriptionRequest, TodoResponse, ListTodosQuery, GetTodoQuery, ViewQuery, TodoPage,
+    ImportTodo, ImportMode, ImportQuery, ImportRowError, ImportResponse, ExistsRequest, ReorderRequest,
+    SearchQuery, SearchResult, DuplicateQuery, TitleQuery, DeleteResponse, UndoRequest, PurgeResponse,
+    Board, BoardQuery, ChangesQuery, ChangesResponse, Tombstone, BatchGetRequest, BatchGetResponse,
+    BatchUpdateItem, BatchUpdateQuery, BatchUpdateResponse, DeleteAllResponse, OmitNullDescription,
+};
+pub use user::{User, UserResponse, RegisterRequest, LoginRequest, AuthResponse};
+pub use webhook::{Webhook, WebhookEvent, WebhookResponse, CreateWebhookRequest, UpdateWebhookRequest};
@@ -0,0 +1,44 @@
+use serde::{Deserialize, Serialize};
+use chrono::{DateTime, Utc};
+use uuid::Uuid;
+
+/// A reminder delivered to the notifications table
+#[derive(Debug, Clone, Serialize, Deserialize, sqlx::FromRow)]
+pub struct Notification {
+    pub id: Uuid,
+    /// Owner of the todo the reminder was for
+    pub user_id: Option<Uuid>,
+    /// Kept after the todo is deleted, so it may no longer exist
+    pub todo_id: Uuid,
+    /// Title of the todo when the reminder fired
+    pub title: String,
+    pub remind_at: DateTime<Utc>,
+    pub created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct NotificationResponse {
+    pub id: Uuid,
+    pub todo_id: Uuid,
+    pub title: String,
+    pub remind_at: DateTime<Utc>,
+    pub created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct NotificationQuery {
+    /// Most notifications to return
+    pub limit: Option<i64>,
+}
+
+impl From<Notification> for NotificationResponse {
+    fn from(notification: Notification) -> Self {
+        NotificationResponse {
+            id: notification.id,
+            todo_id: notification.todo_id,
+            title: notification.title,
+            remind_at: notification.remind_at,
+            created_at: notification.created_at,
+        }
+    }
+}
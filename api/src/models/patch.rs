@@ -0,0 +1,44 @@
+use serde::{Deserialize, Deserializer};
+
+/// One nullable field of a partial update. A field left out of the body keeps
+/// its current value, an explicit `null` clears it and any other value
+/// replaces it.
+///
+/// Fields of this type need `#[serde(default)]` so that leaving them out
+/// yields `Missing` rather than an error.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub enum Patch<T> {
+    #[default]
+    Missing,
+    Null,
+    Value(T),
+}
+
+impl<T> Patch<T> {
+    /// The field's new value given its `current` one
+    pub fn apply(self, current: Option<T>) -> Option<T> {
+        match self {
+            Patch::Missing => current,
+            Patch::Null => None,
+            Patch::Value(value) => Some(value),
+        }
+    }
+
+    /// The value sent, if the body set one
+    pub fn value(&self) -> Option<&T> {
+        match self {
+            Patch::Value(value) => Some(value),
+            Patch::Missing | Patch::Null => None,
+        }
+    }
+}
+
+// serde only calls this for fields present in the body; `default` covers the rest
+impl<'de, T: Deserialize<'de>> Deserialize<'de> for Patch<T> {
+    fn deserialize<D: Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        Ok(match Option::<T>::deserialize(deserializer)? {
+            Some(value) => Patch::Value(value),
+            None => Patch::Null,
+        })
+    }
+}
@@ -0,0 +1,106 @@
+//! How the API writes and reads timestamps: RFC 3339 in UTC with exactly three
+//! fractional digits, whatever precision the backend stored them with. Used
+//! through `#[serde(with = ...)]` on the model fields.
+
+use chrono::{DateTime, SecondsFormat, Utc};
+use serde::{de, Deserialize, Deserializer, Serializer};
+
+use super::Patch;
+
+/// A timestamp as responses carry it, e.g. `2024-01-15T10:30:00.000Z`
+pub fn format(time: &DateTime<Utc>) -> String {
+    time.to_rfc3339_opts(SecondsFormat::Millis, true)
+}
+
+/// Parse a timestamp sent by a client. Only UTC is accepted, and nothing finer
+/// than milliseconds, so what is stored is exactly what responses return.
+pub fn parse(value: &str) -> Result<DateTime<Utc>, String> {
+    let time = DateTime::parse_from_rfc3339(value.trim()).map_err(|_| {
+        format!("'{}' is not an RFC 3339 timestamp such as 2024-01-15T10:30:00Z", value)
+    })?;
+    if time.offset().local_minus_utc() != 0 {
+        return Err(format!("'{}' must be in UTC, ending in Z", value));
+    }
+    if time.timestamp_subsec_nanos() % 1_000_000 != 0 {
+        return Err(format!("'{}' is more precise than milliseconds", value));
+    }
+    Ok(time.with_timezone(&Utc))
+}
+
+pub fn serialize<S: Serializer>(time: &DateTime<Utc>, serializer: S) -> Result<S::Ok, S::Error> {
+    serializer.serialize_str(&format(time))
+}
+
+pub fn deserialize<'de, D: Deserializer<'de>>(deserializer: D) -> Result<DateTime<Utc>, D::Error> {
+    parse(&String::deserialize(deserializer)?).map_err(de::Error::custom)
+}
+
+/// The same for optional timestamps, which are `null` when unset. Fields need
+/// `#[serde(default)]` as well so they may be left out.
+pub mod option {
+    use super::*;
+
+    pub fn serialize<S: Serializer>(time: &Option<DateTime<Utc>>, serializer: S) -> Result<S::Ok, S::Error> {
+        match time {
+            Some(time) => super::serialize(time, serializer),
+            None => serializer.serialize_none(),
+        }
+    }
+
+    pub fn deserialize<'de, D: Deserializer<'de>>(deserializer: D) -> Result<Option<DateTime<Utc>>, D::Error> {
+        Option::<String>::deserialize(deserializer)?
+            .map(|value| parse(&value).map_err(de::Error::custom))
+            .transpose()
+    }
+}
+
+/// A timestamp field of a partial update; see `Patch`
+pub fn patch<'de, D: Deserializer<'de>>(deserializer: D) -> Result<Patch<DateTime<Utc>>, D::Error> {
+    Ok(match option::deserialize(deserializer)? {
+        Some(time) => Patch::Value(time),
+        None => Patch::Null,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use chrono::{Duration, TimeZone, Utc};
+    use serde::Deserialize;
+
+    use super::{format, parse};
+
+    #[test]
+    fn formats_milliseconds_in_utc() {
+        let time = Utc.with_ymd_and_hms(2024, 1, 15, 10, 30, 0).unwrap();
+        assert_eq!(format(&time), "2024-01-15T10:30:00.000Z");
+        assert_eq!(format(&(time + Duration::microseconds(123_456))), "2024-01-15T10:30:00.123Z");
+    }
+
+    #[test]
+    fn parses_what_it_formats() {
+        let time = Utc.with_ymd_and_hms(2024, 1, 15, 10, 30, 0).unwrap() + Duration::milliseconds(250);
+        assert_eq!(parse(&format(&time)), Ok(time));
+        assert_eq!(parse(" 2024-01-15T10:30:00Z "), Ok(time - Duration::milliseconds(250)));
+    }
+
+    #[test]
+    fn rejects_offsets_excess_precision_and_garbage() {
+        for value in ["2024-01-15T12:30:00+02:00", "2024-01-15T10:30:00.0001Z", "2024-01-15", "yesterday"] {
+            assert!(parse(value).is_err(), "{}", value);
+        }
+    }
+
+    #[test]
+    fn optional_timestamps_may_be_null() {
+        #[derive(Deserialize)]
+        struct Form {
+            #[serde(default, with = "super::option")]
+            due: Option<chrono::DateTime<Utc>>,
+        }
+        let form: Form = serde_json::from_str(r#"{"due": null}"#).unwrap();
+        assert_eq!(form.due, None);
+        let form: Form = serde_json::from_str("{}").unwrap();
+        assert_eq!(form.due, None);
+        assert!(serde_json::from_str::<Form>(r#"{"due": "2024-01-15T10:30:00+01:00"}"#).is_err());
+    }
+}
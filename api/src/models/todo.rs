@@ -1,38 +1,589 @@
 use serde::{Deserialize, Serialize};
-use chrono::{DateTime, Utc};
+use chrono::{DateTime, Datelike, Days, Duration, LocalResult, Months, NaiveDate, NaiveDateTime, TimeZone, Utc};
+use chrono_tz::Tz;
+use std::env;
+use std::sync::OnceLock;
 use uuid::Uuid;
 
+use super::{timestamp, Patch};
+use crate::config::flag;
+
 #[derive(Debug, Clone, Serialize, Deserialize, sqlx::FromRow)]
 pub struct Todo {
     pub id: Uuid,
     pub title: String,
     pub description: Option<String>,
     pub completed: bool,
+    /// Hidden from the default list; independent of `completed`
+    #[serde(default)]
+    pub archived: bool,
+    /// Manual order; lower comes first
+    #[serde(default)]
+    pub position: i64,
+    pub version: i32,
+    pub tags: Vec<String>,
+    pub user_id: Option<Uuid>,
+    pub list_id: Option<Uuid>,
+    pub parent_id: Option<Uuid>,
+    pub due_date: Option<DateTime<Utc>>,
+    pub recurrence: String,
+    /// Repeat every this many days, weeks or months
+    #[serde(default = "default_recurrence_interval")]
+    pub recurrence_interval: i32,
+    /// Day of month the series this occurrence belongs to started on, so
+    /// monthly occurrences return to it after a shorter month
+    #[serde(default)]
+    pub recurrence_day: Option<i32>,
+    /// When the todo was last marked completed; None while it is open
+    #[serde(default)]
+    pub completed_at: Option<DateTime<Utc>>,
+    /// When to send a reminder while the todo is open
+    #[serde(default)]
+    pub remind_at: Option<DateTime<Utc>>,
+    /// When the reminder was sent; reset whenever `remind_at` changes
+    #[serde(default)]
+    pub reminded_at: Option<DateTime<Utc>>,
     pub created_at: DateTime<Utc>,
     pub updated_at: DateTime<Utc>,
+    /// Who created the todo and who changed it last, when known
+    #[serde(default)]
+    pub created_by: Option<Uuid>,
+    #[serde(default)]
+    pub updated_by: Option<Uuid>,
 }
 
-#[derive(Debug, Serialize)]
+fn default_recurrence_interval() -> i32 {
+    1
+}
+
+/// Largest accepted `recurrence_interval`
+pub const MAX_RECURRENCE_INTERVAL: i32 = 365;
+
+/// How a todo repeats. Completing a recurring todo creates its next occurrence.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Recurrence {
+    #[default]
+    None,
+    Daily,
+    Weekly,
+    Monthly,
+}
+
+impl Recurrence {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Recurrence::None => "none",
+            Recurrence::Daily => "daily",
+            Recurrence::Weekly => "weekly",
+            Recurrence::Monthly => "monthly",
+        }
+    }
+
+    /// Parse the value stored in `todos.recurrence`
+    pub fn from_db(recurrence: &str) -> Option<Recurrence> {
+        match recurrence {
+            "none" => Some(Recurrence::None),
+            "daily" => Some(Recurrence::Daily),
+            "weekly" => Some(Recurrence::Weekly),
+            "monthly" => Some(Recurrence::Monthly),
+            _ => None,
+        }
+    }
+
+    /// Due date of the occurrence `interval` periods after one due at `due`,
+    /// or None for todos that do not repeat. Periods are counted on the
+    /// calendar of `tz`, so occurrences keep their local time of day across
+    /// daylight saving changes. Monthly occurrences fall on `day`, or on the
+    /// last day of a month too short for it (Jan 31 -> Feb 28 -> Mar 31).
+    pub fn next_due(&self, due: DateTime<Utc>, interval: i32, day: u32, tz: Tz) -> Option<DateTime<Utc>> {
+        let interval = interval.max(1) as u32;
+        let local = due.with_timezone(&tz).naive_local();
+        let date = match self {
+            Recurrence::None => return None,
+            Recurrence::Daily => local.date().checked_add_days(Days::new(interval.into()))?,
+            Recurrence::Weekly => local.date().checked_add_days(Days::new(7 * u64::from(interval)))?,
+            Recurrence::Monthly => {
+                let month = local.date().with_day(1)?.checked_add_months(Months::new(interval))?;
+                month.with_day(day.min(days_in_month(month)))?
+            }
+        };
+        resolve_local(date.and_time(local.time()), tz)
+    }
+
+    /// The day of month the series of a todo due at `due` falls on: `stored`
+    /// while `due` is still on it, or on the last day of a month too short for
+    /// it; otherwise, as when the due date was moved by hand, the day of `due`
+    pub fn series_day(due: DateTime<Utc>, stored: Option<i32>, tz: Tz) -> u32 {
+        let date = due.with_timezone(&tz).date_naive();
+        match stored.and_then(|day| u32::try_from(day).ok()) {
+            Some(day) if (1..=31).contains(&day) && date.day() == day.min(days_in_month(date)) => day,
+            _ => date.day(),
+        }
+    }
+}
+
+/// Number of days in the month of `date`
+fn days_in_month(date: NaiveDate) -> u32 {
+    (28..=31).rev().find(|&day| date.with_day(day).is_some()).unwrap_or(28)
+}
+
+/// The instant `local` names in `tz`. When clocks go back it is the first of
+/// the two; when they go forward past it, the same time after the change
+/// (02:30 -> 03:30).
+fn resolve_local(local: NaiveDateTime, tz: Tz) -> Option<DateTime<Utc>> {
+    match tz.from_local_datetime(&local) {
+        LocalResult::Single(time) | LocalResult::Ambiguous(time, _) => Some(time.with_timezone(&Utc)),
+        LocalResult::None => {
+            let before = tz.from_local_datetime(&(local - Duration::hours(1))).earliest()?;
+            Some(before.with_timezone(&Utc) + Duration::hours(1))
+        }
+    }
+}
+
+/// The time zone recurring todos count days and months in, set with
+/// RECURRENCE_TZ. UTC by default.
+#[derive(Debug, Clone, Copy)]
+pub struct RecurrenceZone(pub Tz);
+
+static RECURRENCE_ZONE: OnceLock<Tz> = OnceLock::new();
+
+impl RecurrenceZone {
+    pub fn from_env() -> Result<Self, String> {
+        match env::var("RECURRENCE_TZ").ok().filter(|v| !v.is_empty()) {
+            None => Ok(RecurrenceZone(Tz::UTC)),
+            Some(name) => name.parse().map(RecurrenceZone).map_err(|_| {
+                format!("RECURRENCE_TZ must be an IANA time zone such as Europe/Bucharest, got '{}'", name)
+            }),
+        }
+    }
+
+    /// Make this the zone every repository steps recurring todos in. Only the
+    /// first call has an effect.
+    pub fn install(self) {
+        let _ = RECURRENCE_ZONE.set(self.0);
+    }
+
+    /// The installed zone, UTC when none was
+    pub fn current() -> Tz {
+        RECURRENCE_ZONE.get().copied().unwrap_or(Tz::UTC)
+    }
+}
+
+fn is_false(value: &bool) -> bool {
+    !*value
+}
+
+/// Whether todos without a description leave the key out instead of sending
+/// `null`, set with OMIT_NULL_DESCRIPTION. Off by default because some clients
+/// expect the key to be there.
+#[derive(Debug, Clone, Copy)]
+pub struct OmitNullDescription(pub bool);
+
+static OMIT_NULL_DESCRIPTION: OnceLock<bool> = OnceLock::new();
+
+impl OmitNullDescription {
+    pub fn from_env() -> Result<Self, String> {
+        flag("OMIT_NULL_DESCRIPTION", false).map(OmitNullDescription)
+    }
+
+    /// Make this the choice every todo is serialized with. Only the first
+    /// call has an effect.
+    pub fn install(self) {
+        let _ = OMIT_NULL_DESCRIPTION.set(self.0);
+    }
+}
+
+/// The installed choice, false when none was
+pub fn omit_null_description() -> bool {
+    OMIT_NULL_DESCRIPTION.get().copied().unwrap_or(false)
+}
+
+fn skip_description(description: &Option<String>) -> bool {
+    description.is_none() && omit_null_description()
+}
+
+#[derive(Debug, Clone, Serialize)]
 pub struct TodoResponse {
     pub id: Uuid,
     pub title: String,
+    #[serde(skip_serializing_if = "skip_description")]
     pub description: Option<String>,
+    /// Set when `?description=summary` shortened the description
+    #[serde(skip_serializing_if = "is_false")]
+    pub description_truncated: bool,
     pub completed: bool,
+    pub archived: bool,
+    pub position: i64,
+    pub version: i32,
+    pub tags: Vec<String>,
+    pub list_id: Option<Uuid>,
+    pub parent_id: Option<Uuid>,
+    #[serde(serialize_with = "timestamp::option::serialize")]
+    pub due_date: Option<DateTime<Utc>>,
+    pub recurrence: String,
+    pub recurrence_interval: i32,
+    #[serde(serialize_with = "timestamp::option::serialize")]
+    pub completed_at: Option<DateTime<Utc>>,
+    #[serde(serialize_with = "timestamp::option::serialize")]
+    pub remind_at: Option<DateTime<Utc>>,
+    #[serde(serialize_with = "timestamp::option::serialize")]
+    pub reminded_at: Option<DateTime<Utc>>,
+    #[serde(serialize_with = "timestamp::serialize")]
     pub created_at: DateTime<Utc>,
+    #[serde(serialize_with = "timestamp::serialize")]
     pub updated_at: DateTime<Utc>,
+    pub created_by: Option<Uuid>,
+    pub updated_by: Option<Uuid>,
+    /// Set when completing a recurring todo created its next occurrence
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub next_occurrence_id: Option<Uuid>,
 }
 
-#[derive(Debug, Deserialize)]
+#[derive(Debug, Serialize, Deserialize)]
 pub struct CreateTodoRequest {
     pub title: String,
     pub description: Option<String>,
+    pub tags: Option<Vec<String>>,
+    pub list_id: Option<Uuid>,
+    pub parent_id: Option<Uuid>,
+    #[serde(default, with = "timestamp::option")]
+    pub due_date: Option<DateTime<Utc>>,
+    pub recurrence: Option<Recurrence>,
+    /// Defaults to 1; between 1 and MAX_RECURRENCE_INTERVAL
+    pub recurrence_interval: Option<i32>,
+    #[serde(default, with = "timestamp::option")]
+    pub remind_at: Option<DateTime<Utc>>,
 }
 
+/// A create request posted as `application/x-www-form-urlencoded`. Form fields
+/// cannot repeat a list, so `tags` is one comma separated value.
+#[derive(Debug, Deserialize)]
+pub struct CreateTodoForm {
+    pub title: String,
+    pub description: Option<String>,
+    pub tags: Option<String>,
+    pub list_id: Option<Uuid>,
+    pub parent_id: Option<Uuid>,
+    #[serde(default, deserialize_with = "timestamp::option::deserialize")]
+    pub due_date: Option<DateTime<Utc>>,
+    pub recurrence: Option<Recurrence>,
+    pub recurrence_interval: Option<i32>,
+    #[serde(default, deserialize_with = "timestamp::option::deserialize")]
+    pub remind_at: Option<DateTime<Utc>>,
+}
+
+impl From<CreateTodoForm> for CreateTodoRequest {
+    fn from(form: CreateTodoForm) -> Self {
+        CreateTodoRequest {
+            title: form.title,
+            description: form.description,
+            tags: form.tags.map(|tags| tags.split(',').map(str::to_string).collect()),
+            list_id: form.list_id,
+            parent_id: form.parent_id,
+            due_date: form.due_date,
+            recurrence: form.recurrence,
+            recurrence_interval: form.recurrence_interval,
+            remind_at: form.remind_at,
+        }
+    }
+}
+
+/// Changes to a todo. Fields left out keep their value. The nullable fields
+/// (`description`, `parent_id`, `due_date` and `remind_at`) are cleared by
+/// sending `null`; `null` for any other field is the same as leaving it out.
 #[derive(Debug, Deserialize)]
 pub struct UpdateTodoRequest {
     pub title: Option<String>,
+    #[serde(default)]
+    pub description: Patch<String>,
+    pub completed: Option<bool>,
+    pub tags: Option<Vec<String>>,
+    #[serde(default)]
+    pub parent_id: Patch<Uuid>,
+    #[serde(default, deserialize_with = "timestamp::patch")]
+    pub due_date: Patch<DateTime<Utc>>,
+    pub recurrence: Option<Recurrence>,
+    pub recurrence_interval: Option<i32>,
+    #[serde(default, deserialize_with = "timestamp::patch")]
+    pub remind_at: Patch<DateTime<Utc>>,
+    /// Expected current version; when set, the update only applies if it still matches.
+    pub version: Option<i32>,
+}
+
+/// Body of `PATCH /api/todos/{id}/title`
+#[derive(Debug, Deserialize)]
+pub struct UpdateTitleRequest {
+    pub title: String,
+    /// Expected current version; when set, the update only applies if it still matches.
+    pub version: Option<i32>,
+}
+
+/// Body of `PATCH /api/todos/{id}/description`; `null` clears the description
+#[derive(Debug, Deserialize)]
+pub struct UpdateDescriptionRequest {
+    #[serde(default)]
+    pub description: Patch<String>,
+    /// Expected current version; when set, the update only applies if it still matches.
+    pub version: Option<i32>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ListTodosQuery {
+    /// Only return todos carrying this tag
+    pub tag: Option<String>,
+    /// Opaque cursor from a previous page's `next_cursor`
+    pub after: Option<String>,
+    /// Page size; setting it or `after` switches to a paginated response
+    pub limit: Option<i64>,
+    /// Comma separated todo fields to return instead of the whole todo
+    pub fields: Option<String>,
+    /// `summary` shortens each description; `full`, the default, does not
     pub description: Option<String>,
+    /// List archived todos instead of the active ones
+    pub archived: Option<bool>,
+    /// Only completed todos, or with `false` only open ones
     pub completed: Option<bool>,
+    /// Order to list in, overriding DEFAULT_SORT
+    pub sort: Option<String>,
+    /// Wrap the todos as `{"data": [...], "meta": {...}}`
+    pub envelope: Option<bool>,
+    /// Only todos updated after this, typically the previous X-Server-Time
+    pub updated_since: Option<DateTime<Utc>>,
+    /// Only todos created after this
+    pub created_after: Option<DateTime<Utc>>,
+    /// Only todos created before this
+    pub created_before: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct BoardQuery {
+    pub tag: Option<String>,
+    /// Board the archived todos instead of the active ones
+    pub archived: Option<bool>,
+    /// Order within each column, overriding DEFAULT_SORT
+    pub sort: Option<String>,
+    /// Most todos per column
+    pub limit: Option<i64>,
+}
+
+/// Query of GET /api/todos/views/{name}
+#[derive(Debug, Deserialize)]
+pub struct ViewQuery {
+    /// IANA time zone the days are counted in, UTC when missing
+    pub tz: Option<String>,
+    /// How many days after today the `upcoming` view covers
+    pub days: Option<i64>,
+    pub tag: Option<String>,
+    /// Order to list in, overriding DEFAULT_SORT
+    pub sort: Option<String>,
+    /// Opaque cursor from a previous page's `next_cursor`
+    pub after: Option<String>,
+    /// Page size; setting it or `after` switches to a paginated response
+    pub limit: Option<i64>,
+}
+
+/// Returned by GET /api/todos/board
+#[derive(Debug, Default, Serialize)]
+pub struct Board {
+    pub pending: Vec<TodoResponse>,
+    pub completed: Vec<TodoResponse>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct GetTodoQuery {
+    /// Comma separated todo fields to return instead of the whole todo
+    pub fields: Option<String>,
+    /// `summary` shortens the description; `full`, the default, does not
+    pub description: Option<String>,
+}
+
+/// Returned by DELETE; the token undoes the deletion until `undo_expires_at`
+#[derive(Debug, Serialize)]
+pub struct DeleteResponse {
+    pub undo_token: String,
+    pub undo_expires_at: DateTime<Utc>,
+}
+
+/// Returned by DELETE /api/todos/all
+#[derive(Debug, Serialize)]
+pub struct DeleteAllResponse {
+    pub deleted: u64,
+}
+
+/// Returned by POST /api/admin/purge
+#[derive(Debug, Serialize)]
+pub struct PurgeResponse {
+    /// Archived todos deleted
+    pub purged: u64,
+    /// Archived todos last changed before this were due
+    pub before: DateTime<Utc>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ChangesQuery {
+    /// The previous response's `server_time`
+    pub since: DateTime<Utc>,
+}
+
+/// A todo deleted since the last sync
+#[derive(Debug, Clone, Serialize, sqlx::FromRow)]
+pub struct Tombstone {
+    pub id: Uuid,
+    pub deleted_at: DateTime<Utc>,
+}
+
+/// Returned by GET /api/todos/changes
+#[derive(Debug, Serialize)]
+pub struct ChangesResponse {
+    /// Created, updated or restored todos, least recently updated first
+    pub todos: Vec<TodoResponse>,
+    /// Deleted todos that are still gone, least recently deleted first
+    pub deleted: Vec<Tombstone>,
+    /// Pass as `since` on the next call
+    pub server_time: DateTime<Utc>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct UndoRequest {
+    pub token: String,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct DuplicateQuery {
+    /// Append " (copy)" to the title; defaults to true
+    pub suffix: Option<bool>,
+}
+
+/// Query of the writes that set a title
+#[derive(Debug, Deserialize)]
+pub struct TitleQuery {
+    /// `false` refuses a title another open todo has, as STRICT_UNIQUE_TITLES
+    /// does for every request
+    pub allow_duplicate: Option<bool>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct SearchQuery {
+    /// Words to look for in titles and descriptions
+    pub q: Option<String>,
+    pub limit: Option<i64>,
+}
+
+/// A todo matching a search, with how well it matches; higher is better
+#[derive(Debug, Serialize)]
+pub struct SearchResult {
+    #[serde(flatten)]
+    pub todo: TodoResponse,
+    pub rank: f32,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ReorderRequest {
+    /// Every todo the caller owns, in the new order
+    pub ids: Vec<Uuid>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ExistsRequest {
+    /// Todo IDs to look up; parsed by the handler so a bad one can be named
+    pub ids: Vec<String>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct BatchGetRequest {
+    /// Todo IDs to fetch; parsed by the handler so a bad one can be named
+    pub ids: Vec<String>,
+}
+
+/// Returned by POST /api/todos/batch-get
+#[derive(Debug, Serialize)]
+pub struct BatchGetResponse {
+    /// The todos found, in the order they were asked for
+    pub todos: Vec<TodoResponse>,
+    /// IDs that are not todos the caller can see
+    pub missing: Vec<Uuid>,
+}
+
+/// One entry of `PATCH /api/todos/batch`: the todo to change, with the fields
+/// `PUT /api/todos/{id}` takes
+#[derive(Debug, Deserialize)]
+pub struct BatchUpdateItem {
+    pub id: Uuid,
+    #[serde(flatten)]
+    pub changes: UpdateTodoRequest,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct BatchUpdateQuery {
+    /// Skip IDs that are not todos the caller can see instead of failing with 404
+    pub partial: Option<bool>,
+    /// As in `TitleQuery`
+    pub allow_duplicate: Option<bool>,
+}
+
+/// Returned by PATCH /api/todos/batch?partial=true
+#[derive(Debug, Serialize)]
+pub struct BatchUpdateResponse {
+    /// The updated todos, in the order they were sent
+    pub todos: Vec<TodoResponse>,
+    /// IDs that are not todos the caller can see and were skipped
+    pub missing: Vec<Uuid>,
+}
+
+/// One page of todos. `next_cursor` is empty on the last page.
+#[derive(Debug, Serialize)]
+pub struct TodoPage<T = TodoResponse> {
+    pub todos: Vec<T>,
+    pub next_cursor: String,
+}
+
+/// A single todo in an import payload. Mirrors the export layout; everything
+/// except the title is optional.
+#[derive(Debug, Clone, Deserialize)]
+pub struct ImportTodo {
+    pub id: Option<Uuid>,
+    pub title: String,
+    pub description: Option<String>,
+    pub completed: Option<bool>,
+    pub tags: Option<Vec<String>>,
+    pub created_at: Option<DateTime<Utc>>,
+    pub updated_at: Option<DateTime<Utc>>,
+}
+
+/// What an import does with rows whose id already exists
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum ImportMode {
+    /// Abort the whole import
+    #[default]
+    Fail,
+    /// Leave the existing todo alone
+    Skip,
+    /// Replace the existing todo with the imported one
+    Overwrite,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ImportQuery {
+    #[serde(default)]
+    pub mode: ImportMode,
+}
+
+/// A row that could not be imported. `row` counts data rows from 1, not
+/// counting the CSV header.
+#[derive(Debug, Clone, Serialize)]
+pub struct ImportRowError {
+    pub row: usize,
+    pub error: String,
+}
+
+#[derive(Debug, Serialize)]
+pub struct ImportResponse {
+    pub imported: usize,
+    pub skipped: usize,
+    pub failed: usize,
+    pub errors: Vec<ImportRowError>,
 }
 
 impl From<Todo> for TodoResponse {
@@ -41,9 +592,81 @@ impl From<Todo> for TodoResponse {
             id: todo.id,
             title: todo.title,
             description: todo.description,
+            description_truncated: false,
             completed: todo.completed,
+            archived: todo.archived,
+            position: todo.position,
+            version: todo.version,
+            tags: todo.tags,
+            list_id: todo.list_id,
+            parent_id: todo.parent_id,
+            due_date: todo.due_date,
+            recurrence: todo.recurrence,
+            recurrence_interval: todo.recurrence_interval,
+            completed_at: todo.completed_at,
+            remind_at: todo.remind_at,
+            reminded_at: todo.reminded_at,
             created_at: todo.created_at,
             updated_at: todo.updated_at,
+            created_by: todo.created_by,
+            updated_by: todo.updated_by,
+            next_occurrence_id: None,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use chrono::{DateTime, Utc};
+    use chrono_tz::Tz;
+
+    use super::Recurrence;
+
+    fn at(rfc3339: &str) -> DateTime<Utc> {
+        DateTime::parse_from_rfc3339(rfc3339).unwrap().with_timezone(&Utc)
+    }
+
+    #[test]
+    fn next_due_steps_on_the_local_calendar() {
+        let bucharest: Tz = "Europe/Bucharest".parse().unwrap();
+        let cases = [
+            // (recurrence, interval, series day, zone, due, next due)
+            (Recurrence::Daily, 1, 1, Tz::UTC, "2025-03-29T09:00:00Z", "2025-03-30T09:00:00Z"),
+            (Recurrence::Monthly, 1, 31, Tz::UTC, "2025-01-31T09:00:00Z", "2025-02-28T09:00:00Z"),
+            (Recurrence::Monthly, 1, 31, Tz::UTC, "2025-02-28T09:00:00Z", "2025-03-31T09:00:00Z"),
+            (Recurrence::Monthly, 1, 31, Tz::UTC, "2024-01-31T09:00:00Z", "2024-02-29T09:00:00Z"),
+            (Recurrence::Monthly, 2, 31, Tz::UTC, "2024-12-31T09:00:00Z", "2025-02-28T09:00:00Z"),
+            (Recurrence::Monthly, 1, 30, Tz::UTC, "2025-02-28T09:00:00Z", "2025-03-30T09:00:00Z"),
+            // Clocks go forward on 2025-03-30 and back on 2025-10-26 in Bucharest
+            (Recurrence::Daily, 1, 29, bucharest, "2025-03-29T09:00:00+02:00", "2025-03-30T09:00:00+03:00"),
+            (Recurrence::Weekly, 1, 21, bucharest, "2025-10-21T09:00:00+03:00", "2025-10-28T09:00:00+02:00"),
+            (Recurrence::Daily, 1, 29, bucharest, "2025-03-29T03:30:00+02:00", "2025-03-30T04:30:00+03:00"),
+            (Recurrence::Daily, 1, 25, bucharest, "2025-10-25T03:30:00+03:00", "2025-10-26T03:30:00+03:00"),
+            // Month ends are local too: 23:30 UTC on Jan 30 is already Jan 31 in Bucharest
+            (Recurrence::Monthly, 1, 31, bucharest, "2025-01-30T23:30:00Z", "2025-02-28T01:30:00+02:00"),
+            (Recurrence::Monthly, 1, 31, bucharest, "2025-03-31T09:00:00+03:00", "2025-04-30T09:00:00+03:00"),
+        ];
+        for (recurrence, interval, day, tz, due, expected) in cases {
+            let next = recurrence.next_due(at(due), interval, day, tz);
+            assert_eq!(next, Some(at(expected)), "{:?} from {}", recurrence, due);
+        }
+        assert_eq!(Recurrence::None.next_due(at("2025-01-31T09:00:00Z"), 1, 31, Tz::UTC), None);
+    }
+
+    #[test]
+    fn series_day_survives_short_months_but_not_moves() {
+        let cases = [
+            // (due, stored day, series day)
+            ("2025-01-31T09:00:00Z", None, 31),
+            ("2025-02-28T09:00:00Z", Some(31), 31),
+            ("2025-02-28T09:00:00Z", Some(30), 30),
+            ("2025-04-30T09:00:00Z", Some(31), 31),
+            ("2025-03-15T09:00:00Z", Some(31), 15),
+            ("2025-02-27T09:00:00Z", Some(31), 27),
+            ("2025-02-28T09:00:00Z", Some(0), 28),
+        ];
+        for (due, stored, expected) in cases {
+            assert_eq!(Recurrence::series_day(at(due), stored, Tz::UTC), expected, "{} with {:?}", due, stored);
         }
     }
 }
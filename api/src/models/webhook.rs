@@ -0,0 +1,70 @@
+use serde::{Deserialize, Serialize};
+use chrono::{DateTime, Utc};
+use uuid::Uuid;
+
+/// A todo change a webhook can subscribe to
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub enum WebhookEvent {
+    #[serde(rename = "todo.created")]
+    TodoCreated,
+    #[serde(rename = "todo.updated")]
+    TodoUpdated,
+    #[serde(rename = "todo.deleted")]
+    TodoDeleted,
+}
+
+impl WebhookEvent {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            WebhookEvent::TodoCreated => "todo.created",
+            WebhookEvent::TodoUpdated => "todo.updated",
+            WebhookEvent::TodoDeleted => "todo.deleted",
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, sqlx::FromRow)]
+pub struct Webhook {
+    pub id: Uuid,
+    pub user_id: Option<Uuid>,
+    pub url: String,
+    /// Key for the HMAC-SHA256 signature sent with every delivery
+    pub secret: String,
+    /// Subscribed event names, as returned by `WebhookEvent::as_str`
+    pub events: Vec<String>,
+    pub created_at: DateTime<Utc>,
+}
+
+/// A webhook as returned by the API; the secret is never echoed back
+#[derive(Debug, Serialize)]
+pub struct WebhookResponse {
+    pub id: Uuid,
+    pub url: String,
+    pub events: Vec<String>,
+    pub created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct CreateWebhookRequest {
+    pub url: String,
+    pub secret: String,
+    pub events: Vec<WebhookEvent>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct UpdateWebhookRequest {
+    pub url: Option<String>,
+    pub secret: Option<String>,
+    pub events: Option<Vec<WebhookEvent>>,
+}
+
+impl From<Webhook> for WebhookResponse {
+    fn from(webhook: Webhook) -> Self {
+        WebhookResponse {
+            id: webhook.id,
+            url: webhook.url,
+            events: webhook.events,
+            created_at: webhook.created_at,
+        }
+    }
+}
@@ -0,0 +1,270 @@
+//! Reminder scheduler. Every poll it claims the reminders that have come due,
+//! delivers each one either as a POST to REMINDER_WEBHOOK_URL or as a row in
+//! the notifications table, and records the outcome. Claims carry a lease, so
+//! several instances can poll the same database without sending a reminder
+//! twice. Failed deliveries are retried with backoff until they have failed
+//! REMINDER_MAX_ATTEMPTS times; the last error stays on the todo.
+
+use chrono::{DateTime, Utc};
+use reqwest::header::CONTENT_TYPE;
+use serde::Serialize;
+use std::env;
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::sync::watch;
+use uuid::Uuid;
+
+use crate::db::parse_duration;
+use crate::models::{Notification, Todo, TodoResponse};
+use crate::repository::{DueReminder, ReminderRepository};
+
+const DEFAULT_POLL_INTERVAL: Duration = Duration::from_secs(15);
+const DEFAULT_MAX_ATTEMPTS: i32 = 5;
+/// Reminders claimed per poll
+const BATCH_SIZE: i64 = 100;
+/// How long a claim keeps other instances away; longer than a delivery can take
+const LEASE: Duration = Duration::from_secs(120);
+const WEBHOOK_TIMEOUT: Duration = Duration::from_secs(10);
+/// Wait before retrying a failed delivery; doubles after every failed attempt
+const INITIAL_BACKOFF: Duration = Duration::from_secs(30);
+const MAX_BACKOFF: Duration = Duration::from_secs(3600);
+
+/// How reminders are scheduled and delivered, configured through
+/// REMINDER_POLL_INTERVAL, REMINDER_MAX_ATTEMPTS and REMINDER_WEBHOOK_URL
+#[derive(Debug, Clone)]
+pub struct ReminderSettings {
+    pub poll_interval: Duration,
+    /// Deliveries tried per reminder, including the first
+    pub max_attempts: i32,
+    /// Where to POST reminders; without one they go to the notifications table
+    pub webhook_url: Option<reqwest::Url>,
+}
+
+impl ReminderSettings {
+    pub fn from_env() -> Result<Self, String> {
+        let poll_interval = match env::var("REMINDER_POLL_INTERVAL").ok().filter(|v| !v.is_empty()) {
+            None => DEFAULT_POLL_INTERVAL,
+            Some(value) => parse_duration(&value).filter(|d| !d.is_zero()).ok_or_else(|| {
+                format!(
+                    "REMINDER_POLL_INTERVAL must be a positive duration such as '15', '15s' or '500ms', got '{}'",
+                    value
+                )
+            })?,
+        };
+        let max_attempts = match env::var("REMINDER_MAX_ATTEMPTS").ok().filter(|v| !v.is_empty()) {
+            None => DEFAULT_MAX_ATTEMPTS,
+            Some(value) => value.parse().ok().filter(|n| *n > 0).ok_or_else(|| {
+                format!("REMINDER_MAX_ATTEMPTS must be a positive number, got '{}'", value)
+            })?,
+        };
+        let webhook_url = match env::var("REMINDER_WEBHOOK_URL").ok().filter(|v| !v.is_empty()) {
+            None => None,
+            Some(value) => Some(
+                reqwest::Url::parse(&value)
+                    .ok()
+                    .filter(|url| matches!(url.scheme(), "http" | "https"))
+                    .ok_or_else(|| format!("REMINDER_WEBHOOK_URL must be an http(s) URL, got '{}'", value))?,
+            ),
+        };
+
+        Ok(ReminderSettings { poll_interval, max_attempts, webhook_url })
+    }
+}
+
+/// Where a due reminder goes
+enum Channel {
+    Webhook { client: reqwest::Client, url: reqwest::Url },
+    Notifications,
+}
+
+/// Body POSTed to REMINDER_WEBHOOK_URL
+#[derive(Serialize)]
+struct Payload<'a> {
+    id: Uuid,
+    event: &'static str,
+    created_at: DateTime<Utc>,
+    todo: &'a TodoResponse,
+}
+
+/// The running scheduler; stop it before closing the storage
+pub struct Scheduler {
+    stop: watch::Sender<bool>,
+    task: actix_web::rt::task::JoinHandle<()>,
+}
+
+impl Scheduler {
+    /// Let the current poll finish delivering, then stop polling
+    pub async fn stop(self) {
+        let _ = self.stop.send(true);
+        if let Err(e) = self.task.await {
+            log::error!(error = e.to_string().as_str(); "reminder scheduler failed");
+        }
+    }
+}
+
+/// Start polling for due reminders in the background
+pub fn spawn(
+    reminders: Arc<dyn ReminderRepository>,
+    settings: ReminderSettings,
+) -> Result<Scheduler, reqwest::Error> {
+    let channel = match settings.webhook_url.clone() {
+        Some(url) => Channel::Webhook {
+            client: reqwest::Client::builder().timeout(WEBHOOK_TIMEOUT).build()?,
+            url,
+        },
+        None => Channel::Notifications,
+    };
+    let (stop, mut stopped) = watch::channel(false);
+
+    let task = actix_web::rt::spawn(async move {
+        let mut interval = actix_web::rt::time::interval(settings.poll_interval);
+        loop {
+            tokio::select! {
+                _ = interval.tick() => {}
+                _ = stopped.changed() => break,
+            }
+            if let Err(e) = poll(reminders.as_ref(), &channel, settings.max_attempts, Utc::now()).await {
+                log::warn!(error = e.as_str(); "failed to claim due reminders");
+            }
+        }
+    });
+    Ok(Scheduler { stop, task })
+}
+
+/// Claim the reminders due at `now` and deliver them one by one. `now` is
+/// the scheduler's clock for the whole poll, so tests can run it at any time.
+async fn poll(
+    reminders: &dyn ReminderRepository,
+    channel: &Channel,
+    max_attempts: i32,
+    now: DateTime<Utc>,
+) -> Result<(), String> {
+    let lease_until = now + to_chrono(LEASE);
+    let due = reminders
+        .claim_due(now, lease_until, max_attempts, BATCH_SIZE)
+        .await
+        .map_err(|e| e.to_string())?;
+
+    for reminder in due {
+        let todo_id = reminder.todo.id.to_string();
+        let result = match deliver(channel, &reminder.todo, now).await {
+            Ok(notification) => reminders.mark_sent(&reminder.todo, now, notification.as_ref()).await,
+            Err(error) => record_failure(reminders, &reminder, &error, max_attempts, now).await,
+        };
+        if let Err(e) = result {
+            log::error!(todo_id = todo_id.as_str(), error = e.to_string().as_str(); "failed to record reminder");
+        }
+    }
+    Ok(())
+}
+
+/// Send one reminder. A webhook delivery returns no notification; otherwise
+/// the notification to store is the delivery.
+async fn deliver(channel: &Channel, todo: &Todo, now: DateTime<Utc>) -> Result<Option<Notification>, String> {
+    match channel {
+        Channel::Notifications => Ok(Some(Notification {
+            id: Uuid::new_v4(),
+            user_id: todo.user_id,
+            todo_id: todo.id,
+            title: todo.title.clone(),
+            remind_at: todo.remind_at.unwrap_or(now),
+            created_at: now,
+        })),
+        Channel::Webhook { client, url } => {
+            let todo = TodoResponse::from(todo.clone());
+            let payload = Payload { id: Uuid::new_v4(), event: "todo.reminder", created_at: now, todo: &todo };
+            let response = client
+                .post(url.clone())
+                .header(CONTENT_TYPE, "application/json")
+                .json(&payload)
+                .send()
+                .await
+                .map_err(|e| e.to_string())?;
+            if !response.status().is_success() {
+                return Err(format!("receiver answered {}", response.status()));
+            }
+            Ok(None)
+        }
+    }
+}
+
+async fn record_failure(
+    reminders: &dyn ReminderRepository,
+    reminder: &DueReminder,
+    error: &str,
+    max_attempts: i32,
+    now: DateTime<Utc>,
+) -> Result<(), crate::error::ApiError> {
+    let attempt = reminder.attempts + 1;
+    let todo_id = reminder.todo.id.to_string();
+    if attempt >= max_attempts {
+        log::warn!(
+            todo_id = todo_id.as_str(), attempts = attempt, error = error;
+            "reminder delivery failed; giving up"
+        );
+    } else {
+        log::debug!(
+            todo_id = todo_id.as_str(), attempt = attempt, error = error;
+            "reminder delivery failed; retrying"
+        );
+    }
+    let retry_at = now + to_chrono(backoff(attempt));
+    reminders.mark_failed(&reminder.todo, error, retry_at).await
+}
+
+/// Wait after the `attempt`th failed delivery
+fn backoff(attempt: i32) -> Duration {
+    let doublings = attempt.saturating_sub(1).clamp(0, 16) as u32;
+    INITIAL_BACKOFF.saturating_mul(1 << doublings).min(MAX_BACKOFF)
+}
+
+fn to_chrono(duration: Duration) -> chrono::Duration {
+    chrono::Duration::from_std(duration).unwrap_or_else(|_| chrono::Duration::zero())
+}
+
+#[cfg(test)]
+mod tests {
+    use chrono::{Duration, Utc};
+
+    use super::{poll, Channel, DEFAULT_MAX_ATTEMPTS};
+    use crate::auth::{Actor, AuthUser};
+    use crate::models::Recurrence;
+    use crate::repository::{MemoryRepository, NewTodo, ReminderRepository, TodoRepository};
+
+    #[actix_web::test]
+    async fn due_reminder_fires_exactly_once() {
+        let repo = MemoryRepository::new();
+        // A day ahead of the real clock, so only the fake one can reach it
+        let remind_at = Utc::now() + Duration::days(1);
+        let new = NewTodo {
+            title: "Call the dentist".to_string(),
+            description: None,
+            tags: Vec::new(),
+            list_id: None,
+            parent_id: None,
+            due_date: None,
+            recurrence: Recurrence::None,
+            recurrence_interval: 1,
+            remind_at: Some(remind_at),
+            unique_title: false,
+            actor: Actor::default(),
+        };
+        let todo = TodoRepository::create(&repo, AuthUser::default(), new, None).await.unwrap();
+        let sent = || repo.notifications(AuthUser::default(), 10);
+
+        poll(&repo, &Channel::Notifications, DEFAULT_MAX_ATTEMPTS, remind_at - Duration::seconds(1)).await.unwrap();
+        assert!(sent().await.unwrap().is_empty());
+
+        for later in [Duration::zero(), Duration::seconds(15), Duration::hours(1)] {
+            poll(&repo, &Channel::Notifications, DEFAULT_MAX_ATTEMPTS, remind_at + later).await.unwrap();
+        }
+        let notifications = sent().await.unwrap();
+        assert_eq!(notifications.len(), 1);
+        assert_eq!(notifications[0].todo_id, todo.id);
+        assert_eq!(notifications[0].remind_at, remind_at);
+        assert_eq!(notifications[0].created_at, remind_at);
+
+        let (todo, _) = repo.find(AuthUser::default(), todo.id).await.unwrap().unwrap();
+        assert_eq!(todo.reminded_at, Some(remind_at));
+    }
+}
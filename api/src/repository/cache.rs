@@ -0,0 +1,551 @@
+//! Optional in-process cache in front of the todo reads every page load makes:
+//! listing, counting and finding a todo. Any write through this process
+//! empties it, so only changes made by other instances can be served stale,
+//! and then for at most CACHE_TTL.
+
+use async_trait::async_trait;
+use chrono::{DateTime, Utc};
+use serde_json::Value;
+use std::collections::HashMap;
+use std::env;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex, MutexGuard};
+use std::time::{Duration, Instant};
+use tokio::sync::mpsc;
+use uuid::Uuid;
+
+use crate::auth::{Actor, AuthUser};
+use crate::db::parse_duration;
+use crate::error::ApiError;
+use crate::models::{CacheStats, HistoryEvent, ImportMode, ListMember, Notification, Role, Todo, TodoList};
+
+use super::{
+    Changes, DueReminder, IdempotencyKey, ImportOutcome, ImportRow, ListRepository, NewTodo, ReminderRepository,
+    StoredResponse, TodoChanges, TodoFilter, TodoRepository, UndoToken, Updated,
+};
+
+const DEFAULT_MAX_ENTRIES: usize = 1000;
+
+/// How long cached reads stay fresh and how many are kept, configured through
+/// CACHE_TTL and CACHE_MAX_ENTRIES
+#[derive(Debug, Clone, Copy)]
+pub struct CacheSettings {
+    pub ttl: Duration,
+    pub max_entries: usize,
+}
+
+impl CacheSettings {
+    /// None unless CACHE_TTL is set to a positive duration
+    pub fn from_env() -> Result<Option<Self>, String> {
+        let ttl = match env::var("CACHE_TTL").ok().filter(|v| !v.is_empty()) {
+            None => return Ok(None),
+            Some(value) => parse_duration(&value).ok_or_else(|| {
+                format!("CACHE_TTL must be a duration such as '5s' or '1m', or 0 to disable, got '{}'", value)
+            })?,
+        };
+        if ttl.is_zero() {
+            return Ok(None);
+        }
+        let max_entries = match env::var("CACHE_MAX_ENTRIES").ok().filter(|v| !v.is_empty()) {
+            None => DEFAULT_MAX_ENTRIES,
+            Some(value) => value.parse().ok().filter(|n| *n > 0).ok_or_else(|| {
+                format!("CACHE_MAX_ENTRIES must be a positive number, got '{}'", value)
+            })?,
+        };
+        Ok(Some(CacheSettings { ttl, max_entries }))
+    }
+}
+
+/// A cached read result
+#[derive(Clone)]
+enum Cached {
+    List(Vec<Todo>),
+    Count(i64),
+    Find(Option<(Todo, Role)>),
+}
+
+struct Entry {
+    stored_at: Instant,
+    value: Cached,
+}
+
+struct Entries {
+    /// Bumped by every invalidation, so a read that started before a write
+    /// cannot store what it read once the write has emptied the cache
+    generation: u64,
+    map: HashMap<String, Entry>,
+}
+
+/// Recent read results, shared by the repository wrappers below
+pub struct TodoCache {
+    settings: CacheSettings,
+    entries: Mutex<Entries>,
+    hits: AtomicU64,
+    misses: AtomicU64,
+}
+
+impl TodoCache {
+    pub fn new(settings: CacheSettings) -> Self {
+        TodoCache {
+            settings,
+            entries: Mutex::new(Entries { generation: 0, map: HashMap::new() }),
+            hits: AtomicU64::new(0),
+            misses: AtomicU64::new(0),
+        }
+    }
+
+    fn lock(&self) -> MutexGuard<'_, Entries> {
+        self.entries.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// The fresh value under `key` taken out with `take`, or on a miss the
+    /// generation to `put` the value read instead under
+    fn get<T>(&self, key: &str, take: impl FnOnce(&Cached) -> Option<T>) -> Result<T, u64> {
+        let entries = self.lock();
+        let hit = entries
+            .map
+            .get(key)
+            .filter(|entry| entry.stored_at.elapsed() < self.settings.ttl)
+            .and_then(|entry| take(&entry.value));
+        match hit {
+            Some(value) => {
+                self.hits.fetch_add(1, Ordering::Relaxed);
+                Ok(value)
+            }
+            None => {
+                self.misses.fetch_add(1, Ordering::Relaxed);
+                Err(entries.generation)
+            }
+        }
+    }
+
+    /// Store a value read at `generation`, unless a write has happened since.
+    /// When full, expired entries go first and then the oldest one.
+    fn put(&self, key: String, generation: u64, value: Cached) {
+        let mut entries = self.lock();
+        if entries.generation != generation {
+            return;
+        }
+        if entries.map.len() >= self.settings.max_entries && !entries.map.contains_key(&key) {
+            let ttl = self.settings.ttl;
+            entries.map.retain(|_, entry| entry.stored_at.elapsed() < ttl);
+            if entries.map.len() >= self.settings.max_entries {
+                let oldest = entries.map.iter().min_by_key(|(_, entry)| entry.stored_at).map(|(k, _)| k.clone());
+                if let Some(oldest) = oldest {
+                    entries.map.remove(&oldest);
+                }
+            }
+        }
+        entries.map.insert(key, Entry { stored_at: Instant::now(), value });
+    }
+
+    /// Forget everything. Todos are visible to every member of their list, so
+    /// a write cannot tell which users' reads it affects.
+    pub fn invalidate(&self) {
+        let mut entries = self.lock();
+        entries.generation += 1;
+        entries.map.clear();
+    }
+
+    pub fn stats(&self) -> CacheStats {
+        CacheStats {
+            ttl_secs: self.settings.ttl.as_secs_f64(),
+            max_entries: self.settings.max_entries,
+            entries: self.lock().map.len(),
+            hits: self.hits.load(Ordering::Relaxed),
+            misses: self.misses.load(Ordering::Relaxed),
+        }
+    }
+}
+
+/// Todo storage answering `list`, `count` and `find` from the cache when it
+/// can, and emptying the cache after every write
+pub struct CachedTodos {
+    inner: Arc<dyn TodoRepository>,
+    cache: Arc<TodoCache>,
+}
+
+impl CachedTodos {
+    pub fn new(inner: Arc<dyn TodoRepository>, cache: Arc<TodoCache>) -> Self {
+        CachedTodos { inner, cache }
+    }
+
+    /// Run a write and empty the cache once it is done, whether or not it
+    /// succeeded
+    async fn write<T>(&self, result: impl std::future::Future<Output = T>) -> T {
+        let result = result.await;
+        self.cache.invalidate();
+        result
+    }
+}
+
+#[async_trait]
+impl TodoRepository for CachedTodos {
+    async fn list(&self, user: AuthUser, filter: &TodoFilter) -> Result<Vec<Todo>, ApiError> {
+        let key = format!("list {:?} {:?}", user, filter);
+        let generation = match self.cache.get(&key, |c| match c {
+            Cached::List(todos) => Some(todos.clone()),
+            _ => None,
+        }) {
+            Ok(todos) => return Ok(todos),
+            Err(generation) => generation,
+        };
+        let todos = self.inner.list(user, filter).await?;
+        self.cache.put(key, generation, Cached::List(todos.clone()));
+        Ok(todos)
+    }
+
+    async fn count(&self, user: AuthUser, filter: &TodoFilter) -> Result<i64, ApiError> {
+        let key = format!("count {:?} {:?}", user, filter);
+        let generation = match self.cache.get(&key, |c| match c {
+            Cached::Count(count) => Some(*count),
+            _ => None,
+        }) {
+            Ok(count) => return Ok(count),
+            Err(generation) => generation,
+        };
+        let count = self.inner.count(user, filter).await?;
+        self.cache.put(key, generation, Cached::Count(count));
+        Ok(count)
+    }
+
+    async fn export(&self, user: AuthUser, rows: mpsc::Sender<Result<Todo, ApiError>>) {
+        self.inner.export(user, rows).await
+    }
+
+    async fn find(&self, user: AuthUser, id: Uuid) -> Result<Option<(Todo, Role)>, ApiError> {
+        let key = format!("find {:?} {}", user, id);
+        let generation = match self.cache.get(&key, |c| match c {
+            Cached::Find(found) => Some(found.clone()),
+            _ => None,
+        }) {
+            Ok(found) => return Ok(found),
+            Err(generation) => generation,
+        };
+        let found = self.inner.find(user, id).await?;
+        self.cache.put(key, generation, Cached::Find(found.clone()));
+        Ok(found)
+    }
+
+    async fn subtasks(&self, user: AuthUser, id: Uuid) -> Result<Vec<Todo>, ApiError> {
+        self.inner.subtasks(user, id).await
+    }
+
+    async fn search(&self, user: AuthUser, query: &str, limit: i64) -> Result<Vec<(Todo, f32)>, ApiError> {
+        self.inner.search(user, query, limit).await
+    }
+
+    async fn existing(&self, user: AuthUser, ids: &[Uuid]) -> Result<Vec<Uuid>, ApiError> {
+        self.inner.existing(user, ids).await
+    }
+
+    async fn find_many(&self, user: AuthUser, ids: &[Uuid]) -> Result<Vec<Todo>, ApiError> {
+        self.inner.find_many(user, ids).await
+    }
+
+    async fn has_subtasks(&self, id: Uuid) -> Result<bool, ApiError> {
+        self.inner.has_subtasks(id).await
+    }
+
+    async fn is_ancestor(&self, ancestor: Uuid, id: Uuid) -> Result<bool, ApiError> {
+        self.inner.is_ancestor(ancestor, id).await
+    }
+
+    async fn open_titled(&self, user_id: Option<Uuid>, title: &str) -> Result<Option<Uuid>, ApiError> {
+        self.inner.open_titled(user_id, title).await
+    }
+
+    async fn create(
+        &self,
+        user: AuthUser,
+        todo: NewTodo,
+        idempotency: Option<IdempotencyKey>,
+    ) -> Result<Todo, ApiError> {
+        self.write(self.inner.create(user, todo, idempotency)).await
+    }
+
+    async fn idempotent_response(
+        &self,
+        user: AuthUser,
+        key: &str,
+        request: &Value,
+        ttl_secs: i64,
+    ) -> Result<Option<StoredResponse>, ApiError> {
+        self.inner.idempotent_response(user, key, request, ttl_secs).await
+    }
+
+    async fn update(&self, existing: &Todo, changes: TodoChanges) -> Result<Updated, ApiError> {
+        self.write(self.inner.update(existing, changes)).await
+    }
+
+    async fn update_many(&self, updates: Vec<(Todo, TodoChanges)>) -> Result<Vec<Updated>, ApiError> {
+        self.write(self.inner.update_many(updates)).await
+    }
+
+    async fn set_completed(&self, existing: &Todo, completed: bool, actor: Actor) -> Result<Updated, ApiError> {
+        self.write(self.inner.set_completed(existing, completed, actor)).await
+    }
+
+    async fn set_archived(&self, existing: &Todo, archived: bool, actor: Actor) -> Result<Todo, ApiError> {
+        self.write(self.inner.set_archived(existing, archived, actor)).await
+    }
+
+    async fn reorder(&self, user: AuthUser, ids: &[Uuid], actor: Actor) -> Result<(), ApiError> {
+        self.write(self.inner.reorder(user, ids, actor)).await
+    }
+
+    async fn delete(
+        &self,
+        user: AuthUser,
+        id: Uuid,
+        actor: Actor,
+        undo: &UndoToken,
+    ) -> Result<Option<Todo>, ApiError> {
+        self.write(self.inner.delete(user, id, actor, undo)).await
+    }
+
+    async fn restore(
+        &self,
+        user: AuthUser,
+        token: &str,
+        actor: Actor,
+        now: DateTime<Utc>,
+    ) -> Result<Vec<Todo>, ApiError> {
+        self.write(self.inner.restore(user, token, actor, now)).await
+    }
+
+    async fn purge_expired_deletes(&self, now: DateTime<Utc>) -> Result<u64, ApiError> {
+        // Finalizing a deletion only drops rows nothing lists any more
+        self.inner.purge_expired_deletes(now).await
+    }
+
+    async fn purge_archived(&self, before: DateTime<Utc>, limit: i64) -> Result<u64, ApiError> {
+        self.write(self.inner.purge_archived(before, limit)).await
+    }
+
+    async fn changes(&self, user: AuthUser, since: DateTime<Utc>) -> Result<Changes, ApiError> {
+        self.inner.changes(user, since).await
+    }
+
+    async fn delete_all(&self) -> Result<u64, ApiError> {
+        self.write(self.inner.delete_all()).await
+    }
+
+    async fn history(&self, id: Uuid, after: Option<i64>, limit: i64) -> Result<Vec<HistoryEvent>, ApiError> {
+        self.inner.history(id, after, limit).await
+    }
+
+    async fn import(
+        &self,
+        user: AuthUser,
+        actor: Actor,
+        rows: &[ImportRow],
+        mode: ImportMode,
+    ) -> Result<ImportOutcome, ApiError> {
+        self.write(self.inner.import(user, actor, rows, mode)).await
+    }
+
+    async fn seed(&self, rows: &[ImportRow]) -> Result<usize, ApiError> {
+        self.write(self.inner.seed(rows)).await
+    }
+}
+
+/// List storage that empties the todo cache when membership changes, since
+/// that changes which todos members can see
+pub struct CachedLists {
+    inner: Arc<dyn ListRepository>,
+    cache: Arc<TodoCache>,
+}
+
+impl CachedLists {
+    pub fn new(inner: Arc<dyn ListRepository>, cache: Arc<TodoCache>) -> Self {
+        CachedLists { inner, cache }
+    }
+}
+
+#[async_trait]
+impl ListRepository for CachedLists {
+    async fn lists_for(&self, user_id: Uuid) -> Result<Vec<TodoList>, ApiError> {
+        self.inner.lists_for(user_id).await
+    }
+
+    async fn create(&self, owner_id: Uuid, name: &str) -> Result<TodoList, ApiError> {
+        self.inner.create(owner_id, name).await
+    }
+
+    async fn role(&self, user: AuthUser, list_id: Uuid) -> Result<Option<Role>, ApiError> {
+        self.inner.role(user, list_id).await
+    }
+
+    async fn share(&self, list_id: Uuid, user_id: Uuid, role: Role) -> Result<ListMember, ApiError> {
+        let result = self.inner.share(list_id, user_id, role).await;
+        self.cache.invalidate();
+        result
+    }
+
+    async fn members(&self, list_id: Uuid) -> Result<Vec<ListMember>, ApiError> {
+        self.inner.members(list_id).await
+    }
+
+    async fn revoke(&self, list_id: Uuid, user_id: Uuid) -> Result<bool, ApiError> {
+        let result = self.inner.revoke(list_id, user_id).await;
+        self.cache.invalidate();
+        result
+    }
+}
+
+/// Reminder storage that empties the todo cache once a delivery is recorded,
+/// which sets the todo's `reminded_at`
+pub struct CachedReminders {
+    inner: Arc<dyn ReminderRepository>,
+    cache: Arc<TodoCache>,
+}
+
+impl CachedReminders {
+    pub fn new(inner: Arc<dyn ReminderRepository>, cache: Arc<TodoCache>) -> Self {
+        CachedReminders { inner, cache }
+    }
+}
+
+#[async_trait]
+impl ReminderRepository for CachedReminders {
+    async fn claim_due(
+        &self,
+        now: DateTime<Utc>,
+        lease_until: DateTime<Utc>,
+        max_attempts: i32,
+        limit: i64,
+    ) -> Result<Vec<DueReminder>, ApiError> {
+        self.inner.claim_due(now, lease_until, max_attempts, limit).await
+    }
+
+    async fn mark_sent(
+        &self,
+        todo: &Todo,
+        sent_at: DateTime<Utc>,
+        notification: Option<&Notification>,
+    ) -> Result<(), ApiError> {
+        let result = self.inner.mark_sent(todo, sent_at, notification).await;
+        self.cache.invalidate();
+        result
+    }
+
+    async fn mark_failed(&self, todo: &Todo, error: &str, retry_at: DateTime<Utc>) -> Result<(), ApiError> {
+        self.inner.mark_failed(todo, error, retry_at).await
+    }
+
+    async fn notifications(&self, user: AuthUser, limit: i64) -> Result<Vec<Notification>, ApiError> {
+        self.inner.notifications(user, limit).await
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use chrono::Utc;
+    use std::time::{Duration, Instant};
+    use uuid::Uuid;
+
+    use super::{CacheSettings, Cached, TodoCache};
+    use crate::auth::{Actor, AuthUser};
+    use crate::models::{Recurrence, Role};
+    use crate::repository::{sqlite, MemoryRepository, NewTodo, Repositories, SqliteRepository, TodoFilter};
+
+    const SETTINGS: CacheSettings = CacheSettings { ttl: Duration::from_secs(60), max_entries: 10 };
+
+    fn new_todo(list_id: Option<Uuid>) -> NewTodo {
+        NewTodo {
+            title: "Water plants".to_string(),
+            description: None,
+            tags: Vec::new(),
+            list_id,
+            parent_id: None,
+            due_date: None,
+            recurrence: Recurrence::None,
+            recurrence_interval: 1,
+            remind_at: Some(Utc::now()),
+            unique_title: false,
+            actor: Actor::default(),
+        }
+    }
+
+    async fn user(repositories: &Repositories, name: &str) -> AuthUser {
+        let user = repositories.users.create(name, "hash").await.unwrap();
+        AuthUser { user_id: Some(user.id) }
+    }
+
+    #[test]
+    fn read_overtaken_by_a_write_is_not_stored() {
+        let cache = TodoCache::new(SETTINGS);
+        let generation = cache.get("count", |_| Some(())).unwrap_err();
+        // A write lands while the read is still on its way back from storage
+        cache.invalidate();
+        cache.put("count".to_string(), generation, Cached::Count(1));
+        assert_eq!(cache.stats().entries, 0);
+
+        let generation = cache.get("count", |_| Some(())).unwrap_err();
+        cache.put("count".to_string(), generation, Cached::Count(2));
+        let cached = cache.get("count", |c| match c {
+            Cached::Count(count) => Some(*count),
+            _ => None,
+        });
+        assert_eq!(cached, Ok(2));
+    }
+
+    #[actix_web::test]
+    async fn sharing_and_revoking_empty_the_cache() {
+        let repositories = Repositories::new(MemoryRepository::new()).cached(SETTINGS);
+        let owner = user(&repositories, "owner").await;
+        let member = user(&repositories, "member").await;
+        let list = repositories.lists.create(owner.user_id.unwrap(), "Home").await.unwrap();
+        repositories.todos.create(owner, new_todo(Some(list.id)), None).await.unwrap();
+        let filter = TodoFilter::default();
+
+        assert!(repositories.todos.list(member, &filter).await.unwrap().is_empty());
+        repositories.lists.share(list.id, member.user_id.unwrap(), Role::Viewer).await.unwrap();
+        assert_eq!(repositories.todos.list(member, &filter).await.unwrap().len(), 1);
+
+        repositories.lists.revoke(list.id, member.user_id.unwrap()).await.unwrap();
+        assert!(repositories.todos.list(member, &filter).await.unwrap().is_empty());
+    }
+
+    #[actix_web::test]
+    async fn sending_a_reminder_empties_the_cache() {
+        let repositories = Repositories::new(MemoryRepository::new()).cached(SETTINGS);
+        let todo = repositories.todos.create(AuthUser::default(), new_todo(None), None).await.unwrap();
+        let (found, _) = repositories.todos.find(AuthUser::default(), todo.id).await.unwrap().unwrap();
+        assert_eq!(found.reminded_at, None);
+
+        let sent_at = Utc::now();
+        repositories.reminders.mark_sent(&todo, sent_at, None).await.unwrap();
+        let (found, _) = repositories.todos.find(AuthUser::default(), todo.id).await.unwrap().unwrap();
+        assert_eq!(found.reminded_at, Some(sent_at));
+    }
+
+    async fn time_lists(repositories: &Repositories, rounds: u32) -> Duration {
+        let filter = TodoFilter::default();
+        let started = Instant::now();
+        for _ in 0..rounds {
+            repositories.todos.list(AuthUser::default(), &filter).await.unwrap();
+        }
+        started.elapsed()
+    }
+
+    // Run with `cargo test --release -- --ignored --nocapture cache_benchmark`
+    #[actix_web::test]
+    #[ignore]
+    async fn cache_benchmark() {
+        const TODOS: usize = 500;
+        const ROUNDS: u32 = 200;
+        let pool = sqlite::in_memory().await.unwrap();
+        let uncached = Repositories::new(SqliteRepository::new(pool));
+        for _ in 0..TODOS {
+            uncached.todos.create(AuthUser::default(), new_todo(None), None).await.unwrap();
+        }
+        let cached = uncached.clone().cached(SETTINGS);
+
+        let direct = time_lists(&uncached, ROUNDS).await;
+        let through_cache = time_lists(&cached, ROUNDS).await;
+        println!("list of {TODOS} todos x {ROUNDS}: uncached {direct:?}, cached {through_cache:?}");
+        assert!(through_cache < direct);
+    }
+}
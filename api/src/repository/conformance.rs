@@ -0,0 +1,238 @@
+//! Behaviour every `TodoRepository` must share, checked against each backend
+//! that can run inside a test: the in-memory store and SQLite in memory.
+//! Postgres implements the same trait and is expected to pass it too.
+
+use chrono::{Duration, Utc};
+use std::collections::HashSet;
+use uuid::Uuid;
+
+use crate::auth::{Actor, AuthUser};
+use crate::error::ApiError;
+use crate::models::{ImportMode, ImportTodo, Recurrence, Role, Todo};
+use super::{
+    sqlite, ImportRow, MemoryRepository, NewTodo, SortField, SortKey, SqliteRepository, TodoChanges,
+    TodoFilter, TodoRepository, TodoSort, UndoToken,
+};
+
+fn new_todo(title: &str) -> NewTodo {
+    NewTodo {
+        title: title.to_string(),
+        description: None,
+        tags: vec!["home".to_string()],
+        list_id: None,
+        parent_id: None,
+        due_date: None,
+        recurrence: Recurrence::None,
+        recurrence_interval: 1,
+        remind_at: None,
+        unique_title: false,
+        actor: Actor::default(),
+    }
+}
+
+fn import_row(row: usize, id: Uuid, title: &str) -> ImportRow {
+    let todo = ImportTodo {
+        id: Some(id),
+        title: title.to_string(),
+        description: None,
+        completed: None,
+        tags: None,
+        created_at: None,
+        updated_at: None,
+    };
+    ImportRow { row, location: format!("Item {}", row), id, todo }
+}
+
+fn ids(todos: &[Todo]) -> HashSet<Uuid> {
+    todos.iter().map(|t| t.id).collect()
+}
+
+/// Run every check against `repo`, which must start out empty
+pub(crate) async fn conformance(repo: &dyn TodoRepository) {
+    let alice = AuthUser { user_id: Some(Uuid::new_v4()) };
+    let bob = AuthUser { user_id: Some(Uuid::new_v4()) };
+    let actor = Actor(alice.user_id);
+    let all = TodoFilter::default();
+
+    // Creating, and reading back only as the owner
+    let milk = repo.create(alice, new_todo("Buy milk"), None).await.unwrap();
+    assert_eq!((milk.version, milk.completed, milk.user_id), (1, false, alice.user_id));
+    assert_eq!(milk.tags, vec!["home".to_string()]);
+    let (found, role) = repo.find(alice, milk.id).await.unwrap().unwrap();
+    assert_eq!((found.title.as_str(), role), ("Buy milk", Role::Owner));
+    assert!(repo.find(bob, milk.id).await.unwrap().is_none());
+
+    let dog = repo.create(alice, new_todo("Walk dog"), None).await.unwrap();
+    assert_eq!(ids(&repo.list(alice, &all).await.unwrap()), HashSet::from([milk.id, dog.id]));
+    assert_eq!(repo.count(alice, &all).await.unwrap(), 2);
+    assert_eq!(repo.count(bob, &all).await.unwrap(), 0);
+    assert_eq!(repo.existing(alice, &[milk.id, Uuid::new_v4()]).await.unwrap(), vec![milk.id]);
+    assert!(repo.existing(bob, &[milk.id]).await.unwrap().is_empty());
+    assert_eq!(ids(&repo.find_many(alice, &[milk.id, dog.id]).await.unwrap()), HashSet::from([milk.id, dog.id]));
+    assert_eq!(repo.open_titled(alice.user_id, " buy MILK ").await.unwrap(), Some(milk.id));
+    assert_eq!(repo.open_titled(bob.user_id, "Buy milk").await.unwrap(), None);
+
+    // Updating is optimistic: a stale version is a conflict
+    let changes = TodoChanges { title: "Buy oat milk".to_string(), ..TodoChanges::keep(&milk, actor) };
+    let updated = repo.update(&milk, changes).await.unwrap().todo;
+    assert_eq!((updated.title.as_str(), updated.version), ("Buy oat milk", 2));
+    let stale = repo.update(&milk, TodoChanges::keep(&milk, actor)).await;
+    assert!(matches!(stale, Err(ApiError::Conflict(_))), "{:?}", stale);
+
+    // Under the unique title rule, creating or renaming to an open todo's
+    // title, compared ignoring case and spaces, names the todo in the way
+    let strict = NewTodo { unique_title: true, ..new_todo(" WALK dog") };
+    let clash = repo.create(alice, strict, None).await;
+    assert!(matches!(clash, Err(ApiError::DuplicateTitle { existing_id, .. }) if existing_id == dog.id), "{:?}", clash);
+    let rename =
+        TodoChanges { title: "walk DOG".to_string(), unique_title: true, ..TodoChanges::keep(&updated, actor) };
+    let clash = repo.update(&updated, rename).await;
+    assert!(matches!(clash, Err(ApiError::DuplicateTitle { existing_id, .. }) if existing_id == dog.id), "{:?}", clash);
+
+    // Completing a recurring todo creates its next occurrence
+    let due = Utc::now();
+    let daily = NewTodo { recurrence: Recurrence::Daily, due_date: Some(due), ..new_todo("Stretch") };
+    let daily = repo.create(alice, daily, None).await.unwrap();
+    let completed = repo.set_completed(&daily, true, actor).await.unwrap();
+    assert!(completed.todo.completed && completed.todo.completed_at.is_some());
+    let next = completed.next_occurrence.unwrap();
+    assert_eq!((next.completed, next.title.as_str()), (false, "Stretch"));
+    assert_eq!(next.due_date.map(|d| d.timestamp()), Some((due + Duration::days(1)).timestamp()));
+    // Completing it again from the same stale copy, as a second concurrent
+    // request would, changes nothing and creates no second occurrence
+    let again = repo.set_completed(&daily, true, actor).await.unwrap();
+    assert!(again.next_occurrence.is_none());
+    assert_eq!(again.todo.version, completed.todo.version);
+    let open_stretches = TodoFilter { completed: Some(false), ..all.clone() };
+    let open = repo.list(alice, &open_stretches).await.unwrap();
+    assert_eq!(open.iter().filter(|t| t.title == "Stretch").count(), 1);
+    let reopened = repo.set_completed(&completed.todo, false, actor).await.unwrap();
+    assert!(reopened.next_occurrence.is_none());
+
+    // Subtasks
+    let child = NewTodo { parent_id: Some(updated.id), ..new_todo("Find a shop") };
+    let child = repo.create(alice, child, None).await.unwrap();
+    assert_eq!(ids(&repo.subtasks(alice, updated.id).await.unwrap()), HashSet::from([child.id]));
+    assert!(repo.has_subtasks(updated.id).await.unwrap());
+    assert!(repo.is_ancestor(updated.id, child.id).await.unwrap());
+    assert!(!repo.is_ancestor(child.id, updated.id).await.unwrap());
+
+    // Reordering must name every todo of the owner exactly once
+    let by_position = TodoFilter { sort: TodoSort { field: SortField::Position, descending: false }, ..all.clone() };
+    let before_reorder = repo.list(alice, &by_position).await.unwrap();
+    let mut order: Vec<Uuid> = before_reorder.iter().map(|t| t.id).collect();
+    order.reverse();
+    let partial = repo.reorder(alice, &order[1..], actor).await;
+    assert!(matches!(partial, Err(ApiError::BadRequest(_))), "{:?}", partial);
+    repo.reorder(alice, &order, actor).await.unwrap();
+    let reordered = repo.list(alice, &by_position).await.unwrap();
+    assert_eq!(reordered.iter().map(|t| t.id).collect::<Vec<_>>(), order);
+    // Moving a todo is a change to it, made by the actor and kept in its history
+    let (last, first) = (&before_reorder[before_reorder.len() - 1], &reordered[0]);
+    assert_eq!(first.id, last.id);
+    assert_eq!(first.version, last.version + 1);
+    assert!(first.updated_at > last.updated_at);
+    assert_eq!(first.updated_by, actor.0);
+    let latest = repo.history(first.id, None, 1).await.unwrap();
+    assert_eq!(latest[0].event, "reordered");
+    assert_eq!(latest[0].actor_id, actor.0);
+
+    // Deleting takes subtasks along and can be undone once, by the deleter
+    let undo = UndoToken { token: Uuid::new_v4().to_string(), expires_at: Utc::now() + Duration::minutes(5) };
+    let deleted = repo.delete(alice, updated.id, actor, &undo).await.unwrap().unwrap();
+    assert_eq!(deleted.id, updated.id);
+    assert!(repo.find(alice, child.id).await.unwrap().is_none());
+    assert!(repo.delete(alice, updated.id, actor, &undo).await.unwrap().is_none());
+    let foreign = repo.restore(bob, &undo.token, Actor(bob.user_id), Utc::now()).await;
+    assert!(matches!(foreign, Err(ApiError::NotFound(_))), "{:?}", foreign);
+    let restored = repo.restore(alice, &undo.token, actor, Utc::now()).await.unwrap();
+    assert_eq!(restored.first().map(|t| t.id), Some(updated.id));
+    assert_eq!(ids(&restored), HashSet::from([updated.id, child.id]));
+    let again = repo.restore(alice, &undo.token, actor, Utc::now()).await;
+    assert!(matches!(again, Err(ApiError::NotFound(_))), "{:?}", again);
+    assert!(!repo.history(updated.id, None, 10).await.unwrap().is_empty());
+
+    // The undo window is closed from the instant it expires
+    let expires_at = Utc::now() + Duration::minutes(5);
+    let undo = UndoToken { token: Uuid::new_v4().to_string(), expires_at };
+    repo.delete(alice, child.id, actor, &undo).await.unwrap().unwrap();
+    let late = repo.restore(alice, &undo.token, actor, expires_at).await;
+    assert!(matches!(late, Err(ApiError::Gone(_))), "{:?}", late);
+    let undo = UndoToken { token: Uuid::new_v4().to_string(), expires_at };
+    repo.delete(alice, updated.id, actor, &undo).await.unwrap().unwrap();
+    let just_in_time = repo.restore(alice, &undo.token, actor, expires_at - Duration::milliseconds(1)).await.unwrap();
+    assert_eq!(just_in_time.first().map(|t| t.id), Some(updated.id));
+
+    // Archived todos leave the default list and can be purged
+    let archived = repo.set_archived(&dog, true, actor).await.unwrap();
+    assert!(archived.archived);
+    assert!(!ids(&repo.list(alice, &all).await.unwrap()).contains(&dog.id));
+    let archived_only = TodoFilter { archived: true, ..all.clone() };
+    assert_eq!(ids(&repo.list(alice, &archived_only).await.unwrap()), HashSet::from([dog.id]));
+    assert_eq!(repo.purge_archived(Utc::now() + Duration::seconds(1), 10).await.unwrap(), 1);
+    assert!(repo.find(alice, dog.id).await.unwrap().is_none());
+
+    // Importing, with existing ids handled by mode
+    let imported_id = Uuid::new_v4();
+    let rows = [import_row(1, imported_id, "Imported")];
+    let outcome = repo.import(bob, Actor(bob.user_id), &rows, ImportMode::Fail).await.unwrap();
+    assert_eq!((outcome.imported, outcome.skipped), (1, 0));
+    let outcome = repo.import(bob, Actor(bob.user_id), &rows, ImportMode::Skip).await.unwrap();
+    assert_eq!((outcome.imported, outcome.skipped), (0, 1));
+    let failed = repo.import(bob, Actor(bob.user_id), &rows, ImportMode::Fail).await;
+    assert!(matches!(failed, Err(ApiError::Conflict(_))), "{:?}", failed);
+    let renamed = [import_row(1, imported_id, "Imported again")];
+    let outcome = repo.import(bob, Actor(bob.user_id), &renamed, ImportMode::Overwrite).await.unwrap();
+    assert_eq!(outcome.imported, 1);
+    assert_eq!(repo.find(bob, imported_id).await.unwrap().unwrap().0.title, "Imported again");
+    let events: Vec<String> = repo.history(imported_id, None, 10).await.unwrap().into_iter().map(|e| e.event).collect();
+    assert_eq!(events, ["updated", "created"]);
+
+    // Todos sharing a timestamp come back in id order, the same way round as
+    // the sort, and paging from the middle of a tie neither skips nor repeats
+    let carol = AuthUser { user_id: Some(Uuid::new_v4()) };
+    let stamp = Utc::now() - Duration::days(1);
+    let tied: Vec<ImportRow> = (1..=4)
+        .map(|row| {
+            let mut tied = import_row(row, Uuid::new_v4(), &format!("Tied {}", row));
+            (tied.todo.created_at, tied.todo.updated_at) = (Some(stamp), Some(stamp));
+            tied
+        })
+        .collect();
+    repo.import(carol, Actor(carol.user_id), &tied, ImportMode::Fail).await.unwrap();
+    let mut by_id: Vec<Uuid> = tied.iter().map(|row| row.id).collect();
+    by_id.sort();
+    for field in [SortField::CreatedAt, SortField::UpdatedAt] {
+        for descending in [false, true] {
+            let sort = TodoSort { field, descending };
+            let expected: Vec<Uuid> = if descending { by_id.iter().rev().copied().collect() } else { by_id.clone() };
+            let sorted = TodoFilter { sort, ..all.clone() };
+            let listed: Vec<Uuid> = repo.list(carol, &sorted).await.unwrap().iter().map(|t| t.id).collect();
+            assert_eq!(listed, expected, "{:?}", sort);
+            let rest = TodoFilter { after: Some((SortKey::Time(stamp), expected[1])), ..sorted };
+            let listed: Vec<Uuid> = repo.list(carol, &rest).await.unwrap().iter().map(|t| t.id).collect();
+            assert_eq!(listed, expected[2..], "{:?}", sort);
+        }
+    }
+
+    // Seeding skips ids that exist; deleting everything leaves nothing
+    let seeded = [import_row(1, Uuid::new_v4(), "Seeded")];
+    assert_eq!(repo.seed(&seeded).await.unwrap(), 1);
+    assert_eq!(repo.seed(&seeded).await.unwrap(), 0);
+    assert_eq!(repo.history(seeded[0].id, None, 10).await.unwrap().len(), 1);
+    assert_eq!(repo.count(AuthUser::default(), &all).await.unwrap(), 1);
+    assert!(repo.delete_all().await.unwrap() > 0);
+    assert_eq!(repo.count(alice, &all).await.unwrap(), 0);
+    assert_eq!(repo.count(bob, &all).await.unwrap(), 0);
+}
+
+#[actix_web::test]
+async fn memory_repository_conforms() {
+    conformance(&MemoryRepository::new()).await;
+}
+
+#[actix_web::test]
+async fn sqlite_repository_conforms() {
+    let pool = sqlite::in_memory().await.unwrap();
+    conformance(&SqliteRepository::new(pool)).await;
+}
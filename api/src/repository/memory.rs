@@ -0,0 +1,1242 @@
+//! Repository kept entirely in memory, for development and for running the API
+//! without a database. It follows the same access and ordering rules as the SQL
+//! repositories and can be saved to a JSON file on shutdown.
+
+use async_trait::async_trait;
+use chrono::{DateTime, Duration, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::io;
+use std::path::PathBuf;
+use std::sync::{RwLock, RwLockReadGuard, RwLockWriteGuard};
+use tokio::sync::mpsc;
+use uuid::Uuid;
+
+use crate::auth::{Actor, AuthUser};
+use crate::error::ApiError;
+use crate::models::{
+    HistoryAction, HistoryEvent, ImportMode, ListMember, Notification, PoolStats, Recurrence, Role, Todo,
+    TodoList, TodoResponse, Tombstone, User, Webhook, WebhookEvent,
+};
+use super::{
+    check_reorder, duplicate_title, Changes, next_due, next_remind_at, parents_first, plan_import, rank_by_terms,
+    restore_orphaned, search_terms, snapshot, title_key, todo_not_found, undo_expired, undo_not_found, DueReminder,
+    HealthRepository, IdempotencyKey, ImportOutcome, ImportRow, ListRepository, NewTodo, ReminderRepository,
+    StoredResponse, TodoChanges, TodoFilter, TodoRepository, UndoToken, Updated, UserRepository,
+    WebhookRepository, IMPORT_BATCH_ROWS,
+};
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct StoredUser {
+    id: Uuid,
+    username: String,
+    password_hash: String,
+    created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct StoredList {
+    id: Uuid,
+    name: String,
+    owner_id: Uuid,
+    created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct StoredMember {
+    list_id: Uuid,
+    user_id: Uuid,
+    role: String,
+    created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct StoredKey {
+    key: String,
+    user_id: Option<Uuid>,
+    request: Value,
+    response: Value,
+    created_at: DateTime<Utc>,
+}
+
+/// Todos deleted under an undo token, the deleted one first
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct PendingDelete {
+    token: String,
+    user_id: Option<Uuid>,
+    todos: Vec<Todo>,
+    expires_at: DateTime<Utc>,
+}
+
+/// Delivery bookkeeping for a todo's reminder, like the reminder_* columns of
+/// the SQL backends
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct ReminderAttempts {
+    todo_id: Uuid,
+    attempts: i32,
+    error: Option<String>,
+    /// Not claimed again before this, after a failure or while delivering
+    retry_at: Option<DateTime<Utc>>,
+}
+
+/// Everything the store holds; also the layout of the JSON file
+#[derive(Debug, Default, Serialize, Deserialize)]
+#[serde(default)]
+struct State {
+    todos: Vec<Todo>,
+    users: Vec<StoredUser>,
+    lists: Vec<StoredList>,
+    members: Vec<StoredMember>,
+    idempotency_keys: Vec<StoredKey>,
+    webhooks: Vec<Webhook>,
+    /// Todo history, oldest first
+    events: Vec<HistoryEvent>,
+    pending_deletes: Vec<PendingDelete>,
+    reminders: Vec<ReminderAttempts>,
+    /// Delivered reminders, oldest first
+    notifications: Vec<Notification>,
+}
+
+impl State {
+    fn member_role(&self, user: AuthUser, list_id: Uuid) -> Option<Role> {
+        self.members
+            .iter()
+            .find(|m| m.list_id == list_id && Some(m.user_id) == user.user_id)
+            .and_then(|m| Role::from_db(&m.role))
+    }
+
+    /// Owner for todos the user created, otherwise their role on the todo's list
+    fn role_on(&self, user: AuthUser, todo: &Todo) -> Option<Role> {
+        if todo.user_id == user.user_id {
+            return Some(Role::Owner);
+        }
+        todo.list_id.and_then(|list_id| self.member_role(user, list_id))
+    }
+
+    /// Todos visible to `user`, newest first
+    fn visible(&self, user: AuthUser) -> Vec<Todo> {
+        let mut todos: Vec<Todo> = self
+            .todos
+            .iter()
+            .filter(|t| self.role_on(user, t).is_some())
+            .cloned()
+            .collect();
+        todos.sort_by(|a, b| (b.created_at, b.id).cmp(&(a.created_at, a.id)));
+        todos
+    }
+
+    fn member(&self, list_id: Uuid, user_id: Uuid) -> Option<ListMember> {
+        let member = self
+            .members
+            .iter()
+            .find(|m| m.list_id == list_id && m.user_id == user_id)?;
+        let user = self.users.iter().find(|u| u.id == user_id)?;
+        Some(ListMember {
+            user_id,
+            username: user.username.clone(),
+            role: member.role.clone(),
+            created_at: member.created_at,
+        })
+    }
+
+    /// The open todo of `user_id` other than `except` whose title matches,
+    /// compared as `title_key` does
+    fn open_titled(&self, user_id: Option<Uuid>, title: &str, except: Option<Uuid>) -> Option<Uuid> {
+        let key = title_key(title);
+        self.todos
+            .iter()
+            .find(|t| !t.completed && Some(t.id) != except && t.user_id == user_id && title_key(&t.title) == key)
+            .map(|t| t.id)
+    }
+
+    /// Fail with 409 Conflict if an open todo of `user_id` other than `id`
+    /// already has `title`
+    fn check_title_free(&self, user_id: Option<Uuid>, title: &str, id: Uuid) -> Result<(), ApiError> {
+        match self.open_titled(user_id, title, Some(id)) {
+            Some(existing_id) => Err(duplicate_title(title, existing_id)),
+            None => Ok(()),
+        }
+    }
+
+    /// Record `action` on `todo` in its history
+    fn record(&mut self, action: HistoryAction, todo: &Todo, actor: Option<Uuid>) -> Result<(), ApiError> {
+        let id = self.events.last().map_or(1, |e| e.id + 1);
+        self.events.push(HistoryEvent {
+            id,
+            todo_id: todo.id,
+            user_id: todo.user_id,
+            event: action.as_str().to_string(),
+            actor_id: actor,
+            snapshot: snapshot(todo)?,
+            created_at: Utc::now(),
+        });
+        Ok(())
+    }
+
+    /// Store `todo` in place of the row with the same id, adding the occurrence
+    /// that follows it when it was just completed
+    fn replace(&mut self, existing: &Todo, mut todo: Todo, now: DateTime<Utc>) -> Result<Updated, ApiError> {
+        todo.completed_at = if todo.completed { todo.completed_at.or(Some(now)) } else { None };
+
+        let next_occurrence = if todo.completed && !existing.completed {
+            next_occurrence(&todo, now, next_position(&self.todos))
+        } else {
+            None
+        };
+        if let Some(next) = &next_occurrence {
+            self.todos.push(next.clone());
+        }
+
+        if let Some(slot) = self.todos.iter_mut().find(|t| t.id == todo.id) {
+            *slot = todo.clone();
+        }
+        self.record(HistoryAction::Updated, &todo, todo.updated_by)?;
+        if let Some(next) = &next_occurrence {
+            self.record(HistoryAction::Created, next, next.created_by)?;
+        }
+        Ok(Updated { todo, next_occurrence })
+    }
+
+    /// Apply `changes` to `existing` if it is still at `changes.version`
+    fn update(&mut self, existing: &Todo, changes: TodoChanges, now: DateTime<Utc>) -> Result<Updated, ApiError> {
+        // Only apply the update if the todo still has the version the client last saw
+        let current = self
+            .todos
+            .iter()
+            .find(|t| t.id == existing.id)
+            .cloned()
+            .ok_or_else(|| todo_not_found(existing.id))?;
+        if current.version != changes.version {
+            return Err(ApiError::Conflict("Todo was modified by someone else".to_string()));
+        }
+        if changes.unique_title {
+            self.check_title_free(current.user_id, &changes.title, current.id)?;
+        }
+
+        // A new reminder time makes the reminder due again
+        let reminder_moved = changes.remind_at != current.remind_at;
+        if reminder_moved {
+            self.reminders.retain(|r| r.todo_id != current.id);
+        }
+        let todo = Todo {
+            title: changes.title,
+            description: changes.description,
+            completed: changes.completed,
+            tags: changes.tags,
+            parent_id: changes.parent_id,
+            due_date: changes.due_date,
+            recurrence: changes.recurrence,
+            recurrence_interval: changes.recurrence_interval,
+            remind_at: changes.remind_at,
+            reminded_at: if reminder_moved { None } else { current.reminded_at },
+            version: current.version + 1,
+            updated_at: now,
+            updated_by: changes.actor.0,
+            ..current
+        };
+        self.replace(existing, todo, now)
+    }
+}
+
+/// The position placing a new todo after every stored one, like the sequence
+/// behind the SQL column
+fn next_position(todos: &[Todo]) -> i64 {
+    todos.iter().map(|t| t.position).max().unwrap_or(0) + 1
+}
+
+/// The occurrence that follows a completed recurring todo, if it repeats
+fn next_occurrence(todo: &Todo, now: DateTime<Utc>, position: i64) -> Option<Todo> {
+    let (due_date, day) = next_due(todo, now)?;
+    Some(Todo {
+        id: Uuid::new_v4(),
+        completed: false,
+        archived: false,
+        position,
+        version: 1,
+        due_date: Some(due_date),
+        recurrence_day: Some(day),
+        completed_at: None,
+        remind_at: next_remind_at(todo, due_date),
+        reminded_at: None,
+        created_at: now,
+        updated_at: now,
+        // Whoever completed the todo brought the next occurrence about
+        created_by: todo.updated_by,
+        ..todo.clone()
+    })
+}
+
+/// In-memory implementation of every repository trait
+#[derive(Debug, Default)]
+pub struct MemoryRepository {
+    state: RwLock<State>,
+    /// Where the state is loaded from on start and saved to on shutdown
+    file: Option<PathBuf>,
+}
+
+impl MemoryRepository {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// A store backed by `file`, starting from its contents when it exists
+    pub fn open(file: PathBuf) -> io::Result<Self> {
+        let state = match fs::read(&file) {
+            Ok(data) => serde_json::from_slice(&data)
+                .map_err(|e| io::Error::new(io::ErrorKind::InvalidData, e))?,
+            Err(e) if e.kind() == io::ErrorKind::NotFound => State::default(),
+            Err(e) => return Err(e),
+        };
+        Ok(MemoryRepository { state: RwLock::new(state), file: Some(file) })
+    }
+
+    /// Write the current state to the store's file, if it has one. The file is
+    /// replaced atomically so a crash mid-write keeps the previous copy.
+    pub fn save(&self) -> io::Result<()> {
+        let Some(file) = &self.file else {
+            return Ok(());
+        };
+
+        let data = serde_json::to_vec(&*self.read())
+            .map_err(|e| io::Error::new(io::ErrorKind::InvalidData, e))?;
+        let tmp = file.with_extension("tmp");
+        fs::write(&tmp, data)?;
+        fs::rename(&tmp, file)
+    }
+
+    // A panic while holding the lock cannot leave the state half-updated in a
+    // way later requests care about, so a poisoned lock is still used
+    fn read(&self) -> RwLockReadGuard<'_, State> {
+        self.state.read().unwrap_or_else(|e| e.into_inner())
+    }
+
+    fn write(&self) -> RwLockWriteGuard<'_, State> {
+        self.state.write().unwrap_or_else(|e| e.into_inner())
+    }
+}
+
+#[async_trait]
+impl TodoRepository for MemoryRepository {
+    async fn list(&self, user: AuthUser, filter: &TodoFilter) -> Result<Vec<Todo>, ApiError> {
+        let limit = filter.limit.map_or(usize::MAX, |l| l.max(0) as usize);
+        let mut todos = self.read().visible(user);
+        todos.sort_by(|a, b| filter.sort.compare(a, b));
+        let todos = todos
+            .into_iter()
+            .filter(|t| filter.matches(t))
+            .filter(|t| filter.after.map_or(true, |after| filter.sort.is_after(t, after)))
+            .take(limit)
+            .collect();
+        Ok(todos)
+    }
+
+    async fn count(&self, user: AuthUser, filter: &TodoFilter) -> Result<i64, ApiError> {
+        Ok(self.read().visible(user).iter().filter(|t| filter.matches(t)).count() as i64)
+    }
+
+    async fn export(&self, user: AuthUser, rows: mpsc::Sender<Result<Todo, ApiError>>) {
+        // Snapshot first; the lock cannot be held across the sends
+        let todos = self.read().visible(user);
+        for todo in todos {
+            if rows.send(Ok(todo)).await.is_err() {
+                break;
+            }
+        }
+    }
+
+    async fn find(&self, user: AuthUser, id: Uuid) -> Result<Option<(Todo, Role)>, ApiError> {
+        let state = self.read();
+        Ok(state
+            .todos
+            .iter()
+            .find(|t| t.id == id)
+            .and_then(|t| state.role_on(user, t).map(|role| (t.clone(), role))))
+    }
+
+    async fn subtasks(&self, user: AuthUser, id: Uuid) -> Result<Vec<Todo>, ApiError> {
+        let mut todos: Vec<Todo> = self
+            .read()
+            .visible(user)
+            .into_iter()
+            .filter(|t| t.parent_id == Some(id))
+            .collect();
+        todos.sort_by_key(|t| (t.created_at, t.id));
+        Ok(todos)
+    }
+
+    async fn search(
+        &self,
+        user: AuthUser,
+        query: &str,
+        limit: i64,
+    ) -> Result<Vec<(Todo, f32)>, ApiError> {
+        let active = self.read().visible(user).into_iter().filter(|t| !t.archived).collect();
+        Ok(rank_by_terms(active, &search_terms(query), limit))
+    }
+
+    async fn existing(&self, user: AuthUser, ids: &[Uuid]) -> Result<Vec<Uuid>, ApiError> {
+        let state = self.read();
+        Ok(state
+            .todos
+            .iter()
+            .filter(|t| ids.contains(&t.id) && state.role_on(user, t).is_some())
+            .map(|t| t.id)
+            .collect())
+    }
+
+    async fn find_many(&self, user: AuthUser, ids: &[Uuid]) -> Result<Vec<Todo>, ApiError> {
+        let state = self.read();
+        Ok(state
+            .todos
+            .iter()
+            .filter(|t| ids.contains(&t.id) && state.role_on(user, t).is_some())
+            .cloned()
+            .collect())
+    }
+
+    async fn has_subtasks(&self, id: Uuid) -> Result<bool, ApiError> {
+        Ok(self.read().todos.iter().any(|t| t.parent_id == Some(id)))
+    }
+
+    async fn is_ancestor(&self, ancestor: Uuid, id: Uuid) -> Result<bool, ApiError> {
+        let state = self.read();
+        let mut seen = Vec::new();
+        let mut current = state.todos.iter().find(|t| t.id == id);
+        while let Some(todo) = current {
+            if todo.id == ancestor {
+                return Ok(true);
+            }
+            if seen.contains(&todo.id) {
+                break;
+            }
+            seen.push(todo.id);
+            current = todo
+                .parent_id
+                .and_then(|parent| state.todos.iter().find(|t| t.id == parent));
+        }
+        Ok(false)
+    }
+
+    async fn open_titled(&self, user_id: Option<Uuid>, title: &str) -> Result<Option<Uuid>, ApiError> {
+        Ok(self.read().open_titled(user_id, title, None))
+    }
+
+    async fn create(
+        &self,
+        user: AuthUser,
+        new: NewTodo,
+        idempotency: Option<IdempotencyKey>,
+    ) -> Result<Todo, ApiError> {
+        let now = Utc::now();
+        let mut state = self.write();
+        let todo = Todo {
+            id: Uuid::new_v4(),
+            title: new.title,
+            description: new.description,
+            completed: false,
+            archived: false,
+            position: next_position(&state.todos),
+            version: 1,
+            tags: new.tags,
+            user_id: user.user_id,
+            list_id: new.list_id,
+            parent_id: new.parent_id,
+            due_date: new.due_date,
+            recurrence: new.recurrence.as_str().to_string(),
+            recurrence_interval: new.recurrence_interval,
+            recurrence_day: None,
+            completed_at: None,
+            remind_at: new.remind_at,
+            reminded_at: None,
+            created_at: now,
+            updated_at: now,
+            created_by: new.actor.0,
+            updated_by: new.actor.0,
+        };
+
+        if new.unique_title {
+            state.check_title_free(todo.user_id, &todo.title, todo.id)?;
+        }
+        if let Some(idempotency) = idempotency {
+            let taken = state
+                .idempotency_keys
+                .iter()
+                .any(|k| k.key == idempotency.key && k.user_id == user.user_id);
+            if taken {
+                return Err(ApiError::Conflict(
+                    "A request with this Idempotency-Key is already being processed".to_string(),
+                ));
+            }
+
+            let response = serde_json::to_value(TodoResponse::from(todo.clone()))
+                .map_err(|e| ApiError::InternalServerError(format!("Failed to encode response: {}", e)))?;
+            state.idempotency_keys.push(StoredKey {
+                key: idempotency.key,
+                user_id: user.user_id,
+                request: idempotency.request,
+                response,
+                created_at: now,
+            });
+        }
+
+        state.todos.push(todo.clone());
+        state.record(HistoryAction::Created, &todo, todo.created_by)?;
+        Ok(todo)
+    }
+
+    async fn idempotent_response(
+        &self,
+        user: AuthUser,
+        key: &str,
+        request: &Value,
+        ttl_secs: i64,
+    ) -> Result<Option<StoredResponse>, ApiError> {
+        let mut state = self.write();
+
+        // Every expired key goes, not just this one, so keys nobody repeats do
+        // not pile up; an expired key may be reused for a new request
+        let cutoff = Utc::now() - Duration::seconds(ttl_secs);
+        state.idempotency_keys.retain(|k| k.created_at >= cutoff);
+
+        Ok(state
+            .idempotency_keys
+            .iter()
+            .find(|k| k.key == key && k.user_id == user.user_id)
+            .map(|k| StoredResponse {
+                same_request: &k.request == request,
+                response: k.response.clone(),
+            }))
+    }
+
+    async fn update(&self, existing: &Todo, changes: TodoChanges) -> Result<Updated, ApiError> {
+        self.write().update(existing, changes, Utc::now())
+    }
+
+    async fn update_many(&self, updates: Vec<(Todo, TodoChanges)>) -> Result<Vec<Updated>, ApiError> {
+        let now = Utc::now();
+        let mut state = self.write();
+
+        // Keep what an update touches so a failing one can undo the others
+        let todos = state.todos.clone();
+        let events = state.events.clone();
+        let reminders = state.reminders.clone();
+
+        let mut updated = Vec::with_capacity(updates.len());
+        for (existing, changes) in updates {
+            match state.update(&existing, changes, now) {
+                Ok(todo) => updated.push(todo),
+                Err(e) => {
+                    state.todos = todos;
+                    state.events = events;
+                    state.reminders = reminders;
+                    return Err(e);
+                }
+            }
+        }
+        Ok(updated)
+    }
+
+    async fn set_completed(
+        &self,
+        existing: &Todo,
+        completed: bool,
+        actor: Actor,
+    ) -> Result<Updated, ApiError> {
+        let now = Utc::now();
+        let mut state = self.write();
+
+        let current = state
+            .todos
+            .iter()
+            .find(|t| t.id == existing.id)
+            .cloned()
+            .ok_or_else(|| todo_not_found(existing.id))?;
+        // Already in that state: leave it as it is, so completing twice
+        // creates a single next occurrence
+        if current.completed == completed {
+            return Ok(Updated { todo: current, next_occurrence: None });
+        }
+
+        let todo = Todo {
+            completed,
+            version: current.version + 1,
+            updated_at: now,
+            updated_by: actor.0,
+            ..current.clone()
+        };
+        state.replace(&current, todo, now)
+    }
+
+    async fn set_archived(
+        &self,
+        existing: &Todo,
+        archived: bool,
+        actor: Actor,
+    ) -> Result<Todo, ApiError> {
+        let mut state = self.write();
+        let todo = state
+            .todos
+            .iter_mut()
+            .find(|t| t.id == existing.id)
+            .ok_or_else(|| todo_not_found(existing.id))?;
+
+        todo.archived = archived;
+        todo.version += 1;
+        todo.updated_at = Utc::now();
+        todo.updated_by = actor.0;
+        let todo = todo.clone();
+        state.record(HistoryAction::Updated, &todo, actor.0)?;
+        Ok(todo)
+    }
+
+    async fn reorder(&self, user: AuthUser, ids: &[Uuid], actor: Actor) -> Result<(), ApiError> {
+        let mut state = self.write();
+        let mut owned: Vec<(Uuid, i64)> = state
+            .todos
+            .iter()
+            .filter(|t| t.user_id == user.user_id)
+            .map(|t| (t.id, t.position))
+            .collect();
+        owned.sort_by_key(|(_, position)| *position);
+        let owned_ids: Vec<Uuid> = owned.iter().map(|(id, _)| *id).collect();
+        check_reorder(&owned_ids, ids)?;
+
+        // Hand the caller's existing positions out in the requested order so
+        // their todos keep their place relative to everyone else's. Moved
+        // todos count as changed, so syncing clients and If-Match see it.
+        let positions: HashMap<Uuid, i64> =
+            ids.iter().zip(&owned).map(|(id, (_, position))| (*id, *position)).collect();
+        let now = Utc::now();
+        let mut moved = Vec::new();
+        for todo in state.todos.iter_mut() {
+            match positions.get(&todo.id) {
+                Some(position) if *position != todo.position => {
+                    todo.position = *position;
+                    todo.updated_at = now;
+                    todo.updated_by = actor.0;
+                    todo.version += 1;
+                    moved.push(todo.clone());
+                }
+                _ => {}
+            }
+        }
+        for todo in &moved {
+            state.record(HistoryAction::Reordered, todo, actor.0)?;
+        }
+        Ok(())
+    }
+
+    async fn delete(
+        &self,
+        user: AuthUser,
+        id: Uuid,
+        actor: Actor,
+        undo: &UndoToken,
+    ) -> Result<Option<Todo>, ApiError> {
+        let mut state = self.write();
+        let Some(deleted) = state.todos.iter().find(|t| t.id == id).cloned() else {
+            return Ok(None);
+        };
+
+        // Subtasks go with their parent, like ON DELETE CASCADE on parent_id
+        let mut descendants = Vec::new();
+        let mut pending = vec![id];
+        while let Some(id) = pending.pop() {
+            for child in state.todos.iter().filter(|t| t.parent_id == Some(id)) {
+                pending.push(child.id);
+                descendants.push(child.clone());
+            }
+            state.todos.retain(|t| t.id != id);
+        }
+        // Every removed row gets its own event, so changes() reports the
+        // subtasks gone too
+        state.record(HistoryAction::Deleted, &deleted, actor.0)?;
+        for descendant in &descendants {
+            state.record(HistoryAction::Deleted, descendant, actor.0)?;
+        }
+        state.pending_deletes.push(PendingDelete {
+            token: undo.token.clone(),
+            user_id: user.user_id,
+            todos: parents_first(deleted.clone(), descendants),
+            expires_at: undo.expires_at,
+        });
+        Ok(Some(deleted))
+    }
+
+    async fn restore(
+        &self,
+        user: AuthUser,
+        token: &str,
+        actor: Actor,
+        now: DateTime<Utc>,
+    ) -> Result<Vec<Todo>, ApiError> {
+        let mut state = self.write();
+        let index = state
+            .pending_deletes
+            .iter()
+            .position(|p| p.token == token && p.user_id == user.user_id)
+            .ok_or_else(undo_not_found)?;
+        if state.pending_deletes[index].expires_at <= now {
+            return Err(undo_expired());
+        }
+
+        let todos = state.pending_deletes[index].todos.clone();
+        // Mirror the foreign key on parent_id; the subtasks' parents come back with them
+        if let Some(root) = todos.first() {
+            if root.parent_id.is_some_and(|parent| !state.todos.iter().any(|t| t.id == parent)) {
+                return Err(restore_orphaned(root.id));
+            }
+        }
+        state.pending_deletes.remove(index);
+        state.todos.extend(todos.iter().cloned());
+        for todo in &todos {
+            state.record(HistoryAction::Restored, todo, actor.0)?;
+        }
+        Ok(todos)
+    }
+
+    async fn purge_expired_deletes(&self, now: DateTime<Utc>) -> Result<u64, ApiError> {
+        let mut state = self.write();
+        let before = state.pending_deletes.len();
+        state.pending_deletes.retain(|p| p.expires_at > now);
+        Ok((before - state.pending_deletes.len()) as u64)
+    }
+
+    async fn purge_archived(&self, before: DateTime<Utc>, limit: i64) -> Result<u64, ApiError> {
+        let mut state = self.write();
+        let doomed: Vec<Todo> = state
+            .todos
+            .iter()
+            .filter(|t| t.archived && t.updated_at < before)
+            .filter(|t| !state.todos.iter().any(|c| c.parent_id == Some(t.id)))
+            .take(limit.max(0) as usize)
+            .cloned()
+            .collect();
+        let ids: HashSet<Uuid> = doomed.iter().map(|t| t.id).collect();
+        state.todos.retain(|t| !ids.contains(&t.id));
+        state.reminders.retain(|r| !ids.contains(&r.todo_id));
+        // Nobody asked for the purge, so the events have no actor
+        for todo in &doomed {
+            state.record(HistoryAction::Deleted, todo, None)?;
+        }
+        Ok(doomed.len() as u64)
+    }
+
+    async fn delete_all(&self) -> Result<u64, ApiError> {
+        let mut state = self.write();
+        let deleted = std::mem::take(&mut state.todos);
+        state.pending_deletes.clear();
+        state.reminders.clear();
+        for todo in &deleted {
+            state.record(HistoryAction::Deleted, todo, None)?;
+        }
+        Ok(deleted.len() as u64)
+    }
+
+    async fn changes(&self, user: AuthUser, since: DateTime<Utc>) -> Result<Changes, ApiError> {
+        let state = self.read();
+        let recent = || state.events.iter().filter(|e| e.created_at > since);
+
+        // Restoring keeps the original updated_at, so restores are found
+        // through the history instead
+        let restored: HashSet<Uuid> = recent()
+            .filter(|e| e.event == HistoryAction::Restored.as_str())
+            .map(|e| e.todo_id)
+            .collect();
+        let mut todos: Vec<Todo> = state
+            .visible(user)
+            .into_iter()
+            .filter(|t| t.updated_at > since || restored.contains(&t.id))
+            .collect();
+        todos.sort_by(|a, b| (a.updated_at, a.id).cmp(&(b.updated_at, b.id)));
+
+        // Events are oldest first, so a todo's latest deletion wins
+        let mut deleted_at = HashMap::new();
+        for event in recent().filter(|e| e.event == HistoryAction::Deleted.as_str()) {
+            if state.todos.iter().any(|t| t.id == event.todo_id) {
+                continue;
+            }
+            let list_id = event
+                .snapshot
+                .get("list_id")
+                .and_then(Value::as_str)
+                .and_then(|id| id.parse::<Uuid>().ok());
+            let visible = event.user_id == user.user_id
+                || list_id.is_some_and(|list_id| state.member_role(user, list_id).is_some());
+            if visible {
+                deleted_at.insert(event.todo_id, event.created_at);
+            }
+        }
+        let mut deleted: Vec<Tombstone> = deleted_at
+            .into_iter()
+            .map(|(id, deleted_at)| Tombstone { id, deleted_at })
+            .collect();
+        deleted.sort_by(|a, b| (a.deleted_at, a.id).cmp(&(b.deleted_at, b.id)));
+
+        Ok(Changes { todos, deleted })
+    }
+
+    async fn history(
+        &self,
+        id: Uuid,
+        after: Option<i64>,
+        limit: i64,
+    ) -> Result<Vec<HistoryEvent>, ApiError> {
+        Ok(self
+            .read()
+            .events
+            .iter()
+            .rev()
+            .filter(|e| e.todo_id == id && after.map_or(true, |after| e.id < after))
+            .take(limit as usize)
+            .cloned()
+            .collect())
+    }
+
+    async fn import(
+        &self,
+        user: AuthUser,
+        actor: Actor,
+        rows: &[ImportRow],
+        mode: ImportMode,
+    ) -> Result<ImportOutcome, ApiError> {
+        let now = Utc::now();
+        let mut state = self.write();
+        let mut outcome = ImportOutcome::default();
+        let mut seen = HashSet::new();
+
+        // Work on a copy so a bad row leaves the store untouched
+        let mut todos = state.todos.clone();
+        let mut written = Vec::new();
+        for batch in rows.chunks(IMPORT_BATCH_ROWS) {
+            let existing: HashMap<Uuid, Option<Uuid>> = todos
+                .iter()
+                .filter(|t| batch.iter().any(|row| row.id == t.id))
+                .map(|t| (t.id, t.user_id))
+                .collect();
+            let plan = plan_import(user, mode, batch, &existing, &mut seen, &mut outcome)?;
+
+            for row in plan.insert.iter().chain(&plan.overwrite) {
+                let todo = &row.todo;
+                let completed = todo.completed.unwrap_or(false);
+
+                match todos.iter_mut().find(|t| t.id == row.id) {
+                    Some(stored) => {
+                        stored.title = todo.title.clone();
+                        stored.description = todo.description.clone();
+                        stored.completed = completed;
+                        stored.tags = todo.tags.clone().unwrap_or_default();
+                        stored.created_at = todo.created_at.unwrap_or(stored.created_at);
+                        stored.updated_at = todo.updated_at.unwrap_or(now);
+                        stored.completed_at = match completed {
+                            true => stored.completed_at.or(Some(stored.updated_at)),
+                            false => None,
+                        };
+                        stored.updated_by = actor.0;
+                        stored.version += 1;
+                        written.push((HistoryAction::Updated, row.id));
+                    }
+                    None => {
+                        let created_at = todo.created_at.unwrap_or(now);
+                        let position = next_position(&todos);
+                        todos.push(Todo {
+                            id: row.id,
+                            title: todo.title.clone(),
+                            description: todo.description.clone(),
+                            completed,
+                            archived: false,
+                            position,
+                            version: 1,
+                            tags: todo.tags.clone().unwrap_or_default(),
+                            user_id: user.user_id,
+                            list_id: None,
+                            parent_id: None,
+                            due_date: None,
+                            recurrence: Recurrence::None.as_str().to_string(),
+                            recurrence_interval: 1,
+                            recurrence_day: None,
+                            completed_at: completed.then(|| todo.updated_at.unwrap_or(created_at)),
+                            remind_at: None,
+                            reminded_at: None,
+                            created_at,
+                            updated_at: todo.updated_at.unwrap_or(created_at),
+                            created_by: actor.0,
+                            updated_by: actor.0,
+                        });
+                        written.push((HistoryAction::Created, row.id));
+                    }
+                }
+                outcome.imported += 1;
+            }
+        }
+
+        let events: Vec<(HistoryAction, Todo)> = written
+            .into_iter()
+            .filter_map(|(action, id)| todos.iter().find(|t| t.id == id).map(|t| (action, t.clone())))
+            .collect();
+        state.todos = todos;
+        for (action, todo) in &events {
+            state.record(*action, todo, actor.0)?;
+        }
+        Ok(outcome)
+    }
+
+    async fn seed(&self, rows: &[ImportRow]) -> Result<usize, ApiError> {
+        let now = Utc::now();
+        let mut state = self.write();
+        let mut inserted = 0;
+
+        for row in rows {
+            let todo = &row.todo;
+            let id = row.id;
+            if state.todos.iter().any(|t| t.id == id) {
+                continue;
+            }
+
+            let created_at = todo.created_at.unwrap_or(now);
+            let position = next_position(&state.todos);
+            let seeded = Todo {
+                id,
+                title: todo.title.clone(),
+                description: todo.description.clone(),
+                completed: todo.completed.unwrap_or(false),
+                archived: false,
+                position,
+                version: 1,
+                tags: todo.tags.clone().unwrap_or_default(),
+                user_id: None,
+                list_id: None,
+                parent_id: None,
+                due_date: None,
+                recurrence: Recurrence::None.as_str().to_string(),
+                recurrence_interval: 1,
+                recurrence_day: None,
+                completed_at: todo.completed.unwrap_or(false).then(|| todo.updated_at.unwrap_or(created_at)),
+                remind_at: None,
+                reminded_at: None,
+                created_at,
+                updated_at: todo.updated_at.unwrap_or(created_at),
+                created_by: None,
+                updated_by: None,
+            };
+            state.record(HistoryAction::Created, &seeded, None)?;
+            state.todos.push(seeded);
+            inserted += 1;
+        }
+
+        Ok(inserted)
+    }
+}
+
+#[async_trait]
+impl ListRepository for MemoryRepository {
+    async fn lists_for(&self, user_id: Uuid) -> Result<Vec<TodoList>, ApiError> {
+        let state = self.read();
+        let mut lists: Vec<TodoList> = state
+            .members
+            .iter()
+            .filter(|m| m.user_id == user_id)
+            .filter_map(|m| {
+                let list = state.lists.iter().find(|l| l.id == m.list_id)?;
+                Some(TodoList {
+                    id: list.id,
+                    name: list.name.clone(),
+                    owner_id: list.owner_id,
+                    role: m.role.clone(),
+                    created_at: list.created_at,
+                })
+            })
+            .collect();
+        lists.sort_by(|a, b| (b.created_at, b.id).cmp(&(a.created_at, a.id)));
+        Ok(lists)
+    }
+
+    async fn create(&self, owner_id: Uuid, name: &str) -> Result<TodoList, ApiError> {
+        let id = Uuid::new_v4();
+        let now = Utc::now();
+        let mut state = self.write();
+
+        state.lists.push(StoredList { id, name: name.to_string(), owner_id, created_at: now });
+        // The owner is stored as a member too, so access checks only need members
+        state.members.push(StoredMember {
+            list_id: id,
+            user_id: owner_id,
+            role: Role::Owner.as_str().to_string(),
+            created_at: now,
+        });
+
+        Ok(TodoList {
+            id,
+            name: name.to_string(),
+            owner_id,
+            role: Role::Owner.as_str().to_string(),
+            created_at: now,
+        })
+    }
+
+    async fn role(&self, user: AuthUser, list_id: Uuid) -> Result<Option<Role>, ApiError> {
+        Ok(self.read().member_role(user, list_id))
+    }
+
+    async fn share(&self, list_id: Uuid, user_id: Uuid, role: Role) -> Result<ListMember, ApiError> {
+        let mut state = self.write();
+
+        match state
+            .members
+            .iter()
+            .position(|m| m.list_id == list_id && m.user_id == user_id)
+        {
+            Some(i) => state.members[i].role = role.as_str().to_string(),
+            None => state.members.push(StoredMember {
+                list_id,
+                user_id,
+                role: role.as_str().to_string(),
+                created_at: Utc::now(),
+            }),
+        }
+
+        state
+            .member(list_id, user_id)
+            .ok_or_else(|| ApiError::NotFound("Resource not found".to_string()))
+    }
+
+    async fn members(&self, list_id: Uuid) -> Result<Vec<ListMember>, ApiError> {
+        let state = self.read();
+        let mut members: Vec<ListMember> = state
+            .members
+            .iter()
+            .filter(|m| m.list_id == list_id)
+            .filter_map(|m| state.member(list_id, m.user_id))
+            .collect();
+        members.sort_by_key(|m| (m.created_at, m.user_id));
+        Ok(members)
+    }
+
+    async fn revoke(&self, list_id: Uuid, user_id: Uuid) -> Result<bool, ApiError> {
+        let mut state = self.write();
+        let before = state.members.len();
+        state.members.retain(|m| {
+            !(m.list_id == list_id && m.user_id == user_id && m.role != Role::Owner.as_str())
+        });
+        Ok(state.members.len() < before)
+    }
+}
+
+#[async_trait]
+impl UserRepository for MemoryRepository {
+    async fn create(&self, username: &str, password_hash: &str) -> Result<User, ApiError> {
+        let mut state = self.write();
+        if state.users.iter().any(|u| u.username == username) {
+            return Err(ApiError::Conflict(format!("Username '{}' is already taken", username)));
+        }
+
+        let user = StoredUser {
+            id: Uuid::new_v4(),
+            username: username.to_string(),
+            password_hash: password_hash.to_string(),
+            created_at: Utc::now(),
+        };
+        state.users.push(user.clone());
+
+        Ok(User {
+            id: user.id,
+            username: user.username,
+            password_hash: user.password_hash,
+            created_at: user.created_at,
+        })
+    }
+
+    async fn find_by_username(&self, username: &str) -> Result<Option<User>, ApiError> {
+        Ok(self.read().users.iter().find(|u| u.username == username).map(|u| User {
+            id: u.id,
+            username: u.username.clone(),
+            password_hash: u.password_hash.clone(),
+            created_at: u.created_at,
+        }))
+    }
+}
+
+#[async_trait]
+impl HealthRepository for MemoryRepository {
+    async fn pool_stats(&self) -> Result<PoolStats, ApiError> {
+        Err(ApiError::ServiceUnavailable(
+            "No database pool; todos are kept in memory".to_string(),
+        ))
+    }
+}
+
+#[async_trait]
+impl ReminderRepository for MemoryRepository {
+    async fn claim_due(
+        &self,
+        now: DateTime<Utc>,
+        lease_until: DateTime<Utc>,
+        max_attempts: i32,
+        limit: i64,
+    ) -> Result<Vec<DueReminder>, ApiError> {
+        let mut state = self.write();
+        let mut due: Vec<DueReminder> = state
+            .todos
+            .iter()
+            .filter(|t| !t.completed && t.reminded_at.is_none() && t.remind_at.is_some_and(|at| at <= now))
+            .filter_map(|todo| {
+                let attempts = state.reminders.iter().find(|r| r.todo_id == todo.id);
+                let waiting = attempts.and_then(|r| r.retry_at).is_some_and(|at| at > now);
+                let attempts = attempts.map_or(0, |r| r.attempts);
+                (attempts < max_attempts && !waiting).then(|| DueReminder { todo: todo.clone(), attempts })
+            })
+            .collect();
+        due.sort_by_key(|d| d.todo.remind_at);
+        due.truncate(limit.max(0) as usize);
+
+        for reminder in &due {
+            match state.reminders.iter_mut().find(|r| r.todo_id == reminder.todo.id) {
+                Some(stored) => stored.retry_at = Some(lease_until),
+                None => state.reminders.push(ReminderAttempts {
+                    todo_id: reminder.todo.id,
+                    attempts: 0,
+                    error: None,
+                    retry_at: Some(lease_until),
+                }),
+            }
+        }
+        Ok(due)
+    }
+
+    async fn mark_sent(
+        &self,
+        todo: &Todo,
+        sent_at: DateTime<Utc>,
+        notification: Option<&Notification>,
+    ) -> Result<(), ApiError> {
+        let mut state = self.write();
+        let Some(stored) = state
+            .todos
+            .iter_mut()
+            .find(|t| t.id == todo.id && t.remind_at == todo.remind_at)
+        else {
+            return Ok(());
+        };
+        stored.reminded_at = Some(sent_at);
+
+        if let Some(attempts) = state.reminders.iter_mut().find(|r| r.todo_id == todo.id) {
+            attempts.error = None;
+            attempts.retry_at = None;
+        }
+        if let Some(notification) = notification {
+            state.notifications.push(notification.clone());
+        }
+        Ok(())
+    }
+
+    async fn mark_failed(&self, todo: &Todo, error: &str, retry_at: DateTime<Utc>) -> Result<(), ApiError> {
+        let mut state = self.write();
+        match state.reminders.iter_mut().find(|r| r.todo_id == todo.id) {
+            Some(stored) => {
+                stored.attempts += 1;
+                stored.error = Some(error.to_string());
+                stored.retry_at = Some(retry_at);
+            }
+            None => state.reminders.push(ReminderAttempts {
+                todo_id: todo.id,
+                attempts: 1,
+                error: Some(error.to_string()),
+                retry_at: Some(retry_at),
+            }),
+        }
+        Ok(())
+    }
+
+    async fn notifications(&self, user: AuthUser, limit: i64) -> Result<Vec<Notification>, ApiError> {
+        Ok(self
+            .read()
+            .notifications
+            .iter()
+            .rev()
+            .filter(|n| n.user_id == user.user_id)
+            .take(limit.max(0) as usize)
+            .cloned()
+            .collect())
+    }
+}
+
+#[async_trait]
+impl WebhookRepository for MemoryRepository {
+    async fn list(&self, user: AuthUser) -> Result<Vec<Webhook>, ApiError> {
+        let mut webhooks: Vec<Webhook> = self
+            .read()
+            .webhooks
+            .iter()
+            .filter(|w| w.user_id == user.user_id)
+            .cloned()
+            .collect();
+        webhooks.sort_by_key(|w| (w.created_at, w.id));
+        Ok(webhooks)
+    }
+
+    async fn find(&self, user: AuthUser, id: Uuid) -> Result<Option<Webhook>, ApiError> {
+        Ok(self
+            .read()
+            .webhooks
+            .iter()
+            .find(|w| w.id == id && w.user_id == user.user_id)
+            .cloned())
+    }
+
+    async fn create(
+        &self,
+        user: AuthUser,
+        url: &str,
+        secret: &str,
+        events: &[String],
+    ) -> Result<Webhook, ApiError> {
+        let webhook = Webhook {
+            id: Uuid::new_v4(),
+            user_id: user.user_id,
+            url: url.to_string(),
+            secret: secret.to_string(),
+            events: events.to_vec(),
+            created_at: Utc::now(),
+        };
+        self.write().webhooks.push(webhook.clone());
+        Ok(webhook)
+    }
+
+    async fn update(&self, webhook: &Webhook) -> Result<bool, ApiError> {
+        let mut state = self.write();
+        match state.webhooks.iter_mut().find(|w| w.id == webhook.id) {
+            Some(stored) => {
+                stored.url = webhook.url.clone();
+                stored.secret = webhook.secret.clone();
+                stored.events = webhook.events.clone();
+                Ok(true)
+            }
+            None => Ok(false),
+        }
+    }
+
+    async fn delete(&self, user: AuthUser, id: Uuid) -> Result<bool, ApiError> {
+        let mut state = self.write();
+        let before = state.webhooks.len();
+        state.webhooks.retain(|w| !(w.id == id && w.user_id == user.user_id));
+        Ok(state.webhooks.len() < before)
+    }
+
+    async fn subscribed(
+        &self,
+        user_id: Option<Uuid>,
+        event: WebhookEvent,
+    ) -> Result<Vec<Webhook>, ApiError> {
+        let mut webhooks: Vec<Webhook> = self
+            .read()
+            .webhooks
+            .iter()
+            .filter(|w| w.user_id == user_id && w.events.iter().any(|e| e == event.as_str()))
+            .cloned()
+            .collect();
+        webhooks.sort_by_key(|w| (w.created_at, w.id));
+        Ok(webhooks)
+    }
+}
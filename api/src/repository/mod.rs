@@ -0,0 +1,993 @@
+//! Storage access for the handlers. Handlers only talk to these traits, so the
+//! SQL lives in one place and the in-memory store can stand in for a database.
+
+use async_trait::async_trait;
+use chrono::{DateTime, Utc};
+use serde_json::Value;
+use sqlx::{PgPool, SqlitePool};
+use std::cmp::Ordering;
+use std::collections::{HashMap, HashSet};
+use std::env;
+use std::error::Error;
+use std::io;
+use std::path::PathBuf;
+use std::sync::Arc;
+use tokio::sync::mpsc;
+use uuid::Uuid;
+
+use crate::auth::{Actor, AuthUser};
+use crate::db::{self, DatabaseSettings, Driver};
+use crate::error::ApiError;
+use crate::models::{
+    HistoryEvent, ImportMode, ImportRowError, ImportTodo, ListMember, Notification, PoolStats, Recurrence,
+    RecurrenceZone, Role, Todo, TodoList, TodoResponse, Tombstone, User, Webhook, WebhookEvent,
+};
+
+pub mod cache;
+#[cfg(test)]
+mod conformance;
+pub mod memory;
+pub mod postgres;
+pub mod sqlite;
+
+pub use cache::{CacheSettings, TodoCache};
+pub use memory::MemoryRepository;
+pub use postgres::PgRepository;
+pub use sqlite::SqliteRepository;
+
+/// Where data is kept, chosen by STORAGE
+#[derive(Debug, Clone)]
+pub enum Backend {
+    /// The database at DATABASE_URL
+    Database(DatabaseSettings),
+    /// In-memory store, loaded from and saved to MEMORY_STORE_FILE when set
+    Memory(Option<PathBuf>),
+}
+
+impl Backend {
+    pub fn from_env() -> Result<Self, String> {
+        match env::var("STORAGE").ok().as_deref().map(str::trim) {
+            None | Some("") | Some("database") => Ok(Backend::Database(DatabaseSettings::from_env()?)),
+            Some("memory") => Ok(Backend::Memory(
+                env::var("MEMORY_STORE_FILE")
+                    .ok()
+                    .filter(|f| !f.trim().is_empty())
+                    .map(PathBuf::from),
+            )),
+            Some(other) => Err(format!(
+                "STORAGE must be 'database' or 'memory', got '{}'",
+                other
+            )),
+        }
+    }
+}
+
+/// The repositories handed to the handlers, all served by one backend
+#[derive(Clone)]
+pub struct Repositories {
+    pub todos: Arc<dyn TodoRepository>,
+    pub lists: Arc<dyn ListRepository>,
+    pub users: Arc<dyn UserRepository>,
+    pub webhooks: Arc<dyn WebhookRepository>,
+    pub health: Arc<dyn HealthRepository>,
+    pub reminders: Arc<dyn ReminderRepository>,
+    /// Set for the in-memory backend so it can be saved on shutdown
+    memory: Option<Arc<MemoryRepository>>,
+    /// Set for the database backends so the pool can be closed on shutdown
+    pool: Option<Pool>,
+    /// Set when CACHE_TTL puts a cache in front of the todo reads
+    cache: Option<Arc<TodoCache>>,
+}
+
+/// Every repository trait, i.e. what a backend implements
+pub trait Storage:
+    TodoRepository + ListRepository + UserRepository + WebhookRepository + HealthRepository + ReminderRepository
+{
+}
+
+impl<R> Storage for R where
+    R: TodoRepository + ListRepository + UserRepository + WebhookRepository + HealthRepository + ReminderRepository
+{
+}
+
+/// Connection pool behind a database backend
+enum Pool {
+    Postgres(PgPool),
+    Sqlite(SqlitePool),
+}
+
+impl Repositories {
+    pub fn new<R: Storage + 'static>(repository: R) -> Self {
+        Self::shared(Arc::new(repository))
+    }
+
+    fn shared<R: Storage + 'static>(repository: Arc<R>) -> Self {
+        Repositories {
+            todos: repository.clone(),
+            lists: repository.clone(),
+            users: repository.clone(),
+            webhooks: repository.clone(),
+            health: repository.clone(),
+            reminders: repository,
+            memory: None,
+            pool: None,
+            cache: None,
+        }
+    }
+
+    fn database<R: Storage + 'static>(repository: R, pool: Pool) -> Self {
+        Repositories { pool: Some(pool), ..Self::new(repository) }
+    }
+
+    fn memory(repository: MemoryRepository) -> Self {
+        let repository = Arc::new(repository);
+        Repositories { memory: Some(repository.clone()), ..Self::shared(repository) }
+    }
+
+    /// Serve todo reads from an in-process cache, emptied by every write made
+    /// through these repositories
+    pub fn cached(self, settings: CacheSettings) -> Self {
+        let cache = Arc::new(TodoCache::new(settings));
+        Repositories {
+            todos: Arc::new(cache::CachedTodos::new(self.todos, cache.clone())),
+            lists: Arc::new(cache::CachedLists::new(self.lists, cache.clone())),
+            reminders: Arc::new(cache::CachedReminders::new(self.reminders, cache.clone())),
+            cache: Some(cache),
+            ..self
+        }
+    }
+
+    pub fn cache(&self) -> Option<Arc<TodoCache>> {
+        self.cache.clone()
+    }
+
+    /// Flush state that only lives in this process. Only the in-memory store
+    /// with a MEMORY_STORE_FILE has anything to save.
+    pub fn save(&self) -> io::Result<()> {
+        match &self.memory {
+            Some(memory) => memory.save(),
+            None => Ok(()),
+        }
+    }
+
+    /// Close the database pool, waiting for checked out connections to be
+    /// returned. Call once no more requests are being served.
+    pub async fn close(&self) {
+        match &self.pool {
+            Some(Pool::Postgres(pool)) => pool.close().await,
+            Some(Pool::Sqlite(pool)) => pool.close().await,
+            None => {}
+        }
+    }
+}
+
+/// Open the repositories for `backend`, connecting to its database if it has one
+pub async fn open(backend: &Backend) -> Result<Repositories, Box<dyn Error + Send + Sync>> {
+    match backend {
+        Backend::Database(settings) => match settings.driver {
+            Driver::Postgres => {
+                let pool = db::establish_connection(settings).await?;
+                if settings.auto_migrate {
+                    db::migrate::run(&pool).await?;
+                }
+                Ok(Repositories::database(PgRepository::new(pool.clone()), Pool::Postgres(pool)))
+            }
+            Driver::Sqlite => {
+                let pool = sqlite::connect(&settings.url, settings.query_timeout).await?;
+                Ok(Repositories::database(SqliteRepository::new(pool.clone()), Pool::Sqlite(pool)))
+            }
+        },
+        Backend::Memory(None) => Ok(Repositories::memory(MemoryRepository::new())),
+        Backend::Memory(Some(file)) => Ok(Repositories::memory(MemoryRepository::open(file.clone())?)),
+    }
+}
+
+/// Bring the schema of `backend` up to date without serving requests
+pub async fn migrate(backend: &Backend) -> Result<(), Box<dyn Error + Send + Sync>> {
+    match backend {
+        Backend::Database(settings) => match settings.driver {
+            Driver::Postgres => {
+                let pool = db::establish_connection(settings).await?;
+                Ok(db::migrate::run(&pool).await?)
+            }
+            // Opening a SQLite database applies its schema
+            Driver::Sqlite => {
+                sqlite::connect(&settings.url, settings.query_timeout).await?;
+                Ok(())
+            }
+        },
+        Backend::Memory(_) => Err("the in-memory store has no schema to migrate".into()),
+    }
+}
+
+/// Check a reorder request names exactly the todos in `owned`
+pub(crate) fn check_reorder(owned: &[Uuid], ids: &[Uuid]) -> Result<(), ApiError> {
+    let requested: HashSet<Uuid> = ids.iter().copied().collect();
+    if requested.len() != ids.len() {
+        return Err(ApiError::BadRequest("ids must not contain duplicates".to_string()));
+    }
+    if requested.len() != owned.len() || !owned.iter().all(|id| requested.contains(id)) {
+        return Err(ApiError::BadRequest(
+            "ids must list every one of your todos exactly once".to_string(),
+        ));
+    }
+    Ok(())
+}
+
+/// The error for a todo that does not exist or is not visible to the caller
+pub(crate) fn todo_not_found(id: Uuid) -> ApiError {
+    ApiError::NotFound(format!("Todo with id {} not found", id))
+}
+
+/// How a deletion can be undone: the token handed to the client and the
+/// moment it stops working
+#[derive(Debug, Clone)]
+pub struct UndoToken {
+    pub token: String,
+    pub expires_at: DateTime<Utc>,
+}
+
+pub(crate) fn undo_not_found() -> ApiError {
+    ApiError::NotFound("Undo token not found; it may have been used already".to_string())
+}
+
+pub(crate) fn undo_expired() -> ApiError {
+    ApiError::Gone("Undo token has expired; the deletion is final".to_string())
+}
+
+/// Encode deleted todos for keeping until their undo window closes
+pub(crate) fn encode_deleted(todos: &[Todo]) -> Result<Value, ApiError> {
+    serde_json::to_value(todos)
+        .map_err(|e| ApiError::InternalServerError(format!("Failed to encode deleted todos: {}", e)))
+}
+
+pub(crate) fn decode_deleted(todos: Value) -> Result<Vec<Todo>, ApiError> {
+    serde_json::from_value(todos)
+        .map_err(|e| ApiError::InternalServerError(format!("Invalid deleted todos stored: {}", e)))
+}
+
+/// The error for a restored todo whose parent or list was removed meanwhile
+pub(crate) fn restore_orphaned(id: Uuid) -> ApiError {
+    ApiError::Conflict(format!(
+        "Todo with id {} cannot be restored: its parent or list no longer exists",
+        id
+    ))
+}
+
+/// `root` followed by its deleted descendants, each after its parent, so they
+/// can be inserted back in order
+pub(crate) fn parents_first(root: Todo, mut descendants: Vec<Todo>) -> Vec<Todo> {
+    let mut ordered = vec![root];
+    let mut next = 0;
+    while next < ordered.len() {
+        let parent = ordered[next].id;
+        let (children, rest): (Vec<Todo>, Vec<Todo>) =
+            descendants.into_iter().partition(|t| t.parent_id == Some(parent));
+        ordered.extend(children);
+        descendants = rest;
+        next += 1;
+    }
+    ordered
+}
+
+/// The todo as the API returns it, stored with each history event
+pub(crate) fn snapshot(todo: &Todo) -> Result<Value, ApiError> {
+    serde_json::to_value(TodoResponse::from(todo.clone()))
+        .map_err(|e| ApiError::InternalServerError(format!("Failed to encode todo: {}", e)))
+}
+
+/// Due date of the occurrence after the completed recurring `todo`, counted
+/// from `now` when it had none, and the day of month its series falls on.
+/// None when the todo does not repeat.
+pub(crate) fn next_due(todo: &Todo, now: DateTime<Utc>) -> Option<(DateTime<Utc>, i32)> {
+    let recurrence = Recurrence::from_db(&todo.recurrence).unwrap_or_default();
+    let tz = RecurrenceZone::current();
+    let due = todo.due_date.unwrap_or(now);
+    let day = Recurrence::series_day(due, todo.recurrence_day, tz);
+    let next = recurrence.next_due(due, todo.recurrence_interval, day, tz)?;
+    Some((next, day as i32))
+}
+
+/// Reminder for the occurrence after `todo`, due at `next_due`: the same time
+/// ahead of the due date as the completed one had. None unless the todo had
+/// both a reminder and a due date.
+pub(crate) fn next_remind_at(todo: &Todo, next_due: DateTime<Utc>) -> Option<DateTime<Utc>> {
+    let lead = todo.due_date? - todo.remind_at?;
+    next_due.checked_sub_signed(lead)
+}
+
+/// Lowercase words of a search query
+pub(crate) fn search_terms(query: &str) -> Vec<String> {
+    query.split_whitespace().map(str::to_lowercase).collect()
+}
+
+/// Relevance for backends without full-text search: every term must appear in
+/// the title or description, and terms in the title count double, like the
+/// weights of the Postgres search vector. Zero means no match.
+fn term_rank(todo: &Todo, terms: &[String]) -> f32 {
+    let title = todo.title.to_lowercase();
+    let description = todo.description.as_deref().unwrap_or_default().to_lowercase();
+
+    let mut rank = 0.0;
+    for term in terms {
+        let hits = 2 * title.matches(term.as_str()).count() + description.matches(term.as_str()).count();
+        if hits == 0 {
+            return 0.0;
+        }
+        rank += hits as f32;
+    }
+    rank
+}
+
+/// Rank `todos` against `terms` with `term_rank` and keep the best `limit`
+/// matches, ties broken by id like the Postgres search
+pub(crate) fn rank_by_terms(todos: Vec<Todo>, terms: &[String], limit: i64) -> Vec<(Todo, f32)> {
+    let mut ranked: Vec<(Todo, f32)> = todos
+        .into_iter()
+        .map(|todo| {
+            let rank = term_rank(&todo, terms);
+            (todo, rank)
+        })
+        .filter(|(_, rank)| *rank > 0.0)
+        .collect();
+    ranked.sort_by(|(a, a_rank), (b, b_rank)| b_rank.total_cmp(a_rank).then(a.id.cmp(&b.id)));
+    ranked.truncate(usize::try_from(limit).unwrap_or(0));
+    ranked
+}
+
+/// Columns selected for every `Todo` row by both SQL backends. Rows are read
+/// into `Todo` (and SQLite's `TodoRow`) by column name, so the order here does
+/// not matter, but a field missing from the list fails every read.
+pub(crate) const TODO_COLUMNS: &str = "id, title, description, completed, archived, position, version, tags, \
+     user_id, list_id, parent_id, due_date, recurrence, recurrence_interval, completed_at, remind_at, \
+     reminded_at, created_at, updated_at, created_by, updated_by, recurrence_day";
+
+/// What two titles must differ in to both be open when titles must be unique:
+/// surrounding whitespace and case are ignored, so "Deploy v2" and
+/// " deploy V2" clash
+pub(crate) fn title_key(title: &str) -> String {
+    title.trim().to_lowercase()
+}
+
+/// The error for a todo whose title clashes with the open todo `existing_id`
+pub(crate) fn duplicate_title(title: &str, existing_id: Uuid) -> ApiError {
+    ApiError::DuplicateTitle { title: title.to_string(), existing_id }
+}
+
+/// Order todos are listed in. `id` always breaks ties so todos sharing a
+/// sort value keep a stable order across calls and pages.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct TodoSort {
+    pub field: SortField,
+    pub descending: bool,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum SortField {
+    CreatedAt,
+    UpdatedAt,
+    /// The manual order set through reordering
+    Position,
+}
+
+/// The value a todo is sorted by
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum SortKey {
+    Time(DateTime<Utc>),
+    Position(i64),
+}
+
+impl SortKey {
+    pub fn time(self) -> Option<DateTime<Utc>> {
+        match self {
+            SortKey::Time(time) => Some(time),
+            SortKey::Position(_) => None,
+        }
+    }
+
+    pub fn position(self) -> Option<i64> {
+        match self {
+            SortKey::Position(position) => Some(position),
+            SortKey::Time(_) => None,
+        }
+    }
+}
+
+impl Default for TodoSort {
+    fn default() -> Self {
+        TodoSort { field: SortField::CreatedAt, descending: true }
+    }
+}
+
+impl TodoSort {
+    /// Parse `created_at`, `updated_at` or `position`, optionally followed by
+    /// `:asc` or `:desc`. Timestamps default to newest first and positions to
+    /// ascending.
+    pub fn parse(spec: &str) -> Option<Self> {
+        let spec = spec.trim().to_ascii_lowercase();
+        let (field, direction) = match spec.split_once(':') {
+            Some((field, direction)) => (field, Some(direction)),
+            None => (spec.as_str(), None),
+        };
+        let field = match field {
+            "created_at" => SortField::CreatedAt,
+            "updated_at" => SortField::UpdatedAt,
+            "position" => SortField::Position,
+            _ => return None,
+        };
+        let descending = match direction {
+            Some("desc") => true,
+            Some("asc") => false,
+            Some(_) => return None,
+            None => field != SortField::Position,
+        };
+        Some(TodoSort { field, descending })
+    }
+
+    /// Read DEFAULT_SORT, see `parse`
+    pub fn from_env() -> Result<Self, String> {
+        match env::var("DEFAULT_SORT") {
+            Ok(value) if !value.trim().is_empty() => TodoSort::parse(&value).ok_or_else(|| {
+                format!(
+                    "DEFAULT_SORT must be 'created_at', 'updated_at' or 'position', optionally followed by ':asc' or ':desc', got '{}'",
+                    value
+                )
+            }),
+            _ => Ok(TodoSort::default()),
+        }
+    }
+
+    pub fn column(&self) -> &'static str {
+        match self.field {
+            SortField::CreatedAt => "created_at",
+            SortField::UpdatedAt => "updated_at",
+            SortField::Position => "position",
+        }
+    }
+
+    /// The value `todo` is sorted by
+    pub fn key(&self, todo: &Todo) -> SortKey {
+        match self.field {
+            SortField::CreatedAt => SortKey::Time(todo.created_at),
+            SortField::UpdatedAt => SortKey::Time(todo.updated_at),
+            SortField::Position => SortKey::Position(todo.position),
+        }
+    }
+
+    /// SQL ordering, e.g. `created_at DESC, id DESC`
+    pub fn order_by(&self) -> String {
+        let direction = if self.descending { "DESC" } else { "ASC" };
+        format!("{0} {1}, id {1}", self.column(), direction)
+    }
+
+    /// SQL comparison selecting rows after a `(key, id)` position
+    pub fn after_operator(&self) -> &'static str {
+        if self.descending { "<" } else { ">" }
+    }
+
+    /// Order two todos for the in-memory store
+    pub fn compare(&self, a: &Todo, b: &Todo) -> Ordering {
+        let order = (self.key(a), a.id).cmp(&(self.key(b), b.id));
+        if self.descending { order.reverse() } else { order }
+    }
+
+    /// Whether `todo` comes after the `(key, id)` position
+    pub fn is_after(&self, todo: &Todo, (key, id): (SortKey, Uuid)) -> bool {
+        let position = (self.key(todo), todo.id);
+        if self.descending { position < (key, id) } else { position > (key, id) }
+    }
+}
+
+/// Filters for listing todos
+#[derive(Debug, Clone, Default)]
+pub struct TodoFilter {
+    pub tag: Option<String>,
+    /// Return archived todos instead of active ones
+    pub archived: bool,
+    /// Only completed todos, or only open ones
+    pub completed: Option<bool>,
+    /// Only todos updated strictly after this
+    pub updated_since: Option<DateTime<Utc>>,
+    /// Only todos created strictly after this
+    pub created_after: Option<DateTime<Utc>>,
+    /// Only todos created strictly before this
+    pub created_before: Option<DateTime<Utc>>,
+    /// Only todos due at or after this
+    pub due_from: Option<DateTime<Utc>>,
+    /// Only todos due strictly before this
+    pub due_before: Option<DateTime<Utc>>,
+    /// Only todos with a due date, or only those without one
+    pub has_due_date: Option<bool>,
+    pub sort: TodoSort,
+    /// Only return todos ordered after this `(sort key, id)` position
+    pub after: Option<(SortKey, Uuid)>,
+    pub limit: Option<i64>,
+}
+
+impl TodoFilter {
+    /// Whether `todo` passes the tag, archived, completed, time and due filters;
+    /// the position filter `after` is not considered
+    pub fn matches(&self, todo: &Todo) -> bool {
+        todo.archived == self.archived
+            && self.completed.map_or(true, |completed| todo.completed == completed)
+            && self.tag.as_ref().map_or(true, |tag| todo.tags.contains(tag))
+            && self.updated_since.map_or(true, |since| todo.updated_at > since)
+            && self.created_after.map_or(true, |after| todo.created_at > after)
+            && self.created_before.map_or(true, |before| todo.created_at < before)
+            && self.due_from.map_or(true, |from| todo.due_date.map_or(false, |due| due >= from))
+            && self.due_before.map_or(true, |before| todo.due_date.map_or(false, |due| due < before))
+            && self.has_due_date.map_or(true, |has| todo.due_date.is_some() == has)
+    }
+}
+
+/// Fields of a todo being created
+#[derive(Debug, Clone)]
+pub struct NewTodo {
+    pub title: String,
+    pub description: Option<String>,
+    pub tags: Vec<String>,
+    pub list_id: Option<Uuid>,
+    pub parent_id: Option<Uuid>,
+    pub due_date: Option<DateTime<Utc>>,
+    pub recurrence: Recurrence,
+    pub recurrence_interval: i32,
+    pub remind_at: Option<DateTime<Utc>>,
+    /// Refuse the todo with 409 if another open todo of the caller has the
+    /// same title, compared as `title_key` does
+    pub unique_title: bool,
+    /// Recorded as both `created_by` and `updated_by`
+    pub actor: Actor,
+}
+
+/// New values for every editable field of a todo
+#[derive(Debug, Clone)]
+pub struct TodoChanges {
+    pub title: String,
+    pub description: Option<String>,
+    pub completed: bool,
+    pub tags: Vec<String>,
+    pub parent_id: Option<Uuid>,
+    pub due_date: Option<DateTime<Utc>>,
+    pub recurrence: String,
+    pub recurrence_interval: i32,
+    /// Changing it makes the reminder due again
+    pub remind_at: Option<DateTime<Utc>>,
+    /// Only apply the changes if the todo is still at this version
+    pub version: i32,
+    /// Refuse the changes with 409 if another open todo of the owner has the
+    /// new title, compared as `title_key` does
+    pub unique_title: bool,
+    /// Recorded as `updated_by`
+    pub actor: Actor,
+}
+
+impl TodoChanges {
+    /// Changes that leave every field of `todo` as it is, to override one at a time
+    pub fn keep(todo: &Todo, actor: Actor) -> Self {
+        TodoChanges {
+            title: todo.title.clone(),
+            description: todo.description.clone(),
+            completed: todo.completed,
+            tags: todo.tags.clone(),
+            parent_id: todo.parent_id,
+            due_date: todo.due_date,
+            recurrence: todo.recurrence.clone(),
+            recurrence_interval: todo.recurrence_interval,
+            remind_at: todo.remind_at,
+            version: todo.version,
+            unique_title: false,
+            actor,
+        }
+    }
+}
+
+/// Result of changing a todo. Completing a recurring todo also creates the
+/// next occurrence.
+#[derive(Debug, Clone)]
+pub struct Updated {
+    pub todo: Todo,
+    pub next_occurrence: Option<Todo>,
+}
+
+/// What changed for a user since a point in time
+#[derive(Debug, Default)]
+pub struct Changes {
+    /// Todos created, updated or restored since, least recently updated first
+    pub todos: Vec<Todo>,
+    /// Todos deleted since and not restored, least recently deleted first
+    pub deleted: Vec<Tombstone>,
+}
+
+/// An Idempotency-Key together with the request body it was first sent with
+#[derive(Debug, Clone)]
+pub struct IdempotencyKey {
+    pub key: String,
+    pub request: Value,
+}
+
+/// A response remembered for an Idempotency-Key
+#[derive(Debug, Clone)]
+pub struct StoredResponse {
+    /// Whether the stored request body equals the one being replayed
+    pub same_request: bool,
+    pub response: Value,
+}
+
+/// A parsed todo together with where it came from in an import payload, so
+/// errors can point at the offending row
+#[derive(Debug, Clone)]
+pub struct ImportRow {
+    /// Position among the data rows, counting from 1
+    pub row: usize,
+    pub location: String,
+    /// `todo.id`, or a fresh id when the payload has none
+    pub id: Uuid,
+    pub todo: ImportTodo,
+}
+
+/// How many rows an import writes per statement
+pub const IMPORT_BATCH_ROWS: usize = 500;
+
+/// What came of an import
+#[derive(Debug, Default)]
+pub struct ImportOutcome {
+    pub imported: usize,
+    pub skipped: usize,
+    pub errors: Vec<ImportRowError>,
+}
+
+/// The rows of one import batch that need writing
+#[derive(Debug, Default)]
+pub struct ImportPlan<'a> {
+    pub insert: Vec<&'a ImportRow>,
+    pub overwrite: Vec<&'a ImportRow>,
+}
+
+/// Decide what happens to each row of an import batch. `existing` maps the ids
+/// already stored to their owners, and `seen` collects the ids of earlier rows
+/// so an id repeated within the payload counts as existing too. Skipped and
+/// failed rows are recorded in `outcome`; in `Fail` mode the first existing id
+/// aborts the import with 409 Conflict.
+pub fn plan_import<'a>(
+    user: AuthUser,
+    mode: ImportMode,
+    batch: &'a [ImportRow],
+    existing: &HashMap<Uuid, Option<Uuid>>,
+    seen: &mut HashSet<Uuid>,
+    outcome: &mut ImportOutcome,
+) -> Result<ImportPlan<'a>, ApiError> {
+    let mut plan = ImportPlan::default();
+    for row in batch {
+        let owner = match existing.get(&row.id) {
+            Some(owner) => Some(*owner),
+            None if seen.contains(&row.id) => Some(user.user_id),
+            None => None,
+        };
+        seen.insert(row.id);
+
+        match (owner, mode) {
+            (None, _) => plan.insert.push(row),
+            (Some(_), ImportMode::Fail) => {
+                return Err(ApiError::Conflict(format!(
+                    "{}: a todo with this id already exists",
+                    row.location
+                )))
+            }
+            (Some(_), ImportMode::Skip) => outcome.skipped += 1,
+            (Some(owner), ImportMode::Overwrite) if owner == user.user_id => plan.overwrite.push(row),
+            (Some(_), ImportMode::Overwrite) => outcome.errors.push(ImportRowError {
+                row: row.row,
+                error: format!("{}: a todo with this id belongs to another user", row.location),
+            }),
+        }
+    }
+    Ok(plan)
+}
+
+/// Storage for todos. `create`, `update`, `set_completed`, `set_archived`,
+/// `delete` and `restore` each record a history event in the same transaction
+/// as the change, as does creating the next occurrence of a recurring todo.
+#[async_trait]
+pub trait TodoRepository: Send + Sync {
+    /// Todos visible to `user` in `filter.sort` order
+    async fn list(&self, user: AuthUser, filter: &TodoFilter) -> Result<Vec<Todo>, ApiError>;
+
+    /// How many todos `list` would return for `filter` without its position
+    /// and limit, i.e. across all pages
+    async fn count(&self, user: AuthUser, filter: &TodoFilter) -> Result<i64, ApiError>;
+
+    /// Send every todo visible to `user` into `rows`, stopping early when the
+    /// receiver is dropped
+    async fn export(&self, user: AuthUser, rows: mpsc::Sender<Result<Todo, ApiError>>);
+
+    /// A todo visible to `user` and the role they have on it
+    async fn find(&self, user: AuthUser, id: Uuid) -> Result<Option<(Todo, Role)>, ApiError>;
+
+    /// Direct children of a todo that are visible to `user`
+    async fn subtasks(&self, user: AuthUser, id: Uuid) -> Result<Vec<Todo>, ApiError>;
+
+    /// Active todos visible to `user` matching the words in `query`, best
+    /// match first, each with its rank
+    async fn search(
+        &self,
+        user: AuthUser,
+        query: &str,
+        limit: i64,
+    ) -> Result<Vec<(Todo, f32)>, ApiError>;
+
+    /// Which of `ids` belong to todos visible to `user`
+    async fn existing(&self, user: AuthUser, ids: &[Uuid]) -> Result<Vec<Uuid>, ApiError>;
+
+    /// The todos among `ids` visible to `user`, in no particular order
+    async fn find_many(&self, user: AuthUser, ids: &[Uuid]) -> Result<Vec<Todo>, ApiError>;
+
+    async fn has_subtasks(&self, id: Uuid) -> Result<bool, ApiError>;
+
+    /// Whether `ancestor` is `id` itself or one of its ancestors
+    async fn is_ancestor(&self, ancestor: Uuid, id: Uuid) -> Result<bool, ApiError>;
+
+    /// The open todo of `user_id` whose title matches `title` as `title_key`
+    /// compares them, if there is one
+    async fn open_titled(&self, user_id: Option<Uuid>, title: &str) -> Result<Option<Uuid>, ApiError>;
+
+    /// Create a todo, remembering its response under `idempotency` in the same
+    /// transaction when given
+    async fn create(
+        &self,
+        user: AuthUser,
+        todo: NewTodo,
+        idempotency: Option<IdempotencyKey>,
+    ) -> Result<Todo, ApiError>;
+
+    /// The response stored for an Idempotency-Key within the last `ttl_secs`.
+    /// Keys older than that are removed, whoever stored them.
+    async fn idempotent_response(
+        &self,
+        user: AuthUser,
+        key: &str,
+        request: &Value,
+        ttl_secs: i64,
+    ) -> Result<Option<StoredResponse>, ApiError>;
+
+    /// Apply `changes` to `existing` and return the stored result, failing with
+    /// 409 Conflict if it was modified in the meantime and 404 if it is gone
+    async fn update(&self, existing: &Todo, changes: TodoChanges) -> Result<Updated, ApiError>;
+
+    /// Apply several updates in one transaction, in order. The first that
+    /// fails as `update` would rolls back all of them.
+    async fn update_many(&self, updates: Vec<(Todo, TodoChanges)>) -> Result<Vec<Updated>, ApiError>;
+
+    /// Set the completed flag, failing with 404 if the todo is gone
+    async fn set_completed(
+        &self,
+        existing: &Todo,
+        completed: bool,
+        actor: Actor,
+    ) -> Result<Updated, ApiError>;
+
+    /// Set the archived flag, failing with 404 if the todo is gone
+    async fn set_archived(
+        &self,
+        existing: &Todo,
+        archived: bool,
+        actor: Actor,
+    ) -> Result<Todo, ApiError>;
+
+    /// Give the todos owned by `user` the order of `ids`, which must list each
+    /// of them exactly once; fails with 400 Bad Request otherwise. Every todo
+    /// that moves is recorded as changed by `actor`.
+    async fn reorder(&self, user: AuthUser, ids: &[Uuid], actor: Actor) -> Result<(), ApiError>;
+
+    /// Delete a todo along with its subtasks and return it as it was; None when
+    /// it no longer exists. The deleted rows are kept under `undo` until it
+    /// expires so `restore` can bring them back.
+    async fn delete(
+        &self,
+        user: AuthUser,
+        id: Uuid,
+        actor: Actor,
+        undo: &UndoToken,
+    ) -> Result<Option<Todo>, ApiError>;
+
+    /// Put back the todos `user` deleted under `token`, with their original ids
+    /// and timestamps, the deleted todo first. Fails with 404 for unknown or
+    /// used tokens and 410 Gone for tokens that expired at or before `now`.
+    async fn restore(
+        &self,
+        user: AuthUser,
+        token: &str,
+        actor: Actor,
+        now: DateTime<Utc>,
+    ) -> Result<Vec<Todo>, ApiError>;
+
+    /// Make deletions whose undo window closed before `now` final; returns how
+    /// many were finalized
+    async fn purge_expired_deletes(&self, now: DateTime<Utc>) -> Result<u64, ApiError>;
+
+    /// Permanently delete up to `limit` archived todos last changed before
+    /// `before`. Todos that still have subtasks are skipped so the purge never
+    /// takes active subtasks with it. Returns how many were deleted.
+    async fn purge_archived(&self, before: DateTime<Utc>, limit: i64) -> Result<u64, ApiError>;
+
+    /// What changed after `since` for `user`: the todos they can see that were
+    /// created, updated or restored since, and the todos deleted since that
+    /// they owned or could see through a list. Deletions come from the
+    /// history, so they are found even once the undo window has closed.
+    async fn changes(&self, user: AuthUser, since: DateTime<Utc>) -> Result<Changes, ApiError>;
+
+    /// Delete every todo of every user, along with pending undos so none can
+    /// be brought back; returns how many todos there were
+    async fn delete_all(&self) -> Result<u64, ApiError>;
+
+    /// Events recorded for todo `id`, newest first, starting below the event id
+    /// `after` when given. Events outlive the todo, so this also works for
+    /// deleted todos.
+    async fn history(
+        &self,
+        id: Uuid,
+        after: Option<i64>,
+        limit: i64,
+    ) -> Result<Vec<HistoryEvent>, ApiError>;
+
+    /// Import rows in a single transaction, inserting them in batches of
+    /// `IMPORT_BATCH_ROWS`. `mode` decides what happens to rows whose id already
+    /// exists (see `plan_import`); any error rolls back the whole import.
+    async fn import(
+        &self,
+        user: AuthUser,
+        actor: Actor,
+        rows: &[ImportRow],
+        mode: ImportMode,
+    ) -> Result<ImportOutcome, ApiError>;
+
+    /// Insert rows without an owner, skipping those whose id already exists.
+    /// Returns how many were inserted.
+    async fn seed(&self, rows: &[ImportRow]) -> Result<usize, ApiError>;
+}
+
+#[async_trait]
+pub trait ListRepository: Send + Sync {
+    /// Lists `user_id` is a member of, with their role
+    async fn lists_for(&self, user_id: Uuid) -> Result<Vec<TodoList>, ApiError>;
+
+    /// Create a list with `owner_id` as its owner
+    async fn create(&self, owner_id: Uuid, name: &str) -> Result<TodoList, ApiError>;
+
+    /// The role `user` has on a list, if any
+    async fn role(&self, user: AuthUser, list_id: Uuid) -> Result<Option<Role>, ApiError>;
+
+    /// Add a member or change their role
+    async fn share(&self, list_id: Uuid, user_id: Uuid, role: Role) -> Result<ListMember, ApiError>;
+
+    async fn members(&self, list_id: Uuid) -> Result<Vec<ListMember>, ApiError>;
+
+    /// Remove a non-owner member; returns false when they were not a member
+    async fn revoke(&self, list_id: Uuid, user_id: Uuid) -> Result<bool, ApiError>;
+}
+
+#[async_trait]
+pub trait UserRepository: Send + Sync {
+    /// Create a user, failing with 409 Conflict if the username is taken
+    async fn create(&self, username: &str, password_hash: &str) -> Result<User, ApiError>;
+
+    async fn find_by_username(&self, username: &str) -> Result<Option<User>, ApiError>;
+}
+
+#[async_trait]
+pub trait WebhookRepository: Send + Sync {
+    /// Webhooks registered by `user`, oldest first
+    async fn list(&self, user: AuthUser) -> Result<Vec<Webhook>, ApiError>;
+
+    async fn find(&self, user: AuthUser, id: Uuid) -> Result<Option<Webhook>, ApiError>;
+
+    async fn create(
+        &self,
+        user: AuthUser,
+        url: &str,
+        secret: &str,
+        events: &[String],
+    ) -> Result<Webhook, ApiError>;
+
+    /// Store the url, secret and events of `webhook`; returns false when it no
+    /// longer exists
+    async fn update(&self, webhook: &Webhook) -> Result<bool, ApiError>;
+
+    /// Returns false when the webhook does not exist or belongs to someone else
+    async fn delete(&self, user: AuthUser, id: Uuid) -> Result<bool, ApiError>;
+
+    /// Webhooks registered by `user_id` that subscribe to `event`
+    async fn subscribed(
+        &self,
+        user_id: Option<Uuid>,
+        event: WebhookEvent,
+    ) -> Result<Vec<Webhook>, ApiError>;
+}
+
+#[async_trait]
+pub trait HealthRepository: Send + Sync {
+    /// Ping the database and report its connection pool, failing with 503
+    /// when there is no pool or the database does not answer
+    async fn pool_stats(&self) -> Result<PoolStats, ApiError>;
+}
+
+/// A reminder claimed for delivery
+#[derive(Debug, Clone)]
+pub struct DueReminder {
+    pub todo: Todo,
+    /// Failed delivery attempts so far
+    pub attempts: i32,
+}
+
+/// Storage behind reminders: finding the due ones, recording each delivery
+/// and the notifications listed at GET /api/notifications
+#[async_trait]
+pub trait ReminderRepository: Send + Sync {
+    /// Claim up to `limit` reminders due at `now` until `lease_until`, so that
+    /// other instances skip them while this one delivers. A reminder is due
+    /// once `remind_at` has passed on an open todo that has not been reminded,
+    /// unless it already failed `max_attempts` times or is waiting for a retry
+    /// or another instance.
+    async fn claim_due(
+        &self,
+        now: DateTime<Utc>,
+        lease_until: DateTime<Utc>,
+        max_attempts: i32,
+        limit: i64,
+    ) -> Result<Vec<DueReminder>, ApiError>;
+
+    /// Mark the reminder of `todo` sent, storing `notification` in the same
+    /// transaction when given. Does nothing if `remind_at` changed since the
+    /// reminder was claimed.
+    async fn mark_sent(
+        &self,
+        todo: &Todo,
+        sent_at: DateTime<Utc>,
+        notification: Option<&Notification>,
+    ) -> Result<(), ApiError>;
+
+    /// Record a failed delivery; the reminder is claimed again after `retry_at`
+    async fn mark_failed(&self, todo: &Todo, error: &str, retry_at: DateTime<Utc>) -> Result<(), ApiError>;
+
+    /// Notifications for `user`, newest first
+    async fn notifications(&self, user: AuthUser, limit: i64) -> Result<Vec<Notification>, ApiError>;
+}
+
+/// Time acquiring a connection from `pool`, ping it and snapshot the pool's
+/// counters; shared by the database backends
+pub(crate) async fn ping_pool<DB: sqlx::Database>(
+    driver: &'static str,
+    pool: &sqlx::Pool<DB>,
+) -> Result<PoolStats, ApiError> {
+    use sqlx::Connection;
+
+    let unavailable = |e: String| {
+        log::warn!(driver = driver, error = e.as_str(); "database health check failed");
+        ApiError::ServiceUnavailable(format!("{} database is unavailable", driver))
+    };
+
+    // Counters are read before our own connection is taken so it does not
+    // show up as in use
+    let total = pool.size();
+    let idle = pool.num_idle() as u32;
+    let started = std::time::Instant::now();
+    let ping = async {
+        let mut conn = pool.acquire().await?;
+        let acquired = started.elapsed();
+        conn.ping().await?;
+        Ok::<_, sqlx::Error>(acquired)
+    };
+    // Both database pools wait DB_QUERY_TIMEOUT for a connection
+    let acquired = tokio::time::timeout(pool.options().get_acquire_timeout(), ping)
+        .await
+        .map_err(|_| unavailable("timed out".to_string()))?
+        .map_err(|e| unavailable(e.to_string()))?;
+
+    Ok(PoolStats {
+        driver,
+        max_connections: pool.options().get_max_connections(),
+        total,
+        idle,
+        in_use: total.saturating_sub(idle),
+        acquire_ms: acquired.as_secs_f64() * 1000.0,
+    })
+}
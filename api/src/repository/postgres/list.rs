@@ -0,0 +1,123 @@
+use async_trait::async_trait;
+use chrono::Utc;
+use uuid::Uuid;
+
+use crate::auth::AuthUser;
+use crate::db;
+use crate::error::ApiError;
+use crate::models::{ListMember, Role, TodoList};
+use crate::repository::ListRepository;
+use super::PgRepository;
+
+#[async_trait]
+impl ListRepository for PgRepository {
+    async fn lists_for(&self, user_id: Uuid) -> Result<Vec<TodoList>, ApiError> {
+        let lists = sqlx::query_as::<_, TodoList>(
+            "SELECT l.id, l.name, l.owner_id, m.role, l.created_at
+             FROM lists l JOIN list_members m ON m.list_id = l.id
+             WHERE m.user_id = $1
+             ORDER BY l.created_at DESC, l.id DESC"
+        )
+        .bind(user_id)
+        .fetch_all(&self.pool)
+        .await?;
+
+        Ok(lists)
+    }
+
+    async fn create(&self, owner_id: Uuid, name: &str) -> Result<TodoList, ApiError> {
+        let id = Uuid::new_v4();
+        let now = Utc::now();
+        let mut tx = self.pool.begin().await?;
+
+        let result = async {
+            sqlx::query("INSERT INTO lists (id, name, owner_id, created_at) VALUES ($1, $2, $3, $4)")
+                .bind(id)
+                .bind(name)
+                .bind(owner_id)
+                .bind(now)
+                .execute(&mut *tx)
+                .await?;
+
+            // The owner is stored as a member too, so access checks only need list_members
+            sqlx::query("INSERT INTO list_members (list_id, user_id, role, created_at) VALUES ($1, $2, $3, $4)")
+                .bind(id)
+                .bind(owner_id)
+                .bind(Role::Owner.as_str())
+                .bind(now)
+                .execute(&mut *tx)
+                .await?;
+
+            Ok::<_, ApiError>(())
+        }
+        .await;
+        db::finish(tx, result).await?;
+
+        Ok(TodoList {
+            id,
+            name: name.to_string(),
+            owner_id,
+            role: Role::Owner.as_str().to_string(),
+            created_at: now,
+        })
+    }
+
+    async fn role(&self, user: AuthUser, list_id: Uuid) -> Result<Option<Role>, ApiError> {
+        let role: Option<String> = sqlx::query_scalar(
+            "SELECT role FROM list_members WHERE list_id = $1 AND user_id = $2"
+        )
+        .bind(list_id)
+        .bind(user.user_id)
+        .fetch_optional(&self.pool)
+        .await?;
+
+        Ok(role.as_deref().and_then(Role::from_db))
+    }
+
+    async fn share(&self, list_id: Uuid, user_id: Uuid, role: Role) -> Result<ListMember, ApiError> {
+        let member = sqlx::query_as::<_, ListMember>(
+            "WITH upserted AS (
+                 INSERT INTO list_members (list_id, user_id, role, created_at)
+                 VALUES ($1, $2, $3, $4)
+                 ON CONFLICT (list_id, user_id) DO UPDATE SET role = EXCLUDED.role
+                 RETURNING user_id, role, created_at
+             )
+             SELECT upserted.user_id, users.username, upserted.role, upserted.created_at
+             FROM upserted JOIN users ON users.id = upserted.user_id"
+        )
+        .bind(list_id)
+        .bind(user_id)
+        .bind(role.as_str())
+        .bind(Utc::now())
+        .fetch_one(&self.pool)
+        .await?;
+
+        Ok(member)
+    }
+
+    async fn members(&self, list_id: Uuid) -> Result<Vec<ListMember>, ApiError> {
+        let members = sqlx::query_as::<_, ListMember>(
+            "SELECT m.user_id, u.username, m.role, m.created_at
+             FROM list_members m JOIN users u ON u.id = m.user_id
+             WHERE m.list_id = $1
+             ORDER BY m.created_at, m.user_id"
+        )
+        .bind(list_id)
+        .fetch_all(&self.pool)
+        .await?;
+
+        Ok(members)
+    }
+
+    async fn revoke(&self, list_id: Uuid, user_id: Uuid) -> Result<bool, ApiError> {
+        let result = sqlx::query(
+            "DELETE FROM list_members WHERE list_id = $1 AND user_id = $2 AND role <> 'owner'"
+        )
+        .bind(list_id)
+        .bind(user_id)
+        .execute(&self.pool)
+        .await?;
+
+        Ok(result.rows_affected() > 0)
+    }
+}
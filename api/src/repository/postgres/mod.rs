@@ -0,0 +1,46 @@
+use async_trait::async_trait;
+use sqlx::{PgPool, Postgres};
+
+use crate::db::metrics::TimedPool;
+use crate::error::ApiError;
+use crate::models::PoolStats;
+use crate::repository::{ping_pool, HealthRepository};
+
+mod list;
+mod reminder;
+mod todo;
+mod user;
+mod webhook;
+
+/// Postgres-backed implementation of every repository trait
+#[derive(Clone)]
+pub struct PgRepository {
+    pool: TimedPool<Postgres>,
+}
+
+impl PgRepository {
+    pub fn new(pool: PgPool) -> Self {
+        PgRepository { pool: TimedPool::new(pool) }
+    }
+}
+
+#[async_trait]
+impl HealthRepository for PgRepository {
+    async fn pool_stats(&self) -> Result<PoolStats, ApiError> {
+        ping_pool("postgres", self.pool.inner()).await
+    }
+}
+
+/// Turn a unique constraint violation into 409 Conflict with `message`, and any
+/// other database error into the usual API error
+fn conflict_on_duplicate(err: sqlx::Error, message: impl FnOnce() -> String) -> ApiError {
+    let duplicate = matches!(
+        &err,
+        sqlx::Error::Database(db) if db.code().as_deref() == Some("23505")
+    );
+    if duplicate {
+        ApiError::Conflict(message())
+    } else {
+        ApiError::from(err)
+    }
+}
@@ -0,0 +1,1155 @@
+use async_trait::async_trait;
+use chrono::{DateTime, Utc};
+use futures_util::StreamExt;
+use serde_json::Value;
+use sqlx::Postgres;
+use std::collections::{HashMap, HashSet};
+use tokio::sync::mpsc;
+use uuid::Uuid;
+
+use crate::auth::{Actor, AuthUser};
+use crate::db;
+use crate::db::metrics::TimedTransaction;
+use crate::error::ApiError;
+use crate::models::{HistoryAction, HistoryEvent, ImportMode, Role, Todo, TodoResponse, Tombstone};
+use crate::repository::{
+    check_reorder, decode_deleted, Changes, duplicate_title, encode_deleted, next_due, next_remind_at, parents_first,
+    plan_import, restore_orphaned, snapshot, todo_not_found, undo_expired, undo_not_found, IdempotencyKey,
+    ImportOutcome, ImportRow, NewTodo, SortField, StoredResponse, TodoChanges, TodoFilter, TodoRepository, UndoToken,
+    Updated, IMPORT_BATCH_ROWS, TODO_COLUMNS,
+};
+use super::{conflict_on_duplicate, PgRepository};
+
+/// A derived table named `todos` holding only the todos the user bound to
+/// `$user_param` can see, with a `role` column describing their access: owner
+/// for todos they created, otherwise their role on the list the todo is in.
+///
+/// Use it in place of the `todos` table so every query applies the same rules.
+/// Rows are picked by owner or list membership before the role is worked out,
+/// so the planner can use the `user_id` and `list_id` indexes.
+fn accessible_todos(user_param: usize) -> String {
+    format!(
+        "(SELECT todos.*,
+             CASE WHEN todos.user_id IS NOT DISTINCT FROM ${0} THEN 'owner'
+                  ELSE (SELECT m.role FROM list_members m
+                        WHERE m.list_id = todos.list_id AND m.user_id = ${0})
+             END AS role
+         FROM todos
+         WHERE todos.user_id IS NOT DISTINCT FROM ${0}
+            OR todos.list_id IN (SELECT list_id FROM list_members WHERE user_id = ${0})) AS todos",
+        user_param
+    )
+}
+
+#[derive(sqlx::FromRow)]
+struct RankedTodo {
+    #[sqlx(flatten)]
+    todo: Todo,
+    rank: f32,
+}
+
+#[derive(sqlx::FromRow)]
+struct ScopedTodo {
+    #[sqlx(flatten)]
+    todo: Todo,
+    role: String,
+}
+
+/// Log a database failure for a specific todo before turning it into an API error
+fn todo_db_error(id: Uuid) -> impl Fn(sqlx::Error) -> ApiError {
+    move |err| {
+        if !matches!(err, sqlx::Error::RowNotFound) {
+            log::error!(
+                todo_id = id.to_string().as_str(),
+                error = err.to_string().as_str();
+                "database error"
+            );
+        }
+        ApiError::from(err)
+    }
+}
+
+/// Like `todo_db_error`, but reports a parent or list that no longer exists
+/// as 409 Conflict
+fn restore_error(todo: &Todo) -> impl Fn(sqlx::Error) -> ApiError + '_ {
+    move |err| {
+        let orphaned = matches!(&err, sqlx::Error::Database(db) if db.is_foreign_key_violation());
+        if orphaned {
+            restore_orphaned(todo.id)
+        } else {
+            todo_db_error(todo.id)(err)
+        }
+    }
+}
+
+/// Fail with 409 Conflict if an open todo of `user_id` other than `id`
+/// already has `title`. Two strict writes of the same title may both pass
+/// this; idx_todos_strict_open_title refuses the later, see `strict_title_clash`.
+async fn check_title_free(
+    tx: &mut TimedTransaction<'_, Postgres>,
+    user_id: Option<Uuid>,
+    title: &str,
+    id: Uuid,
+) -> Result<(), ApiError> {
+    // Same expression as idx_todos_open_title, so the index serves it
+    let existing: Option<Uuid> = sqlx::query_scalar(
+        "SELECT id FROM todos
+         WHERE COALESCE(user_id, '00000000-0000-0000-0000-000000000000'::uuid)
+               = COALESCE($1, '00000000-0000-0000-0000-000000000000'::uuid)
+           AND lower(btrim(title)) = lower(btrim($2))
+           AND NOT completed AND id <> $3
+         LIMIT 1",
+    )
+    .bind(user_id)
+    .bind(title)
+    .bind(id)
+    .fetch_optional(&mut **tx)
+    .await
+    .map_err(todo_db_error(id))?;
+
+    match existing {
+        Some(existing_id) => Err(duplicate_title(title, existing_id)),
+        None => Ok(()),
+    }
+}
+
+/// Whether `err` is idx_todos_strict_open_title refusing a strict write
+/// because another strict open todo has the title
+fn is_strict_title_clash(err: &sqlx::Error) -> bool {
+    matches!(
+        err,
+        sqlx::Error::Database(db)
+            if db.code().as_deref() == Some("23505") && db.constraint() == Some("idx_todos_strict_open_title")
+    )
+}
+
+/// Mark where a strict write starts, so a clash on idx_todos_strict_open_title
+/// can be undone without aborting the transaction
+async fn strict_title_savepoint(tx: &mut TimedTransaction<'_, Postgres>, id: Uuid) -> Result<(), ApiError> {
+    sqlx::query("SAVEPOINT strict_title")
+        .execute(&mut **tx)
+        .await
+        .map_err(todo_db_error(id))?;
+    Ok(())
+}
+
+/// Turn a strict write idx_todos_strict_open_title refused into 409 Conflict
+/// naming the todo it clashed with. The index waits for that todo's
+/// transaction to commit, so once back at the savepoint the next statement
+/// sees it.
+async fn strict_title_clash(
+    tx: &mut TimedTransaction<'_, Postgres>,
+    user_id: Option<Uuid>,
+    title: &str,
+    id: Uuid,
+) -> ApiError {
+    if let Err(err) = sqlx::query("ROLLBACK TO SAVEPOINT strict_title").execute(&mut **tx).await {
+        return todo_db_error(id)(err);
+    }
+    match check_title_free(tx, user_id, title, id).await {
+        Err(err) => err,
+        // The clashing todo was completed or renamed in the meantime
+        Ok(()) => ApiError::Conflict(format!("Another open todo is titled '{}'", title)),
+    }
+}
+
+/// Record `action` on `todo` in its history, inside the transaction making the change
+async fn record_event(
+    tx: &mut TimedTransaction<'_, Postgres>,
+    action: HistoryAction,
+    todo: &Todo,
+    actor: Option<Uuid>,
+) -> Result<(), ApiError> {
+    sqlx::query(
+        "INSERT INTO todo_events (todo_id, user_id, event, actor_id, snapshot, created_at)
+         VALUES ($1, $2, $3, $4, $5, $6)",
+    )
+    .bind(todo.id)
+    .bind(todo.user_id)
+    .bind(action.as_str())
+    .bind(actor)
+    .bind(snapshot(todo)?)
+    .bind(Utc::now())
+    .execute(&mut **tx)
+    .await
+    .map_err(todo_db_error(todo.id))?;
+    Ok(())
+}
+
+/// Insert the occurrence that follows a completed recurring todo. Returns None
+/// when the todo does not repeat.
+async fn create_next_occurrence(
+    tx: &mut TimedTransaction<'_, Postgres>,
+    todo: &Todo,
+    now: DateTime<Utc>,
+) -> Result<Option<Todo>, ApiError> {
+    let Some((due_date, day)) = next_due(todo, now) else {
+        return Ok(None);
+    };
+
+    let next = sqlx::query_as::<_, Todo>(&format!(
+        "INSERT INTO todos (id, title, description, completed, tags, user_id, list_id, parent_id,
+             due_date, recurrence, recurrence_interval, remind_at, created_at, updated_at, created_by,
+             updated_by, recurrence_day)
+         VALUES ($1, $2, $3, FALSE, $4, $5, $6, $7, $8, $9, $12, $13, $10, $10, $11, $11, $14)
+         RETURNING {}",
+        TODO_COLUMNS
+    ))
+    .bind(Uuid::new_v4())
+    .bind(&todo.title)
+    .bind(&todo.description)
+    .bind(&todo.tags)
+    .bind(todo.user_id)
+    .bind(todo.list_id)
+    .bind(todo.parent_id)
+    .bind(due_date)
+    .bind(&todo.recurrence)
+    .bind(now)
+    // Whoever completed the todo brought the next occurrence about
+    .bind(todo.updated_by)
+    .bind(todo.recurrence_interval)
+    .bind(next_remind_at(todo, due_date))
+    .bind(day)
+    .fetch_one(&mut **tx)
+    .await
+    .map_err(todo_db_error(todo.id))?;
+
+    record_event(tx, HistoryAction::Created, &next, next.created_by).await?;
+    Ok(Some(next))
+}
+
+/// Apply `changes` to `existing` if it is still at `changes.version`,
+/// completing a recurring todo creating its next occurrence
+async fn apply_update(
+    tx: &mut TimedTransaction<'_, Postgres>,
+    existing: &Todo,
+    changes: &TodoChanges,
+    now: DateTime<Utc>,
+) -> Result<Updated, ApiError> {
+    let id = existing.id;
+    if changes.unique_title {
+        check_title_free(tx, existing.user_id, &changes.title, id).await?;
+        strict_title_savepoint(tx, id).await?;
+    }
+
+    // A new reminder time makes the reminder due again
+    sqlx::query(
+        "UPDATE todos SET reminded_at = NULL, reminder_attempts = 0, reminder_error = NULL,
+             reminder_retry_at = NULL
+         WHERE id = $1 AND remind_at IS DISTINCT FROM $2"
+    )
+    .bind(id)
+    .bind(changes.remind_at)
+    .execute(&mut **tx)
+    .await
+    .map_err(todo_db_error(id))?;
+
+    // Only apply the update if the row still has the version the client last saw
+    let updated = sqlx::query_as::<_, Todo>(&format!(
+        "UPDATE todos SET title = $1, description = $2, completed = $3, tags = $4,
+             parent_id = $5, due_date = $6, recurrence = $7, recurrence_interval = $12, remind_at = $13,
+             completed_at = CASE WHEN $3 THEN COALESCE(completed_at, $8) END,
+             updated_at = $8, updated_by = $11, version = version + 1, strict_title = $14
+         WHERE id = $9 AND version = $10
+         RETURNING {}",
+        TODO_COLUMNS
+    ))
+    .bind(&changes.title)
+    .bind(&changes.description)
+    .bind(changes.completed)
+    .bind(&changes.tags)
+    .bind(changes.parent_id)
+    .bind(changes.due_date)
+    .bind(&changes.recurrence)
+    .bind(now)
+    .bind(id)
+    .bind(changes.version)
+    .bind(changes.actor.0)
+    .bind(changes.recurrence_interval)
+    .bind(changes.remind_at)
+    .bind(changes.unique_title)
+    .fetch_optional(&mut **tx)
+    .await;
+    let todo = match updated {
+        Ok(todo) => todo,
+        Err(err) if is_strict_title_clash(&err) => {
+            return Err(strict_title_clash(tx, existing.user_id, &changes.title, id).await)
+        }
+        Err(err) => return Err(todo_db_error(id)(err)),
+    };
+
+    // No row means either a newer version or a todo deleted since it was read
+    let Some(todo) = todo else {
+        let exists: bool = sqlx::query_scalar("SELECT EXISTS (SELECT 1 FROM todos WHERE id = $1)")
+            .bind(id)
+            .fetch_one(&mut **tx)
+            .await?;
+        return Err(if exists {
+            ApiError::Conflict("Todo was modified by someone else".to_string())
+        } else {
+            todo_not_found(id)
+        });
+    };
+    record_event(tx, HistoryAction::Updated, &todo, changes.actor.0).await?;
+
+    let next_occurrence = if todo.completed && !existing.completed {
+        create_next_occurrence(tx, &todo, now).await?
+    } else {
+        None
+    };
+
+    Ok(Updated { todo, next_occurrence })
+}
+
+#[async_trait]
+impl TodoRepository for PgRepository {
+    async fn list(&self, user: AuthUser, filter: &TodoFilter) -> Result<Vec<Todo>, ApiError> {
+        let todos = sqlx::query_as::<_, Todo>(&format!(
+            "SELECT {} FROM {}
+             WHERE ($2::text IS NULL OR $2 = ANY(tags))
+               AND archived = $6
+               AND ($8::boolean IS NULL OR completed = $8)
+               AND ($9::timestamptz IS NULL OR updated_at > $9)
+               AND ($10::timestamptz IS NULL OR created_at > $10)
+               AND ($11::timestamptz IS NULL OR created_at < $11)
+               AND ($12::timestamptz IS NULL OR due_date >= $12)
+               AND ($13::timestamptz IS NULL OR due_date < $13)
+               AND ($14::boolean IS NULL OR (due_date IS NOT NULL) = $14)
+               AND ($3::timestamptz IS NULL AND $7::bigint IS NULL OR ({}, id) {} (${}, $4))
+             ORDER BY {}
+             LIMIT $5",
+            TODO_COLUMNS,
+            accessible_todos(1),
+            filter.sort.column(),
+            filter.sort.after_operator(),
+            if filter.sort.field == SortField::Position { 7 } else { 3 },
+            filter.sort.order_by()
+        ))
+        .bind(user.user_id)
+        .bind(&filter.tag)
+        .bind(filter.after.and_then(|(key, _)| key.time()))
+        .bind(filter.after.map(|(_, id)| id))
+        .bind(filter.limit)
+        .bind(filter.archived)
+        .bind(filter.after.and_then(|(key, _)| key.position()))
+        .bind(filter.completed)
+        .bind(filter.updated_since)
+        .bind(filter.created_after)
+        .bind(filter.created_before)
+        .bind(filter.due_from)
+        .bind(filter.due_before)
+        .bind(filter.has_due_date)
+        .fetch_all(&self.pool)
+        .await?;
+
+        Ok(todos)
+    }
+
+    async fn count(&self, user: AuthUser, filter: &TodoFilter) -> Result<i64, ApiError> {
+        let count = sqlx::query_scalar(&format!(
+            "SELECT count(*) FROM {}
+             WHERE ($2::text IS NULL OR $2 = ANY(tags))
+               AND archived = $3
+               AND ($4::boolean IS NULL OR completed = $4)
+               AND ($5::timestamptz IS NULL OR updated_at > $5)
+               AND ($6::timestamptz IS NULL OR created_at > $6)
+               AND ($7::timestamptz IS NULL OR created_at < $7)
+               AND ($8::timestamptz IS NULL OR due_date >= $8)
+               AND ($9::timestamptz IS NULL OR due_date < $9)
+               AND ($10::boolean IS NULL OR (due_date IS NOT NULL) = $10)",
+            accessible_todos(1)
+        ))
+        .bind(user.user_id)
+        .bind(&filter.tag)
+        .bind(filter.archived)
+        .bind(filter.completed)
+        .bind(filter.updated_since)
+        .bind(filter.created_after)
+        .bind(filter.created_before)
+        .bind(filter.due_from)
+        .bind(filter.due_before)
+        .bind(filter.has_due_date)
+        .fetch_one(&self.pool)
+        .await?;
+        Ok(count)
+    }
+
+    async fn export(&self, user: AuthUser, rows: mpsc::Sender<Result<Todo, ApiError>>) {
+        let sql = format!(
+            "SELECT {} FROM {} ORDER BY created_at DESC, id DESC",
+            TODO_COLUMNS,
+            accessible_todos(1)
+        );
+        let mut stream = sqlx::query_as::<_, Todo>(&sql)
+            .bind(user.user_id)
+            .fetch(&self.pool);
+
+        while let Some(row) = stream.next().await {
+            let row = row.map_err(ApiError::from);
+            let failed = row.is_err();
+            // Stop when the receiver went away or the query failed mid-stream
+            if rows.send(row).await.is_err() || failed {
+                break;
+            }
+        }
+    }
+
+    async fn find(&self, user: AuthUser, id: Uuid) -> Result<Option<(Todo, Role)>, ApiError> {
+        let scoped = sqlx::query_as::<_, ScopedTodo>(&format!(
+            "SELECT {}, role FROM {} WHERE id = $2",
+            TODO_COLUMNS,
+            accessible_todos(1)
+        ))
+        .bind(user.user_id)
+        .bind(id)
+        .fetch_optional(&self.pool)
+        .await
+        .map_err(todo_db_error(id))?;
+
+        Ok(scoped.and_then(|s| Role::from_db(&s.role).map(|role| (s.todo, role))))
+    }
+
+    async fn subtasks(&self, user: AuthUser, id: Uuid) -> Result<Vec<Todo>, ApiError> {
+        let todos = sqlx::query_as::<_, Todo>(&format!(
+            "SELECT {} FROM {} WHERE parent_id = $2 ORDER BY created_at, id",
+            TODO_COLUMNS,
+            accessible_todos(1)
+        ))
+        .bind(user.user_id)
+        .bind(id)
+        .fetch_all(&self.pool)
+        .await?;
+
+        Ok(todos)
+    }
+
+    async fn search(
+        &self,
+        user: AuthUser,
+        query: &str,
+        limit: i64,
+    ) -> Result<Vec<(Todo, f32)>, ApiError> {
+        let found = sqlx::query_as::<_, RankedTodo>(&format!(
+            "SELECT {}, ts_rank(search_vector, query) AS rank
+             FROM {}, plainto_tsquery('english', $2) AS query
+             WHERE search_vector @@ query AND NOT archived
+             ORDER BY rank DESC, id
+             LIMIT $3",
+            TODO_COLUMNS,
+            accessible_todos(1)
+        ))
+        .bind(user.user_id)
+        .bind(query)
+        .bind(limit)
+        .fetch_all(&self.pool)
+        .await?;
+
+        Ok(found.into_iter().map(|found| (found.todo, found.rank)).collect())
+    }
+
+    async fn existing(&self, user: AuthUser, ids: &[Uuid]) -> Result<Vec<Uuid>, ApiError> {
+        let found = sqlx::query_scalar(&format!(
+            "SELECT id FROM {} WHERE id = ANY($2)",
+            accessible_todos(1)
+        ))
+        .bind(user.user_id)
+        .bind(ids)
+        .fetch_all(&self.pool)
+        .await?;
+
+        Ok(found)
+    }
+
+    async fn find_many(&self, user: AuthUser, ids: &[Uuid]) -> Result<Vec<Todo>, ApiError> {
+        let todos = sqlx::query_as::<_, Todo>(&format!(
+            "SELECT {} FROM {} WHERE id = ANY($2)",
+            TODO_COLUMNS,
+            accessible_todos(1)
+        ))
+        .bind(user.user_id)
+        .bind(ids)
+        .fetch_all(&self.pool)
+        .await?;
+
+        Ok(todos)
+    }
+
+    async fn has_subtasks(&self, id: Uuid) -> Result<bool, ApiError> {
+        let exists = sqlx::query_scalar("SELECT EXISTS (SELECT 1 FROM todos WHERE parent_id = $1)")
+            .bind(id)
+            .fetch_one(&self.pool)
+            .await?;
+        Ok(exists)
+    }
+
+    async fn is_ancestor(&self, ancestor: Uuid, id: Uuid) -> Result<bool, ApiError> {
+        let found = sqlx::query_scalar(
+            "WITH RECURSIVE ancestors AS (
+                 SELECT id, parent_id FROM todos WHERE id = $1
+                 UNION
+                 SELECT t.id, t.parent_id FROM todos t JOIN ancestors a ON t.id = a.parent_id
+             )
+             SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = $2)"
+        )
+        .bind(id)
+        .bind(ancestor)
+        .fetch_one(&self.pool)
+        .await?;
+        Ok(found)
+    }
+
+    async fn open_titled(&self, user_id: Option<Uuid>, title: &str) -> Result<Option<Uuid>, ApiError> {
+        // Same expression as idx_todos_open_title, so the index serves it
+        let id = sqlx::query_scalar(
+            "SELECT id FROM todos
+             WHERE COALESCE(user_id, '00000000-0000-0000-0000-000000000000'::uuid)
+                   = COALESCE($1, '00000000-0000-0000-0000-000000000000'::uuid)
+               AND lower(btrim(title)) = lower(btrim($2))
+               AND NOT completed
+             LIMIT 1",
+        )
+        .bind(user_id)
+        .bind(title)
+        .fetch_optional(&self.pool)
+        .await?;
+        Ok(id)
+    }
+
+    async fn create(
+        &self,
+        user: AuthUser,
+        new: NewTodo,
+        idempotency: Option<IdempotencyKey>,
+    ) -> Result<Todo, ApiError> {
+        let id = Uuid::new_v4();
+        let now = Utc::now();
+        let mut tx = self.pool.begin().await?;
+
+        let result = async {
+            if new.unique_title {
+                check_title_free(&mut tx, user.user_id, &new.title, id).await?;
+                strict_title_savepoint(&mut tx, id).await?;
+            }
+            let inserted = sqlx::query_as::<_, Todo>(&format!(
+                "INSERT INTO todos (id, title, description, completed, tags, user_id, list_id, parent_id,
+                     due_date, recurrence, recurrence_interval, remind_at, created_at, updated_at, created_by,
+                     updated_by, strict_title)
+                 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $14, $15, $11, $12, $13, $13, $16)
+                 RETURNING {}",
+                TODO_COLUMNS
+            ))
+            .bind(id)
+            .bind(&new.title)
+            .bind(&new.description)
+            .bind(false)
+            .bind(&new.tags)
+            .bind(user.user_id)
+            .bind(new.list_id)
+            .bind(new.parent_id)
+            .bind(new.due_date)
+            .bind(new.recurrence.as_str())
+            .bind(now)
+            .bind(now)
+            .bind(new.actor.0)
+            .bind(new.recurrence_interval)
+            .bind(new.remind_at)
+            .bind(new.unique_title)
+            .fetch_one(&mut *tx)
+            .await;
+            let todo = match inserted {
+                Ok(todo) => todo,
+                Err(err) if is_strict_title_clash(&err) => {
+                    return Err(strict_title_clash(&mut tx, user.user_id, &new.title, id).await)
+                }
+                Err(err) => return Err(todo_db_error(id)(err)),
+            };
+            record_event(&mut tx, HistoryAction::Created, &todo, new.actor.0).await?;
+
+            if let Some(idempotency) = idempotency {
+                let response = serde_json::to_value(TodoResponse::from(todo.clone()))
+                    .map_err(|e| ApiError::InternalServerError(format!("Failed to encode response: {}", e)))?;
+
+                sqlx::query(
+                    "INSERT INTO idempotency_keys (key, user_id, request_body, todo_id, response_body)
+                     VALUES ($1, $2, $3, $4, $5)"
+                )
+                .bind(&idempotency.key)
+                .bind(user.user_id)
+                .bind(&idempotency.request)
+                .bind(id)
+                .bind(response)
+                .execute(&mut *tx)
+                .await
+                .map_err(|e| {
+                    conflict_on_duplicate(e, || {
+                        "A request with this Idempotency-Key is already being processed".to_string()
+                    })
+                })?;
+            }
+
+            Ok::<_, ApiError>(todo)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn idempotent_response(
+        &self,
+        user: AuthUser,
+        key: &str,
+        request: &Value,
+        ttl_secs: i64,
+    ) -> Result<Option<StoredResponse>, ApiError> {
+        // Every expired key goes, not just this one, so keys nobody repeats do
+        // not pile up; an expired key may be reused for a new request
+        sqlx::query("DELETE FROM idempotency_keys WHERE created_at < NOW() - make_interval(secs => $1)")
+            .bind(ttl_secs as f64)
+            .execute(&self.pool)
+            .await?;
+
+        let stored: Option<(bool, Value)> = sqlx::query_as(
+            "SELECT request_body = $3, response_body FROM idempotency_keys
+             WHERE key = $1 AND user_id IS NOT DISTINCT FROM $2"
+        )
+        .bind(key)
+        .bind(user.user_id)
+        .bind(request)
+        .fetch_optional(&self.pool)
+        .await?;
+
+        Ok(stored.map(|(same_request, response)| StoredResponse { same_request, response }))
+    }
+
+    async fn update(&self, existing: &Todo, changes: TodoChanges) -> Result<Updated, ApiError> {
+        let mut tx = self.pool.begin().await?;
+        let result = apply_update(&mut tx, existing, &changes, Utc::now()).await;
+        db::finish(tx, result).await
+    }
+
+    async fn update_many(&self, updates: Vec<(Todo, TodoChanges)>) -> Result<Vec<Updated>, ApiError> {
+        let now = Utc::now();
+        let mut tx = self.pool.begin().await?;
+
+        let result = async {
+            let mut updated = Vec::with_capacity(updates.len());
+            for (existing, changes) in &updates {
+                updated.push(apply_update(&mut tx, existing, changes, now).await?);
+            }
+            Ok::<_, ApiError>(updated)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn set_completed(
+        &self,
+        existing: &Todo,
+        completed: bool,
+        actor: Actor,
+    ) -> Result<Updated, ApiError> {
+        let id = existing.id;
+        let now = Utc::now();
+        let mut tx = self.pool.begin().await?;
+
+        let result = async {
+            // Only a row that actually flips is changed, so two requests
+            // completing the same todo create a single next occurrence
+            let flipped = sqlx::query_as::<_, Todo>(&format!(
+                "UPDATE todos SET completed = $1, completed_at = CASE WHEN $1 THEN COALESCE(completed_at, $2) END,
+                     updated_at = $2, updated_by = $4, version = version + 1, strict_title = FALSE
+                 WHERE id = $3 AND completed IS DISTINCT FROM $1
+                 RETURNING {}",
+                TODO_COLUMNS
+            ))
+            .bind(completed)
+            .bind(now)
+            .bind(id)
+            .bind(actor.0)
+            .fetch_optional(&mut *tx)
+            .await
+            .map_err(todo_db_error(id))?;
+            let Some(todo) = flipped else {
+                // Already in that state: leave it as it is
+                let todo = sqlx::query_as::<_, Todo>(&format!("SELECT {} FROM todos WHERE id = $1", TODO_COLUMNS))
+                    .bind(id)
+                    .fetch_optional(&mut *tx)
+                    .await
+                    .map_err(todo_db_error(id))?
+                    .ok_or_else(|| todo_not_found(id))?;
+                return Ok(Updated { todo, next_occurrence: None });
+            };
+            record_event(&mut tx, HistoryAction::Updated, &todo, actor.0).await?;
+
+            let next_occurrence = if completed {
+                create_next_occurrence(&mut tx, &todo, now).await?
+            } else {
+                None
+            };
+
+            Ok::<_, ApiError>(Updated { todo, next_occurrence })
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn set_archived(
+        &self,
+        existing: &Todo,
+        archived: bool,
+        actor: Actor,
+    ) -> Result<Todo, ApiError> {
+        let id = existing.id;
+        let mut tx = self.pool.begin().await?;
+
+        let result = async {
+            let todo = sqlx::query_as::<_, Todo>(&format!(
+                "UPDATE todos SET archived = $1, updated_at = $2, updated_by = $4, version = version + 1
+                 WHERE id = $3
+                 RETURNING {}",
+                TODO_COLUMNS
+            ))
+            .bind(archived)
+            .bind(Utc::now())
+            .bind(id)
+            .bind(actor.0)
+            .fetch_optional(&mut *tx)
+            .await
+            .map_err(todo_db_error(id))?
+            .ok_or_else(|| todo_not_found(id))?;
+            record_event(&mut tx, HistoryAction::Updated, &todo, actor.0).await?;
+
+            Ok::<_, ApiError>(todo)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn reorder(&self, user: AuthUser, ids: &[Uuid], actor: Actor) -> Result<(), ApiError> {
+        let mut tx = self.pool.begin().await?;
+        let result = async {
+            let owned: Vec<(Uuid, i64)> = sqlx::query_as(
+                "SELECT id, position FROM todos
+                 WHERE user_id IS NOT DISTINCT FROM $1
+                 ORDER BY position
+                 FOR UPDATE",
+            )
+            .bind(user.user_id)
+            .fetch_all(&mut *tx)
+            .await?;
+            let owned_ids: Vec<Uuid> = owned.iter().map(|(id, _)| *id).collect();
+            check_reorder(&owned_ids, ids)?;
+
+            // Hand the caller's existing positions out in the requested order so
+            // their todos keep their place relative to everyone else's. Moved
+            // todos count as changed, so syncing clients and If-Match see it.
+            let positions: Vec<i64> = owned.iter().map(|(_, position)| *position).collect();
+            let moved = sqlx::query_as::<_, Todo>(&format!(
+                "UPDATE todos SET position = p.moved_to, updated_at = $3, updated_by = $4, version = version + 1
+                 FROM UNNEST($1::uuid[], $2::bigint[]) AS p(moved_id, moved_to)
+                 WHERE todos.id = p.moved_id AND todos.position <> p.moved_to
+                 RETURNING {}",
+                TODO_COLUMNS
+            ))
+            .bind(ids)
+            .bind(&positions)
+            .bind(Utc::now())
+            .bind(actor.0)
+            .fetch_all(&mut *tx)
+            .await?;
+            for todo in &moved {
+                record_event(&mut tx, HistoryAction::Reordered, todo, actor.0).await?;
+            }
+
+            Ok::<_, ApiError>(())
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn delete(
+        &self,
+        user: AuthUser,
+        id: Uuid,
+        actor: Actor,
+        undo: &UndoToken,
+    ) -> Result<Option<Todo>, ApiError> {
+        let mut tx = self.pool.begin().await?;
+
+        let result = async {
+            // Subtasks go with their parent through ON DELETE CASCADE; keep them
+            // too so undoing brings the whole tree back
+            let descendants = sqlx::query_as::<_, Todo>(&format!(
+                "WITH RECURSIVE subtree AS (
+                     SELECT id FROM todos WHERE parent_id = $1
+                     UNION ALL
+                     SELECT t.id FROM todos t JOIN subtree s ON t.parent_id = s.id
+                 )
+                 SELECT {} FROM todos WHERE id IN (SELECT id FROM subtree)",
+                TODO_COLUMNS
+            ))
+            .bind(id)
+            .fetch_all(&mut *tx)
+            .await
+            .map_err(todo_db_error(id))?;
+
+            let deleted = sqlx::query_as::<_, Todo>(&format!(
+                "DELETE FROM todos WHERE id = $1 RETURNING {}",
+                TODO_COLUMNS
+            ))
+            .bind(id)
+            .fetch_optional(&mut *tx)
+            .await
+            .map_err(todo_db_error(id))?;
+            let Some(todo) = deleted else {
+                return Ok(None);
+            };
+            // Every removed row gets its own event, so /api/todos/changes reports
+            // the subtasks gone too
+            record_event(&mut tx, HistoryAction::Deleted, &todo, actor.0).await?;
+            for descendant in &descendants {
+                record_event(&mut tx, HistoryAction::Deleted, descendant, actor.0).await?;
+            }
+
+            sqlx::query(
+                "INSERT INTO pending_deletes (token, user_id, todos, expires_at)
+                 VALUES ($1, $2, $3, $4)",
+            )
+            .bind(&undo.token)
+            .bind(user.user_id)
+            .bind(encode_deleted(&parents_first(todo.clone(), descendants))?)
+            .bind(undo.expires_at)
+            .execute(&mut *tx)
+            .await
+            .map_err(todo_db_error(id))?;
+
+            Ok::<_, ApiError>(Some(todo))
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn restore(
+        &self,
+        user: AuthUser,
+        token: &str,
+        actor: Actor,
+        now: DateTime<Utc>,
+    ) -> Result<Vec<Todo>, ApiError> {
+        let mut tx = self.pool.begin().await?;
+
+        let result = async {
+            // Any failure below rolls this back, so the token stays usable
+            let pending: Option<(Option<Uuid>, Value, DateTime<Utc>)> = sqlx::query_as(
+                "DELETE FROM pending_deletes WHERE token = $1 RETURNING user_id, todos, expires_at",
+            )
+            .bind(token)
+            .fetch_optional(&mut *tx)
+            .await?;
+            let Some((_, todos, expires_at)) = pending.filter(|(owner, ..)| *owner == user.user_id) else {
+                return Err(undo_not_found());
+            };
+            if expires_at <= now {
+                return Err(undo_expired());
+            }
+
+            let todos = decode_deleted(todos)?;
+            for todo in &todos {
+                sqlx::query(&format!(
+                    "INSERT INTO todos ({})
+                     VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17,
+                         $18, $19, $20, $21, $22)",
+                    TODO_COLUMNS
+                ))
+                .bind(todo.id)
+                .bind(&todo.title)
+                .bind(&todo.description)
+                .bind(todo.completed)
+                .bind(todo.archived)
+                .bind(todo.position)
+                .bind(todo.version)
+                .bind(&todo.tags)
+                .bind(todo.user_id)
+                .bind(todo.list_id)
+                .bind(todo.parent_id)
+                .bind(todo.due_date)
+                .bind(&todo.recurrence)
+                .bind(todo.recurrence_interval)
+                .bind(todo.completed_at)
+                .bind(todo.remind_at)
+                .bind(todo.reminded_at)
+                .bind(todo.created_at)
+                .bind(todo.updated_at)
+                .bind(todo.created_by)
+                .bind(todo.updated_by)
+                .bind(todo.recurrence_day)
+                .execute(&mut *tx)
+                .await
+                .map_err(restore_error(todo))?;
+                record_event(&mut tx, HistoryAction::Restored, todo, actor.0).await?;
+            }
+
+            Ok::<_, ApiError>(todos)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn purge_expired_deletes(&self, now: DateTime<Utc>) -> Result<u64, ApiError> {
+        let purged = sqlx::query("DELETE FROM pending_deletes WHERE expires_at <= $1")
+            .bind(now)
+            .execute(&self.pool)
+            .await?
+            .rows_affected();
+        Ok(purged)
+    }
+
+    async fn purge_archived(&self, before: DateTime<Utc>, limit: i64) -> Result<u64, ApiError> {
+        let mut tx = self.pool.begin().await?;
+        let result = async {
+            // The subtask check is repeated outside the subquery so a subtask
+            // added meanwhile is not removed by ON DELETE CASCADE
+            let purged = sqlx::query_as::<_, Todo>(&format!(
+                "DELETE FROM todos t
+                 WHERE t.id IN (
+                     SELECT id FROM todos p
+                     WHERE p.archived AND p.updated_at < $1
+                       AND NOT EXISTS (SELECT 1 FROM todos c WHERE c.parent_id = p.id)
+                     LIMIT $2
+                 )
+                 AND NOT EXISTS (SELECT 1 FROM todos c WHERE c.parent_id = t.id)
+                 RETURNING {}",
+                TODO_COLUMNS
+            ))
+            .bind(before)
+            .bind(limit)
+            .fetch_all(&mut *tx)
+            .await?;
+            // Nobody asked for the purge, so the events have no actor
+            for todo in &purged {
+                record_event(&mut tx, HistoryAction::Deleted, todo, None).await?;
+            }
+
+            Ok::<_, ApiError>(purged.len() as u64)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn delete_all(&self) -> Result<u64, ApiError> {
+        let mut tx = self.pool.begin().await?;
+        let result = async {
+            sqlx::query("DELETE FROM pending_deletes").execute(&mut *tx).await?;
+            let deleted = sqlx::query_as::<_, Todo>(&format!("DELETE FROM todos RETURNING {}", TODO_COLUMNS))
+                .fetch_all(&mut *tx)
+                .await?;
+            for todo in &deleted {
+                record_event(&mut tx, HistoryAction::Deleted, todo, None).await?;
+            }
+            Ok::<_, ApiError>(deleted.len() as u64)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn changes(&self, user: AuthUser, since: DateTime<Utc>) -> Result<Changes, ApiError> {
+        // Restoring keeps the original updated_at, so restores are found
+        // through the history instead
+        let todos = sqlx::query_as::<_, Todo>(&format!(
+            "SELECT {} FROM {}
+             WHERE updated_at > $2
+                OR id IN (SELECT todo_id FROM todo_events WHERE event = 'restored' AND created_at > $2)
+             ORDER BY updated_at, id",
+            TODO_COLUMNS,
+            accessible_todos(1)
+        ))
+        .bind(user.user_id)
+        .bind(since)
+        .fetch_all(&self.pool)
+        .await?;
+
+        let deleted = sqlx::query_as::<_, Tombstone>(
+            "SELECT e.todo_id AS id, max(e.created_at) AS deleted_at
+             FROM todo_events e
+             WHERE e.event = 'deleted' AND e.created_at > $2
+               AND (e.user_id IS NOT DISTINCT FROM $1
+                    OR (e.snapshot->>'list_id')::uuid IN (SELECT list_id FROM list_members WHERE user_id = $1))
+               AND NOT EXISTS (SELECT 1 FROM todos t WHERE t.id = e.todo_id)
+             GROUP BY e.todo_id
+             ORDER BY deleted_at, id",
+        )
+        .bind(user.user_id)
+        .bind(since)
+        .fetch_all(&self.pool)
+        .await?;
+
+        Ok(Changes { todos, deleted })
+    }
+
+    async fn history(
+        &self,
+        id: Uuid,
+        after: Option<i64>,
+        limit: i64,
+    ) -> Result<Vec<HistoryEvent>, ApiError> {
+        let events = sqlx::query_as::<_, HistoryEvent>(
+            "SELECT id, todo_id, user_id, event, actor_id, snapshot, created_at
+             FROM todo_events
+             WHERE todo_id = $1 AND ($2::bigint IS NULL OR id < $2)
+             ORDER BY id DESC
+             LIMIT $3",
+        )
+        .bind(id)
+        .bind(after)
+        .bind(limit)
+        .fetch_all(&self.pool)
+        .await
+        .map_err(todo_db_error(id))?;
+        Ok(events)
+    }
+
+    async fn import(
+        &self,
+        user: AuthUser,
+        actor: Actor,
+        rows: &[ImportRow],
+        mode: ImportMode,
+    ) -> Result<ImportOutcome, ApiError> {
+        let now = Utc::now();
+        let mut tx = self.pool.begin().await?;
+        let result = async {
+            let mut outcome = ImportOutcome::default();
+            let mut seen = HashSet::new();
+
+            for batch in rows.chunks(IMPORT_BATCH_ROWS) {
+                let batch_ids: Vec<Uuid> = batch.iter().map(|row| row.id).collect();
+                let existing: HashMap<Uuid, Option<Uuid>> =
+                    sqlx::query_as("SELECT id, user_id FROM todos WHERE id = ANY($1) FOR UPDATE")
+                        .bind(&batch_ids)
+                        .fetch_all(&mut *tx)
+                        .await?
+                        .into_iter()
+                        .collect();
+                let plan = plan_import(user, mode, batch, &existing, &mut seen, &mut outcome)?;
+
+                if !plan.insert.is_empty() {
+                    let mut ids = Vec::with_capacity(plan.insert.len());
+                    let mut titles = Vec::with_capacity(plan.insert.len());
+                    let mut descriptions = Vec::with_capacity(plan.insert.len());
+                    let mut completed = Vec::with_capacity(plan.insert.len());
+                    let mut tags = Vec::with_capacity(plan.insert.len());
+                    let mut created = Vec::with_capacity(plan.insert.len());
+                    let mut updated = Vec::with_capacity(plan.insert.len());
+                    for row in &plan.insert {
+                        let todo = &row.todo;
+                        let created_at = todo.created_at.unwrap_or(now);
+                        ids.push(row.id);
+                        titles.push(todo.title.as_str());
+                        descriptions.push(todo.description.as_deref());
+                        completed.push(todo.completed.unwrap_or(false));
+                        // Postgres arrays cannot be ragged, so each row's tags travel as JSON
+                        tags.push(serde_json::json!(todo.tags.as_deref().unwrap_or_default()));
+                        created.push(created_at);
+                        updated.push(todo.updated_at.unwrap_or(created_at));
+                    }
+
+                    let inserted = sqlx::query_as::<_, Todo>(&format!(
+                        "INSERT INTO todos (id, title, description, completed, tags, user_id, created_at, updated_at,
+                             completed_at, created_by, updated_by)
+                         SELECT id, title, description, completed,
+                                ARRAY(SELECT jsonb_array_elements_text(tags)), $8, created_at, updated_at,
+                                CASE WHEN completed THEN updated_at END, $9, $9
+                         FROM UNNEST($1::uuid[], $2::text[], $3::text[], $4::bool[], $5::jsonb[],
+                                     $6::timestamptz[], $7::timestamptz[])
+                             AS t(id, title, description, completed, tags, created_at, updated_at)
+                         RETURNING {}",
+                        TODO_COLUMNS
+                    ))
+                    .bind(&ids)
+                    .bind(&titles)
+                    .bind(&descriptions)
+                    .bind(&completed)
+                    .bind(&tags)
+                    .bind(&created)
+                    .bind(&updated)
+                    .bind(user.user_id)
+                    .bind(actor.0)
+                    .fetch_all(&mut *tx)
+                    .await?;
+                    for todo in &inserted {
+                        record_event(&mut tx, HistoryAction::Created, todo, actor.0).await?;
+                    }
+                    outcome.imported += plan.insert.len();
+                }
+
+                for row in &plan.overwrite {
+                    let todo = &row.todo;
+                    let overwritten = sqlx::query_as::<_, Todo>(&format!(
+                        "UPDATE todos
+                         SET title = $2, description = $3, completed = $4, tags = $5,
+                             created_at = COALESCE($6, created_at), updated_at = COALESCE($7, $8),
+                             completed_at = CASE WHEN $4 THEN COALESCE(completed_at, $7, $8) END,
+                             updated_by = $9, version = version + 1, strict_title = FALSE
+                         WHERE id = $1
+                         RETURNING {}",
+                        TODO_COLUMNS
+                    ))
+                    .bind(row.id)
+                    .bind(&todo.title)
+                    .bind(&todo.description)
+                    .bind(todo.completed.unwrap_or(false))
+                    .bind(todo.tags.clone().unwrap_or_default())
+                    .bind(todo.created_at)
+                    .bind(todo.updated_at)
+                    .bind(now)
+                    .bind(actor.0)
+                    .fetch_one(&mut *tx)
+                    .await?;
+                    record_event(&mut tx, HistoryAction::Updated, &overwritten, actor.0).await?;
+                    outcome.imported += 1;
+                }
+            }
+
+            Ok::<_, ApiError>(outcome)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn seed(&self, rows: &[ImportRow]) -> Result<usize, ApiError> {
+        let now = Utc::now();
+        let mut tx = self.pool.begin().await?;
+        let result = async {
+            let mut inserted = 0;
+
+            for row in rows {
+                let todo = &row.todo;
+                let created_at = todo.created_at.unwrap_or(now);
+
+                let seeded = sqlx::query_as::<_, Todo>(&format!(
+                    "INSERT INTO todos (id, title, description, completed, tags, created_at, updated_at, completed_at)
+                     VALUES ($1, $2, $3, $4, $5, $6, $7, CASE WHEN $4 THEN $7 END)
+                     ON CONFLICT DO NOTHING
+                     RETURNING {}",
+                    TODO_COLUMNS
+                ))
+                .bind(row.id)
+                .bind(&todo.title)
+                .bind(&todo.description)
+                .bind(todo.completed.unwrap_or(false))
+                .bind(todo.tags.clone().unwrap_or_default())
+                .bind(created_at)
+                .bind(todo.updated_at.unwrap_or(created_at))
+                .fetch_optional(&mut *tx)
+                .await?;
+                if let Some(todo) = seeded {
+                    record_event(&mut tx, HistoryAction::Created, &todo, None).await?;
+                    inserted += 1;
+                }
+            }
+
+            Ok::<_, ApiError>(inserted)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+}
@@ -0,0 +1,39 @@
+use async_trait::async_trait;
+use chrono::Utc;
+use uuid::Uuid;
+
+use crate::error::ApiError;
+use crate::models::User;
+use crate::repository::UserRepository;
+use super::{conflict_on_duplicate, PgRepository};
+
+#[async_trait]
+impl UserRepository for PgRepository {
+    async fn create(&self, username: &str, password_hash: &str) -> Result<User, ApiError> {
+        sqlx::query_as::<_, User>(
+            "INSERT INTO users (id, username, password_hash, created_at)
+             VALUES ($1, $2, $3, $4)
+             RETURNING id, username, password_hash, created_at"
+        )
+        .bind(Uuid::new_v4())
+        .bind(username)
+        .bind(password_hash)
+        .bind(Utc::now())
+        .fetch_one(&self.pool)
+        .await
+        .map_err(|e| {
+            conflict_on_duplicate(e, || format!("Username '{}' is already taken", username))
+        })
+    }
+
+    async fn find_by_username(&self, username: &str) -> Result<Option<User>, ApiError> {
+        let user = sqlx::query_as::<_, User>(
+            "SELECT id, username, password_hash, created_at FROM users WHERE username = $1"
+        )
+        .bind(username)
+        .fetch_optional(&self.pool)
+        .await?;
+
+        Ok(user)
+    }
+}
@@ -0,0 +1,108 @@
+use async_trait::async_trait;
+use chrono::Utc;
+use uuid::Uuid;
+
+use crate::auth::AuthUser;
+use crate::error::ApiError;
+use crate::models::{Webhook, WebhookEvent};
+use crate::repository::WebhookRepository;
+use super::PgRepository;
+
+/// Columns selected for every `Webhook` row
+const WEBHOOK_COLUMNS: &str = "id, user_id, url, secret, events, created_at";
+
+#[async_trait]
+impl WebhookRepository for PgRepository {
+    async fn list(&self, user: AuthUser) -> Result<Vec<Webhook>, ApiError> {
+        let webhooks = sqlx::query_as::<_, Webhook>(&format!(
+            "SELECT {} FROM webhooks WHERE user_id IS NOT DISTINCT FROM $1 ORDER BY created_at, id",
+            WEBHOOK_COLUMNS
+        ))
+        .bind(user.user_id)
+        .fetch_all(&self.pool)
+        .await?;
+
+        Ok(webhooks)
+    }
+
+    async fn find(&self, user: AuthUser, id: Uuid) -> Result<Option<Webhook>, ApiError> {
+        let webhook = sqlx::query_as::<_, Webhook>(&format!(
+            "SELECT {} FROM webhooks WHERE id = $1 AND user_id IS NOT DISTINCT FROM $2",
+            WEBHOOK_COLUMNS
+        ))
+        .bind(id)
+        .bind(user.user_id)
+        .fetch_optional(&self.pool)
+        .await?;
+
+        Ok(webhook)
+    }
+
+    async fn create(
+        &self,
+        user: AuthUser,
+        url: &str,
+        secret: &str,
+        events: &[String],
+    ) -> Result<Webhook, ApiError> {
+        let webhook = sqlx::query_as::<_, Webhook>(&format!(
+            "INSERT INTO webhooks (id, user_id, url, secret, events, created_at)
+             VALUES ($1, $2, $3, $4, $5, $6)
+             RETURNING {}",
+            WEBHOOK_COLUMNS
+        ))
+        .bind(Uuid::new_v4())
+        .bind(user.user_id)
+        .bind(url)
+        .bind(secret)
+        .bind(events)
+        .bind(Utc::now())
+        .fetch_one(&self.pool)
+        .await?;
+
+        Ok(webhook)
+    }
+
+    async fn update(&self, webhook: &Webhook) -> Result<bool, ApiError> {
+        let result = sqlx::query(
+            "UPDATE webhooks SET url = $2, secret = $3, events = $4 WHERE id = $1"
+        )
+        .bind(webhook.id)
+        .bind(&webhook.url)
+        .bind(&webhook.secret)
+        .bind(&webhook.events)
+        .execute(&self.pool)
+        .await?;
+
+        Ok(result.rows_affected() > 0)
+    }
+
+    async fn delete(&self, user: AuthUser, id: Uuid) -> Result<bool, ApiError> {
+        let result = sqlx::query("DELETE FROM webhooks WHERE id = $1 AND user_id IS NOT DISTINCT FROM $2")
+            .bind(id)
+            .bind(user.user_id)
+            .execute(&self.pool)
+            .await?;
+
+        Ok(result.rows_affected() > 0)
+    }
+
+    async fn subscribed(
+        &self,
+        user_id: Option<Uuid>,
+        event: WebhookEvent,
+    ) -> Result<Vec<Webhook>, ApiError> {
+        let webhooks = sqlx::query_as::<_, Webhook>(&format!(
+            "SELECT {} FROM webhooks
+             WHERE user_id IS NOT DISTINCT FROM $1 AND $2 = ANY(events)
+             ORDER BY created_at, id",
+            WEBHOOK_COLUMNS
+        ))
+        .bind(user_id)
+        .bind(event.as_str())
+        .fetch_all(&self.pool)
+        .await?;
+
+        Ok(webhooks)
+    }
+}
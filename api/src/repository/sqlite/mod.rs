@@ -0,0 +1,306 @@
+use async_trait::async_trait;
+use chrono::{DateTime, Utc};
+use sqlx::sqlite::{SqliteConnectOptions, SqliteJournalMode, SqlitePoolOptions, SqliteSynchronous};
+use sqlx::{ConnectOptions, Sqlite, SqlitePool};
+use log::LevelFilter;
+use std::str::FromStr;
+use std::time::Duration;
+use uuid::fmt::Hyphenated;
+use uuid::Uuid;
+
+use crate::db::metrics::TimedPool;
+use crate::error::ApiError;
+use crate::models::{HistoryEvent, ListMember, Notification, PoolStats, Todo, TodoList, User, Webhook};
+use crate::repository::{ping_pool, HealthRepository};
+
+mod list;
+mod reminder;
+mod schema;
+mod todo;
+mod user;
+mod webhook;
+
+/// SQLite-backed implementation of every repository trait, for single-user
+/// self-hosting without a Postgres server
+#[derive(Clone)]
+pub struct SqliteRepository {
+    pool: TimedPool<Sqlite>,
+}
+
+impl SqliteRepository {
+    pub fn new(pool: SqlitePool) -> Self {
+        SqliteRepository { pool: TimedPool::new(pool) }
+    }
+}
+
+#[async_trait]
+impl HealthRepository for SqliteRepository {
+    async fn pool_stats(&self) -> Result<PoolStats, ApiError> {
+        ping_pool("sqlite", self.pool.inner()).await
+    }
+}
+
+/// Open (creating if needed) the database at `url` and bring its schema up to
+/// date. `url` may be `sqlite:///path/to/todo.db` or a plain file path.
+///
+/// SQLite allows a single writer at a time. WAL mode lets reads proceed during a
+/// write, and `busy_timeout` makes a writer wait for the lock instead of failing
+/// straight away with SQLITE_BUSY.
+pub async fn connect(url: &str, busy_timeout: Duration) -> Result<SqlitePool, sqlx::Error> {
+    let options = SqliteConnectOptions::from_str(url)?
+        .create_if_missing(true)
+        .foreign_keys(true)
+        .journal_mode(SqliteJournalMode::Wal)
+        .synchronous(SqliteSynchronous::Normal)
+        .busy_timeout(busy_timeout)
+        // Reported by TimedPool instead
+        .log_slow_statements(LevelFilter::Off, Duration::ZERO);
+
+    let pool = SqlitePoolOptions::new()
+        .max_connections(5)
+        .acquire_timeout(busy_timeout)
+        .connect_with(options)
+        .await?;
+
+    schema::migrate(&pool).await?;
+    Ok(pool)
+}
+
+/// A fresh in-memory database with the current schema. It has a single
+/// connection, since every in-memory connection is a database of its own.
+#[cfg(test)]
+pub async fn in_memory() -> Result<SqlitePool, sqlx::Error> {
+    let options = SqliteConnectOptions::from_str("sqlite::memory:")?.foreign_keys(true);
+    let pool = SqlitePoolOptions::new().max_connections(1).connect_with(options).await?;
+    schema::migrate(&pool).await?;
+    Ok(pool)
+}
+
+/// Turn a unique constraint violation into 409 Conflict with `message`, and any
+/// other database error into the usual API error
+fn conflict_on_duplicate(err: sqlx::Error, message: impl FnOnce() -> String) -> ApiError {
+    let duplicate = matches!(&err, sqlx::Error::Database(db) if db.is_unique_violation());
+    if duplicate {
+        ApiError::Conflict(message())
+    } else {
+        ApiError::from(err)
+    }
+}
+
+/// A `todos` row as stored by SQLite
+#[derive(sqlx::FromRow)]
+struct TodoRow {
+    id: Hyphenated,
+    title: String,
+    description: Option<String>,
+    completed: bool,
+    archived: bool,
+    position: i64,
+    version: i32,
+    /// JSON array of strings
+    tags: String,
+    user_id: Option<Hyphenated>,
+    list_id: Option<Hyphenated>,
+    parent_id: Option<Hyphenated>,
+    due_date: Option<DateTime<Utc>>,
+    recurrence: String,
+    recurrence_interval: i32,
+    completed_at: Option<DateTime<Utc>>,
+    remind_at: Option<DateTime<Utc>>,
+    reminded_at: Option<DateTime<Utc>>,
+    created_at: DateTime<Utc>,
+    updated_at: DateTime<Utc>,
+    created_by: Option<Hyphenated>,
+    updated_by: Option<Hyphenated>,
+    recurrence_day: Option<i32>,
+}
+
+impl TryFrom<TodoRow> for Todo {
+    type Error = ApiError;
+
+    fn try_from(row: TodoRow) -> Result<Self, ApiError> {
+        let tags = serde_json::from_str(&row.tags).map_err(|e| {
+            ApiError::InternalServerError(format!("Invalid tags stored for todo {}: {}", row.id, e))
+        })?;
+
+        Ok(Todo {
+            id: row.id.into_uuid(),
+            title: row.title,
+            description: row.description,
+            completed: row.completed,
+            archived: row.archived,
+            position: row.position,
+            version: row.version,
+            tags,
+            user_id: row.user_id.map(Hyphenated::into_uuid),
+            list_id: row.list_id.map(Hyphenated::into_uuid),
+            parent_id: row.parent_id.map(Hyphenated::into_uuid),
+            due_date: row.due_date,
+            recurrence: row.recurrence,
+            recurrence_interval: row.recurrence_interval,
+            recurrence_day: row.recurrence_day,
+            completed_at: row.completed_at,
+            remind_at: row.remind_at,
+            reminded_at: row.reminded_at,
+            created_at: row.created_at,
+            updated_at: row.updated_at,
+            created_by: row.created_by.map(Hyphenated::into_uuid),
+            updated_by: row.updated_by.map(Hyphenated::into_uuid),
+        })
+    }
+}
+
+/// Encode tags the way the `todos.tags` column stores them
+fn encode_tags(tags: &[String]) -> String {
+    serde_json::to_string(tags).unwrap_or_else(|_| "[]".to_string())
+}
+
+fn hyphenated(id: Option<Uuid>) -> Option<Hyphenated> {
+    id.map(Uuid::hyphenated)
+}
+
+#[derive(sqlx::FromRow)]
+struct UserRow {
+    id: Hyphenated,
+    username: String,
+    password_hash: String,
+    created_at: DateTime<Utc>,
+}
+
+impl From<UserRow> for User {
+    fn from(row: UserRow) -> Self {
+        User {
+            id: row.id.into_uuid(),
+            username: row.username,
+            password_hash: row.password_hash,
+            created_at: row.created_at,
+        }
+    }
+}
+
+#[derive(sqlx::FromRow)]
+struct ListRow {
+    id: Hyphenated,
+    name: String,
+    owner_id: Hyphenated,
+    role: String,
+    created_at: DateTime<Utc>,
+}
+
+impl From<ListRow> for TodoList {
+    fn from(row: ListRow) -> Self {
+        TodoList {
+            id: row.id.into_uuid(),
+            name: row.name,
+            owner_id: row.owner_id.into_uuid(),
+            role: row.role,
+            created_at: row.created_at,
+        }
+    }
+}
+
+#[derive(sqlx::FromRow)]
+struct MemberRow {
+    user_id: Hyphenated,
+    username: String,
+    role: String,
+    created_at: DateTime<Utc>,
+}
+
+impl From<MemberRow> for ListMember {
+    fn from(row: MemberRow) -> Self {
+        ListMember {
+            user_id: row.user_id.into_uuid(),
+            username: row.username,
+            role: row.role,
+            created_at: row.created_at,
+        }
+    }
+}
+
+/// A `webhooks` row as stored by SQLite
+#[derive(sqlx::FromRow)]
+struct WebhookRow {
+    id: Hyphenated,
+    user_id: Option<Hyphenated>,
+    url: String,
+    secret: String,
+    /// JSON array of event names
+    events: String,
+    created_at: DateTime<Utc>,
+}
+
+impl TryFrom<WebhookRow> for Webhook {
+    type Error = ApiError;
+
+    fn try_from(row: WebhookRow) -> Result<Self, ApiError> {
+        let events = serde_json::from_str(&row.events).map_err(|e| {
+            ApiError::InternalServerError(format!("Invalid events stored for webhook {}: {}", row.id, e))
+        })?;
+
+        Ok(Webhook {
+            id: row.id.into_uuid(),
+            user_id: row.user_id.map(Hyphenated::into_uuid),
+            url: row.url,
+            secret: row.secret,
+            events,
+            created_at: row.created_at,
+        })
+    }
+}
+
+/// A `todo_events` row as stored by SQLite
+#[derive(sqlx::FromRow)]
+struct HistoryRow {
+    id: i64,
+    todo_id: Hyphenated,
+    user_id: Option<Hyphenated>,
+    event: String,
+    actor_id: Option<Hyphenated>,
+    /// JSON object
+    snapshot: String,
+    created_at: DateTime<Utc>,
+}
+
+impl TryFrom<HistoryRow> for HistoryEvent {
+    type Error = ApiError;
+
+    fn try_from(row: HistoryRow) -> Result<Self, ApiError> {
+        let snapshot = serde_json::from_str(&row.snapshot).map_err(|e| {
+            ApiError::InternalServerError(format!("Invalid snapshot stored for todo event {}: {}", row.id, e))
+        })?;
+
+        Ok(HistoryEvent {
+            id: row.id,
+            todo_id: row.todo_id.into_uuid(),
+            user_id: row.user_id.map(Hyphenated::into_uuid),
+            event: row.event,
+            actor_id: row.actor_id.map(Hyphenated::into_uuid),
+            snapshot,
+            created_at: row.created_at,
+        })
+    }
+}
+
+#[derive(sqlx::FromRow)]
+struct NotificationRow {
+    id: Hyphenated,
+    user_id: Option<Hyphenated>,
+    todo_id: Hyphenated,
+    title: String,
+    remind_at: DateTime<Utc>,
+    created_at: DateTime<Utc>,
+}
+
+impl From<NotificationRow> for Notification {
+    fn from(row: NotificationRow) -> Self {
+        Notification {
+            id: row.id.into_uuid(),
+            user_id: row.user_id.map(Hyphenated::into_uuid),
+            todo_id: row.todo_id.into_uuid(),
+            title: row.title,
+            remind_at: row.remind_at,
+            created_at: row.created_at,
+        }
+    }
+}
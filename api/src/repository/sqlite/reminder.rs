@@ -0,0 +1,128 @@
+use async_trait::async_trait;
+use chrono::{DateTime, Utc};
+
+use crate::auth::AuthUser;
+use crate::db;
+use crate::error::ApiError;
+use crate::models::{Notification, Todo};
+use crate::repository::{DueReminder, ReminderRepository, TODO_COLUMNS};
+use super::{hyphenated, NotificationRow, SqliteRepository, TodoRow};
+
+/// A claimed todo together with its failed delivery attempts
+#[derive(sqlx::FromRow)]
+struct DueRow {
+    #[sqlx(flatten)]
+    todo: TodoRow,
+    reminder_attempts: i32,
+}
+
+#[async_trait]
+impl ReminderRepository for SqliteRepository {
+    async fn claim_due(
+        &self,
+        now: DateTime<Utc>,
+        lease_until: DateTime<Utc>,
+        max_attempts: i32,
+        limit: i64,
+    ) -> Result<Vec<DueReminder>, ApiError> {
+        // SQLite serializes writers, so the claim needs no row locks
+        let rows = sqlx::query_as::<_, DueRow>(&format!(
+            "UPDATE todos SET reminder_retry_at = ?2
+             WHERE id IN (
+                 SELECT id FROM todos
+                 WHERE remind_at <= ?1 AND reminded_at IS NULL AND completed = 0
+                   AND reminder_attempts < ?3
+                   AND (reminder_retry_at IS NULL OR reminder_retry_at <= ?1)
+                 ORDER BY remind_at
+                 LIMIT ?4
+             )
+             RETURNING {}, reminder_attempts",
+            TODO_COLUMNS
+        ))
+        .bind(now)
+        .bind(lease_until)
+        .bind(max_attempts)
+        .bind(limit)
+        .fetch_all(&self.pool)
+        .await?;
+
+        rows.into_iter()
+            .map(|row| {
+                Ok(DueReminder {
+                    todo: Todo::try_from(row.todo)?,
+                    attempts: row.reminder_attempts,
+                })
+            })
+            .collect()
+    }
+
+    async fn mark_sent(
+        &self,
+        todo: &Todo,
+        sent_at: DateTime<Utc>,
+        notification: Option<&Notification>,
+    ) -> Result<(), ApiError> {
+        let mut tx = self.pool.begin().await?;
+
+        let result = async {
+            let marked = sqlx::query(
+                "UPDATE todos SET reminded_at = ?2, reminder_error = NULL, reminder_retry_at = NULL
+                 WHERE id = ?1 AND remind_at IS ?3"
+            )
+            .bind(todo.id.hyphenated())
+            .bind(sent_at)
+            .bind(todo.remind_at)
+            .execute(&mut *tx)
+            .await?
+            .rows_affected();
+
+            if let Some(notification) = notification.filter(|_| marked > 0) {
+                sqlx::query(
+                    "INSERT INTO notifications (id, user_id, todo_id, title, remind_at, created_at)
+                     VALUES (?1, ?2, ?3, ?4, ?5, ?6)"
+                )
+                .bind(notification.id.hyphenated())
+                .bind(hyphenated(notification.user_id))
+                .bind(notification.todo_id.hyphenated())
+                .bind(&notification.title)
+                .bind(notification.remind_at)
+                .bind(notification.created_at)
+                .execute(&mut *tx)
+                .await?;
+            }
+
+            Ok::<_, ApiError>(())
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn mark_failed(&self, todo: &Todo, error: &str, retry_at: DateTime<Utc>) -> Result<(), ApiError> {
+        sqlx::query(
+            "UPDATE todos SET reminder_attempts = reminder_attempts + 1, reminder_error = ?2,
+                 reminder_retry_at = ?3
+             WHERE id = ?1"
+        )
+        .bind(todo.id.hyphenated())
+        .bind(error)
+        .bind(retry_at)
+        .execute(&self.pool)
+        .await?;
+        Ok(())
+    }
+
+    async fn notifications(&self, user: AuthUser, limit: i64) -> Result<Vec<Notification>, ApiError> {
+        let rows = sqlx::query_as::<_, NotificationRow>(
+            "SELECT id, user_id, todo_id, title, remind_at, created_at FROM notifications
+             WHERE user_id IS ?1
+             ORDER BY created_at DESC, id DESC
+             LIMIT ?2"
+        )
+        .bind(hyphenated(user.user_id))
+        .bind(limit)
+        .fetch_all(&self.pool)
+        .await?;
+
+        Ok(rows.into_iter().map(Notification::from).collect())
+    }
+}
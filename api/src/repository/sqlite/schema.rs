@@ -0,0 +1,181 @@
+use sqlx::{Executor, SqlitePool};
+
+/// Schema changes in the order they were introduced. The index of the last
+/// applied step is kept in `PRAGMA user_version`, so only new steps run on an
+/// existing database. Never edit a released step; append a new one instead.
+const STEPS: &[&str] = &[
+    // UUIDs are stored as hyphenated text, tags and idempotency bodies as JSON
+    // text and timestamps as RFC 3339 text
+    "CREATE TABLE users (
+         id TEXT PRIMARY KEY,
+         username TEXT NOT NULL UNIQUE,
+         password_hash TEXT NOT NULL,
+         created_at TEXT NOT NULL
+     );
+
+     CREATE TABLE lists (
+         id TEXT PRIMARY KEY,
+         name TEXT NOT NULL,
+         owner_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+         created_at TEXT NOT NULL
+     );
+
+     CREATE TABLE list_members (
+         list_id TEXT NOT NULL REFERENCES lists(id) ON DELETE CASCADE,
+         user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+         role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+         created_at TEXT NOT NULL,
+         PRIMARY KEY (list_id, user_id)
+     );
+
+     CREATE INDEX idx_list_members_user_id ON list_members(user_id);
+
+     CREATE TABLE todos (
+         id TEXT PRIMARY KEY,
+         title TEXT NOT NULL,
+         description TEXT,
+         completed INTEGER NOT NULL DEFAULT 0,
+         version INTEGER NOT NULL DEFAULT 1,
+         tags TEXT NOT NULL DEFAULT '[]',
+         user_id TEXT,
+         list_id TEXT REFERENCES lists(id) ON DELETE SET NULL,
+         parent_id TEXT REFERENCES todos(id) ON DELETE CASCADE,
+         due_date TEXT,
+         recurrence TEXT NOT NULL DEFAULT 'none'
+             CHECK (recurrence IN ('none', 'daily', 'weekly', 'monthly')),
+         created_at TEXT NOT NULL,
+         updated_at TEXT NOT NULL
+     );
+
+     CREATE INDEX idx_created_at ON todos(created_at DESC);
+     CREATE INDEX idx_user_id ON todos(user_id);
+     CREATE INDEX idx_list_id ON todos(list_id);
+     CREATE INDEX idx_parent_id ON todos(parent_id);
+
+     CREATE TABLE idempotency_keys (
+         key TEXT NOT NULL,
+         user_id TEXT,
+         request_body TEXT NOT NULL,
+         todo_id TEXT NOT NULL,
+         response_body TEXT NOT NULL,
+         created_at TEXT NOT NULL
+     );
+
+     CREATE UNIQUE INDEX idx_idempotency_keys_key_user ON idempotency_keys
+         (key, COALESCE(user_id, ''));",
+    // Finds a user's open todos by title, for the optional unique title rule
+    "CREATE INDEX idx_todos_open_title ON todos (COALESCE(user_id, ''), title)
+         WHERE completed = 0;",
+    // Outbound webhooks; `events` is a JSON array of event names
+    "CREATE TABLE webhooks (
+         id TEXT PRIMARY KEY,
+         user_id TEXT,
+         url TEXT NOT NULL,
+         secret TEXT NOT NULL,
+         events TEXT NOT NULL DEFAULT '[]',
+         created_at TEXT NOT NULL
+     );
+
+     CREATE INDEX idx_webhooks_user_id ON webhooks(user_id);",
+    // Archiving is independent of completion
+    "ALTER TABLE todos ADD COLUMN archived INTEGER NOT NULL DEFAULT 0;
+
+     CREATE INDEX idx_archived ON todos(archived);",
+    // Manual order; existing todos keep their creation order
+    "ALTER TABLE todos ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
+
+     UPDATE todos SET position = (
+         SELECT COUNT(*) FROM todos AS earlier
+         WHERE (earlier.created_at, earlier.id) <= (todos.created_at, todos.id)
+     );
+
+     CREATE INDEX idx_position ON todos(position);",
+    // Who created and last changed each todo
+    "ALTER TABLE todos ADD COLUMN created_by TEXT;
+     ALTER TABLE todos ADD COLUMN updated_by TEXT;",
+    // Change history; kept after the todo is deleted, so no foreign key
+    "CREATE TABLE todo_events (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         todo_id TEXT NOT NULL,
+         user_id TEXT,
+         event TEXT NOT NULL,
+         actor_id TEXT,
+         snapshot TEXT NOT NULL,
+         created_at TEXT NOT NULL
+     );
+
+     CREATE INDEX idx_todo_events_todo_id ON todo_events(todo_id, id);",
+    // Deleted todos kept until their undo window closes; `todos` is a JSON array
+    "CREATE TABLE pending_deletes (
+         token TEXT PRIMARY KEY,
+         user_id TEXT,
+         todos TEXT NOT NULL,
+         expires_at TEXT NOT NULL
+     );
+
+     CREATE INDEX idx_pending_deletes_expires_at ON pending_deletes(expires_at);",
+    // Recurrence every N periods, and when each todo was completed
+    "ALTER TABLE todos ADD COLUMN recurrence_interval INTEGER NOT NULL DEFAULT 1
+         CHECK (recurrence_interval BETWEEN 1 AND 365);
+     ALTER TABLE todos ADD COLUMN completed_at TEXT;
+
+     UPDATE todos SET completed_at = updated_at WHERE completed = 1;",
+    // Reminders and their delivery bookkeeping; notifications outlive the todo
+    "ALTER TABLE todos ADD COLUMN remind_at TEXT;
+     ALTER TABLE todos ADD COLUMN reminded_at TEXT;
+     ALTER TABLE todos ADD COLUMN reminder_attempts INTEGER NOT NULL DEFAULT 0;
+     ALTER TABLE todos ADD COLUMN reminder_error TEXT;
+     ALTER TABLE todos ADD COLUMN reminder_retry_at TEXT;
+
+     CREATE INDEX idx_todos_pending_reminders ON todos(remind_at)
+         WHERE reminded_at IS NULL AND completed = 0;
+
+     CREATE TABLE notifications (
+         id TEXT PRIMARY KEY,
+         user_id TEXT,
+         todo_id TEXT NOT NULL,
+         title TEXT NOT NULL,
+         remind_at TEXT NOT NULL,
+         created_at TEXT NOT NULL
+     );
+
+     CREATE INDEX idx_notifications_user_id ON notifications(user_id, created_at DESC);",
+    "CREATE INDEX idx_todos_archived_updated_at ON todos(updated_at) WHERE archived = 1;",
+    // Titles are compared regardless of case and surrounding spaces. lower()
+    // only folds ASCII letters here, unlike Postgres.
+    "DROP INDEX idx_todos_open_title;
+
+     CREATE INDEX idx_todos_open_title ON todos (COALESCE(user_id, ''), lower(trim(title)))
+         WHERE completed = 0;",
+    "CREATE INDEX idx_todos_updated_at ON todos(updated_at);
+
+     CREATE INDEX idx_todo_events_event_created_at ON todo_events(event, created_at);",
+    // Day of month a monthly series started on
+    "ALTER TABLE todos ADD COLUMN recurrence_day INTEGER CHECK (recurrence_day BETWEEN 1 AND 31);",
+    // Open todos written while unique titles were required; no two of a
+    // user's may share a title. See migrations/24_add_todo_strict_title.sql.
+    "ALTER TABLE todos ADD COLUMN strict_title INTEGER NOT NULL DEFAULT 0;
+
+     CREATE UNIQUE INDEX idx_todos_strict_open_title ON todos
+         (COALESCE(user_id, ''), lower(trim(title)))
+         WHERE completed = 0 AND strict_title = 1;",
+];
+
+/// Bring the database schema up to date
+pub async fn migrate(pool: &SqlitePool) -> Result<(), sqlx::Error> {
+    let mut tx = pool.begin().await?;
+    let applied: i64 = sqlx::query_scalar("PRAGMA user_version")
+        .fetch_one(&mut *tx)
+        .await?;
+
+    for (i, step) in STEPS.iter().enumerate().skip(applied as usize) {
+        log::info!(step = i + 1; "applying sqlite schema step");
+        (&mut *tx).execute(*step).await?;
+    }
+    // PRAGMA does not accept bound parameters
+    (&mut *tx)
+        .execute(format!("PRAGMA user_version = {}", STEPS.len()).as_str())
+        .await?;
+
+    tx.commit().await
+}
@@ -0,0 +1,1144 @@
+use async_trait::async_trait;
+use chrono::{DateTime, Duration, Utc};
+use futures_util::StreamExt;
+use serde_json::Value;
+use sqlx::Sqlite;
+use std::collections::{HashMap, HashSet};
+use tokio::sync::mpsc;
+use uuid::fmt::Hyphenated;
+use uuid::Uuid;
+
+use crate::auth::{Actor, AuthUser};
+use crate::db;
+use crate::db::metrics::TimedTransaction;
+use crate::error::ApiError;
+use crate::models::{HistoryAction, HistoryEvent, ImportMode, Role, Todo, TodoResponse, Tombstone};
+use crate::repository::{
+    check_reorder, decode_deleted, Changes, duplicate_title, encode_deleted, next_due, next_remind_at,
+    parents_first, plan_import, rank_by_terms, restore_orphaned, search_terms, snapshot, todo_not_found, undo_expired,
+    undo_not_found, IdempotencyKey, ImportOutcome, ImportRow, NewTodo, SortField, StoredResponse, TodoChanges,
+    TodoFilter, TodoRepository, UndoToken, Updated, IMPORT_BATCH_ROWS, TODO_COLUMNS,
+};
+use super::{conflict_on_duplicate, encode_tags, hyphenated, HistoryRow, SqliteRepository, TodoRow};
+
+/// Places a new todo after every existing one. Postgres takes this from a
+/// sequence; SQLite has none so the insert computes it.
+const NEXT_POSITION: &str = "(SELECT COALESCE(MAX(position), 0) + 1 FROM todos)";
+
+/// A derived table named `todos` holding only the todos the user bound to
+/// `?user_param` can see, with a `role` column describing their access. Mirrors
+/// the Postgres repository.
+fn accessible_todos(user_param: usize) -> String {
+    format!(
+        "(SELECT todos.*,
+             CASE WHEN todos.user_id IS ?{0} THEN 'owner'
+                  ELSE (SELECT m.role FROM list_members m
+                        WHERE m.list_id = todos.list_id AND m.user_id = ?{0})
+             END AS role
+         FROM todos
+         WHERE todos.user_id IS ?{0}
+            OR todos.list_id IN (SELECT list_id FROM list_members WHERE user_id = ?{0})) AS todos",
+        user_param
+    )
+}
+
+#[derive(sqlx::FromRow)]
+struct ScopedRow {
+    #[sqlx(flatten)]
+    todo: TodoRow,
+    role: String,
+}
+
+fn encode_json(value: &Value) -> Result<String, ApiError> {
+    serde_json::to_string(value)
+        .map_err(|e| ApiError::InternalServerError(format!("Failed to encode JSON: {}", e)))
+}
+
+/// Fail with 409 Conflict if an open todo of `user_id` other than `id`
+/// already has `title`. Call it after the transaction's write to the todo:
+/// SQLite has a single writer, so from then on no other transaction can add a
+/// clashing todo before this one ends.
+async fn check_title_free(
+    tx: &mut TimedTransaction<'_, Sqlite>,
+    user_id: Option<Uuid>,
+    title: &str,
+    id: Uuid,
+) -> Result<(), ApiError> {
+    // Same expression as idx_todos_open_title, so the index serves it
+    let existing: Option<Hyphenated> = sqlx::query_scalar(
+        "SELECT id FROM todos
+         WHERE COALESCE(user_id, '') = COALESCE(?1, '')
+           AND lower(trim(title)) = lower(trim(?2))
+           AND NOT completed AND id <> ?3
+         LIMIT 1",
+    )
+    .bind(hyphenated(user_id))
+    .bind(title)
+    .bind(id.hyphenated())
+    .fetch_optional(&mut **tx)
+    .await?;
+
+    match existing {
+        Some(existing_id) => Err(duplicate_title(title, existing_id.into_uuid())),
+        None => Ok(()),
+    }
+}
+
+/// Whether `err` is idx_todos_strict_open_title refusing a strict write
+/// because another strict open todo has the title
+fn is_strict_title_clash(err: &sqlx::Error) -> bool {
+    matches!(
+        err,
+        sqlx::Error::Database(db)
+            if db.is_unique_violation() && db.message().contains("idx_todos_strict_open_title")
+    )
+}
+
+/// Turn a strict write idx_todos_strict_open_title refused into 409 Conflict
+/// naming the todo it clashed with. SQLite only undoes the failed statement,
+/// so the transaction can still look it up.
+async fn strict_title_clash(
+    tx: &mut TimedTransaction<'_, Sqlite>,
+    user_id: Option<Uuid>,
+    title: &str,
+    id: Uuid,
+) -> ApiError {
+    match check_title_free(tx, user_id, title, id).await {
+        Err(err) => err,
+        Ok(()) => ApiError::Conflict(format!("Another open todo is titled '{}'", title)),
+    }
+}
+
+/// Record `action` on `todo` in its history, inside the transaction making the change
+async fn record_event(
+    tx: &mut TimedTransaction<'_, Sqlite>,
+    action: HistoryAction,
+    todo: &Todo,
+    actor: Option<Uuid>,
+) -> Result<(), ApiError> {
+    sqlx::query(
+        "INSERT INTO todo_events (todo_id, user_id, event, actor_id, snapshot, created_at)
+         VALUES (?1, ?2, ?3, ?4, ?5, ?6)",
+    )
+    .bind(todo.id.hyphenated())
+    .bind(hyphenated(todo.user_id))
+    .bind(action.as_str())
+    .bind(hyphenated(actor))
+    .bind(encode_json(&snapshot(todo)?)?)
+    .bind(Utc::now())
+    .execute(&mut **tx)
+    .await?;
+    Ok(())
+}
+
+/// Report a parent or list that no longer exists as 409 Conflict
+fn restore_error(todo: &Todo) -> impl Fn(sqlx::Error) -> ApiError + '_ {
+    move |err| {
+        let orphaned = matches!(&err, sqlx::Error::Database(db) if db.is_foreign_key_violation());
+        if orphaned {
+            restore_orphaned(todo.id)
+        } else {
+            ApiError::from(err)
+        }
+    }
+}
+
+/// Insert the occurrence that follows a completed recurring todo. Returns None
+/// when the todo does not repeat.
+async fn create_next_occurrence(
+    tx: &mut TimedTransaction<'_, Sqlite>,
+    todo: &Todo,
+    now: DateTime<Utc>,
+) -> Result<Option<Todo>, ApiError> {
+    let Some((due_date, day)) = next_due(todo, now) else {
+        return Ok(None);
+    };
+
+    let next = sqlx::query_as::<_, TodoRow>(&format!(
+        "INSERT INTO todos (id, title, description, completed, tags, user_id, list_id, parent_id,
+             due_date, recurrence, recurrence_interval, remind_at, position, created_at, updated_at,
+             created_by, updated_by, recurrence_day)
+         VALUES (?1, ?2, ?3, 0, ?4, ?5, ?6, ?7, ?8, ?9, ?12, ?13, {}, ?10, ?10, ?11, ?11, ?14)
+         RETURNING {}",
+        NEXT_POSITION,
+        TODO_COLUMNS
+    ))
+    .bind(Uuid::new_v4().hyphenated())
+    .bind(&todo.title)
+    .bind(&todo.description)
+    .bind(encode_tags(&todo.tags))
+    .bind(hyphenated(todo.user_id))
+    .bind(hyphenated(todo.list_id))
+    .bind(hyphenated(todo.parent_id))
+    .bind(due_date)
+    .bind(&todo.recurrence)
+    .bind(now)
+    // Whoever completed the todo brought the next occurrence about
+    .bind(hyphenated(todo.updated_by))
+    .bind(todo.recurrence_interval)
+    .bind(next_remind_at(todo, due_date))
+    .bind(day)
+    .fetch_one(&mut **tx)
+    .await?;
+
+    let next = Todo::try_from(next)?;
+    record_event(tx, HistoryAction::Created, &next, next.created_by).await?;
+    Ok(Some(next))
+}
+
+/// Apply `changes` to `existing` if it is still at `changes.version`,
+/// completing a recurring todo creating its next occurrence
+async fn apply_update(
+    tx: &mut TimedTransaction<'_, Sqlite>,
+    existing: &Todo,
+    changes: &TodoChanges,
+    now: DateTime<Utc>,
+) -> Result<Updated, ApiError> {
+    let id = existing.id;
+
+    // A new reminder time makes the reminder due again
+    sqlx::query(
+        "UPDATE todos SET reminded_at = NULL, reminder_attempts = 0, reminder_error = NULL,
+             reminder_retry_at = NULL
+         WHERE id = ?1 AND remind_at IS NOT ?2"
+    )
+    .bind(id.hyphenated())
+    .bind(changes.remind_at)
+    .execute(&mut **tx)
+    .await?;
+
+    // Only apply the update if the row still has the version the client last saw
+    let updated = sqlx::query_as::<_, TodoRow>(&format!(
+        "UPDATE todos SET title = ?1, description = ?2, completed = ?3, tags = ?4,
+             parent_id = ?5, due_date = ?6, recurrence = ?7, recurrence_interval = ?12, remind_at = ?13,
+             completed_at = CASE WHEN ?3 THEN COALESCE(completed_at, ?8) END,
+             updated_at = ?8, updated_by = ?11, version = version + 1, strict_title = ?14
+         WHERE id = ?9 AND version = ?10
+         RETURNING {}",
+        TODO_COLUMNS
+    ))
+    .bind(&changes.title)
+    .bind(&changes.description)
+    .bind(changes.completed)
+    .bind(encode_tags(&changes.tags))
+    .bind(hyphenated(changes.parent_id))
+    .bind(changes.due_date)
+    .bind(&changes.recurrence)
+    .bind(now)
+    .bind(id.hyphenated())
+    .bind(changes.version)
+    .bind(hyphenated(changes.actor.0))
+    .bind(changes.recurrence_interval)
+    .bind(changes.remind_at)
+    .bind(changes.unique_title)
+    .fetch_optional(&mut **tx)
+    .await;
+    let row = match updated {
+        Ok(row) => row,
+        Err(err) if is_strict_title_clash(&err) => {
+            return Err(strict_title_clash(tx, existing.user_id, &changes.title, id).await)
+        }
+        Err(err) => return Err(err.into()),
+    };
+
+    // No row means either a newer version or a todo deleted since it was read
+    let Some(row) = row else {
+        let exists: bool = sqlx::query_scalar("SELECT EXISTS (SELECT 1 FROM todos WHERE id = ?1)")
+            .bind(id.hyphenated())
+            .fetch_one(&mut **tx)
+            .await?;
+        return Err(if exists {
+            ApiError::Conflict("Todo was modified by someone else".to_string())
+        } else {
+            todo_not_found(id)
+        });
+    };
+    let todo = Todo::try_from(row)?;
+    if changes.unique_title {
+        check_title_free(tx, todo.user_id, &todo.title, id).await?;
+    }
+    record_event(tx, HistoryAction::Updated, &todo, changes.actor.0).await?;
+
+    let next_occurrence = if todo.completed && !existing.completed {
+        create_next_occurrence(tx, &todo, now).await?
+    } else {
+        None
+    };
+
+    Ok(Updated { todo, next_occurrence })
+}
+
+#[async_trait]
+impl TodoRepository for SqliteRepository {
+    async fn list(&self, user: AuthUser, filter: &TodoFilter) -> Result<Vec<Todo>, ApiError> {
+        let rows = sqlx::query_as::<_, TodoRow>(&format!(
+            "SELECT {} FROM {}
+             WHERE (?2 IS NULL OR EXISTS (SELECT 1 FROM json_each(todos.tags) WHERE value = ?2))
+               AND archived = ?6
+               AND (?8 IS NULL OR completed = ?8)
+               AND (?9 IS NULL OR updated_at > ?9)
+               AND (?10 IS NULL OR created_at > ?10)
+               AND (?11 IS NULL OR created_at < ?11)
+               AND (?12 IS NULL OR due_date >= ?12)
+               AND (?13 IS NULL OR due_date < ?13)
+               AND (?14 IS NULL OR (due_date IS NOT NULL) = ?14)
+               AND (?3 IS NULL AND ?7 IS NULL OR ({}, id) {} (?{}, ?4))
+             ORDER BY {}
+             LIMIT ?5",
+            TODO_COLUMNS,
+            accessible_todos(1),
+            filter.sort.column(),
+            filter.sort.after_operator(),
+            if filter.sort.field == SortField::Position { 7 } else { 3 },
+            filter.sort.order_by()
+        ))
+        .bind(hyphenated(user.user_id))
+        .bind(&filter.tag)
+        .bind(filter.after.and_then(|(key, _)| key.time()))
+        .bind(filter.after.map(|(_, id)| id.hyphenated()))
+        // A negative LIMIT means no limit in SQLite
+        .bind(filter.limit.unwrap_or(-1))
+        .bind(filter.archived)
+        .bind(filter.after.and_then(|(key, _)| key.position()))
+        .bind(filter.completed)
+        .bind(filter.updated_since)
+        .bind(filter.created_after)
+        .bind(filter.created_before)
+        .bind(filter.due_from)
+        .bind(filter.due_before)
+        .bind(filter.has_due_date)
+        .fetch_all(&self.pool)
+        .await?;
+
+        rows.into_iter().map(Todo::try_from).collect()
+    }
+
+    async fn count(&self, user: AuthUser, filter: &TodoFilter) -> Result<i64, ApiError> {
+        let count = sqlx::query_scalar(&format!(
+            "SELECT count(*) FROM {}
+             WHERE (?2 IS NULL OR EXISTS (SELECT 1 FROM json_each(todos.tags) WHERE value = ?2))
+               AND archived = ?3
+               AND (?4 IS NULL OR completed = ?4)
+               AND (?5 IS NULL OR updated_at > ?5)
+               AND (?6 IS NULL OR created_at > ?6)
+               AND (?7 IS NULL OR created_at < ?7)
+               AND (?8 IS NULL OR due_date >= ?8)
+               AND (?9 IS NULL OR due_date < ?9)
+               AND (?10 IS NULL OR (due_date IS NOT NULL) = ?10)",
+            accessible_todos(1)
+        ))
+        .bind(hyphenated(user.user_id))
+        .bind(&filter.tag)
+        .bind(filter.archived)
+        .bind(filter.completed)
+        .bind(filter.updated_since)
+        .bind(filter.created_after)
+        .bind(filter.created_before)
+        .bind(filter.due_from)
+        .bind(filter.due_before)
+        .bind(filter.has_due_date)
+        .fetch_one(&self.pool)
+        .await?;
+        Ok(count)
+    }
+
+    async fn export(&self, user: AuthUser, rows: mpsc::Sender<Result<Todo, ApiError>>) {
+        let sql = format!(
+            "SELECT {} FROM {} ORDER BY created_at DESC, id DESC",
+            TODO_COLUMNS,
+            accessible_todos(1)
+        );
+        let mut stream = sqlx::query_as::<_, TodoRow>(&sql)
+            .bind(hyphenated(user.user_id))
+            .fetch(&self.pool);
+
+        while let Some(row) = stream.next().await {
+            let row = row.map_err(ApiError::from).and_then(Todo::try_from);
+            let failed = row.is_err();
+            // Stop when the receiver went away or the query failed mid-stream
+            if rows.send(row).await.is_err() || failed {
+                break;
+            }
+        }
+    }
+
+    async fn find(&self, user: AuthUser, id: Uuid) -> Result<Option<(Todo, Role)>, ApiError> {
+        let scoped = sqlx::query_as::<_, ScopedRow>(&format!(
+            "SELECT {}, role FROM {} WHERE id = ?2",
+            TODO_COLUMNS,
+            accessible_todos(1)
+        ))
+        .bind(hyphenated(user.user_id))
+        .bind(id.hyphenated())
+        .fetch_optional(&self.pool)
+        .await?;
+
+        let Some(scoped) = scoped else {
+            return Ok(None);
+        };
+        let todo = Todo::try_from(scoped.todo)?;
+        Ok(Role::from_db(&scoped.role).map(|role| (todo, role)))
+    }
+
+    async fn subtasks(&self, user: AuthUser, id: Uuid) -> Result<Vec<Todo>, ApiError> {
+        let rows = sqlx::query_as::<_, TodoRow>(&format!(
+            "SELECT {} FROM {} WHERE parent_id = ?2 ORDER BY created_at, id",
+            TODO_COLUMNS,
+            accessible_todos(1)
+        ))
+        .bind(hyphenated(user.user_id))
+        .bind(id.hyphenated())
+        .fetch_all(&self.pool)
+        .await?;
+
+        rows.into_iter().map(Todo::try_from).collect()
+    }
+
+    /// SQLite has no full-text index here, so candidates containing every term
+    /// are ranked with `rank_by_terms`
+    async fn search(
+        &self,
+        user: AuthUser,
+        query: &str,
+        limit: i64,
+    ) -> Result<Vec<(Todo, f32)>, ApiError> {
+        let terms = search_terms(query);
+        let encoded = serde_json::to_string(&terms)
+            .map_err(|e| ApiError::InternalServerError(format!("Failed to encode terms: {}", e)))?;
+
+        let rows = sqlx::query_as::<_, TodoRow>(&format!(
+            "SELECT {} FROM {}
+             WHERE archived = 0
+               AND NOT EXISTS (
+                   SELECT 1 FROM json_each(?2)
+                   WHERE instr(lower(title || ' ' || COALESCE(description, '')), value) = 0
+               )",
+            TODO_COLUMNS,
+            accessible_todos(1)
+        ))
+        .bind(hyphenated(user.user_id))
+        .bind(encoded)
+        .fetch_all(&self.pool)
+        .await?;
+
+        let todos = rows.into_iter().map(Todo::try_from).collect::<Result<Vec<_>, _>>()?;
+        Ok(rank_by_terms(todos, &terms, limit))
+    }
+
+    async fn existing(&self, user: AuthUser, ids: &[Uuid]) -> Result<Vec<Uuid>, ApiError> {
+        // SQLite has no arrays, so the IDs travel as one JSON array
+        let ids = serde_json::to_string(ids)
+            .map_err(|e| ApiError::InternalServerError(format!("Failed to encode ids: {}", e)))?;
+
+        let found: Vec<Hyphenated> = sqlx::query_scalar(&format!(
+            "SELECT id FROM {} WHERE id IN (SELECT value FROM json_each(?2))",
+            accessible_todos(1)
+        ))
+        .bind(hyphenated(user.user_id))
+        .bind(ids)
+        .fetch_all(&self.pool)
+        .await?;
+
+        Ok(found.into_iter().map(Hyphenated::into_uuid).collect())
+    }
+
+    async fn find_many(&self, user: AuthUser, ids: &[Uuid]) -> Result<Vec<Todo>, ApiError> {
+        // SQLite has no arrays, so the IDs travel as one JSON array
+        let ids = serde_json::to_string(ids)
+            .map_err(|e| ApiError::InternalServerError(format!("Failed to encode ids: {}", e)))?;
+
+        let rows = sqlx::query_as::<_, TodoRow>(&format!(
+            "SELECT {} FROM {} WHERE id IN (SELECT value FROM json_each(?2))",
+            TODO_COLUMNS,
+            accessible_todos(1)
+        ))
+        .bind(hyphenated(user.user_id))
+        .bind(ids)
+        .fetch_all(&self.pool)
+        .await?;
+
+        rows.into_iter().map(Todo::try_from).collect()
+    }
+
+    async fn has_subtasks(&self, id: Uuid) -> Result<bool, ApiError> {
+        let exists = sqlx::query_scalar("SELECT EXISTS (SELECT 1 FROM todos WHERE parent_id = ?1)")
+            .bind(id.hyphenated())
+            .fetch_one(&self.pool)
+            .await?;
+        Ok(exists)
+    }
+
+    async fn is_ancestor(&self, ancestor: Uuid, id: Uuid) -> Result<bool, ApiError> {
+        let found = sqlx::query_scalar(
+            "WITH RECURSIVE ancestors AS (
+                 SELECT id, parent_id FROM todos WHERE id = ?1
+                 UNION
+                 SELECT t.id, t.parent_id FROM todos t JOIN ancestors a ON t.id = a.parent_id
+             )
+             SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = ?2)"
+        )
+        .bind(id.hyphenated())
+        .bind(ancestor.hyphenated())
+        .fetch_one(&self.pool)
+        .await?;
+        Ok(found)
+    }
+
+    async fn open_titled(&self, user_id: Option<Uuid>, title: &str) -> Result<Option<Uuid>, ApiError> {
+        // Same expression as idx_todos_open_title, so it finds the row the index clashed with
+        let id: Option<Hyphenated> = sqlx::query_scalar(
+            "SELECT id FROM todos
+             WHERE COALESCE(user_id, '') = COALESCE(?1, '')
+               AND lower(trim(title)) = lower(trim(?2))
+               AND NOT completed
+             LIMIT 1",
+        )
+        .bind(hyphenated(user_id))
+        .bind(title)
+        .fetch_optional(&self.pool)
+        .await?;
+        Ok(id.map(Hyphenated::into_uuid))
+    }
+
+    async fn create(
+        &self,
+        user: AuthUser,
+        new: NewTodo,
+        idempotency: Option<IdempotencyKey>,
+    ) -> Result<Todo, ApiError> {
+        let id = Uuid::new_v4();
+        let now = Utc::now();
+        let mut tx = self.pool.begin().await?;
+
+        let result = async {
+            let inserted = sqlx::query_as::<_, TodoRow>(&format!(
+                "INSERT INTO todos (id, title, description, completed, tags, user_id, list_id, parent_id,
+                     due_date, recurrence, recurrence_interval, remind_at, position, created_at, updated_at,
+                     created_by, updated_by, strict_title)
+                 VALUES (?1, ?2, ?3, 0, ?4, ?5, ?6, ?7, ?8, ?9, ?12, ?13, {}, ?10, ?10, ?11, ?11, ?14)
+                 RETURNING {}",
+                NEXT_POSITION,
+                TODO_COLUMNS
+            ))
+            .bind(id.hyphenated())
+            .bind(&new.title)
+            .bind(&new.description)
+            .bind(encode_tags(&new.tags))
+            .bind(hyphenated(user.user_id))
+            .bind(hyphenated(new.list_id))
+            .bind(hyphenated(new.parent_id))
+            .bind(new.due_date)
+            .bind(new.recurrence.as_str())
+            .bind(now)
+            .bind(hyphenated(new.actor.0))
+            .bind(new.recurrence_interval)
+            .bind(new.remind_at)
+            .bind(new.unique_title)
+            .fetch_one(&mut *tx)
+            .await;
+            let todo: Todo = match inserted {
+                Ok(row) => row.try_into()?,
+                Err(err) if is_strict_title_clash(&err) => {
+                    return Err(strict_title_clash(&mut tx, user.user_id, &new.title, id).await)
+                }
+                Err(err) => return Err(err.into()),
+            };
+            if new.unique_title {
+                check_title_free(&mut tx, user.user_id, &new.title, id).await?;
+            }
+            record_event(&mut tx, HistoryAction::Created, &todo, new.actor.0).await?;
+
+            if let Some(idempotency) = idempotency {
+                let response = serde_json::to_value(TodoResponse::from(todo.clone()))
+                    .map_err(|e| ApiError::InternalServerError(format!("Failed to encode response: {}", e)))?;
+
+                sqlx::query(
+                    "INSERT INTO idempotency_keys (key, user_id, request_body, todo_id, response_body, created_at)
+                     VALUES (?1, ?2, ?3, ?4, ?5, ?6)"
+                )
+                .bind(&idempotency.key)
+                .bind(hyphenated(user.user_id))
+                .bind(encode_json(&idempotency.request)?)
+                .bind(id.hyphenated())
+                .bind(encode_json(&response)?)
+                .bind(now)
+                .execute(&mut *tx)
+                .await
+                .map_err(|e| {
+                    conflict_on_duplicate(e, || {
+                        "A request with this Idempotency-Key is already being processed".to_string()
+                    })
+                })?;
+            }
+
+            Ok::<_, ApiError>(todo)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn idempotent_response(
+        &self,
+        user: AuthUser,
+        key: &str,
+        request: &Value,
+        ttl_secs: i64,
+    ) -> Result<Option<StoredResponse>, ApiError> {
+        // Every expired key goes, not just this one, so keys nobody repeats do
+        // not pile up; an expired key may be reused for a new request
+        sqlx::query("DELETE FROM idempotency_keys WHERE created_at < ?1")
+            .bind(Utc::now() - Duration::seconds(ttl_secs))
+            .execute(&self.pool)
+            .await?;
+
+        let stored: Option<(String, String)> = sqlx::query_as(
+            "SELECT request_body, response_body FROM idempotency_keys WHERE key = ?1 AND user_id IS ?2"
+        )
+        .bind(key)
+        .bind(hyphenated(user.user_id))
+        .fetch_optional(&self.pool)
+        .await?;
+
+        let Some((stored_request, response)) = stored else {
+            return Ok(None);
+        };
+        let stored_request: Value = serde_json::from_str(&stored_request)
+            .map_err(|e| ApiError::InternalServerError(format!("Invalid stored request: {}", e)))?;
+        let response = serde_json::from_str(&response)
+            .map_err(|e| ApiError::InternalServerError(format!("Invalid stored response: {}", e)))?;
+
+        Ok(Some(StoredResponse { same_request: &stored_request == request, response }))
+    }
+
+    async fn update(&self, existing: &Todo, changes: TodoChanges) -> Result<Updated, ApiError> {
+        let mut tx = self.pool.begin().await?;
+        let result = apply_update(&mut tx, existing, &changes, Utc::now()).await;
+        db::finish(tx, result).await
+    }
+
+    async fn update_many(&self, updates: Vec<(Todo, TodoChanges)>) -> Result<Vec<Updated>, ApiError> {
+        let now = Utc::now();
+        let mut tx = self.pool.begin().await?;
+
+        let result = async {
+            let mut updated = Vec::with_capacity(updates.len());
+            for (existing, changes) in &updates {
+                updated.push(apply_update(&mut tx, existing, changes, now).await?);
+            }
+            Ok::<_, ApiError>(updated)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn set_completed(
+        &self,
+        existing: &Todo,
+        completed: bool,
+        actor: Actor,
+    ) -> Result<Updated, ApiError> {
+        let now = Utc::now();
+        let mut tx = self.pool.begin().await?;
+
+        let result = async {
+            // Only a row that actually flips is changed, so two requests
+            // completing the same todo create a single next occurrence
+            let flipped = sqlx::query_as::<_, TodoRow>(&format!(
+                "UPDATE todos SET completed = ?1, completed_at = CASE WHEN ?1 THEN COALESCE(completed_at, ?2) END,
+                     updated_at = ?2, updated_by = ?4, version = version + 1, strict_title = 0
+                 WHERE id = ?3 AND completed IS NOT ?1
+                 RETURNING {}",
+                TODO_COLUMNS
+            ))
+            .bind(completed)
+            .bind(now)
+            .bind(existing.id.hyphenated())
+            .bind(hyphenated(actor.0))
+            .fetch_optional(&mut *tx)
+            .await?;
+            let Some(row) = flipped else {
+                // Already in that state: leave it as it is
+                let todo: Todo =
+                    sqlx::query_as::<_, TodoRow>(&format!("SELECT {} FROM todos WHERE id = ?1", TODO_COLUMNS))
+                        .bind(existing.id.hyphenated())
+                        .fetch_optional(&mut *tx)
+                        .await?
+                        .ok_or_else(|| todo_not_found(existing.id))?
+                        .try_into()?;
+                return Ok(Updated { todo, next_occurrence: None });
+            };
+            let todo = Todo::try_from(row)?;
+            record_event(&mut tx, HistoryAction::Updated, &todo, actor.0).await?;
+
+            let next_occurrence = if completed {
+                create_next_occurrence(&mut tx, &todo, now).await?
+            } else {
+                None
+            };
+
+            Ok::<_, ApiError>(Updated { todo, next_occurrence })
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn set_archived(
+        &self,
+        existing: &Todo,
+        archived: bool,
+        actor: Actor,
+    ) -> Result<Todo, ApiError> {
+        let mut tx = self.pool.begin().await?;
+
+        let result = async {
+            let todo: Todo = sqlx::query_as::<_, TodoRow>(&format!(
+                "UPDATE todos SET archived = ?1, updated_at = ?2, updated_by = ?4, version = version + 1
+                 WHERE id = ?3
+                 RETURNING {}",
+                TODO_COLUMNS
+            ))
+            .bind(archived)
+            .bind(Utc::now())
+            .bind(existing.id.hyphenated())
+            .bind(hyphenated(actor.0))
+            .fetch_optional(&mut *tx)
+            .await?
+            .ok_or_else(|| todo_not_found(existing.id))?
+            .try_into()?;
+            record_event(&mut tx, HistoryAction::Updated, &todo, actor.0).await?;
+
+            Ok::<_, ApiError>(todo)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn reorder(&self, user: AuthUser, ids: &[Uuid], actor: Actor) -> Result<(), ApiError> {
+        let mut tx = self.pool.begin().await?;
+        let result = async {
+            let owned: Vec<(Hyphenated, i64)> = sqlx::query_as(
+                "SELECT id, position FROM todos WHERE user_id IS ?1 ORDER BY position"
+            )
+            .bind(hyphenated(user.user_id))
+            .fetch_all(&mut *tx)
+            .await?;
+            let owned_ids: Vec<Uuid> = owned.iter().map(|(id, _)| id.into_uuid()).collect();
+            check_reorder(&owned_ids, ids)?;
+
+            // Hand the caller's existing positions out in the requested order so
+            // their todos keep their place relative to everyone else's. Moved
+            // todos count as changed, so syncing clients and If-Match see it.
+            let now = Utc::now();
+            for (id, (_, position)) in ids.iter().zip(&owned) {
+                let moved = sqlx::query_as::<_, TodoRow>(&format!(
+                    "UPDATE todos SET position = ?1, updated_at = ?3, updated_by = ?4, version = version + 1
+                     WHERE id = ?2 AND position <> ?1
+                     RETURNING {}",
+                    TODO_COLUMNS
+                ))
+                .bind(position)
+                .bind(id.hyphenated())
+                .bind(now)
+                .bind(hyphenated(actor.0))
+                .fetch_optional(&mut *tx)
+                .await?;
+                if let Some(row) = moved {
+                    let todo: Todo = row.try_into()?;
+                    record_event(&mut tx, HistoryAction::Reordered, &todo, actor.0).await?;
+                }
+            }
+
+            Ok::<_, ApiError>(())
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn delete(
+        &self,
+        user: AuthUser,
+        id: Uuid,
+        actor: Actor,
+        undo: &UndoToken,
+    ) -> Result<Option<Todo>, ApiError> {
+        let mut tx = self.pool.begin().await?;
+
+        let result = async {
+            // Subtasks go with their parent through ON DELETE CASCADE; keep them
+            // too so undoing brings the whole tree back
+            let descendants = sqlx::query_as::<_, TodoRow>(&format!(
+                "WITH RECURSIVE subtree AS (
+                     SELECT id FROM todos WHERE parent_id = ?1
+                     UNION ALL
+                     SELECT t.id FROM todos t JOIN subtree s ON t.parent_id = s.id
+                 )
+                 SELECT {} FROM todos WHERE id IN (SELECT id FROM subtree)",
+                TODO_COLUMNS
+            ))
+            .bind(id.hyphenated())
+            .fetch_all(&mut *tx)
+            .await?
+            .into_iter()
+            .map(Todo::try_from)
+            .collect::<Result<Vec<_>, _>>()?;
+
+            let deleted = sqlx::query_as::<_, TodoRow>(&format!(
+                "DELETE FROM todos WHERE id = ?1 RETURNING {}",
+                TODO_COLUMNS
+            ))
+            .bind(id.hyphenated())
+            .fetch_optional(&mut *tx)
+            .await?
+            .map(Todo::try_from)
+            .transpose()?;
+            let Some(todo) = deleted else {
+                return Ok(None);
+            };
+            // Every removed row gets its own event, so /api/todos/changes reports
+            // the subtasks gone too
+            record_event(&mut tx, HistoryAction::Deleted, &todo, actor.0).await?;
+            for descendant in &descendants {
+                record_event(&mut tx, HistoryAction::Deleted, descendant, actor.0).await?;
+            }
+
+            sqlx::query(
+                "INSERT INTO pending_deletes (token, user_id, todos, expires_at)
+                 VALUES (?1, ?2, ?3, ?4)",
+            )
+            .bind(&undo.token)
+            .bind(hyphenated(user.user_id))
+            .bind(encode_json(&encode_deleted(&parents_first(todo.clone(), descendants))?)?)
+            .bind(undo.expires_at)
+            .execute(&mut *tx)
+            .await?;
+
+            Ok::<_, ApiError>(Some(todo))
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn restore(
+        &self,
+        user: AuthUser,
+        token: &str,
+        actor: Actor,
+        now: DateTime<Utc>,
+    ) -> Result<Vec<Todo>, ApiError> {
+        let mut tx = self.pool.begin().await?;
+
+        let result = async {
+            // Any failure below rolls this back, so the token stays usable
+            let pending: Option<(Option<Hyphenated>, String, DateTime<Utc>)> = sqlx::query_as(
+                "DELETE FROM pending_deletes WHERE token = ?1 RETURNING user_id, todos, expires_at",
+            )
+            .bind(token)
+            .fetch_optional(&mut *tx)
+            .await?;
+            let Some((_, todos, expires_at)) =
+                pending.filter(|(owner, ..)| owner.map(Hyphenated::into_uuid) == user.user_id)
+            else {
+                return Err(undo_not_found());
+            };
+            if expires_at <= now {
+                return Err(undo_expired());
+            }
+
+            let todos: Value = serde_json::from_str(&todos)
+                .map_err(|e| ApiError::InternalServerError(format!("Invalid deleted todos stored: {}", e)))?;
+            let todos = decode_deleted(todos)?;
+            for todo in &todos {
+                sqlx::query(&format!(
+                    "INSERT INTO todos ({})
+                     VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15, ?16, ?17,
+                         ?18, ?19, ?20, ?21, ?22)",
+                    TODO_COLUMNS
+                ))
+                .bind(todo.id.hyphenated())
+                .bind(&todo.title)
+                .bind(&todo.description)
+                .bind(todo.completed)
+                .bind(todo.archived)
+                .bind(todo.position)
+                .bind(todo.version)
+                .bind(encode_tags(&todo.tags))
+                .bind(hyphenated(todo.user_id))
+                .bind(hyphenated(todo.list_id))
+                .bind(hyphenated(todo.parent_id))
+                .bind(todo.due_date)
+                .bind(&todo.recurrence)
+                .bind(todo.recurrence_interval)
+                .bind(todo.completed_at)
+                .bind(todo.remind_at)
+                .bind(todo.reminded_at)
+                .bind(todo.created_at)
+                .bind(todo.updated_at)
+                .bind(hyphenated(todo.created_by))
+                .bind(hyphenated(todo.updated_by))
+                .bind(todo.recurrence_day)
+                .execute(&mut *tx)
+                .await
+                .map_err(restore_error(todo))?;
+                record_event(&mut tx, HistoryAction::Restored, todo, actor.0).await?;
+            }
+
+            Ok::<_, ApiError>(todos)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn purge_expired_deletes(&self, now: DateTime<Utc>) -> Result<u64, ApiError> {
+        let purged = sqlx::query("DELETE FROM pending_deletes WHERE expires_at <= ?1")
+            .bind(now)
+            .execute(&self.pool)
+            .await?
+            .rows_affected();
+        Ok(purged)
+    }
+
+    async fn purge_archived(&self, before: DateTime<Utc>, limit: i64) -> Result<u64, ApiError> {
+        let mut tx = self.pool.begin().await?;
+        let result = async {
+            let purged = sqlx::query_as::<_, TodoRow>(&format!(
+                "DELETE FROM todos
+                 WHERE id IN (
+                     SELECT id FROM todos p
+                     WHERE p.archived = 1 AND p.updated_at < ?1
+                       AND NOT EXISTS (SELECT 1 FROM todos c WHERE c.parent_id = p.id)
+                     LIMIT ?2
+                 )
+                 RETURNING {}",
+                TODO_COLUMNS
+            ))
+            .bind(before)
+            .bind(limit)
+            .fetch_all(&mut *tx)
+            .await?
+            .into_iter()
+            .map(Todo::try_from)
+            .collect::<Result<Vec<_>, _>>()?;
+            // Nobody asked for the purge, so the events have no actor
+            for todo in &purged {
+                record_event(&mut tx, HistoryAction::Deleted, todo, None).await?;
+            }
+
+            Ok::<_, ApiError>(purged.len() as u64)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn delete_all(&self) -> Result<u64, ApiError> {
+        let mut tx = self.pool.begin().await?;
+        let result = async {
+            sqlx::query("DELETE FROM pending_deletes").execute(&mut *tx).await?;
+            let deleted = sqlx::query_as::<_, TodoRow>(&format!("DELETE FROM todos RETURNING {}", TODO_COLUMNS))
+                .fetch_all(&mut *tx)
+                .await?
+                .into_iter()
+                .map(Todo::try_from)
+                .collect::<Result<Vec<_>, _>>()?;
+            for todo in &deleted {
+                record_event(&mut tx, HistoryAction::Deleted, todo, None).await?;
+            }
+            Ok::<_, ApiError>(deleted.len() as u64)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn changes(&self, user: AuthUser, since: DateTime<Utc>) -> Result<Changes, ApiError> {
+        // Restoring keeps the original updated_at, so restores are found
+        // through the history instead
+        let rows = sqlx::query_as::<_, TodoRow>(&format!(
+            "SELECT {} FROM {}
+             WHERE updated_at > ?2
+                OR id IN (SELECT todo_id FROM todo_events WHERE event = 'restored' AND created_at > ?2)
+             ORDER BY updated_at, id",
+            TODO_COLUMNS,
+            accessible_todos(1)
+        ))
+        .bind(hyphenated(user.user_id))
+        .bind(since)
+        .fetch_all(&self.pool)
+        .await?;
+        let todos = rows.into_iter().map(Todo::try_from).collect::<Result<_, _>>()?;
+
+        let deleted: Vec<(Hyphenated, DateTime<Utc>)> = sqlx::query_as(
+            "SELECT e.todo_id, max(e.created_at) AS deleted_at
+             FROM todo_events e
+             WHERE e.event = 'deleted' AND e.created_at > ?2
+               AND (e.user_id IS ?1
+                    OR json_extract(e.snapshot, '$.list_id') IN
+                       (SELECT list_id FROM list_members WHERE user_id = ?1))
+               AND NOT EXISTS (SELECT 1 FROM todos t WHERE t.id = e.todo_id)
+             GROUP BY e.todo_id
+             ORDER BY deleted_at, e.todo_id",
+        )
+        .bind(hyphenated(user.user_id))
+        .bind(since)
+        .fetch_all(&self.pool)
+        .await?;
+        let deleted = deleted
+            .into_iter()
+            .map(|(id, deleted_at)| Tombstone { id: id.into_uuid(), deleted_at })
+            .collect();
+
+        Ok(Changes { todos, deleted })
+    }
+
+    async fn history(
+        &self,
+        id: Uuid,
+        after: Option<i64>,
+        limit: i64,
+    ) -> Result<Vec<HistoryEvent>, ApiError> {
+        let rows = sqlx::query_as::<_, HistoryRow>(
+            "SELECT id, todo_id, user_id, event, actor_id, snapshot, created_at
+             FROM todo_events
+             WHERE todo_id = ?1 AND (?2 IS NULL OR id < ?2)
+             ORDER BY id DESC
+             LIMIT ?3",
+        )
+        .bind(id.hyphenated())
+        .bind(after)
+        .bind(limit)
+        .fetch_all(&self.pool)
+        .await?;
+        rows.into_iter().map(HistoryEvent::try_from).collect()
+    }
+
+    async fn import(
+        &self,
+        user: AuthUser,
+        actor: Actor,
+        rows: &[ImportRow],
+        mode: ImportMode,
+    ) -> Result<ImportOutcome, ApiError> {
+        let now = Utc::now();
+        let mut tx = self.pool.begin().await?;
+        let result = async {
+            let mut outcome = ImportOutcome::default();
+            let mut seen = HashSet::new();
+
+            for batch in rows.chunks(IMPORT_BATCH_ROWS) {
+                let ids: Vec<Uuid> = batch.iter().map(|row| row.id).collect();
+                let ids = serde_json::to_string(&ids)
+                    .map_err(|e| ApiError::InternalServerError(format!("Failed to encode ids: {}", e)))?;
+                let existing: HashMap<Uuid, Option<Uuid>> = sqlx::query_as::<_, (Hyphenated, Option<Hyphenated>)>(
+                    "SELECT id, user_id FROM todos WHERE id IN (SELECT value FROM json_each(?1))"
+                )
+                .bind(ids)
+                .fetch_all(&mut *tx)
+                .await?
+                .into_iter()
+                .map(|(id, owner)| (id.into_uuid(), owner.map(Hyphenated::into_uuid)))
+                .collect();
+                let plan = plan_import(user, mode, batch, &existing, &mut seen, &mut outcome)?;
+
+                // Statements are cheap inside a local transaction, so rows are
+                // written one at a time
+                for row in &plan.insert {
+                    let todo = &row.todo;
+                    let created_at = todo.created_at.unwrap_or(now);
+
+                    let inserted: Todo = sqlx::query_as::<_, TodoRow>(&format!(
+                        "INSERT INTO todos (id, title, description, completed, tags, user_id, position,
+                             created_at, updated_at, completed_at, created_by, updated_by)
+                         VALUES (?1, ?2, ?3, ?4, ?5, ?6, {}, ?7, ?8, CASE WHEN ?4 THEN ?8 END, ?9, ?9)
+                         RETURNING {}",
+                        NEXT_POSITION,
+                        TODO_COLUMNS
+                    ))
+                    .bind(row.id.hyphenated())
+                    .bind(&todo.title)
+                    .bind(&todo.description)
+                    .bind(todo.completed.unwrap_or(false))
+                    .bind(encode_tags(todo.tags.as_deref().unwrap_or_default()))
+                    .bind(hyphenated(user.user_id))
+                    .bind(created_at)
+                    .bind(todo.updated_at.unwrap_or(created_at))
+                    .bind(hyphenated(actor.0))
+                    .fetch_one(&mut *tx)
+                    .await?
+                    .try_into()?;
+                    record_event(&mut tx, HistoryAction::Created, &inserted, actor.0).await?;
+                    outcome.imported += 1;
+                }
+
+                for row in &plan.overwrite {
+                    let todo = &row.todo;
+                    let overwritten: Todo = sqlx::query_as::<_, TodoRow>(&format!(
+                        "UPDATE todos
+                         SET title = ?2, description = ?3, completed = ?4, tags = ?5,
+                             created_at = COALESCE(?6, created_at), updated_at = COALESCE(?7, ?8),
+                             completed_at = CASE WHEN ?4 THEN COALESCE(completed_at, ?7, ?8) END,
+                             updated_by = ?9, version = version + 1, strict_title = 0
+                         WHERE id = ?1
+                         RETURNING {}",
+                        TODO_COLUMNS
+                    ))
+                    .bind(row.id.hyphenated())
+                    .bind(&todo.title)
+                    .bind(&todo.description)
+                    .bind(todo.completed.unwrap_or(false))
+                    .bind(encode_tags(todo.tags.as_deref().unwrap_or_default()))
+                    .bind(todo.created_at)
+                    .bind(todo.updated_at)
+                    .bind(now)
+                    .bind(hyphenated(actor.0))
+                    .fetch_one(&mut *tx)
+                    .await?
+                    .try_into()?;
+                    record_event(&mut tx, HistoryAction::Updated, &overwritten, actor.0).await?;
+                    outcome.imported += 1;
+                }
+            }
+
+            Ok::<_, ApiError>(outcome)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+
+    async fn seed(&self, rows: &[ImportRow]) -> Result<usize, ApiError> {
+        let now = Utc::now();
+        let mut tx = self.pool.begin().await?;
+        let result = async {
+            let mut inserted = 0;
+
+            for row in rows {
+                let todo = &row.todo;
+                let created_at = todo.created_at.unwrap_or(now);
+
+                let seeded = sqlx::query_as::<_, TodoRow>(&format!(
+                    "INSERT INTO todos (id, title, description, completed, tags, position, created_at,
+                         updated_at, completed_at)
+                     VALUES (?1, ?2, ?3, ?4, ?5, {}, ?6, ?7, CASE WHEN ?4 THEN ?7 END)
+                     ON CONFLICT DO NOTHING
+                     RETURNING {}",
+                    NEXT_POSITION,
+                    TODO_COLUMNS
+                ))
+                .bind(row.id.hyphenated())
+                .bind(&todo.title)
+                .bind(&todo.description)
+                .bind(todo.completed.unwrap_or(false))
+                .bind(encode_tags(todo.tags.as_deref().unwrap_or_default()))
+                .bind(created_at)
+                .bind(todo.updated_at.unwrap_or(created_at))
+                .fetch_optional(&mut *tx)
+                .await?;
+                if let Some(row) = seeded {
+                    record_event(&mut tx, HistoryAction::Created, &Todo::try_from(row)?, None).await?;
+                    inserted += 1;
+                }
+            }
+
+            Ok::<_, ApiError>(inserted)
+        }
+        .await;
+        db::finish(tx, result).await
+    }
+}
@@ -0,0 +1,109 @@
+use async_trait::async_trait;
+use chrono::Utc;
+use uuid::Uuid;
+
+use crate::auth::AuthUser;
+use crate::error::ApiError;
+use crate::models::{Webhook, WebhookEvent};
+use crate::repository::WebhookRepository;
+use super::{encode_tags, hyphenated, SqliteRepository, WebhookRow};
+
+/// Columns selected for every `Webhook` row
+const WEBHOOK_COLUMNS: &str = "id, user_id, url, secret, events, created_at";
+
+#[async_trait]
+impl WebhookRepository for SqliteRepository {
+    async fn list(&self, user: AuthUser) -> Result<Vec<Webhook>, ApiError> {
+        let rows = sqlx::query_as::<_, WebhookRow>(&format!(
+            "SELECT {} FROM webhooks WHERE user_id IS ?1 ORDER BY created_at, id",
+            WEBHOOK_COLUMNS
+        ))
+        .bind(hyphenated(user.user_id))
+        .fetch_all(&self.pool)
+        .await?;
+
+        rows.into_iter().map(Webhook::try_from).collect()
+    }
+
+    async fn find(&self, user: AuthUser, id: Uuid) -> Result<Option<Webhook>, ApiError> {
+        let row = sqlx::query_as::<_, WebhookRow>(&format!(
+            "SELECT {} FROM webhooks WHERE id = ?1 AND user_id IS ?2",
+            WEBHOOK_COLUMNS
+        ))
+        .bind(id.hyphenated())
+        .bind(hyphenated(user.user_id))
+        .fetch_optional(&self.pool)
+        .await?;
+
+        row.map(Webhook::try_from).transpose()
+    }
+
+    async fn create(
+        &self,
+        user: AuthUser,
+        url: &str,
+        secret: &str,
+        events: &[String],
+    ) -> Result<Webhook, ApiError> {
+        let row = sqlx::query_as::<_, WebhookRow>(&format!(
+            "INSERT INTO webhooks (id, user_id, url, secret, events, created_at)
+             VALUES (?1, ?2, ?3, ?4, ?5, ?6)
+             RETURNING {}",
+            WEBHOOK_COLUMNS
+        ))
+        .bind(Uuid::new_v4().hyphenated())
+        .bind(hyphenated(user.user_id))
+        .bind(url)
+        .bind(secret)
+        // Events are stored as a JSON array of strings, like tags
+        .bind(encode_tags(events))
+        .bind(Utc::now())
+        .fetch_one(&self.pool)
+        .await?;
+
+        row.try_into()
+    }
+
+    async fn update(&self, webhook: &Webhook) -> Result<bool, ApiError> {
+        let result = sqlx::query(
+            "UPDATE webhooks SET url = ?2, secret = ?3, events = ?4 WHERE id = ?1"
+        )
+        .bind(webhook.id.hyphenated())
+        .bind(&webhook.url)
+        .bind(&webhook.secret)
+        .bind(encode_tags(&webhook.events))
+        .execute(&self.pool)
+        .await?;
+
+        Ok(result.rows_affected() > 0)
+    }
+
+    async fn delete(&self, user: AuthUser, id: Uuid) -> Result<bool, ApiError> {
+        let result = sqlx::query("DELETE FROM webhooks WHERE id = ?1 AND user_id IS ?2")
+            .bind(id.hyphenated())
+            .bind(hyphenated(user.user_id))
+            .execute(&self.pool)
+            .await?;
+
+        Ok(result.rows_affected() > 0)
+    }
+
+    async fn subscribed(
+        &self,
+        user_id: Option<Uuid>,
+        event: WebhookEvent,
+    ) -> Result<Vec<Webhook>, ApiError> {
+        let rows = sqlx::query_as::<_, WebhookRow>(&format!(
+            "SELECT {} FROM webhooks
+             WHERE user_id IS ?1 AND EXISTS (SELECT 1 FROM json_each(webhooks.events) WHERE value = ?2)
+             ORDER BY created_at, id",
+            WEBHOOK_COLUMNS
+        ))
+        .bind(hyphenated(user_id))
+        .bind(event.as_str())
+        .fetch_all(&self.pool)
+        .await?;
+
+        rows.into_iter().map(Webhook::try_from).collect()
+    }
+}
@@ -0,0 +1,70 @@
+use actix_web::dev::{AppService, HttpServiceFactory};
+use actix_web::http::header::{HeaderValue, ALLOW};
+use actix_web::http::Method;
+use actix_web::{web, FromRequest, Handler, HttpRequest, HttpResponse, Resource, ResponseError, Responder};
+use std::future::ready;
+
+use crate::error::ApiError;
+
+/// One path and the methods routed on it. Unlike separate `.route()` calls,
+/// the path is matched once, so a method with no handler is answered with
+/// 405 Method Not Allowed rather than falling through to 404, and OPTIONS
+/// answers with the methods that do have one. Both carry an Allow header.
+pub struct Endpoint {
+    resource: Resource,
+    methods: Vec<Method>,
+}
+
+pub fn endpoint(path: &str) -> Endpoint {
+    Endpoint { resource: web::resource(path), methods: Vec::new() }
+}
+
+impl Endpoint {
+    /// Handle `method` on this path with `handler`
+    pub fn on<F, Args>(mut self, method: Method, handler: F) -> Self
+    where
+        F: Handler<Args>,
+        Args: FromRequest + 'static,
+        F::Output: Responder + 'static,
+    {
+        self.resource = self.resource.route(web::to(handler).method(method.clone()));
+        self.methods.push(method);
+        self
+    }
+
+    /// The finished resource, for wrapping in middleware of its own
+    pub fn build(self) -> Resource {
+        let mut methods: Vec<&str> = self.methods.iter().map(Method::as_str).collect();
+        methods.push(Method::OPTIONS.as_str());
+        let allowed = methods.join(", ");
+        // Method names are tokens, so they are always a valid header value
+        let allow = HeaderValue::from_str(&allowed).expect("method names form a valid Allow header");
+
+        let options_allow = allow.clone();
+        self.resource
+            .route(web::route().method(Method::OPTIONS).to(move || {
+                ready(HttpResponse::NoContent().insert_header((ALLOW, options_allow.clone())).finish())
+            }))
+            .default_service(web::to(move |req: HttpRequest| {
+                ready(method_not_allowed(&req, &allowed, allow.clone()))
+            }))
+    }
+}
+
+impl HttpServiceFactory for Endpoint {
+    fn register(self, config: &mut AppService) {
+        self.build().register(config)
+    }
+}
+
+fn method_not_allowed(req: &HttpRequest, allowed: &str, allow: HeaderValue) -> HttpResponse {
+    let error = ApiError::MethodNotAllowed(format!(
+        "{} is not supported on {}; allowed methods are {}",
+        req.method(),
+        req.path(),
+        allowed
+    ));
+    let mut response = error.error_response();
+    response.headers_mut().insert(ALLOW, allow);
+    response
+}
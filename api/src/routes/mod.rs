@@ -1,13 +1,121 @@
+mod endpoint;
+
 use actix_web::web;
+use actix_web::http::Method;
+use actix_web::middleware::from_fn;
 use crate::handlers;
+use crate::handlers::docs::Docs;
+use crate::middleware;
+
+use endpoint::endpoint;
+
+pub fn configure_routes(cfg: &mut web::ServiceConfig, docs: Docs) {
+    cfg.service(endpoint("/health").on(Method::GET, handlers::health));
+    cfg.service(endpoint("/health/db").on(Method::GET, handlers::database_health));
+    cfg.service(endpoint("/openapi.json").on(Method::GET, handlers::openapi_spec));
+    // Registered ahead of the /api scope so the spec stays public
+    cfg.service(endpoint("/api/openapi.json").on(Method::GET, handlers::openapi_spec));
+    if docs.0 {
+        cfg.service(endpoint("/docs").on(Method::GET, handlers::swagger_ui));
+    }
 
-pub fn configure_routes(cfg: &mut web::ServiceConfig) {
     cfg.service(
-        web::scope("/api/todos")
-            .route("", web::get().to(handlers::list_todos))
-            .route("", web::post().to(handlers::create_todo))
-            .route("/{id}", web::get().to(handlers::get_todo))
-            .route("/{id}", web::put().to(handlers::update_todo))
-            .route("/{id}", web::delete().to(handlers::delete_todo))
+        web::scope("/api")
+            .wrap(from_fn(middleware::limit_concurrency))
+            .wrap(from_fn(middleware::require_api_key))
+            .wrap(from_fn(middleware::rate_limit))
+            .service(
+                web::scope("/auth")
+                    .service(endpoint("/register").on(Method::POST, handlers::register))
+                    .service(endpoint("/login").on(Method::POST, handlers::login))
+            )
+            .service(
+                web::scope("/todos")
+                    .wrap(from_fn(middleware::authenticate_jwt))
+                    .service(
+                        endpoint("")
+                            .on(Method::GET, handlers::list_todos)
+                            .on(Method::HEAD, handlers::count_todos)
+                            .on(Method::POST, handlers::create_todo)
+                    )
+                    .service(endpoint("/export").on(Method::GET, handlers::export_todos))
+                    .service(endpoint("/board").on(Method::GET, handlers::todo_board))
+                    .service(endpoint("/changes").on(Method::GET, handlers::todo_changes))
+                    .service(endpoint("/views/{name}").on(Method::GET, handlers::todo_view))
+                    .service(endpoint("/import").on(Method::POST, handlers::import_todos))
+                    .service(endpoint("/exists").on(Method::POST, handlers::todos_exist))
+                    .service(endpoint("/batch-get").on(Method::POST, handlers::batch_get_todos))
+                    .service(endpoint("/batch").on(Method::PATCH, handlers::batch_update_todos))
+                    .service(
+                        endpoint("/all")
+                            .on(Method::DELETE, handlers::delete_all_todos)
+                            .build()
+                            .wrap(from_fn(middleware::require_admin_token))
+                    )
+                    .service(endpoint("/search").on(Method::GET, handlers::search_todos))
+                    .service(endpoint("/reorder").on(Method::PUT, handlers::reorder_todos))
+                    .service(endpoint("/undo").on(Method::POST, handlers::undo_delete))
+                    .service(endpoint("/ws").on(Method::GET, handlers::todo_updates))
+                    .service(
+                        endpoint("/{id}")
+                            .on(Method::GET, handlers::get_todo)
+                            .on(Method::PUT, handlers::update_todo)
+                            .on(Method::DELETE, handlers::delete_todo)
+                    )
+                    .service(endpoint("/{id}/title").on(Method::PATCH, handlers::update_todo_title))
+                    .service(endpoint("/{id}/description").on(Method::PATCH, handlers::update_todo_description))
+                    .service(endpoint("/{id}/complete").on(Method::POST, handlers::complete_todo))
+                    .service(endpoint("/{id}/uncomplete").on(Method::POST, handlers::uncomplete_todo))
+                    .service(endpoint("/{id}/archive").on(Method::POST, handlers::archive_todo))
+                    .service(endpoint("/{id}/unarchive").on(Method::POST, handlers::unarchive_todo))
+                    .service(endpoint("/{id}/duplicate").on(Method::POST, handlers::duplicate_todo))
+                    .service(endpoint("/{id}/subtasks").on(Method::GET, handlers::list_subtasks))
+                    .service(endpoint("/{id}/history").on(Method::GET, handlers::todo_history))
+            )
+            .service(
+                web::scope("/lists")
+                    .wrap(from_fn(middleware::authenticate_jwt))
+                    .service(
+                        endpoint("")
+                            .on(Method::GET, handlers::list_lists)
+                            .on(Method::POST, handlers::create_list)
+                    )
+                    .service(endpoint("/{id}/share").on(Method::POST, handlers::share_list))
+                    .service(endpoint("/{id}/members").on(Method::GET, handlers::list_members))
+                    .service(endpoint("/{id}/members/{user_id}").on(Method::DELETE, handlers::revoke_member))
+            )
+            .service(
+                endpoint("/ws")
+                    .on(Method::GET, handlers::todo_updates)
+                    .build()
+                    .wrap(from_fn(middleware::authenticate_jwt))
+            )
+            .service(
+                web::scope("/webhooks")
+                    .wrap(from_fn(middleware::authenticate_jwt))
+                    .service(
+                        endpoint("")
+                            .on(Method::GET, handlers::list_webhooks)
+                            .on(Method::POST, handlers::create_webhook)
+                    )
+                    .service(
+                        endpoint("/{id}")
+                            .on(Method::GET, handlers::get_webhook)
+                            .on(Method::PUT, handlers::update_webhook)
+                            .on(Method::DELETE, handlers::delete_webhook)
+                    )
+            )
+            .service(
+                web::scope("/notifications")
+                    .wrap(from_fn(middleware::authenticate_jwt))
+                    .service(endpoint("").on(Method::GET, handlers::list_notifications))
+            )
+            .service(
+                web::scope("/admin")
+                    .wrap(from_fn(middleware::require_admin_token))
+                    .service(endpoint("/purge").on(Method::POST, handlers::purge_now))
+                    .service(endpoint("/status").on(Method::GET, handlers::admin_status))
+                    .service(endpoint("/loglevel").on(Method::PUT, handlers::set_log_level))
+            )
     );
 }
@@ -0,0 +1,176 @@
+use std::env;
+use std::fs;
+use std::path::{Path, PathBuf};
+use uuid::Uuid;
+
+use crate::handlers::todo::normalize_tags;
+use crate::models::ImportTodo;
+use crate::repository::{ImportRow, TodoRepository};
+
+/// Small demo dataset used by `--seed` when no file is given
+const DEFAULT_DATASET: &str = include_str!("../../seed/todos.json");
+
+/// Where seed todos come from
+#[derive(Debug, Clone)]
+pub enum SeedSource {
+    Default,
+    File(PathBuf),
+}
+
+impl SeedSource {
+    /// `--seed [FILE]` on the command line, or else SEED_FILE. Returns None when
+    /// seeding was not asked for, and an error when the file does not exist.
+    pub fn from_env() -> Result<Option<Self>, String> {
+        let source = Self::requested();
+        if let Some(SeedSource::File(file)) = &source {
+            if !file.is_file() {
+                return Err(format!("seed file {} does not exist", file.display()));
+            }
+        }
+        Ok(source)
+    }
+
+    fn requested() -> Option<Self> {
+        let mut args = env::args().skip(1).peekable();
+        while let Some(arg) = args.next() {
+            if arg == "--seed" || arg == "-seed" {
+                return Some(match args.next_if(|next| !next.starts_with('-')) {
+                    Some(file) => SeedSource::File(PathBuf::from(file)),
+                    None => SeedSource::Default,
+                });
+            }
+            if let Some(file) = arg.strip_prefix("--seed=") {
+                return Some(SeedSource::File(PathBuf::from(file)));
+            }
+        }
+
+        env::var("SEED_FILE")
+            .ok()
+            .filter(|f| !f.trim().is_empty())
+            .map(|f| SeedSource::File(PathBuf::from(f)))
+    }
+
+    pub fn describe(&self) -> String {
+        match self {
+            SeedSource::Default => "the default dataset".to_string(),
+            SeedSource::File(file) => file.display().to_string(),
+        }
+    }
+
+    /// Read and validate the seed todos. Files ending in .yaml or .yml are
+    /// parsed as YAML, anything else as JSON.
+    fn load(&self) -> Result<Vec<ImportRow>, String> {
+        let todos: Vec<ImportTodo> = match self {
+            SeedSource::Default => parse_json(DEFAULT_DATASET)?,
+            SeedSource::File(file) => {
+                let data = fs::read_to_string(file)
+                    .map_err(|e| format!("cannot read seed file {}: {}", file.display(), e))?;
+                if is_yaml(file) {
+                    serde_yaml::from_str(&data).map_err(|e| match e.location() {
+                        Some(at) => format!("invalid YAML at line {}: {}", at.line(), e),
+                        None => format!("invalid YAML: {}", e),
+                    })?
+                } else {
+                    parse_json(&data)?
+                }
+            }
+        };
+
+        todos
+            .into_iter()
+            .enumerate()
+            .map(|(i, mut todo)| {
+                let location = format!("Item {}", i + 1);
+                if todo.title.trim().is_empty() {
+                    return Err(format!("{}: title cannot be empty", location));
+                }
+                todo.tags = Some(normalize_tags(todo.tags.as_deref().unwrap_or_default()));
+                Ok(ImportRow { row: i + 1, location, id: todo.id.unwrap_or_else(Uuid::new_v4), todo })
+            })
+            .collect()
+    }
+}
+
+fn is_yaml(file: &Path) -> bool {
+    matches!(
+        file.extension().and_then(|e| e.to_str()),
+        Some("yaml") | Some("yml")
+    )
+}
+
+fn parse_json(data: &str) -> Result<Vec<ImportTodo>, String> {
+    serde_json::from_str(data).map_err(|e| format!("invalid JSON at line {}: {}", e.line(), e))
+}
+
+/// Load the seed todos into storage. Todos whose id already exists are left
+/// alone, so seeding on every start only adds what is missing. Returns how many
+/// todos were added.
+pub async fn run(todos: &dyn TodoRepository, source: &SeedSource) -> Result<usize, String> {
+    let rows = source.load()?;
+    todos
+        .seed(&rows)
+        .await
+        .map_err(|e| format!("failed to seed todos: {}", e))
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::path::PathBuf;
+    use uuid::Uuid;
+
+    use super::{run, SeedSource};
+    use crate::auth::AuthUser;
+    use crate::repository::{MemoryRepository, TodoFilter, TodoRepository};
+
+    /// A seed file in the temp directory, removed again when dropped
+    struct SeedFile(PathBuf);
+
+    impl SeedFile {
+        fn new(extension: &str, contents: &str) -> Self {
+            let path = std::env::temp_dir().join(format!("seed-{}.{}", Uuid::new_v4(), extension));
+            fs::write(&path, contents).unwrap();
+            SeedFile(path)
+        }
+
+        fn source(&self) -> SeedSource {
+            SeedSource::File(self.0.clone())
+        }
+    }
+
+    impl Drop for SeedFile {
+        fn drop(&mut self) {
+            let _ = fs::remove_file(&self.0);
+        }
+    }
+
+    #[actix_web::test]
+    async fn default_dataset_is_only_added_once() {
+        let repo = MemoryRepository::new();
+        assert_eq!(run(&repo, &SeedSource::Default).await, Ok(4));
+        assert_eq!(run(&repo, &SeedSource::Default).await, Ok(0));
+        assert_eq!(repo.count(AuthUser::default(), &TodoFilter::default()).await.unwrap(), 4);
+    }
+
+    #[actix_web::test]
+    async fn yaml_and_json_files_add_every_row() {
+        let yaml = SeedFile::new("yml", "- title: First\n  tags: [home, ' home ', '']\n- title: Second\n");
+        let json = SeedFile::new("json", r#"[{"title": "Third"}]"#);
+        let repo = MemoryRepository::new();
+
+        let rows = yaml.source().load().unwrap();
+        assert_eq!(rows.len(), 2);
+        assert_eq!(rows[0].todo.tags.as_deref(), Some(&["home".to_string()][..]));
+        assert_eq!(run(&repo, &yaml.source()).await, Ok(2));
+        assert_eq!(run(&repo, &json.source()).await, Ok(1));
+        assert_eq!(repo.count(AuthUser::default(), &TodoFilter::default()).await.unwrap(), 3);
+    }
+
+    #[test]
+    fn invalid_rows_name_their_position() {
+        let file = SeedFile::new("json", r#"[{"title": "Fine"}, {"title": "  "}]"#);
+        assert_eq!(file.source().load().err().as_deref(), Some("Item 2: title cannot be empty"));
+        let file = SeedFile::new("yaml", "- title: [unterminated");
+        assert!(file.source().load().err().unwrap().starts_with("invalid YAML"));
+    }
+}
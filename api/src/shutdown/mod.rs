@@ -0,0 +1,116 @@
+use actix_web::dev::Server;
+use std::env;
+use std::io;
+use std::time::Duration;
+
+use crate::db::parse_duration;
+
+const DEFAULT_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// Seconds actix's workers wait beyond SHUTDOWN_TIMEOUT before dropping
+/// requests themselves
+const WORKER_GRACE_SECS: u64 = 5;
+
+/// Exit code when in-flight requests are abandoned, either because draining
+/// took longer than SHUTDOWN_TIMEOUT or because a second signal arrived
+pub const FORCED_EXIT_CODE: i32 = 3;
+
+/// How long to wait for in-flight requests once a shutdown signal arrives,
+/// configured through SHUTDOWN_TIMEOUT
+#[derive(Debug, Clone, Copy)]
+pub struct ShutdownTimeout(pub Duration);
+
+impl ShutdownTimeout {
+    pub fn from_env() -> Result<Self, String> {
+        match env::var("SHUTDOWN_TIMEOUT").ok().filter(|v| !v.is_empty()) {
+            None => Ok(ShutdownTimeout(DEFAULT_TIMEOUT)),
+            Some(value) => parse_duration(&value).map(ShutdownTimeout).ok_or_else(|| {
+                format!("SHUTDOWN_TIMEOUT must be a duration such as '30', '30s' or '500ms', got '{}'", value)
+            }),
+        }
+    }
+
+    /// Whole seconds for actix's own worker shutdown. They outlast the timeout
+    /// by WORKER_GRACE_SECS so the workers never drop requests on their own:
+    /// only `serve` gives up on them, and it exits with FORCED_EXIT_CODE.
+    pub fn worker_secs(&self) -> u64 {
+        self.0.as_secs() + WORKER_GRACE_SECS
+    }
+}
+
+/// Wait for SIGINT (Ctrl-C) or, on Unix, SIGTERM
+async fn signal() -> &'static str {
+    #[cfg(unix)]
+    {
+        use tokio::signal::unix::{signal, SignalKind};
+        match signal(SignalKind::terminate()) {
+            Ok(mut term) => tokio::select! {
+                _ = tokio::signal::ctrl_c() => "SIGINT",
+                _ = term.recv() => "SIGTERM",
+            },
+            Err(_) => {
+                let _ = tokio::signal::ctrl_c().await;
+                "SIGINT"
+            }
+        }
+    }
+    #[cfg(not(unix))]
+    {
+        let _ = tokio::signal::ctrl_c().await;
+        "SIGINT"
+    }
+}
+
+/// Run `server` until a shutdown signal, then stop accepting connections and
+/// wait up to `timeout` for in-flight requests to finish. Returns once the
+/// server has stopped so the caller can release storage afterwards. If the
+/// requests are still running after `timeout`, or a second signal arrives,
+/// the process exits with FORCED_EXIT_CODE instead of returning.
+///
+/// The server must be built with `disable_signals()` so only this function
+/// reacts to them.
+pub async fn serve(server: Server, timeout: ShutdownTimeout) -> io::Result<()> {
+    let handle = server.handle();
+    let mut running = actix_web::rt::spawn(server);
+
+    let received = tokio::select! {
+        result = &mut running => return result.map_err(|e| io::Error::new(io::ErrorKind::Other, e))?,
+        received = signal() => received,
+    };
+    log::info!(
+        signal = received, timeout_ms = timeout.0.as_millis() as u64;
+        "shutting down; no longer accepting connections, waiting for in-flight requests"
+    );
+
+    tokio::select! {
+        _ = handle.stop(true) => {}
+        _ = tokio::time::sleep(timeout.0) => force_exit("in-flight requests did not finish within SHUTDOWN_TIMEOUT"),
+        received = signal() => {
+            log::warn!(signal = received; "second signal received");
+            force_exit("second signal during shutdown")
+        }
+    }
+
+    log::info!("all requests finished; server stopped");
+    running.await.map_err(|e| io::Error::new(io::ErrorKind::Other, e))?
+}
+
+fn force_exit(reason: &str) -> ! {
+    log::error!(reason = reason, exit_code = FORCED_EXIT_CODE; "forced shutdown; abandoning in-flight requests");
+    log::logger().flush();
+    std::process::exit(FORCED_EXIT_CODE)
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use super::ShutdownTimeout;
+
+    #[test]
+    fn workers_outlast_the_timeout() {
+        for timeout in [Duration::ZERO, Duration::from_millis(500), Duration::from_secs(30)] {
+            assert!(Duration::from_secs(ShutdownTimeout(timeout).worker_secs()) > timeout);
+        }
+    }
+}
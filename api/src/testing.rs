@@ -0,0 +1,172 @@
+//! Helpers shared by the unit tests: the API app wired as `main` wires it, on
+//! top of the in-memory repository, and a way to set environment variables
+//! without tests running in parallel seeing each other's settings.
+
+use actix_web::body::MessageBody;
+use actix_web::dev::{ServiceFactory, ServiceRequest, ServiceResponse};
+use actix_web::http::header::AUTHORIZATION;
+use actix_web::middleware::{from_fn, DefaultHeaders};
+use actix_web::test::TestRequest;
+use actix_web::{web, App};
+use std::env;
+use std::sync::Mutex;
+use uuid::Uuid;
+
+use crate::config::Config;
+use crate::error;
+use crate::events::Broker;
+use crate::handlers::admin::StartedAt;
+use crate::middleware;
+use crate::repository::{MemoryRepository, Repositories};
+use crate::routes;
+use crate::version;
+
+/// Every variable the configuration reads. They are cleared while a test's
+/// own settings are in place, so the environment the tests run in does not
+/// leak into them.
+const CONFIG_VARS: &[&str] = &[
+    "ADDR", "ADMIN_TOKEN", "ALLOW_DESTRUCTIVE", "API_KEY", "API_KEYS", "AUTH_ENABLED", "AUTO_MIGRATE",
+    "CACHE_MAX_ENTRIES", "CACHE_TTL", "CORS_ALLOWED_HEADERS", "CORS_ALLOWED_METHODS", "CORS_ALLOWED_ORIGINS",
+    "CORS_ALLOW_CREDENTIALS", "CORS_MAX_AGE", "DATABASE_URL", "DB_CONNECT_TIMEOUT", "DB_DRIVER", "DB_QUERY_TIMEOUT",
+    "DEFAULT_SORT", "ENABLE_DOCS", "ENABLE_PPROF", "HOST", "IDEMPOTENCY_TTL_SECS", "JWT_EXPIRY_SECS", "JWT_SECRET",
+    "LISTEN_FDS", "LISTEN_PID", "LOG_LEVEL", "MAX_BODY_BYTES", "MAX_CONCURRENT_REQUESTS", "MEMORY_STORE_FILE",
+    "OMIT_NULL_DESCRIPTION", "PORT", "PPROF_PORT", "PURGE_AFTER", "PURGE_INTERVAL", "RATE_LIMIT", "RATE_LIMIT_BURST",
+    "RATE_LIMIT_RPS", "READ_ONLY", "RECURRENCE_TZ", "REMINDER_MAX_ATTEMPTS", "REMINDER_POLL_INTERVAL",
+    "REMINDER_WEBHOOK_URL", "REQUEST_TIMEOUT", "SEED_FILE", "SHUTDOWN_TIMEOUT", "SLOW_QUERY_THRESHOLD", "STORAGE",
+    "STRICT_UNIQUE_TITLES", "SUBTASK_DELETE_POLICY", "TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_REDIRECT_PORT",
+    "TRUSTED_PROXIES", "TRUST_PROXY", "UNDO_WINDOW", "WEBHOOK_ALLOW_PRIVATE", "WEBHOOK_MAX_ATTEMPTS",
+    "WEBHOOK_QUEUE_SIZE", "WEBHOOK_TIMEOUT_SECS", "WS_MAX_CONNECTIONS",
+];
+
+static ENV_LOCK: Mutex<()> = Mutex::new(());
+
+/// Puts back the variables a test changed, even when it panics
+struct RestoreEnv(Vec<(String, Option<String>)>);
+
+impl Drop for RestoreEnv {
+    fn drop(&mut self) {
+        for (name, value) in &self.0 {
+            match value {
+                Some(value) => env::set_var(name, value),
+                None => env::remove_var(name),
+            }
+        }
+    }
+}
+
+/// Run `f` with only `vars` set among the configuration variables
+pub(crate) fn with_env<T>(vars: &[(&str, &str)], f: impl FnOnce() -> T) -> T {
+    let _lock = ENV_LOCK.lock().unwrap_or_else(|e| e.into_inner());
+    let names = CONFIG_VARS.iter().copied().chain(vars.iter().map(|(name, _)| *name));
+    let _restore = RestoreEnv(names.map(|name| (name.to_string(), env::var(name).ok())).collect());
+
+    for name in CONFIG_VARS {
+        env::remove_var(name);
+    }
+    for (name, value) in vars {
+        env::set_var(name, value);
+    }
+    f()
+}
+
+/// The configuration of an in-memory server with `vars` set
+pub(crate) fn config(vars: &[(&str, &str)]) -> Config {
+    let mut vars = vars.to_vec();
+    if !vars.iter().any(|(name, _)| *name == "STORAGE") {
+        vars.push(("STORAGE", "memory"));
+    }
+    with_env(&vars, Config::from_env).unwrap_or_else(|e| panic!("{}", e))
+}
+
+/// Empty in-memory repositories
+pub(crate) fn repositories() -> Repositories {
+    Repositories::new(MemoryRepository::new())
+}
+
+/// The API app serving `repositories` with `config`, with the same state,
+/// middleware and routes as the real server
+pub(crate) fn app(
+    config: Config,
+    repositories: &Repositories,
+) -> App<
+    impl ServiceFactory<
+        ServiceRequest,
+        Config = (),
+        Response = ServiceResponse<impl MessageBody>,
+        Error = actix_web::Error,
+        InitError = (),
+    >,
+> {
+    let body_limit = config.body_limit;
+    let docs = config.docs;
+    let rate_limiter = config.rate_limiter.map(web::Data::new);
+    let concurrency_limit = config.concurrency_limit.map(web::Data::new);
+    let todo_cache = repositories.cache().map(web::Data::from);
+
+    App::new()
+        .app_data(web::Data::from(repositories.todos.clone()))
+        .app_data(web::Data::from(repositories.lists.clone()))
+        .app_data(web::Data::from(repositories.users.clone()))
+        .app_data(web::Data::from(repositories.webhooks.clone()))
+        .app_data(web::Data::new(config.webhooks))
+        .app_data(web::Data::from(repositories.reminders.clone()))
+        .app_data(web::Data::from(repositories.health.clone()))
+        .app_data(web::Data::new(config.api_key_auth))
+        .app_data(web::Data::new(config.jwt_auth))
+        .app_data(web::Data::new(Broker::new()))
+        .app_data(web::Data::new(config.trusted_proxies))
+        .app_data(web::Data::new(config.ws_limit))
+        .app_data(web::Data::new(config.idempotency_ttl))
+        .app_data(web::Data::new(config.subtask_policy))
+        .app_data(web::Data::new(config.default_sort))
+        .app_data(web::Data::new(config.undo_window))
+        .app_data(web::Data::new(config.purge))
+        .app_data(web::Data::new(config.admin_token))
+        .app_data(web::Data::new(StartedAt(chrono::Utc::now())))
+        .app_data(web::Data::new(config.allow_destructive))
+        .app_data(web::Data::new(config.unique_titles))
+        .app_data(body_limit)
+        .app_data(body_limit.json_config())
+        .app_data(body_limit.form_config())
+        .app_data(body_limit.payload_config())
+        .app_data(config.request_timeout)
+        .app_data(config.read_only)
+        .app_data(config.profiling)
+        .app_data(config.docs)
+        .app_data(error::path_config())
+        .app_data(error::query_config())
+        .wrap(error::json_error_handlers())
+        .wrap(from_fn(middleware::reject_writes))
+        .wrap(from_fn(middleware::limit_body_size))
+        .wrap(config.cors.build())
+        .wrap(from_fn(middleware::enforce_timeout))
+        .wrap(from_fn(middleware::log_request))
+        .wrap(from_fn(middleware::resolve_client_ip))
+        .wrap(from_fn(middleware::recover))
+        .wrap(from_fn(middleware::propagate_request_id))
+        .wrap(DefaultHeaders::new().add((version::VERSION_HEADER, version::VERSION)))
+        .configure(move |cfg| {
+            if let Some(limiter) = rate_limiter {
+                cfg.app_data(limiter);
+            }
+            if let Some(limit) = concurrency_limit {
+                cfg.app_data(limit);
+            }
+            if let Some(cache) = todo_cache {
+                cfg.app_data(cache);
+            }
+        })
+        .configure(move |cfg| routes::configure_routes(cfg, docs))
+}
+
+/// Add `Authorization: Bearer <token>` to a test request
+pub(crate) fn bearer(req: TestRequest, token: &str) -> TestRequest {
+    req.insert_header((AUTHORIZATION, format!("Bearer {}", token)))
+}
+
+/// A JWT for a fresh user id, issued with `config`'s secret
+pub(crate) fn token(config: &Config) -> (Uuid, String) {
+    let user_id = Uuid::new_v4();
+    let (token, _) = config.jwt_auth.issue(user_id).expect("JWT_SECRET is set");
+    (user_id, token)
+}
@@ -0,0 +1,162 @@
+use actix_web::{http::header::LOCATION, web, HttpRequest, HttpResponse};
+use rustls::pki_types::{CertificateDer, PrivateKeyDer};
+use rustls::ServerConfig;
+use std::env;
+use std::fs::File;
+use std::io::BufReader;
+
+/// TLS configuration read from TLS_CERT_FILE and TLS_KEY_FILE. When neither is
+/// set the server keeps speaking plain HTTP.
+#[derive(Debug, Clone)]
+pub struct TlsSettings {
+    cert_file: String,
+    key_file: String,
+    /// Port of an optional plain HTTP listener that redirects to HTTPS
+    redirect_port: Option<u16>,
+}
+
+impl TlsSettings {
+    /// Returns None when TLS is not configured, or an error when the
+    /// configuration is incomplete or invalid
+    pub fn from_env() -> Result<Option<Self>, String> {
+        let var = |name: &str| env::var(name).ok().filter(|v| !v.is_empty());
+
+        let (cert_file, key_file) = match (var("TLS_CERT_FILE"), var("TLS_KEY_FILE")) {
+            (None, None) => return Ok(None),
+            (Some(cert), Some(key)) => (cert, key),
+            (Some(_), None) => return Err("TLS_CERT_FILE is set but TLS_KEY_FILE is not".to_string()),
+            (None, Some(_)) => return Err("TLS_KEY_FILE is set but TLS_CERT_FILE is not".to_string()),
+        };
+
+        let redirect_port = match var("TLS_REDIRECT_PORT") {
+            Some(port) => Some(
+                port.parse()
+                    .map_err(|_| format!("TLS_REDIRECT_PORT must be a port number, got '{}'", port))?,
+            ),
+            None => None,
+        };
+
+        Ok(Some(TlsSettings { cert_file, key_file, redirect_port }))
+    }
+
+    pub fn redirect_port(&self) -> Option<u16> {
+        self.redirect_port
+    }
+
+    /// Read the certificate chain and private key into a rustls server config
+    pub fn server_config(&self) -> Result<ServerConfig, String> {
+        let open = |path: &str| {
+            File::open(path)
+                .map(BufReader::new)
+                .map_err(|e| format!("Failed to read {}: {}", path, e))
+        };
+
+        let certs: Vec<CertificateDer<'static>> = rustls_pemfile::certs(&mut open(&self.cert_file)?)
+            .collect::<Result<_, _>>()
+            .map_err(|e| format!("Invalid certificate in {}: {}", self.cert_file, e))?;
+        if certs.is_empty() {
+            return Err(format!("No certificates found in {}", self.cert_file));
+        }
+
+        let key: PrivateKeyDer<'static> = rustls_pemfile::private_key(&mut open(&self.key_file)?)
+            .map_err(|e| format!("Invalid private key in {}: {}", self.key_file, e))?
+            .ok_or_else(|| format!("No private key found in {}", self.key_file))?;
+
+        ServerConfig::builder()
+            .with_no_client_auth()
+            .with_single_cert(certs, key)
+            .map_err(|e| format!("Certificate and key do not match: {}", e))
+    }
+}
+
+/// Port HTTPS is served on, shared with the redirect listener
+#[derive(Debug, Clone, Copy)]
+pub struct HttpsPort(pub u16);
+
+/// Remove a trailing `:port` from a Host header value, keeping IPv6 literals intact
+fn strip_port(host: &str) -> &str {
+    match host.rsplit_once(':') {
+        Some((name, port))
+            if port.parse::<u16>().is_ok() && (!name.contains(':') || name.ends_with(']')) =>
+        {
+            name
+        }
+        _ => host,
+    }
+}
+
+/// Permanently redirect any plain HTTP request to the same URL over HTTPS
+pub async fn redirect_to_https(req: HttpRequest, port: web::Data<HttpsPort>) -> HttpResponse {
+    let info = req.connection_info();
+    // The Host port points at the redirect listener, not at HTTPS
+    let host = strip_port(info.host());
+
+    let authority = match port.0 {
+        443 => host.to_string(),
+        port => format!("{}:{}", host, port),
+    };
+    let path = req.uri().path_and_query().map(|p| p.as_str()).unwrap_or("/");
+
+    HttpResponse::PermanentRedirect()
+        .insert_header((LOCATION, format!("https://{}{}", authority, path)))
+        .finish()
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::{web, App, HttpResponse, HttpServer};
+    use std::fs;
+    use std::path::PathBuf;
+    use uuid::Uuid;
+
+    use super::TlsSettings;
+
+    /// A PEM file in the temp directory, removed again when dropped
+    struct PemFile(PathBuf);
+
+    impl PemFile {
+        fn new(contents: &str) -> Self {
+            let path = std::env::temp_dir().join(format!("tls-{}.pem", Uuid::new_v4()));
+            fs::write(&path, contents).unwrap();
+            PemFile(path)
+        }
+
+        fn path(&self) -> String {
+            self.0.to_string_lossy().into_owned()
+        }
+    }
+
+    impl Drop for PemFile {
+        fn drop(&mut self) {
+            let _ = fs::remove_file(&self.0);
+        }
+    }
+
+    #[actix_web::test]
+    async fn serves_https_with_a_self_signed_certificate() {
+        let certified = rcgen::generate_simple_self_signed(vec!["localhost".to_string()]).unwrap();
+        let cert_pem = certified.cert.pem();
+        let cert = PemFile::new(&cert_pem);
+        let key = PemFile::new(&certified.key_pair.serialize_pem());
+        let settings = TlsSettings { cert_file: cert.path(), key_file: key.path(), redirect_port: None };
+
+        let server = HttpServer::new(|| App::new().route("/health", web::get().to(HttpResponse::Ok)))
+            .workers(1)
+            .bind_rustls_0_23("127.0.0.1:0", settings.server_config().unwrap())
+            .unwrap();
+        let addr = server.addrs()[0];
+        let server = server.run();
+        let handle = server.handle();
+        actix_web::rt::spawn(server);
+
+        let client = reqwest::Client::builder()
+            .add_root_certificate(reqwest::Certificate::from_pem(cert_pem.as_bytes()).unwrap())
+            .resolve("localhost", addr)
+            .build()
+            .unwrap();
+        let res = client.get(format!("https://localhost:{}/health", addr.port())).send().await.unwrap();
+        assert_eq!(res.status(), reqwest::StatusCode::OK);
+
+        handle.stop(false).await;
+    }
+}
@@ -0,0 +1,16 @@
+//! Which build is running. Both values are fixed at compile time from the
+//! APP_VERSION and GIT_COMMIT environment variables, e.g.
+//! `APP_VERSION=1.4.0 GIT_COMMIT=$(git rev-parse --short HEAD) cargo build --release`.
+
+pub const VERSION: &str = match option_env!("APP_VERSION") {
+    Some(version) => version,
+    None => "dev",
+};
+
+pub const GIT_COMMIT: &str = match option_env!("GIT_COMMIT") {
+    Some(commit) => commit,
+    None => "unknown",
+};
+
+/// Response header carrying VERSION on every response
+pub const VERSION_HEADER: &str = "x-app-version";
@@ -0,0 +1,479 @@
+//! Outbound webhooks. A dispatcher follows the todo events published on the
+//! broker and queues a signed delivery for every webhook subscribed to them,
+//! and a worker sends the deliveries, retrying failures with backoff. None of
+//! this runs on the request path, so a slow or failing receiver never delays or
+//! fails an API call.
+
+use chrono::{DateTime, Utc};
+use hmac::{Hmac, Mac};
+use reqwest::header::CONTENT_TYPE;
+use serde::Serialize;
+use sha2::Sha256;
+use std::env;
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr};
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::sync::{broadcast, mpsc, Semaphore};
+use uuid::Uuid;
+
+use crate::config::flag;
+use crate::events::{Broker, EventKind, TodoEvent};
+use crate::models::{TodoResponse, Webhook, WebhookEvent};
+use crate::repository::WebhookRepository;
+
+/// `sha256=` followed by the hex HMAC-SHA256 of the body, keyed with the secret
+pub const SIGNATURE_HEADER: &str = "X-Webhook-Signature";
+pub const EVENT_HEADER: &str = "X-Webhook-Event";
+/// Unique per delivery and unchanged across retries, so receivers can drop repeats
+pub const DELIVERY_HEADER: &str = "X-Webhook-Delivery";
+
+const DEFAULT_QUEUE_SIZE: usize = 1000;
+const DEFAULT_MAX_ATTEMPTS: u32 = 5;
+const DEFAULT_TIMEOUT_SECS: u64 = 10;
+/// Deliveries in flight at once
+const CONCURRENCY: usize = 8;
+/// Wait before the first retry; doubles after every failed attempt
+const INITIAL_BACKOFF: Duration = Duration::from_secs(1);
+const MAX_BACKOFF: Duration = Duration::from_secs(60);
+
+#[derive(Debug, Clone, Copy)]
+pub struct WebhookSettings {
+    /// Deliveries waiting to be sent before new ones are dropped
+    pub queue_size: usize,
+    /// Attempts per delivery, including the first
+    pub max_attempts: u32,
+    /// How long one attempt may take
+    pub timeout: Duration,
+    /// Accept webhook URLs on loopback, private and link-local addresses,
+    /// for receivers on the same host or network
+    pub allow_private: bool,
+}
+
+/// A positive number from `name`, `default` when unset or empty
+fn positive_env<T: std::str::FromStr + PartialOrd + Default>(name: &str, default: T) -> Result<T, String> {
+    match env::var(name).ok().filter(|v| !v.is_empty()) {
+        None => Ok(default),
+        Some(value) => value
+            .trim()
+            .parse()
+            .ok()
+            .filter(|v| *v > T::default())
+            .ok_or_else(|| format!("{} must be a positive number, got '{}'", name, value)),
+    }
+}
+
+impl WebhookSettings {
+    pub fn from_env() -> Result<Self, String> {
+        Ok(WebhookSettings {
+            queue_size: positive_env("WEBHOOK_QUEUE_SIZE", DEFAULT_QUEUE_SIZE)?,
+            max_attempts: positive_env("WEBHOOK_MAX_ATTEMPTS", DEFAULT_MAX_ATTEMPTS)?,
+            timeout: Duration::from_secs(positive_env("WEBHOOK_TIMEOUT_SECS", DEFAULT_TIMEOUT_SECS)?),
+            allow_private: flag("WEBHOOK_ALLOW_PRIVATE", false)?,
+        })
+    }
+}
+
+/// Whether deliveries may go to `ip`: not loopback, private, link-local,
+/// carrier-grade NAT, benchmarking, multicast, reserved or unspecified, so a
+/// webhook cannot reach services only the server can see, such as cloud
+/// metadata endpoints. IPv6 addresses carrying an IPv4 one are judged by it.
+pub(crate) fn is_public(ip: IpAddr) -> bool {
+    match ip {
+        IpAddr::V4(ip) => {
+            let [a, b, ..] = ip.octets();
+            // 224.0.0.0/4 is multicast and 240.0.0.0/4 reserved, broadcast included
+            !(ip.is_loopback()
+                || ip.is_private()
+                || ip.is_link_local()
+                || ip.is_unspecified()
+                || a == 0
+                || a >= 224
+                || (a == 100 && (64..128).contains(&b))
+                || (a == 198 && (b == 18 || b == 19)))
+        }
+        IpAddr::V6(ip) => match embedded_ipv4(ip) {
+            Some(v4) => is_public(IpAddr::V4(v4)),
+            None => {
+                let first = ip.segments()[0];
+                // fc00::/7 is unique local, fe80::/10 link-local, ff00::/8 multicast
+                !(ip.is_loopback()
+                    || ip.is_unspecified()
+                    || ip.is_multicast()
+                    || first & 0xfe00 == 0xfc00
+                    || first & 0xffc0 == 0xfe80)
+            }
+        },
+    }
+}
+
+/// The IPv4 address `ip` stands for, if it is IPv4-mapped (::ffff:0:0/96),
+/// IPv4-compatible (::/96), NAT64 (64:ff9b::/96) or 6to4 (2002::/16)
+fn embedded_ipv4(ip: Ipv6Addr) -> Option<Ipv4Addr> {
+    let s = ip.segments();
+    let join = |high: u16, low: u16| Ipv4Addr::from((u32::from(high) << 16) | u32::from(low));
+    match s {
+        [0, 0, 0, 0, 0, 0xffff, high, low] | [0, 0, 0, 0, 0, 0, high, low] => Some(join(high, low)),
+        [0x64, 0xff9b, 0, 0, 0, 0, high, low] => Some(join(high, low)),
+        [0x2002, high, low, ..] => Some(join(high, low)),
+        _ => None,
+    }
+}
+
+/// Resolve `url`'s host and check that every address is public, unless
+/// `allow_private`. Returns the addresses, or why the URL is refused.
+pub async fn resolve_target(url: &reqwest::Url, allow_private: bool) -> Result<Vec<SocketAddr>, String> {
+    let host = url.host_str().ok_or_else(|| "url has no host".to_string())?;
+    let port = url.port_or_known_default().unwrap_or(443);
+    // IPv6 literals keep their brackets in the URL
+    let host = host.trim_start_matches('[').trim_end_matches(']');
+
+    let addrs: Vec<SocketAddr> = match host.parse() {
+        Ok(ip) => vec![SocketAddr::new(ip, port)],
+        Err(_) => tokio::net::lookup_host((host, port))
+            .await
+            .map_err(|e| format!("url host {} could not be resolved: {}", host, e))?
+            .collect(),
+    };
+    if addrs.is_empty() {
+        return Err(format!("url host {} could not be resolved", host));
+    }
+    if !allow_private && !addrs.iter().all(|addr| is_public(addr.ip())) {
+        return Err(
+            "url must not point at a loopback, private or link-local address (set WEBHOOK_ALLOW_PRIVATE to allow it)"
+                .to_string(),
+        );
+    }
+    Ok(addrs)
+}
+
+/// Check that every address `url`'s host resolves to is public, unless
+/// `allow_private`. Returns why the URL is refused.
+pub async fn check_target(url: &reqwest::Url, allow_private: bool) -> Result<(), String> {
+    resolve_target(url, allow_private).await.map(|_| ())
+}
+
+/// A client that sends requests for `url` only to `addrs`, the addresses just
+/// checked, so a DNS answer that changes between the check and the request
+/// cannot send a delivery somewhere else
+fn pinned_client(url: &reqwest::Url, addrs: &[SocketAddr], timeout: Duration) -> Result<reqwest::Client, String> {
+    // A redirect could send the delivery on to an address resolve_target refuses
+    let mut builder = reqwest::Client::builder()
+        .timeout(timeout)
+        .redirect(reqwest::redirect::Policy::none());
+    // IP literals are not looked up, so only host names need pinning
+    if let Some(domain) = url.domain() {
+        builder = builder.resolve_to_addrs(domain, addrs);
+    }
+    builder.build().map_err(|e| e.to_string())
+}
+
+/// Body of every delivery
+#[derive(Serialize)]
+struct Payload<'a> {
+    id: Uuid,
+    event: &'static str,
+    created_at: DateTime<Utc>,
+    todo: &'a TodoResponse,
+}
+
+/// One event on its way to one webhook
+struct Delivery {
+    id: Uuid,
+    webhook_id: Uuid,
+    url: String,
+    event: WebhookEvent,
+    body: Vec<u8>,
+    signature: String,
+}
+
+impl Delivery {
+    fn new(webhook: &Webhook, event: WebhookEvent, todo: &TodoResponse) -> Result<Self, serde_json::Error> {
+        let id = Uuid::new_v4();
+        let body = serde_json::to_vec(&Payload { id, event: event.as_str(), created_at: Utc::now(), todo })?;
+        Ok(Delivery {
+            id,
+            webhook_id: webhook.id,
+            url: webhook.url.clone(),
+            event,
+            signature: sign(&webhook.secret, &body),
+            body,
+        })
+    }
+}
+
+fn sign(secret: &str, body: &[u8]) -> String {
+    // HMAC accepts keys of any length
+    let mut mac = Hmac::<Sha256>::new_from_slice(secret.as_bytes()).expect("HMAC key of any size");
+    mac.update(body);
+    format!("sha256={}", hex::encode(mac.finalize().into_bytes()))
+}
+
+fn webhook_event(kind: EventKind) -> WebhookEvent {
+    match kind {
+        EventKind::Created => WebhookEvent::TodoCreated,
+        EventKind::Updated => WebhookEvent::TodoUpdated,
+        EventKind::Deleted => WebhookEvent::TodoDeleted,
+    }
+}
+
+/// Start the dispatcher and delivery worker in the background
+pub fn spawn(broker: &Broker, webhooks: Arc<dyn WebhookRepository>, settings: WebhookSettings) {
+    let (queue, deliveries) = mpsc::channel(settings.queue_size);
+
+    tokio::spawn(dispatch(broker.subscribe(), webhooks, queue));
+    tokio::spawn(work(deliveries, settings));
+}
+
+/// Queue a delivery for every webhook subscribed to each event. When the queue
+/// is full the delivery is dropped rather than holding up later events.
+async fn dispatch(
+    mut events: broadcast::Receiver<TodoEvent>,
+    webhooks: Arc<dyn WebhookRepository>,
+    queue: mpsc::Sender<Delivery>,
+) {
+    loop {
+        let event = match events.recv().await {
+            Ok(event) => event,
+            Err(broadcast::error::RecvError::Lagged(missed)) => {
+                log::warn!(missed = missed; "webhook dispatcher fell behind; events skipped");
+                continue;
+            }
+            Err(broadcast::error::RecvError::Closed) => break,
+        };
+
+        let kind = webhook_event(event.kind);
+        let subscribed = match webhooks.subscribed(event.user_id, kind).await {
+            Ok(subscribed) => subscribed,
+            Err(e) => {
+                log::error!(error = e.to_string().as_str(); "failed to look up webhooks");
+                continue;
+            }
+        };
+
+        for webhook in subscribed {
+            let delivery = match Delivery::new(&webhook, kind, &event.snapshot) {
+                Ok(delivery) => delivery,
+                Err(e) => {
+                    log::error!(error = e.to_string().as_str(); "failed to encode webhook payload");
+                    continue;
+                }
+            };
+            if queue.try_send(delivery).is_err() {
+                log::warn!(
+                    webhook_id = webhook.id.to_string().as_str();
+                    "webhook queue full; delivery dropped"
+                );
+            }
+        }
+    }
+}
+
+/// Send queued deliveries, at most `CONCURRENCY` at a time
+async fn work(mut deliveries: mpsc::Receiver<Delivery>, settings: WebhookSettings) {
+    let permits = Arc::new(Semaphore::new(CONCURRENCY));
+    while let Some(delivery) = deliveries.recv().await {
+        let Ok(permit) = permits.clone().acquire_owned().await else {
+            break;
+        };
+        tokio::spawn(async move {
+            deliver(&delivery, &settings).await;
+            drop(permit);
+        });
+    }
+}
+
+/// Make one attempt at a delivery. The URL was checked when the webhook was
+/// saved, but its host may resolve differently now, so it is resolved and
+/// checked again and the request goes to exactly the addresses that passed.
+async fn attempt(delivery: &Delivery, delivery_id: &str, settings: &WebhookSettings) -> Result<(), String> {
+    let url = reqwest::Url::parse(&delivery.url).map_err(|e| e.to_string())?;
+    let addrs = resolve_target(&url, settings.allow_private).await?;
+    let res = pinned_client(&url, &addrs, settings.timeout)?
+        .post(url)
+        .header(CONTENT_TYPE, "application/json")
+        .header(EVENT_HEADER, delivery.event.as_str())
+        .header(DELIVERY_HEADER, delivery_id)
+        .header(SIGNATURE_HEADER, &delivery.signature)
+        .body(delivery.body.clone())
+        .send()
+        .await
+        .map_err(|e| e.to_string())?;
+
+    if res.status().is_success() {
+        Ok(())
+    } else {
+        Err(format!("receiver answered {}", res.status()))
+    }
+}
+
+/// POST a delivery until the receiver answers 2xx or the attempts run out
+async fn deliver(delivery: &Delivery, settings: &WebhookSettings) {
+    let webhook_id = delivery.webhook_id.to_string();
+    let delivery_id = delivery.id.to_string();
+    let max_attempts = settings.max_attempts;
+    let mut backoff = INITIAL_BACKOFF;
+
+    for attempt_number in 1..=max_attempts {
+        let error = match attempt(delivery, &delivery_id, settings).await {
+            Ok(()) => {
+                log::debug!(
+                    webhook_id = webhook_id.as_str(),
+                    delivery_id = delivery_id.as_str(),
+                    attempt = attempt_number;
+                    "webhook delivered"
+                );
+                return;
+            }
+            Err(error) => error,
+        };
+
+        if attempt_number == max_attempts {
+            log::warn!(
+                webhook_id = webhook_id.as_str(),
+                delivery_id = delivery_id.as_str(),
+                attempts = attempt_number,
+                error = error.as_str();
+                "webhook delivery failed; giving up"
+            );
+            return;
+        }
+        log::debug!(
+            webhook_id = webhook_id.as_str(),
+            delivery_id = delivery_id.as_str(),
+            attempt = attempt_number,
+            error = error.as_str();
+            "webhook delivery failed; retrying"
+        );
+        tokio::time::sleep(backoff).await;
+        backoff = (backoff * 2).min(MAX_BACKOFF);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use actix_web::{web, App, HttpRequest, HttpResponse, HttpServer};
+    use hmac::{Hmac, Mac};
+    use sha2::Sha256;
+    use std::sync::Mutex;
+    use std::time::Duration;
+    use uuid::Uuid;
+
+    use super::{
+        check_target, deliver, is_public, sign, Delivery, WebhookSettings, DELIVERY_HEADER, SIGNATURE_HEADER,
+    };
+    use crate::models::WebhookEvent;
+
+    #[test]
+    fn only_public_addresses_are_public() {
+        let cases = [
+            ("93.184.216.34", true),
+            ("2606:2800:220:1:248:1893:25c8:1946", true),
+            ("127.0.0.1", false),
+            ("10.1.2.3", false),
+            ("172.16.0.1", false),
+            ("192.168.1.10", false),
+            ("169.254.169.254", false),
+            ("100.64.0.1", false),
+            ("0.0.0.0", false),
+            ("::1", false),
+            ("::", false),
+            ("fd00::1", false),
+            ("fe80::1", false),
+            ("::ffff:127.0.0.1", false),
+            ("::ffff:93.184.216.34", true),
+            ("224.0.0.1", false),
+            ("239.255.255.250", false),
+            ("240.0.0.1", false),
+            ("255.255.255.255", false),
+            ("198.18.0.1", false),
+            ("198.19.255.255", false),
+            ("198.20.0.1", true),
+            ("223.255.255.254", true),
+            ("64:ff9b::7f00:1", false),
+            ("64:ff9b::a9fe:a9fe", false),
+            ("64:ff9b::5db8:d822", true),
+            ("2002:7f00:1::", false),
+            ("2002:c0a8:10a::1", false),
+            ("2002:5db8:d822::1", true),
+            ("::127.0.0.1", false),
+            ("::10.0.0.1", false),
+            ("::93.184.216.34", true),
+            ("ff02::1", false),
+            ("ff0e::1", false),
+        ];
+        for (ip, public) in cases {
+            assert_eq!(is_public(ip.parse().unwrap()), public, "{}", ip);
+        }
+    }
+
+    #[actix_web::test]
+    async fn private_targets_need_to_be_allowed() {
+        for url in ["http://127.0.0.1:8080/hook", "https://[::1]/hook", "http://169.254.169.254/latest"] {
+            let url = reqwest::Url::parse(url).unwrap();
+            assert!(check_target(&url, false).await.is_err(), "{}", url);
+            assert!(check_target(&url, true).await.is_ok(), "{}", url);
+        }
+        let url = reqwest::Url::parse("https://93.184.216.34/hook").unwrap();
+        assert!(check_target(&url, false).await.is_ok());
+    }
+
+    /// Signature and delivery id of every request the receiver got
+    type Received = web::Data<Mutex<Vec<(String, String, web::Bytes)>>>;
+
+    /// Records each delivery, failing the first so it has to be retried
+    async fn receive(req: HttpRequest, body: web::Bytes, received: Received) -> HttpResponse {
+        let header = |name: &str| req.headers().get(name).and_then(|v| v.to_str().ok()).unwrap_or_default().to_string();
+        let mut received = received.lock().unwrap();
+        received.push((header(SIGNATURE_HEADER), header(DELIVERY_HEADER), body));
+        if received.len() == 1 {
+            HttpResponse::ServiceUnavailable().finish()
+        } else {
+            HttpResponse::NoContent().finish()
+        }
+    }
+
+    #[actix_web::test]
+    async fn deliveries_are_signed_and_retried() {
+        let received: Received = web::Data::new(Mutex::new(Vec::new()));
+        let state = received.clone();
+        let server = HttpServer::new(move || App::new().app_data(state.clone()).route("/hook", web::post().to(receive)))
+            .workers(1)
+            .bind(("127.0.0.1", 0))
+            .unwrap();
+        let port = server.addrs()[0].port();
+        let server = server.run();
+        let handle = server.handle();
+        actix_web::rt::spawn(server);
+
+        let body = br#"{"event":"todo.created"}"#.to_vec();
+        let delivery = Delivery {
+            id: Uuid::new_v4(),
+            webhook_id: Uuid::new_v4(),
+            url: format!("http://localhost:{}/hook", port),
+            event: WebhookEvent::TodoCreated,
+            signature: sign("s3cret", &body),
+            body: body.clone(),
+        };
+        let mut settings =
+            WebhookSettings { queue_size: 1, max_attempts: 3, timeout: Duration::from_secs(5), allow_private: false };
+
+        // localhost resolves to loopback, which is refused unless allowed
+        deliver(&delivery, &WebhookSettings { max_attempts: 1, ..settings }).await;
+        assert!(received.lock().unwrap().is_empty());
+
+        settings.allow_private = true;
+        deliver(&delivery, &settings).await;
+        let received = received.lock().unwrap();
+        assert_eq!(received.len(), 2);
+        let mut mac = Hmac::<Sha256>::new_from_slice(b"s3cret").unwrap();
+        mac.update(&body);
+        let expected = format!("sha256={}", hex::encode(mac.finalize().into_bytes()));
+        for (signature, delivery_id, received_body) in received.iter() {
+            assert_eq!(signature, &expected);
+            assert_eq!(delivery_id, &delivery.id.to_string());
+            assert_eq!(received_body.as_ref(), body.as_slice());
+        }
+        drop(received);
+        handle.stop(true).await;
+    }
+}